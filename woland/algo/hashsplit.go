@@ -18,19 +18,18 @@ const windowSize = 32
 
 type HashBlock struct {
 	Hash   []byte
-	Length uint32
+	Length int64
 }
 
-func getHashBlock(hashFun hash.Hash, length uint32, bufs ...[]byte) HashBlock {
+func getHashBlock(hashFun hash.Hash, length int64, bufs ...[]byte) HashBlock {
 	hashFun.Reset()
 	for _, buf := range bufs {
 		hashFun.Write(buf)
 	}
-	block := HashBlock{
+	return HashBlock{
+		Hash:   hashFun.Sum(nil),
 		Length: length,
 	}
-	copy(block.Hash[:], hashFun.Sum(nil))
-	return block
 }
 
 func HashSplit(r io.Reader, splitBits uint, hashFun hash.Hash) (blocks []HashBlock, err error) {
@@ -53,14 +52,6 @@ func HashSplit(r io.Reader, splitBits uint, hashFun hash.Hash) (blocks []HashBlo
 
 	for {
 		n, err := r.Read(inp)
-		if err == io.EOF {
-			if len(buf) > 0 {
-				blocks = append(blocks, getHashBlock(hashFun, uint32(len(buf)), buf))
-			}
-			break
-		} else if err != nil {
-			return nil, err
-		}
 
 		step := 1
 		for i := 0; i < n; i += step {
@@ -70,10 +61,19 @@ func HashSplit(r io.Reader, splitBits uint, hashFun hash.Hash) (blocks []HashBlo
 
 			sum32 := h.Sum32()
 			if sum32&mask == mask {
-				blocks = append(blocks, getHashBlock(hashFun, uint32(len(buf)), buf))
+				blocks = append(blocks, getHashBlock(hashFun, int64(len(buf)), buf))
 				buf = buf[:0]
 			}
 		}
+
+		if err == io.EOF {
+			if len(buf) > 0 {
+				blocks = append(blocks, getHashBlock(hashFun, int64(len(buf)), buf))
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
 	}
 
 	return blocks, err
@@ -87,8 +87,8 @@ const (
 )
 
 type Range struct {
-	Start  uint32
-	Length uint32
+	Start  int64
+	Length int64
 }
 
 type Edit struct {
@@ -109,7 +109,7 @@ func HashDiff2(source, dest []HashBlock) []Edit {
 	actions := make([][]Edit, sLen)
 
 	var diffs []Edit
-	var sOffset, dOffset uint32
+	var sOffset, dOffset int64
 
 	for y := 1; y <= sLen; y++ {
 		column[y] = y
@@ -163,7 +163,7 @@ func HashDiff(source, dest []HashBlock) []Edit {
 	// 	j++
 	// }
 
-	var sOffset, dOffset uint32
+	var sOffset, dOffset int64
 	var edits []Edit
 	for i < sLen && j < dLen {
 		s := source[i]
@@ -233,7 +233,7 @@ func levenshteinEditDistance(dest, source []HashBlock) []Edit {
 	column := make([]int, sLen+1)
 	trace := make([][]int, dLen+1)
 
-	var sOffset, dOffset uint32
+	var sOffset, dOffset int64
 
 	for y := 1; y <= sLen; y++ {
 		column[y] = y
@@ -1,54 +1,94 @@
 package algo
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"hash"
 	"io"
 	"os"
+
+	"golang.org/x/crypto/blake2b"
 )
 
+// MerkleTree is a binary hash tree over the blocks produced by HashSplit. Blocks contains the leaves followed by each
+// upper row of the tree; the root is the last block. When a row has an odd number of blocks, the last block is carried
+// to the upper row unchanged.
 type MerkleTree struct {
-	DataLength uint32
+	DataLength int64
+	Leaves     int
 	Blocks     []HashBlock
 }
 
 var UseSimd bool
 
-func MerkleTreeFromFile(name string, splitBits uint) (MerkleTree, error) {
+var ErrInvalidMerkleTree = fmt.Errorf("invalid merkle tree")
+
+// internalNode is the prefix of the hash of an internal node, so that it cannot be confused with a leaf
+var internalNode = []byte{1}
+
+func MerkleTreeFromFile(name string, splitBits uint, hashFun hash.Hash) (MerkleTree, error) {
 	f, err := os.Open(name)
 	if err != nil {
 		return MerkleTree{}, err
 	}
 	defer f.Close()
 
-	return MerkleTreeFromReader(f, splitBits)
+	return MerkleTreeFromReader(f, splitBits, hashFun)
 }
 
-func MerkleTreeFromReader(r io.Reader, splitBits uint) (MerkleTree, error) {
-	blocks, err := HashSplit(r, splitBits, nil)
+// MerkleTreeFromReader splits the data with HashSplit and builds the tree over the blocks. When hashFun is nil,
+// blake2b-256 is used.
+func MerkleTreeFromReader(r io.Reader, splitBits uint, hashFun hash.Hash) (MerkleTree, error) {
+	var err error
+	if hashFun == nil {
+		hashFun, err = blake2b.New256(nil)
+		if err != nil {
+			return MerkleTree{}, err
+		}
+	}
+
+	blocks, err := HashSplit(r, splitBits, hashFun)
 	if err != nil {
 		return MerkleTree{}, err
 	}
+	return MerkleTreeFromBlocks(blocks, hashFun), nil
+}
 
+// MerkleTreeFromBlocks builds the tree over the provided leaves
+func MerkleTreeFromBlocks(leaves []HashBlock, hashFun hash.Hash) MerkleTree {
+	var length int64
+	for _, leaf := range leaves {
+		length += leaf.Length
+	}
+	if len(leaves) == 0 {
+		leaves = []HashBlock{getHashBlock(hashFun, 0)}
+	}
+
+	blocks := append([]HashBlock{}, leaves...)
 	start := 0
-	for start < len(blocks)-1 {
-		//		blocks, start = buildMerkleRow(blake, length, blocks, start)
+	for len(blocks)-start > 1 {
+		blocks, start = buildMerkleRow(hashFun, blocks, start)
 	}
 
 	return MerkleTree{
-		Blocks: blocks,
-	}, nil
+		DataLength: length,
+		Leaves:     len(leaves),
+		Blocks:     blocks,
+	}
 }
 
-// buildMerkleRow calculates a new row of a Merkle tree starting from start position until the end of the
-func buildMerkleRow(blake hash.Hash, fileLength uint32, blocks []HashBlock, start int) (blocks2 []HashBlock, start2 int) {
+// buildMerkleRow appends to blocks the row above the row that starts at start. It returns the blocks and the start
+// of the new row.
+func buildMerkleRow(hashFun hash.Hash, blocks []HashBlock, start int) (blocks2 []HashBlock, start2 int) {
 	l := len(blocks)
-	if l%2 == 1 {
-		blocks = append(blocks, getHashBlock(blake, fileLength))
-		l++
-	}
-
 	for i := start; i < l; i += 2 {
-		block := getHashBlock(blake, blocks[i].Length, blocks[i].Hash[:], blocks[i+1].Hash[:])
+		if i+1 == l {
+			blocks = append(blocks, blocks[i])
+			break
+		}
+		block := getHashBlock(hashFun, blocks[i].Length+blocks[i+1].Length, internalNode, blocks[i].Hash,
+			blocks[i+1].Hash)
 		blocks = append(blocks, block)
 	}
 	return blocks, l
@@ -64,17 +104,113 @@ func MerkleTreeHash(m MerkleTree) *[]byte {
 	return &m.Blocks[l].Hash
 }
 
-func MerkleTreeAt(m MerkleTree, idx int) (block HashBlock, length uint32) {
-	block = m.Blocks[idx]
-	if idx+1 == len(m.Blocks) || m.Blocks[idx+1].Length <= m.Blocks[idx].Length {
-		return block, m.DataLength - block.Length
-	} else {
-		return block, m.Blocks[idx+1].Length - block.Length
+// MerkleTreeAt returns the leaf that contains the byte at offset and the offset of the first byte of the leaf
+func MerkleTreeAt(m MerkleTree, offset int64) (idx int, start int64) {
+	for idx = 0; idx < m.Leaves-1; idx++ {
+		if start+m.Blocks[idx].Length > offset {
+			break
+		}
+		start += m.Blocks[idx].Length
 	}
+	return idx, start
 }
 
+// MerkleTreeChildren returns the position in Blocks of the children of the block at idx. Right is -1 when the block
+// is carried from the row below and both are -1 for leaves.
 func MerkleTreeChildren(m MerkleTree, idx int) (left int, right int) {
-	return 0, 0
+	start, count := 0, m.Leaves
+	for count > 1 {
+		next := start + count
+		if idx >= next && idx < next+(count+1)/2 {
+			left = start + (idx-next)*2
+			if left+1 < next {
+				return left, left + 1
+			}
+			return left, -1
+		}
+		start, count = next, (count+1)/2
+	}
+	return -1, -1
+}
+
+// MerkleTreeProof returns the inclusion proof of the leaf at idx: the hashes of the siblings from the leaf to the
+// root. A nil hash means the block has no sibling and is carried to the upper row.
+func MerkleTreeProof(m MerkleTree, idx int) [][]byte {
+	var proof [][]byte
+	start, count := 0, m.Leaves
+	for count > 1 {
+		sibling := idx ^ 1
+		if sibling < count {
+			proof = append(proof, m.Blocks[start+sibling].Hash)
+		} else {
+			proof = append(proof, nil)
+		}
+		start, count, idx = start+count, (count+1)/2, idx/2
+	}
+	return proof
+}
+
+// VerifyMerkleProof checks that the leaf at idx is part of the tree with the root hash
+func VerifyMerkleProof(root []byte, leaf []byte, idx int, leaves int, proof [][]byte, hashFun hash.Hash) bool {
+	h := leaf
+	count := leaves
+	for _, sibling := range proof {
+		if count <= 1 {
+			return false
+		}
+		switch {
+		case sibling == nil && idx^1 < count:
+			return false
+		case sibling == nil:
+		case idx%2 == 0:
+			h = getHashBlock(hashFun, 0, internalNode, h, sibling).Hash
+		default:
+			h = getHashBlock(hashFun, 0, internalNode, sibling, h).Hash
+		}
+		idx, count = idx/2, (count+1)/2
+	}
+	return count == 1 && bytes.Equal(h, root)
+}
+
+// MerkleTreeMarshal encodes the tree in binary form. Lengths are encoded in 64 bits since bodies can exceed 4 GiB.
+func MerkleTreeMarshal(m MerkleTree) []byte {
+	data := binary.BigEndian.AppendUint64(nil, uint64(m.DataLength))
+	data = binary.BigEndian.AppendUint32(data, uint32(m.Leaves))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(m.Blocks)))
+	for _, block := range m.Blocks {
+		data = binary.BigEndian.AppendUint64(data, uint64(block.Length))
+		data = append(data, byte(len(block.Hash)))
+		data = append(data, block.Hash...)
+	}
+	return data
+}
+
+// MerkleTreeUnmarshal decodes a tree encoded with MerkleTreeMarshal
+func MerkleTreeUnmarshal(data []byte) (MerkleTree, error) {
+	if len(data) < 16 {
+		return MerkleTree{}, ErrInvalidMerkleTree
+	}
+	m := MerkleTree{
+		DataLength: int64(binary.BigEndian.Uint64(data)),
+		Leaves:     int(binary.BigEndian.Uint32(data[8:])),
+	}
+	count := int(binary.BigEndian.Uint32(data[12:]))
+	data = data[16:]
+	for i := 0; i < count; i++ {
+		if len(data) < 9 || len(data) < 9+int(data[8]) {
+			return MerkleTree{}, ErrInvalidMerkleTree
+		}
+		l := int(data[8])
+		m.Blocks = append(m.Blocks, HashBlock{
+			Length: int64(binary.BigEndian.Uint64(data)),
+			Hash:   append([]byte{}, data[9:9+l]...),
+		})
+		data = data[9+l:]
+	}
+	if m.Leaves < 1 || m.Leaves > len(m.Blocks) {
+		return MerkleTree{}, ErrInvalidMerkleTree
+	}
+	return m, nil
 }
 
 func min(a, b int) int {
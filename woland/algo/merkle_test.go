@@ -15,19 +15,40 @@ func Test_MerkleTree(t *testing.T) {
 	rand.Read(rn)
 
 	rn[0] = 16
-	m1, err := MerkleTreeFromReader(bytes.NewBuffer(rn), 13)
+	m1, err := MerkleTreeFromReader(bytes.NewBuffer(rn), 13, nil)
 	assert.NoErrorf(t, err, "Cannot create tree: %v", err)
-	assert.Equal(t, uint32(len(rn)), m1.DataLength, "unexpected length")
+	assert.Equal(t, int64(len(rn)), m1.DataLength, "unexpected length")
 
 	rn[0] = 8
-	m2, err := MerkleTreeFromReader(bytes.NewBuffer(rn), 13)
+	m2, err := MerkleTreeFromReader(bytes.NewBuffer(rn), 13, nil)
 	assert.NoErrorf(t, err, "Cannot create tree: %v", err)
-	assert.Equal(t, uint32(len(rn)), m2.DataLength, "unexpected length")
+	assert.Equal(t, int64(len(rn)), m2.DataLength, "unexpected length")
 
 	assert.NotEqualValues(t, m1.Blocks[0].Hash, m2.Blocks[0].Hash, "Unexpected same hash for first block")
 	assert.EqualValues(t, m1.Blocks[1].Hash, m2.Blocks[1].Hash, "Unexpected different hash for second block")
 	assert.NotEqualValues(t, MerkleTreeHash(m1), MerkleTreeHash(m2), "Unexpected same hash")
 
+	blake, _ := blake2b.New256(nil)
+	root, _ := MerkleTreeRoot(m1)
+	assert.Equal(t, m1.DataLength, root.Length, "unexpected root length")
+	for idx := 0; idx < m1.Leaves; idx++ {
+		proof := MerkleTreeProof(m1, idx)
+		assert.True(t, VerifyMerkleProof(root.Hash, m1.Blocks[idx].Hash, idx, m1.Leaves, proof, blake),
+			"cannot verify leaf %d", idx)
+		assert.False(t, VerifyMerkleProof(root.Hash, m2.Blocks[0].Hash, idx, m1.Leaves, proof, blake),
+			"unexpected valid proof for leaf %d", idx)
+	}
+
+	left, right := MerkleTreeChildren(m1, len(m1.Blocks)-1)
+	parent := getHashBlock(blake, 0, internalNode, m1.Blocks[left].Hash, m1.Blocks[right].Hash)
+	assert.Equal(t, root.Hash, parent.Hash, "unexpected children of root")
+
+	idx, start := MerkleTreeAt(m1, 20000)
+	assert.True(t, start <= 20000 && start+m1.Blocks[idx].Length > 20000, "unexpected leaf at offset")
+
+	m3, err := MerkleTreeUnmarshal(MerkleTreeMarshal(m1))
+	assert.NoErrorf(t, err, "Cannot unmarshal tree: %v", err)
+	assert.Equal(t, m1, m3, "unexpected unmarshalled tree")
 }
 
 func Benchmark_Merkle(b *testing.B) {
@@ -36,7 +57,7 @@ func Benchmark_Merkle(b *testing.B) {
 	rand.Read(rn)
 
 	for i := 0; i < 512; i++ {
-		MerkleTreeFromReader(bytes.NewBuffer(rn), 13)
+		MerkleTreeFromReader(bytes.NewBuffer(rn), 13, nil)
 	}
 }
 
@@ -50,3 +71,25 @@ func Benchmark_Blake(b *testing.B) {
 	}
 
 }
+
+func TestMerkleTreeLarge(t *testing.T) {
+	blake, _ := blake2b.New256(nil)
+	const leafSize = int64(2) << 30
+	leaves := []HashBlock{
+		getHashBlock(blake, leafSize, []byte("a")),
+		getHashBlock(blake, leafSize, []byte("b")),
+		getHashBlock(blake, leafSize, []byte("c")),
+	}
+	m := MerkleTreeFromBlocks(leaves, blake)
+	assert.Equal(t, 3*leafSize, m.DataLength, "unexpected length over 4 GiB")
+
+	idx, start := MerkleTreeAt(m, 5<<30)
+	assert.Equal(t, 2, idx, "unexpected leaf beyond 4 GiB")
+	assert.Equal(t, 2*leafSize, start, "unexpected start beyond 4 GiB")
+
+	m2, err := MerkleTreeUnmarshal(MerkleTreeMarshal(m))
+	assert.NoError(t, err, "cannot unmarshal tree")
+	assert.Equal(t, m.DataLength, m2.DataLength, "unexpected length after unmarshal")
+	root, _ := MerkleTreeRoot(m2)
+	assert.Equal(t, 3*leafSize, root.Length, "unexpected root length after unmarshal")
+}
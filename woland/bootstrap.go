@@ -9,7 +9,19 @@ import (
 	"github.com/stregato/master/woland/sql"
 )
 
+// Start opens the DB and uses a clock synchronized with NTP
 func Start(dbPath, appPath string) error {
+	return StartWithClock(dbPath, appPath, nil)
+}
+
+// StartWithClock opens the DB and uses the provided clock, for instance a core.FakeClock in tests or
+// core.SystemClock on devices without access to NTP. A nil clock is a core.NtpClock.
+func StartWithClock(dbPath, appPath string, clock core.Clock) error {
+	if clock == nil {
+		clock = core.NewNtpClock()
+	}
+	core.SetClock(clock)
+
 	err := sql.OpenDB(dbPath)
 	if core.IsErr(err, nil, "cannot open DB at %s: %v", dbPath, err) {
 		return err
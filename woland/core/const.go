@@ -8,6 +8,8 @@ import (
 
 func init() {
 	snowflake.SetStartTime(SnowFlakeStart)
+	// The machine id from the private IP is only a default. Opening a safe replaces it with the machine id of the
+	// installation, which is stored in the DB.
 	snowflake.SetMachineID(snowflake.PrivateIPToMachineID())
 }
 
@@ -1,6 +1,8 @@
 package core
 
 import (
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/beevik/ntp"
@@ -12,44 +14,223 @@ var NtpServers = []string{
 }
 
 var NtpRetries = 10
-var ClockOffset time.Duration
-var timeIsSync bool
-var timeTicker *time.Ticker
+var NtpSyncPeriod = 30 * time.Minute
 
-func init() {
-	timeTicker = time.NewTicker(30 * time.Minute)
+// MaxClockSkew is the skew from the stores above which the clock is reported as wrong
+var MaxClockSkew = time.Minute
+
+// Clock provides the time to the library. The clock in use is set with SetClock.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the clock of the device without corrections. It is the clock in use until SetClock is called.
+var SystemClock Clock = systemClock{}
+
+// NtpClock is the clock of the device corrected with the offset measured against the NTP servers
+type NtpClock struct {
+	lock   sync.Mutex
+	offset time.Duration
+	synced bool
+	ticker *time.Ticker
+	quit   chan bool
+	stop   sync.Once
+}
+
+// NewNtpClock returns a clock that synchronizes with the NTP servers in background every NtpSyncPeriod. Until the
+// first synchronization the clock of the device is used.
+func NewNtpClock() *NtpClock {
+	c := &NtpClock{
+		ticker: time.NewTicker(NtpSyncPeriod),
+		quit:   make(chan bool),
+	}
 	go func() {
-		for ; true; <-timeTicker.C {
-			timeIsSync = syncTime()
+		for {
+			c.sync()
+			select {
+			case <-c.ticker.C:
+			case <-c.quit:
+				return
+			}
 		}
 	}()
+	return c
 }
 
-func syncTime() bool {
+func (c *NtpClock) sync() {
 	for i := 0; i < NtpRetries; i++ {
 		for _, s := range NtpServers {
 			r, err := ntp.Query(s)
 			if err == nil {
-				ClockOffset = r.ClockOffset
-				Info("clock offset %v from %s ", ClockOffset, s)
-				return true
+				c.lock.Lock()
+				c.offset, c.synced = r.ClockOffset, true
+				c.lock.Unlock()
+				Info("clock offset %v from %s ", r.ClockOffset, s)
+				return
 			}
 		}
 	}
-	return false
+	c.lock.Lock()
+	c.synced = false
+	c.lock.Unlock()
+	Info("cannot reach NTP servers, clock offset %v", c.Offset())
 }
 
-func TimeIsSync() bool {
-	if !timeIsSync {
-		timeIsSync = syncTime()
+func (c *NtpClock) Now() time.Time {
+	return time.Now().Add(c.Offset())
+}
+
+// Offset returns the last offset measured against the NTP servers
+func (c *NtpClock) Offset() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.offset
+}
+
+// IsSync returns true when the last synchronization with the NTP servers succeeded
+func (c *NtpClock) IsSync() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.synced
+}
+
+// Stop stops the synchronization in background
+func (c *NtpClock) Stop() {
+	c.stop.Do(func() {
+		c.ticker.Stop()
+		close(c.quit)
+	})
+}
+
+// FakeClock is a clock that moves only when it is set or advanced. It is meant for tests.
+type FakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+// NewFakeClock returns a clock stopped at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now
+func (c *FakeClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var clockLock sync.RWMutex
+var clock = SystemClock
+
+// SetClock sets the clock used by Now and Since. A previous NtpClock is stopped.
+func SetClock(c Clock) {
+	clockLock.Lock()
+	defer clockLock.Unlock()
+	if n, ok := clock.(*NtpClock); ok && n != c {
+		n.Stop()
 	}
-	return timeIsSync
+	clock = c
+}
+
+// GetClock returns the clock in use
+func GetClock() Clock {
+	clockLock.RLock()
+	defer clockLock.RUnlock()
+	return clock
+}
+
+// TimeIsSync returns true when the clock in use is synchronized with a reference time
+func TimeIsSync() bool {
+	s, ok := GetClock().(interface{ IsSync() bool })
+	return ok && s.IsSync()
 }
 
 func Now() time.Time {
-	return time.Now().Add(ClockOffset)
+	return GetClock().Now()
 }
 
 func Since(t time.Time) time.Duration {
-	return time.Since(t) + ClockOffset
+	return Now().Sub(t)
+}
+
+const maxSkewSamples = 16
+
+var skewLock sync.Mutex
+var skewSamples []time.Duration
+
+// ObserveStoreTime records the modification time of a file written to a store between sent and received, as given
+// by Now. The samples estimate the skew of the clock from the stores, which is useful when NTP is not reachable.
+func ObserveStoreTime(modTime, sent, received time.Time) {
+	if modTime.IsZero() || received.Sub(sent) > MaxClockSkew {
+		return
+	}
+	skew := modTime.Sub(sent.Add(received.Sub(sent) / 2))
+
+	skewLock.Lock()
+	skewSamples = append(skewSamples, skew)
+	if len(skewSamples) > maxSkewSamples {
+		skewSamples = skewSamples[len(skewSamples)-maxSkewSamples:]
+	}
+	skewLock.Unlock()
+
+	if !TimeIsSync() && (skew > MaxClockSkew || skew < -MaxClockSkew) {
+		Info("clock differs by %v from the stores and NTP is not reachable", skew)
+	}
+}
+
+// ClockStatus reports the state of the clock in use
+type ClockStatus struct {
+	Synced  bool          `json:"synced"`  // The clock is synchronized with NTP
+	Offset  time.Duration `json:"offset"`  // Correction from NTP
+	Skew    time.Duration `json:"skew"`    // Estimated difference between the stores and the clock
+	Samples int           `json:"samples"` // Number of store times in the estimate
+	Wrong   bool          `json:"wrong"`   // The skew is above MaxClockSkew and NTP is not reachable
+}
+
+// GetClockStatus returns the state of the clock in use with the skew from the stores, which is the median of the
+// latest samples
+func GetClockStatus() ClockStatus {
+	status := ClockStatus{Synced: TimeIsSync()}
+	if n, ok := GetClock().(*NtpClock); ok {
+		status.Offset = n.Offset()
+	}
+
+	skewLock.Lock()
+	samples := append([]time.Duration{}, skewSamples...)
+	skewLock.Unlock()
+
+	status.Samples = len(samples)
+	if len(samples) > 0 {
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		status.Skew = samples[len(samples)/2]
+	}
+	status.Wrong = !status.Synced && (status.Skew > MaxClockSkew || status.Skew < -MaxClockSkew)
+	return status
+}
+
+// ResetClockSkew discards the samples of the store times
+func ResetClockSkew() {
+	skewLock.Lock()
+	defer skewLock.Unlock()
+	skewSamples = nil
 }
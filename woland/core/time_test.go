@@ -0,0 +1,40 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+	SetClock(c)
+	defer SetClock(SystemClock)
+
+	Assert(t, Now().Equal(start), "fake clock not in use: %v", Now())
+	c.Advance(time.Hour)
+	Assert(t, Since(start) == time.Hour, "unexpected since %v", Since(start))
+	c.Set(start)
+	Assert(t, Since(start) == 0, "unexpected since %v after set", Since(start))
+	Assert(t, !TimeIsSync(), "fake clock in sync")
+}
+
+func TestClockSkew(t *testing.T) {
+	SetClock(SystemClock)
+	ResetClockSkew()
+	defer ResetClockSkew()
+
+	status := GetClockStatus()
+	Assert(t, !status.Synced && status.Samples == 0 && status.Skew == 0, "unexpected status %+v", status)
+
+	sent := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	received := sent.Add(2 * time.Second)
+	for _, skew := range []time.Duration{5 * time.Minute, 6 * time.Minute, time.Hour} {
+		ObserveStoreTime(sent.Add(time.Second+skew), sent, received)
+	}
+	ObserveStoreTime(sent, sent, sent.Add(time.Hour)) // too slow to be a sample
+
+	status = GetClockStatus()
+	Assert(t, status.Samples == 3 && status.Skew == 6*time.Minute, "unexpected status %+v", status)
+	Assert(t, status.Wrong, "skew not reported with the system clock")
+}
@@ -11,6 +11,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/sirupsen/logrus"
@@ -19,9 +20,11 @@ import (
 	"github.com/stregato/master/woland/safe"
 	"github.com/stregato/master/woland/security"
 	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
 )
 
 var ErrSafeNotFound = fmt.Errorf("safe not opened yet")
+var ErrSubscriptionNotFound = fmt.Errorf("subscription not found")
 
 var safes = map[int]*safe.Safe{}
 var safesSync sync.Mutex
@@ -83,6 +86,11 @@ func wlnd_factoryReset() C.Result {
 	return cResult(nil, err)
 }
 
+//export wlnd_getClockStatus
+func wlnd_getClockStatus() C.Result {
+	return cResult(core.GetClockStatus(), nil)
+}
+
 type configItem struct {
 	S       string `json:"s,omitempty"`
 	I       int64  `json:"i,omitempty"`
@@ -246,6 +254,27 @@ func wlnd_closeSafe(hnd C.int) C.Result {
 	return cResult(nil, nil)
 }
 
+//export wlnd_wipeSafe
+func wlnd_wipeSafe(identity, name, wipeOptions *C.char) C.Result {
+	var WipeOptions safe.WipeOptions
+	err := cUnmarshal(wipeOptions, &WipeOptions)
+	if core.IsErr(err, nil, "cannot unmarshal wipeOptions: %v") {
+		return cResult(nil, err)
+	}
+
+	var i security.Identity
+	err = cUnmarshal(identity, &i)
+	if core.IsErr(err, nil, "cannot unmarshal identity: %v") {
+		return cResult(nil, err)
+	}
+
+	report, err := safe.Wipe(i, C.GoString(name), WipeOptions)
+	if core.IsErr(err, nil, "cannot wipe safe: %v") {
+		return cResult(nil, err)
+	}
+	return cResult(report, err)
+}
+
 //export wlnd_getSafe
 func wlnd_getSafe(hnd C.int) C.Result {
 	safesSync.Lock()
@@ -291,6 +320,19 @@ func wlnd_listFiles(hnd C.int, dir, listOptions *C.char) C.Result {
 	return cResult(headers, err)
 }
 
+//export wlnd_listQuarantine
+func wlnd_listQuarantine(hnd C.int, bucket *C.char) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	headers, err := safe.ListQuarantine(s, C.GoString(bucket))
+	return cResult(headers, err)
+}
+
 //export wlnd_listDirs
 func wlnd_listDirs(hnd C.int, bucket *C.char, listDirsOptions *C.char) C.Result {
 	safesSync.Lock()
@@ -529,6 +571,135 @@ func wlnd_deleteFile(hnd C.int, bucket *C.char, fileId C.long) C.Result {
 	return cResult(nil, nil)
 }
 
+//export wlnd_listVersions
+func wlnd_listVersions(hnd C.int, bucket, name *C.char) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	versions, err := safe.ListVersions(s, C.GoString(bucket), C.GoString(name))
+	return cResult(versions, err)
+}
+
+//export wlnd_restoreVersion
+func wlnd_restoreVersion(hnd C.int, bucket, name *C.char, fileId C.long) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	header, err := safe.RestoreVersion(s, C.GoString(bucket), C.GoString(name), uint64(fileId))
+	return cResult(header, err)
+}
+
+//export wlnd_setRetention
+func wlnd_setRetention(hnd C.int, bucket *C.char, retention C.int) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	err := safe.SetRetention(s, C.GoString(bucket), int(retention))
+	return cResult(nil, err)
+}
+
+//export wlnd_replicate
+func wlnd_replicate(hnd C.int) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	statuses, err := safe.Replicate(s)
+	return cResult(statuses, err)
+}
+
+//export wlnd_getReplicasStatus
+func wlnd_getReplicasStatus(hnd C.int) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	return cResult(safe.GetReplicasStatus(s), nil)
+}
+
+//export wlnd_getStoreHealth
+func wlnd_getStoreHealth(hnd C.int) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	return cResult(safe.GetStoreHealth(s), nil)
+}
+
+//export wlnd_getUsage
+func wlnd_getUsage(hnd C.int) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	return cResult(safe.GetUsage(s))
+}
+
+//export wlnd_setBudget
+func wlnd_setBudget(hnd C.int, budget C.double) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	return cResult(nil, safe.SetBudget(s, float64(budget)))
+}
+
+//export wlnd_setNetworkPolicy
+func wlnd_setNetworkPolicy(hnd C.int, policy *C.char) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	var policy_ safe.NetworkPolicy
+	err := cUnmarshal(policy, &policy_)
+	if core.IsErr(err, nil, "cannot unmarshal network policy: %v") {
+		return cResult(nil, err)
+	}
+	safe.SetNetworkPolicy(s, policy_)
+	return cResult(nil, nil)
+}
+
+//export wlnd_setGlobalNetworkPolicy
+func wlnd_setGlobalNetworkPolicy(policy *C.char) C.Result {
+	var policy_ safe.NetworkPolicy
+	err := cUnmarshal(policy, &policy_)
+	if core.IsErr(err, nil, "cannot unmarshal network policy: %v") {
+		return cResult(nil, err)
+	}
+	safe.SetGlobalNetworkPolicy(policy_)
+	return cResult(nil, nil)
+}
+
 //export wlnd_setUsers
 func wlnd_setUsers(hnd C.int, users *C.char, setUsersOptions *C.char) C.Result {
 	safesSync.Lock()
@@ -589,25 +760,96 @@ func wlnd_getInitiates(hnd C.int) C.Result {
 	return cResult(initiates, nil)
 }
 
-// //export checkForUpdates
-// func checkForUpdates(hnd C.int, dir *C.char, after *C.char, depth C.int) C.Result {
-// 	safesSync.Lock()
-// 	s, ok := safes[int(hnd)]
-// 	safesSync.Unlock()
-// 	if !ok {
-// 		return cResult(nil, ErrSafeNotFound)
-// 	}
-// 	a, err := time.Parse(time.RFC3339, C.GoString(after))
-// 	if core.IsErr(err, nil, "cannot parse time: %v") {
-// 		return cResult(nil, err)
-// 	}
-
-// 	updates, err := safe.CheckForUpdates(s, C.GoString(dir), a, int(depth))
-// 	if core.IsErr(err, nil, "cannot check for updates: %v") {
-// 		return cResult(nil, err)
-// 	}
-// 	return cResult(updates, nil)
-// }
+//export wlnd_checkForUpdates
+func wlnd_checkForUpdates(hnd C.int, bucket, dir, after *C.char, depth C.int) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+	var a time.Time
+	if C.GoString(after) != "" {
+		var err error
+		a, err = time.Parse(time.RFC3339, C.GoString(after))
+		if core.IsErr(err, nil, "cannot parse time: %v") {
+			return cResult(nil, err)
+		}
+	}
+
+	updates, err := safe.CheckForUpdates(s, C.GoString(bucket), C.GoString(dir), a, int(depth))
+	if core.IsErr(err, nil, "cannot check for updates: %v") {
+		return cResult(nil, err)
+	}
+	return cResult(updates, nil)
+}
+
+var subscriptions = map[int]*safe.Subscription{}
+var subscriptionsSync sync.Mutex
+
+//export wlnd_subscribe
+func wlnd_subscribe(hnd C.int, bucket, subscribeOptions *C.char) C.Result {
+	safesSync.Lock()
+	s, ok := safes[int(hnd)]
+	safesSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSafeNotFound)
+	}
+
+	var SubscribeOptions safe.SubscribeOptions
+	err := cUnmarshal(subscribeOptions, &SubscribeOptions)
+	if core.IsErr(err, nil, "cannot unmarshal subscribeOptions: %v") {
+		return cResult(nil, err)
+	}
+
+	sub := safe.Subscribe(s, C.GoString(bucket), SubscribeOptions)
+	subscriptionsSync.Lock()
+	subscriptions[sub.Id] = sub
+	subscriptionsSync.Unlock()
+	return cResult(sub.Id, nil)
+}
+
+// wlnd_getChanges returns the change events received by the subscription since the last call without blocking
+//
+//export wlnd_getChanges
+func wlnd_getChanges(id C.int) C.Result {
+	subscriptionsSync.Lock()
+	sub, ok := subscriptions[int(id)]
+	subscriptionsSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSubscriptionNotFound)
+	}
+
+	changes := []safe.ChangeEvent{}
+	for {
+		select {
+		case c, ok := <-sub.Changes:
+			if !ok {
+				subscriptionsSync.Lock()
+				delete(subscriptions, int(id))
+				subscriptionsSync.Unlock()
+				return cResult(changes, nil)
+			}
+			changes = append(changes, c)
+		default:
+			return cResult(changes, nil)
+		}
+	}
+}
+
+//export wlnd_unsubscribe
+func wlnd_unsubscribe(id C.int) C.Result {
+	subscriptionsSync.Lock()
+	sub, ok := subscriptions[int(id)]
+	delete(subscriptions, int(id))
+	subscriptionsSync.Unlock()
+	if !ok {
+		return cResult(nil, ErrSubscriptionNotFound)
+	}
+
+	safe.Unsubscribe(sub)
+	return cResult(nil, nil)
+}
 
 //export wlnd_getAllIdentities
 func wlnd_getAllIdentities() C.Result {
@@ -618,6 +860,11 @@ func wlnd_getAllIdentities() C.Result {
 	return cResult(identities, nil)
 }
 
+//export wlnd_listDrivers
+func wlnd_listDrivers() C.Result {
+	return cResult(storage.Drivers(), nil)
+}
+
 //export wlnd_getLogs
 func wlnd_getLogs() C.Result {
 	return cResult(core.RecentLog, nil)
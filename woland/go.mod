@@ -10,6 +10,7 @@ require (
 	github.com/chmduquesne/rollinghash v4.0.0+incompatible
 	github.com/ecies/go/v2 v2.0.6
 	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.15.15
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/pkg/sftp v1.10.1
 	github.com/stretchr/testify v1.8.2
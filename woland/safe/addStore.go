@@ -11,7 +11,12 @@ import (
 	"golang.org/x/crypto/blake2b"
 )
 
+// AddStore adds a replica to the safe. The store is recorded in the change log so that all peers replicate on it.
 func AddStore(s *Safe, storeConfig StoreConfig) error {
+	if s.Permission&Admin == 0 {
+		return ErrNotAdmin
+	}
+
 	data, err := json.Marshal(storeConfig)
 	if core.IsErr(err, nil, "cannot marshal store %s/%s: %v", s.Name, storeConfig.Url) {
 		return err
@@ -20,11 +25,22 @@ func AddStore(s *Safe, storeConfig StoreConfig) error {
 	h := blake2b.Sum384([]byte(storeConfig.Url))
 	n := strings.ReplaceAll(sql.EncodeBase64(h[:]), "/", "_")
 
-	err = storage.WriteFile(s.PrimaryStore, path.Join(s.Name, ConfigFolder, n+".store"), data)
+	err = storage.WriteFile(getPrimaryStore(s), path.Join(s.Name, ConfigFolder, n+".store"), data)
 	if core.IsErr(err, nil, "cannot write store %s/%s: %v", s.Name, storeConfig.Url) {
 		return err
 	}
 
+	err = retryConfigChange(s, func() error {
+		return writeReplicaChange(getPrimaryStore(s), s.Name, s.CurrentUser, storeConfig)
+	})
+	if core.IsErr(err, nil, "cannot write replica change for %s/%s: %v", s.Name, storeConfig.Url) {
+		return err
+	}
+	err = SetCached(s.Name, getPrimaryStore(s), "config/.access.touch", nil, s.CurrentUser.Id)
+	if core.IsErr(err, nil, "cannot create touch file in %s: %v", s.Name) {
+		return err
+	}
+
 	err = setStoreInDB(s.Name, storeConfig)
 	if core.IsErr(err, nil, "cannot set store %s/%s: %v", s.Name, storeConfig.Url) {
 		return err
@@ -37,7 +53,7 @@ func AddStore(s *Safe, storeConfig StoreConfig) error {
 func syncStores(s *Safe) error {
 	now := core.Now()
 
-	store := s.PrimaryStore
+	store := getPrimaryStore(s)
 	name := path.Join(s.Name, ConfigFolder)
 	ls, err := store.ReadDir(name, storage.Filter{Suffix: ".store"})
 	if core.IsErr(err, nil, "cannot read stores in %s: %v", name, err) {
@@ -45,7 +61,7 @@ func syncStores(s *Safe) error {
 	}
 
 	for _, f := range ls {
-		data, err := storage.ReadFile(s.PrimaryStore, path.Join(name, f.Name()))
+		data, err := storage.ReadFile(getPrimaryStore(s), path.Join(name, f.Name()))
 		if core.IsErr(err, nil, "cannot read store %s: %v", f.Name(), err) {
 			continue
 		}
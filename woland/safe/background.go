@@ -15,7 +15,9 @@ func backgroundJob(s *Safe) {
 				connect(s)
 			}
 		case task, ok := <-s.uploadFile:
-			if ok { // channel closed
+			if ok && isMetered(s) { // the upload stays in the DB until the network is not metered
+				core.Info("metered network, upload of %s[%d] postponed", task.Header.Name, task.Header.FileId)
+			} else if ok {
 				uploadFileInBackground(s, task)
 			}
 		case _, ok := <-s.enforceQuota:
@@ -23,7 +25,10 @@ func backgroundJob(s *Safe) {
 				enforceQuota(s)
 			}
 		case c, ok := <-s.compactHeaders:
-			if ok {
+			if ok && !c.NewKey && isMetered(s) { // the compaction is requested again by the next sync
+				core.Info("metered network, compaction of %s postponed", c.BucketDir)
+				s.compactHeadersWg.Done()
+			} else if ok {
 				compactHeadersInBucket(s, c.BucketDir, c.NewKey)
 			}
 		case <-s.quit:
@@ -35,12 +40,37 @@ func backgroundJob(s *Safe) {
 				if !s.Connected {
 					connect(s)
 				} else {
+					if core.Since(s.lastPrimaryProbe) > PrimaryProbePeriod {
+						checkPrimary(s)
+						s.lastPrimaryProbe = core.Now()
+					}
 					SyncUsers(s)
-					uploadFilesInBackground(s)
+					flushUsage(s)
 					if core.Since(s.lastQuotaEnforcement) > 15*time.Minute {
 						enforceQuota(s)
 						s.lastQuotaEnforcement = core.Now()
 					}
+					if core.Since(s.lastBudgetCheck) > BudgetCheckPeriod {
+						checkBudget(s)
+						s.lastBudgetCheck = core.Now()
+					}
+					if isMetered(s) { // only the users and the headers are synchronized
+						continue
+					}
+					uploadFilesInBackground(s)
+					materializeDeltas(s)
+					if core.Since(s.lastGarbageCollection) > GarbageCollectionPeriod {
+						CollectGarbage(s)
+						s.lastGarbageCollection = core.Now()
+					}
+					replicaWatch := DefaultReplicaWatch
+					if isOverBudget(s) {
+						replicaWatch = OverBudgetReplicaWatch
+					}
+					if len(s.StoreConfigs) > 1 && core.Since(s.lastReplication) > replicaWatch {
+						Replicate(s)
+						s.lastReplication = core.Now()
+					}
 				}
 
 			}
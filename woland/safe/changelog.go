@@ -3,6 +3,7 @@ package safe
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"path"
 	"sort"
 	"time"
@@ -15,6 +16,12 @@ import (
 	"github.com/stregato/master/woland/storage"
 )
 
+// ErrConcurrentConfigChange is returned when another peer changes the keystore or the change log at the same time
+var ErrConcurrentConfigChange = fmt.Errorf("the config of the safe was changed concurrently")
+
+// ConfigChangeRetries is the number of times a change of the config is applied again after a concurrent change
+var ConfigChangeRetries = 3
+
 type ChangeLog struct {
 	Changes []Change `json:"changes"`
 }
@@ -50,6 +57,38 @@ func (users Users) Is(userId string, permission Permission) bool {
 	return users[userId]&permission > 0
 }
 
+// canWrite returns true if the permission allows to add files to the safe
+func canWrite(permission Permission) bool {
+	return permission&Suspended == 0 && permission&(Standard|Admin) != 0
+}
+
+// PermissionSince is the permission of a user starting from a point in time
+type PermissionSince struct {
+	Permission Permission `json:"permission"`
+	Since      time.Time  `json:"since"`
+}
+
+// PermissionHistory contains for each user the permissions granted over time in chronological order
+type PermissionHistory map[string][]PermissionSince
+
+// At returns the permission of the user at the given time or 0 if the user had no permission at that time
+func (history PermissionHistory) At(userId string, t time.Time) Permission {
+	var permission Permission
+	for _, p := range history[userId] {
+		if p.Since.After(t) {
+			break
+		}
+		permission = p.Permission
+	}
+	return permission
+}
+
+func (history PermissionHistory) add(users Users, since time.Time) {
+	for userId, permission := range users {
+		history[userId] = append(history[userId], PermissionSince{Permission: permission, Since: since})
+	}
+}
+
 type PermissionChange struct {
 	UserId     string     `json:"userId"`
 	Permission Permission `json:"permission"`
@@ -69,14 +108,17 @@ func isSignatureValid(change Change) bool {
 }
 
 func readChangeLogs(safeName string, s storage.Store, currentUser security.Identity,
-	creatorId string, afterName string) (users Users, newestChangeFile string, err error) {
+	creatorId string, afterName string) (users Users, history PermissionHistory, replicas []StoreConfig,
+	newestChangeFile string, err error) {
 
 	files, err := s.ReadDir(path.Join(safeName, ConfigFolder), storage.Filter{Suffix: ".change", AfterName: afterName})
 	if core.IsErr(err, nil, "cannot read change log files: %v", err) {
-		return nil, "", err
+		return nil, nil, nil, "", err
 	}
 
 	users = Users{creatorId: Standard + Admin + Creator}
+	history = PermissionHistory{}
+	history.add(users, time.Time{})
 	for _, file := range files {
 		var changeLog ChangeLog
 		name := file.Name()
@@ -117,16 +159,37 @@ func readChangeLogs(safeName string, s storage.Store, currentUser security.Ident
 					continue
 				}
 				users[permissionChange.UserId] = permissionChange.Permission
+				history.add(Users{permissionChange.UserId: permissionChange.Permission}, change.ModTime)
 				core.Info("user '%s' in %s has permission %d", permissionChange.UserId, safeName, permissionChange.Permission)
 			}
+
+			if change.Type == ChangeReplicas {
+				if users[change.By]&Admin == 0 {
+					continue
+				}
+
+				var storeConfig StoreConfig
+				err := json.Unmarshal(change.What, &storeConfig)
+				if core.IsErr(err, nil, "cannot unmarshal replicas change: %v", err) {
+					continue
+				}
+				replicas = append(replicas, storeConfig)
+				core.Info("store '%s' is a replica of %s", storeConfig.Url, safeName)
+			}
 		}
 
 		if users[signedBy]&Admin == 0 {
-			return nil, "", fmt.Errorf("invalid change log file: not signed by administrator")
+			return nil, nil, nil, "", fmt.Errorf("invalid change log file: not signed by administrator")
 		}
 	}
 
-	return users, newestChangeFile, nil
+	for _, permissions := range history {
+		sort.SliceStable(permissions, func(i, j int) bool {
+			return permissions[i].Since.Before(permissions[j].Since)
+		})
+	}
+
+	return users, history, replicas, newestChangeFile, nil
 }
 
 func writePermissionChange(s storage.Store, safeName string, currentUser security.Identity, users Users) error {
@@ -165,6 +228,10 @@ func writePermissionChange(s storage.Store, safeName string, currentUser securit
 		return err
 	}
 	name := fmt.Sprintf("%d.change", snowflake.ID())
+	err = claimConfigWrite(s, safeName, name)
+	if core.IsErr(err, nil, "cannot write change log '%s': %v", name, err) {
+		return err
+	}
 	err = storage.WriteFile(s, path.Join(safeName, ConfigFolder, name), data)
 	if core.IsErr(err, nil, "cannot write change log '%s': %v", name, err) {
 		return err
@@ -172,3 +239,75 @@ func writePermissionChange(s storage.Store, safeName string, currentUser securit
 	core.Info("wrote change log '%s' in safe %s, #users=%d", name, safeName, len(users))
 	return nil
 }
+
+// writeReplicaChange adds a store to the replicas of the safe in the change log
+func writeReplicaChange(s storage.Store, safeName string, currentUser security.Identity, storeConfig StoreConfig) error {
+	data, err := json.Marshal(storeConfig)
+	if core.IsErr(err, nil, "cannot marshal replica change: %v", err) {
+		return err
+	}
+
+	change := Change{
+		Type:    ChangeReplicas,
+		By:      currentUser.Id,
+		What:    data,
+		ModTime: core.Now(),
+	}
+	change.Signature, err = security.Sign(currentUser, hashOfChange(change))
+	if core.IsErr(err, nil, "cannot sign replica change: %v", err) {
+		return err
+	}
+
+	data, err = security.Marshal(currentUser, ChangeLog{Changes: []Change{change}}, "signature")
+	if core.IsErr(err, nil, "cannot marshal change log: %v", err) {
+		return err
+	}
+	name := fmt.Sprintf("%d.change", snowflake.ID())
+	err = claimConfigWrite(s, safeName, name)
+	if core.IsErr(err, nil, "cannot write change log '%s': %v", name, err) {
+		return err
+	}
+	err = storage.WriteFile(s, path.Join(safeName, ConfigFolder, name), data)
+	if core.IsErr(err, nil, "cannot write change log '%s': %v", name, err) {
+		return err
+	}
+	core.Info("wrote replica change '%s' in safe %s for store %s", name, safeName, storeConfig.Url)
+	return nil
+}
+
+// retryConfigChange runs apply until it does not fail with ErrConcurrentConfigChange or the retries are over. Before
+// each retry the users and the keystore are read again, so that apply builds on the change of the other peer.
+func retryConfigChange(s *Safe, apply func() error) error {
+	for i := 0; ; i++ {
+		err := apply()
+		if err != ErrConcurrentConfigChange || i == ConfigChangeRetries {
+			return err
+		}
+		core.Info("config of %s changed concurrently, retry %d/%d", s.Name, i+1, ConfigChangeRetries)
+		_, err = syncSafeUsers(s, true)
+		if core.IsErr(err, nil, "cannot sync users in %s: %v", s.Name) {
+			return err
+		}
+	}
+}
+
+// claimConfigWrite updates the sequence file in the config folder with the name of the change log or keystore about
+// to be written. The update is conditional on the version of the sequence file read just before, so that when two
+// peers change the config at the same time one of them fails with ErrConcurrentConfigChange and must apply its
+// change again with retryConfigChange.
+func claimConfigWrite(s storage.Store, safeName string, name string) error {
+	sequence := path.Join(safeName, ConfigFolder, SequenceFile)
+	cond := storage.Condition{IfAbsent: true}
+	etag, err := storage.ETag(s, sequence)
+	if err == nil {
+		cond = storage.Condition{IfMatch: etag}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = storage.WriteFileIf(s, sequence, []byte(name), cond)
+	if err == storage.ErrConditionFailed {
+		return ErrConcurrentConfigChange
+	}
+	return err
+}
@@ -0,0 +1,299 @@
+package safe
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/stregato/master/woland/algo"
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+var ChunkSplitBits uint = 20              // The average size of a chunk is 2^ChunkSplitBits bytes
+var OrphanChunkRetention = 24 * time.Hour // Time an unreferenced chunk is kept in case a peer references it again
+
+// Chunk is a part of a body stored with PutOptions.Chunked. Chunks are shared by all the files of the safe with the
+// same content in the chunk.
+type Chunk struct {
+	Key  []byte `json:"k"` // Hash of the content keyed with the safe key, used as encryption key of the chunk
+	Size int64  `json:"s"` // Size of the chunk
+}
+
+// id returns the name of the chunk in the store. The name does not reveal the encryption key.
+func (c Chunk) id() string {
+	h := blake2b.Sum256(c.Key)
+	return hex.EncodeToString(h[:])
+}
+
+// header returns the encryption parameters of the chunk. The IV is derived from the key so that the same content
+// always produces the same chunk.
+func (c Chunk) header() Header {
+	iv := blake2b.Sum256(append([]byte("iv"), c.Key...))
+	return Header{Size: c.Size, BodyKey: c.Key, IV: iv[:aes.BlockSize], Format: FormatAEAD}
+}
+
+// splitChunks splits the reader in content defined chunks. Small chunks are merged and large chunks are split so
+// that chunks are between a quarter and four times the average size.
+func splitChunks(r io.ReadSeeker, key []byte) ([]Chunk, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		return nil, err
+	}
+	blocks, err := algo.HashSplit(r, ChunkSplitBits, nil)
+	if core.IsErr(err, nil, "cannot split file: %v", err) {
+		return nil, err
+	}
+
+	minSize, maxSize := int64(1)<<(ChunkSplitBits-2), int64(1)<<(ChunkSplitBits+2)
+	var sizes []int64
+	var size int64
+	for i, block := range blocks {
+		size += block.Length
+		for size > maxSize {
+			sizes = append(sizes, maxSize)
+			size -= maxSize
+		}
+		if size >= minSize || i == len(blocks)-1 && size > 0 {
+			sizes = append(sizes, size)
+			size = 0
+		}
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		return nil, err
+	}
+	var chunks []Chunk
+	for _, size := range sizes {
+		hash, _ := blake2b.New256(key)
+		_, err = io.CopyN(hash, r, size)
+		if core.IsErr(err, nil, "cannot hash chunk: %v", err) {
+			return nil, err
+		}
+		chunks = append(chunks, Chunk{Key: hash.Sum(nil), Size: size})
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return chunks, err
+}
+
+// chunkRef returns the name in the store of the reference of a file to a chunk. The references are kept in the store
+// because a peer knows only the files it has synchronized, so its own references cannot tell that a chunk is unused.
+func chunkRef(safeName string, chunkId string, fileId uint64) string {
+	return path.Join(safeName, ChunkRefFolder, fmt.Sprintf("%s.%d", chunkId, fileId))
+}
+
+// writeChunks writes the reference of the file to each chunk and the chunks that are not yet in the store. It returns
+// the number of chunks written.
+func writeChunks(s *Safe, store storage.Store, r io.ReadSeeker, fileId uint64, chunks []Chunk) (int, error) {
+	_, err := r.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		return 0, err
+	}
+
+	written := 0
+	for _, c := range chunks {
+		data := make([]byte, c.Size)
+		_, err = io.ReadFull(r, data)
+		if core.IsErr(err, nil, "cannot read chunk: %v", err) {
+			return written, err
+		}
+
+		// the reference goes first, so that a peer collecting the chunk sees it is in use
+		err = storage.WriteFile(store, chunkRef(s.Name, c.id(), fileId), nil)
+		if core.IsErr(err, nil, "cannot write reference to chunk %s: %v", c.id()) {
+			return written, err
+		}
+		name := path.Join(s.Name, ChunkFolder, c.id())
+		if _, err := store.Stat(name); err == nil {
+			continue
+		}
+		h := c.header()
+		er, err := encryptReader(core.NewBytesReader(data), h.BodyKey, h.IV)
+		if core.IsErr(err, nil, "cannot create encrypting reader: %v", err) {
+			return written, err
+		}
+		err = store.Write(name, er, nil)
+		if core.IsErr(err, nil, "cannot write chunk %s: %v", name) {
+			return written, err
+		}
+		written++
+	}
+	core.Info("wrote %d of %d chunks to %s", written, len(chunks), store)
+	return written, nil
+}
+
+// readChunks writes the content of a chunked file, or the range of it, to w
+func readChunks(s *Safe, header Header, w io.Writer, rang *storage.Range) error {
+	from, to := int64(0), header.Size
+	if rang != nil {
+		from, to = clampRange(header, rang)
+	}
+
+	var offset int64
+	for _, c := range header.Chunks {
+		start, end := offset, offset+c.Size
+		offset = end
+		if end <= from || start >= to {
+			continue
+		}
+
+		h := c.header()
+		r := &storage.Range{From: max64(from-start, 0), To: min64(to, end) - start}
+		dw, err := decryptWriter(w, h, r)
+		if core.IsErr(err, nil, "cannot create decrypting writer: %v", err) {
+			return err
+		}
+		name := path.Join(s.Name, ChunkFolder, c.id())
+		primary, secondary := getStores(s)
+		err = secondary.Read(name, bodyRange(h, r), dw, nil)
+		if err != nil && secondary != primary {
+			err = primary.Read(name, bodyRange(h, r), dw, nil)
+		}
+		if core.IsErr(err, nil, "cannot read chunk %s: %v", name) {
+			return err
+		}
+		err = dw.Close()
+		if core.IsErr(err, nil, "cannot decrypt chunk %s: %v", name) {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertChunkRefsToDB records that the file references its chunks
+func insertChunkRefsToDB(safeName string, header Header) error {
+	for _, c := range header.Chunks {
+		_, err := sql.Exec("INSERT_CHUNK_REF", sql.Args{"safe": safeName, "chunkId": c.id(), "fileId": header.FileId})
+		if core.IsErr(err, nil, "cannot insert chunk reference: %v", err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseChunks removes the references of a deleted file to its chunks from the stores and the DB. Chunks without
+// references in the DB become orphans.
+func releaseChunks(s *Safe, stores []storage.Store, fileId uint64) error {
+	safeName := s.Name
+	var chunkIds []string
+	rows, err := sql.Query("GET_FILE_CHUNKS", sql.Args{"safe": safeName, "fileId": fileId})
+	if core.IsErr(err, nil, "cannot query chunks of %d: %v", fileId) {
+		return err
+	}
+	for rows.Next() {
+		var chunkId string
+		if !core.IsErr(rows.Scan(&chunkId), nil, "cannot scan chunk: %v") {
+			chunkIds = append(chunkIds, chunkId)
+		}
+	}
+	rows.Close()
+
+	for _, chunkId := range chunkIds {
+		name := chunkRef(safeName, chunkId, fileId)
+		for _, store := range stores {
+			err = store.Delete(name)
+			if !os.IsNotExist(err) && core.IsErr(err, nil, "cannot delete chunk reference %s from %s: %v", name, store) {
+				return err
+			}
+		}
+	}
+
+	_, err = sql.Exec("DELETE_FILE_CHUNK_REFS", sql.Args{"safe": safeName, "fileId": fileId})
+	if core.IsErr(err, nil, "cannot delete chunk references of %d: %v", fileId) {
+		return err
+	}
+	for _, chunkId := range chunkIds {
+		var refs int
+		err = sql.QueryRow("COUNT_CHUNK_REFS", sql.Args{"safe": safeName, "chunkId": chunkId}, &refs)
+		if core.IsErr(err, nil, "cannot count references of chunk %s: %v", chunkId) {
+			return err
+		}
+		if refs > 0 {
+			continue
+		}
+		_, err = sql.Exec("INSERT_ORPHAN_CHUNK", sql.Args{"safe": safeName, "chunkId": chunkId,
+			"orphanTime": core.Now().UnixMilli()})
+		if core.IsErr(err, nil, "cannot insert orphan chunk %s: %v", chunkId) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOrphanChunks deletes from the stores the chunks without references for longer than OrphanChunkRetention. A
+// chunk is deleted only when no store holds a reference to it, since files this peer has not synchronized may use it.
+func deleteOrphanChunks(s *Safe, stores []storage.Store) (int, error) {
+	_, err := sql.Exec("DELETE_REFERENCED_ORPHAN_CHUNKS", sql.Args{"safe": s.Name})
+	if core.IsErr(err, nil, "cannot delete referenced orphan chunks: %v", err) {
+		return 0, err
+	}
+
+	rows, err := sql.Query("GET_ORPHAN_CHUNKS", sql.Args{"safe": s.Name,
+		"before": core.Now().Add(-OrphanChunkRetention).UnixMilli()})
+	if core.IsErr(err, nil, "cannot query orphan chunks: %v", err) {
+		return 0, err
+	}
+	var chunkIds []string
+	for rows.Next() {
+		var chunkId string
+		if !core.IsErr(rows.Scan(&chunkId), nil, "cannot scan chunk: %v") {
+			chunkIds = append(chunkIds, chunkId)
+		}
+	}
+	rows.Close()
+
+	deleted := 0
+	for _, chunkId := range chunkIds {
+		if isChunkReferenced(s, stores, chunkId) {
+			_, err = sql.Exec("DELETE_ORPHAN_CHUNK", sql.Args{"safe": s.Name, "chunkId": chunkId})
+			core.IsErr(err, nil, "cannot delete orphan chunk %s: %v", chunkId)
+			continue
+		}
+
+		name := path.Join(s.Name, ChunkFolder, chunkId)
+		for _, store := range stores {
+			err = store.Delete(name)
+			if !os.IsNotExist(err) && core.IsErr(err, nil, "cannot delete chunk %s from %s: %v", name, store) {
+				continue
+			}
+		}
+		_, err = sql.Exec("DELETE_ORPHAN_CHUNK", sql.Args{"safe": s.Name, "chunkId": chunkId})
+		core.IsErr(err, nil, "cannot delete orphan chunk %s: %v", chunkId)
+		deleted++
+	}
+	if deleted > 0 {
+		core.Info("deleted %d orphan chunks in %s", deleted, s.Name)
+	}
+	return deleted, nil
+}
+
+// isChunkReferenced returns true when any of the stores holds a reference to the chunk. A store that cannot be listed
+// counts as a reference.
+func isChunkReferenced(s *Safe, stores []storage.Store, chunkId string) bool {
+	dir := path.Join(s.Name, ChunkRefFolder)
+	for _, store := range stores {
+		ls, err := store.ReadDir(dir, storage.Filter{Prefix: chunkId + ".", MaxResults: 1})
+		if os.IsNotExist(err) {
+			continue
+		}
+		if core.IsErr(err, nil, "cannot list references of chunk %s in %s: %v", chunkId, store) || len(ls) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
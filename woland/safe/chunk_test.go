@@ -0,0 +1,76 @@
+package safe
+
+import (
+	"bytes"
+	"math/rand"
+	"path"
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestChunks(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	splitBits, retention := ChunkSplitBits, OrphanChunkRetention
+	ChunkSplitBits, OrphanChunkRetention = 10, 0
+	defer func() { ChunkSplitBits, OrphanChunkRetention = splitBits, retention }()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	data := make([]byte, 32*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := append([]byte{}, data...)
+	copy(edited[16*1024:], "edited in the middle")
+
+	h1, err := Put(s, "bucket", "first", core.NewBytesReader(data), PutOptions{Chunked: true}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	core.Assert(t, len(h1.Chunks) > 1, "Expected several chunks, got %d", len(h1.Chunks))
+	h2, err := Put(s, "bucket", "second", core.NewBytesReader(edited), PutOptions{Chunked: true}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+
+	chunksDir := path.Join(s.Name, ChunkFolder)
+	ls, err := s.PrimaryStore.ReadDir(chunksDir, storage.Filter{})
+	core.TestErr(t, err, "cannot read chunks: %v")
+	core.Assert(t, len(ls) < len(h1.Chunks)+len(h2.Chunks), "Expected shared chunks, got %d files for %d+%d chunks",
+		len(ls), len(h1.Chunks), len(h2.Chunks))
+	stored := len(ls)
+
+	b := bytes.Buffer{}
+	_, err = Get(s, "bucket", "second", &b, GetOptions{})
+	core.TestErr(t, err, "cannot get file: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), edited), "Unexpected content")
+
+	b.Reset()
+	_, err = Get(s, "bucket", "second", &b, GetOptions{Range: &storage.Range{From: 1000, To: 20000}})
+	core.TestErr(t, err, "cannot get range: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), edited[1000:20000]), "Unexpected range content")
+
+	// a peer that has not synchronized second does not know its chunks, but must not delete them
+	_, err = sql.Exec("DELETE_FILE_CHUNK_REFS", sql.Args{"safe": s.Name, "fileId": h2.FileId})
+	core.TestErr(t, err, "cannot delete chunk references: %v")
+
+	err = DeleteFile(s, "bucket", h1.FileId)
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = CollectGarbage(s)
+	core.TestErr(t, err, "cannot collect garbage: %v")
+
+	ls, err = s.PrimaryStore.ReadDir(chunksDir, storage.Filter{})
+	core.TestErr(t, err, "cannot read chunks: %v")
+	core.Assert(t, len(ls) == len(h2.Chunks) && len(ls) < stored, "Expected only the chunks of second, got %d", len(ls))
+	refs, err := s.PrimaryStore.ReadDir(path.Join(s.Name, ChunkRefFolder), storage.Filter{})
+	core.TestErr(t, err, "cannot read chunk references: %v")
+	core.Assert(t, len(refs) == len(h2.Chunks), "Expected only the references of second, got %d", len(refs))
+
+	b.Reset()
+	_, err = Get(s, "bucket", "second", &b, GetOptions{})
+	core.TestErr(t, err, "cannot get file after garbage collection: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), edited), "Unexpected content after garbage collection")
+}
@@ -1,5 +1,7 @@
 package safe
 
+import "github.com/stregato/master/woland/sql"
+
 func Close(s *Safe) {
 	s.background.Stop()
 	close(s.quit)
@@ -8,10 +10,14 @@ func Close(s *Safe) {
 	close(s.compactHeaders)
 
 	s.wg.Wait()
-	if s.PrimaryStore != nil {
-		s.PrimaryStore.Close()
+	if sql.IsOpen() {
+		flushUsage(s)
+	}
+	primary, secondary := getStores(s)
+	if primary != nil {
+		primary.Close()
 	}
-	if s.SecondaryStore != nil {
-		s.SecondaryStore.Close()
+	if secondary != nil && secondary != primary {
+		secondary.Close()
 	}
 }
@@ -0,0 +1,224 @@
+package safe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/storage"
+)
+
+// Codec creates the writers and readers of a compression format
+type Codec struct {
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// Codecs are the compression formats available for PutOptions.Codec. Other formats can be added before the safe is
+// used; peers must have the same codecs to read the files.
+var Codecs = map[string]Codec{
+	"gzip": {
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	"zstd": {
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+}
+
+var DefaultCodec = "zstd"          // Codec used when PutOptions.Codec is empty
+var CompressionFrameSize = 1 << 20 // Size of the uncompressed frames, which can be decompressed independently
+
+var ErrUnknownCodec = fmt.Errorf("unknown compression codec")
+
+// compressedContentTypes lists content types that do not benefit from compression. Entries ending with / match all
+// the subtypes.
+var compressedContentTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/heic", "video/", "audio/mpeg",
+	"audio/aac", "audio/ogg", "audio/mp4", "application/zip", "application/gzip", "application/x-gzip",
+	"application/zstd", "application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+	"application/vnd.rar", "application/x-rar-compressed",
+}
+
+// Compression describes the compressed body of a file. The body is a sequence of frames compressed independently so
+// that a range of the file can be read without decompressing the whole body.
+type Compression struct {
+	Codec     string  `json:"c"`           // Codec used to compress the frames
+	FrameSize int64   `json:"f,omitempty"` // Uncompressed size of each frame but the last
+	Frames    []int64 `json:"s,omitempty"` // Compressed size of each frame
+}
+
+// size returns the size of the compressed body
+func (c *Compression) size() int64 {
+	var size int64
+	for _, s := range c.Frames {
+		size += s
+	}
+	return size
+}
+
+// isCompressible returns true if the content type is not already compressed
+func isCompressible(contentType string) bool {
+	contentType, _, _ = strings.Cut(contentType, ";")
+	for _, c := range compressedContentTypes {
+		if contentType == c || strings.HasSuffix(c, "/") && strings.HasPrefix(contentType, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// compressFrames compresses the reader in frames with the codec. It returns nil when compression does not reduce the
+// size of the body.
+func compressFrames(r io.ReadSeeker, codecName string) (io.ReadSeeker, *Compression, error) {
+	codec, ok := Codecs[codecName]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownCodec, codecName)
+	}
+	_, err := r.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		return nil, nil, err
+	}
+
+	var size int64
+	var compressed bytes.Buffer
+	compression := Compression{Codec: codecName, FrameSize: int64(CompressionFrameSize)}
+	frame := make([]byte, CompressionFrameSize)
+	for {
+		n, err := io.ReadFull(r, frame)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+
+		start := compressed.Len()
+		w, err := codec.NewWriter(&compressed)
+		if core.IsErr(err, nil, "cannot create %s writer: %v", codecName) {
+			return nil, nil, err
+		}
+		_, err = w.Write(frame[:n])
+		if core.IsErr(err, nil, "cannot compress data: %v", err) {
+			return nil, nil, err
+		}
+		err = w.Close()
+		if core.IsErr(err, nil, "cannot close %s writer: %v", codecName) {
+			return nil, nil, err
+		}
+		size += int64(n)
+		compression.Frames = append(compression.Frames, int64(compressed.Len()-start))
+	}
+
+	if int64(compressed.Len()) >= size {
+		_, err = r.Seek(0, io.SeekStart)
+		return r, nil, err
+	}
+	return core.NewBytesReader(compressed.Bytes()), &compression, nil
+}
+
+// decompressWriter returns a writer that receives the compressed frames containing the range and writes the
+// decompressed range to w. The returned range is the range of the compressed body to read.
+func decompressWriter(w io.Writer, header Header, rang *storage.Range) (io.Writer, *storage.Range, error) {
+	c := header.Compression
+	codec, ok := Codecs[c.Codec]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownCodec, c.Codec)
+	}
+
+	fw := &frameWriter{w: w, codec: codec, frames: c.Frames, limit: -1}
+	if rang == nil {
+		return fw, nil, nil
+	}
+
+	from, to := clampRange(header, rang)
+	first := from / c.FrameSize
+	last := first
+	if to > from {
+		last = (to - 1) / c.FrameSize
+	}
+	last = min64(last, int64(len(c.Frames)-1))
+
+	var offset int64
+	for _, s := range c.Frames[:first] {
+		offset += s
+	}
+	end := offset
+	for _, s := range c.Frames[first : last+1] {
+		end += s
+	}
+	fw.frames = c.Frames[first : last+1]
+	fw.skip = from - first*c.FrameSize
+	fw.limit = to - from
+	return fw, &storage.Range{From: offset, To: end}, nil
+}
+
+// frameWriter decompresses frames as soon as all their bytes are received
+type frameWriter struct {
+	w      io.Writer
+	codec  Codec
+	frames []int64 // Compressed size of the frames still expected
+	buf    []byte  // Bytes of the current frame
+	skip   int64   // Decompressed bytes to skip before writing
+	limit  int64   // Decompressed bytes to write, -1 for all
+}
+
+func (fw *frameWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && len(fw.frames) > 0 {
+		need := int(fw.frames[0]) - len(fw.buf)
+		if need > len(p) {
+			need = len(p)
+		}
+		fw.buf = append(fw.buf, p[:need]...)
+		p = p[need:]
+		if len(fw.buf) < int(fw.frames[0]) {
+			break
+		}
+
+		err := fw.writeFrame()
+		if err != nil {
+			return 0, err
+		}
+		fw.frames = fw.frames[1:]
+		fw.buf = fw.buf[:0]
+	}
+	return n, nil
+}
+
+func (fw *frameWriter) writeFrame() error {
+	r, err := fw.codec.NewReader(bytes.NewReader(fw.buf))
+	if core.IsErr(err, nil, "cannot create decompressing reader: %v", err) {
+		return err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if core.IsErr(err, nil, "cannot decompress frame: %v", err) {
+		return err
+	}
+
+	skip := min64(fw.skip, int64(len(data)))
+	data = data[skip:]
+	fw.skip -= skip
+	if fw.limit >= 0 {
+		data = data[:min64(fw.limit, int64(len(data)))]
+		fw.limit -= int64(len(data))
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	_, err = fw.w.Write(data)
+	return err
+}
@@ -0,0 +1,58 @@
+package safe
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestCompression(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	frameSize := CompressionFrameSize
+	CompressionFrameSize = 1024
+	defer func() { CompressionFrameSize = frameSize }()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	data := bytes.Repeat([]byte("compressible content "), 500)
+	for _, codec := range []string{"gzip", "zstd"} {
+		name := "file." + codec
+		h, err := Put(s, "bucket", name, core.NewBytesReader(data), PutOptions{Zip: true, Codec: codec}, nil)
+		core.TestErr(t, err, "cannot put file: %v")
+		core.Assert(t, h.Compression != nil && h.Compression.Codec == codec, "Expected %s compression", codec)
+		core.Assert(t, len(h.Compression.Frames) == 11, "Expected 11 frames, got %d", len(h.Compression.Frames))
+		core.Assert(t, h.Size == int64(len(data)), "Expected uncompressed size, got %d", h.Size)
+
+		b := bytes.Buffer{}
+		_, err = Get(s, "bucket", name, &b, GetOptions{NoCache: true})
+		core.TestErr(t, err, "cannot get file: %v")
+		core.Assert(t, bytes.Equal(b.Bytes(), data), "Unexpected content with %s", codec)
+
+		for _, r := range []storage.Range{{From: 100, To: 200}, {From: 1000, To: 3100}, {From: 10000, To: 0}} {
+			b.Reset()
+			_, err = Get(s, "bucket", name, &b, GetOptions{Range: &r})
+			core.TestErr(t, err, "cannot get range: %v")
+			to := r.To
+			if to == 0 {
+				to = int64(len(data))
+			}
+			core.Assert(t, bytes.Equal(b.Bytes(), data[r.From:to]), "Unexpected range %d-%d with %s", r.From, r.To, codec)
+		}
+	}
+
+	h, err := Put(s, "bucket", "image.jpg", core.NewBytesReader(data), PutOptions{Zip: true}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	core.Assert(t, h.Compression == nil, "Expected no compression for jpeg")
+
+	_, err = Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{Zip: true, Codec: "lzma"}, nil)
+	core.Assert(t, err != nil, "Expected error for unknown codec")
+}
@@ -35,6 +35,10 @@ func Create(currentUser security.Identity, name string, storeConfig StoreConfig,
 	if core.IsErr(err, nil, "invalid name %s: %v", name) {
 		return nil, err
 	}
+	err = initNode()
+	if core.IsErr(err, nil, "cannot initialize node: %v") {
+		return nil, err
+	}
 	storeConfig.Primary = true
 
 	primary, err := storage.Open(storeConfig.Url)
@@ -79,6 +83,9 @@ func Create(currentUser security.Identity, name string, storeConfig StoreConfig,
 		return nil, err
 	}
 
+	history := PermissionHistory{}
+	history.add(Users{creatorId: Standard + Admin + Creator}, time.Time{})
+	history.add(users, core.Now())
 	err = writePermissionChange(primary, name, currentUser, users)
 	if core.IsErr(err, nil, "cannot write permission change in %s: %v", name) {
 		return nil, err
@@ -97,6 +104,7 @@ func Create(currentUser security.Identity, name string, storeConfig StoreConfig,
 		Description: options.Description,
 		Keystore:    keystore,
 		Users:       users,
+		History:     history,
 	}
 	err = setSafeConfigToDB(name, config)
 	if core.IsErr(err, nil, "cannot write config of safe %s to DB: %v", name) {
@@ -122,13 +130,15 @@ func Create(currentUser security.Identity, name string, storeConfig StoreConfig,
 		Keystore:       keystore,
 		Users:          users,
 		PrimaryStore:   primary,
+		history:        history,
 		SecondaryStore: primary,
 		storeUrl:       storeConfig.Url,
+		primaryUrl:     storeConfig.Url,
 		usersLock:      sync.Mutex{},
 		background:     time.NewTicker(time.Minute),
 		syncUsers:      make(chan bool),
 		uploadFile:     make(chan UploadTask),
-		enforceQuota:   make(chan bool),
+		enforceQuota:   make(chan bool, 10),
 		connect:        make(chan bool),
 		compactHeaders: make(chan CompactHeader),
 		storeSizes:     map[string]int64{},
@@ -138,6 +148,8 @@ func Create(currentUser security.Identity, name string, storeConfig StoreConfig,
 		storeLock:      sync.Mutex{},
 	}
 	safesCounterLock.Unlock()
+	s.PrimaryStore = cacheStore(s, wrapStore(s, primary))
+	s.SecondaryStore = s.PrimaryStore
 
 	err = AddStore(s, storeConfig)
 	if core.IsErr(err, nil, "cannot add store %s/%s: %v", name, storeConfig.Url, err) {
@@ -182,6 +194,37 @@ func resetSafeInDB(name string) error {
 	n, _ = res.RowsAffected()
 	core.Info("deleted %d headers of safe %s from DB", n, name)
 
+	_, err = sql.Exec("DELETE_SAFE_QUARANTINE", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot wipe DB quarantine for safe %s: %v", name, err) {
+		return err
+	}
+
+	_, err = sql.Exec("DELETE_SAFE_TOMBSTONES", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot wipe DB tombstones for safe %s: %v", name, err) {
+		return err
+	}
+
+	_, err = sql.Exec("DELETE_SAFE_CHUNKS", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot wipe DB chunks for safe %s: %v", name, err) {
+		return err
+	}
+	_, err = sql.Exec("DELETE_SAFE_ORPHAN_CHUNKS", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot wipe DB orphan chunks for safe %s: %v", name, err) {
+		return err
+	}
+	_, err = sql.Exec("DELETE_SAFE_MATERIALIZE", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot wipe DB materializations for safe %s: %v", name, err) {
+		return err
+	}
+	_, err = sql.Exec("DELETE_SAFE_DOWNLOAD_PARTS", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot wipe DB download parts for safe %s: %v", name, err) {
+		return err
+	}
+	_, err = sql.Exec("DELETE_SAFE_STORE_USAGE", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot wipe DB store usage for safe %s: %v", name, err) {
+		return err
+	}
+
 	_, err = sql.Exec("DELETE_SAFE_USERS", sql.Args{"safe": name})
 	if core.IsErr(err, nil, "cannot wipe DB users for safe %s: %v", name, err) {
 		return err
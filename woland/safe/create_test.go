@@ -1,10 +1,16 @@
 package safe
 
 import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stregato/master/woland/core"
 	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
 )
 
 // func TestNewAccess(t *testing.T) {
@@ -38,3 +44,58 @@ func TestCreateAndOpen(t *testing.T) {
 	core.TestErr(t, err, "cannot open portal: %v")
 	Close(s)
 }
+
+func TestOpenWithStoreCache(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	cacheFolder := CacheFolder
+	CacheFolder = t.TempDir()
+	defer func() { CacheFolder = cacheFolder }()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	_, err = Put(s, "bucket", "file1", core.NewBytesReader([]byte("file1")), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	Close(s)
+
+	// headers are read again from the store after a reset of the DB and of the sync marker
+	store, err := storage.Open(testUrl)
+	core.TestErr(t, err, "cannot open store: %v")
+	core.TestErr(t, store.Delete(path.Join(testSafe, DataFolder, hashPath("bucket"), ".touch")), "cannot delete touch: %v")
+	store.Close()
+
+	s, err = Open(Identity1, testSafe, testUrl, Identity1.Id, OpenOptions{StoreCacheTTL: time.Minute, ResetDB: true})
+	core.TestErr(t, err, "cannot open safe: %v")
+	defer Close(s)
+
+	files, err := ListFiles(s, "bucket", ListOptions{})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(files) == 1, "expected 1 file, got %d", len(files))
+	headers, _ := filepath.Glob(filepath.Join(CacheFolder, "stores", "*", "*", DataFolder, "*", HeaderFolder, "*"))
+	core.Assert(t, len(headers) > 0, "expected header files in the store cache")
+
+	// the second get of a body is served from the cache, even if the body is no longer in the store
+	b := bytes.Buffer{}
+	h, err := Get(s, "bucket", "file1", &b, GetOptions{NoCache: true})
+	core.TestErr(t, err, "cannot get file: %v")
+	bodies, _ := filepath.Glob(filepath.Join(CacheFolder, "stores", "*", "*", DataFolder, "*", BodyFolder, "*"))
+	core.Assert(t, len(bodies) == 1, "expected the body in the store cache, got %d files", len(bodies))
+	store, err = storage.Open(testUrl)
+	core.TestErr(t, err, "cannot open store: %v")
+	body := path.Join(testSafe, DataFolder, hashPath("bucket"), BodyFolder, fmt.Sprintf("%d", h.FileId))
+	core.TestErr(t, store.Delete(body), "cannot delete body: %v")
+	store.Close()
+	b.Reset()
+	_, err = Get(s, "bucket", "file1", &b, GetOptions{NoCache: true})
+	core.TestErr(t, err, "cannot get file from the store cache: %v")
+	core.Assert(t, b.String() == "file1", "expected 'file1' from the store cache, got '%s'", b.String())
+
+	_, err = Put(s, "bucket", "file2", core.NewBytesReader([]byte("file2")), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	files, err = ListFiles(s, "bucket", ListOptions{})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(files) == 2, "expected 2 files, got %d", len(files))
+}
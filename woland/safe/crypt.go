@@ -3,37 +3,117 @@ package safe
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"math/big"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/stregato/master/woland/storage"
 )
 
-type encryptingReadSeeker struct {
+const (
+	FormatLegacy = 0 // Body encrypted with AES-CTR and header files with AES-CFB, no authentication
+	FormatAEAD   = 1 // Body encrypted with AES-GCM over fixed size segments, header files with AES-GCM
+)
+
+// SegmentSize is the size of the plaintext in each authenticated segment of a body in FormatAEAD
+const SegmentSize = 64 * 1024
+const gcmOverhead = 16
+
+// aeadVersion is the first byte of bodies and header files in FormatAEAD. The high bit is never set in legacy header
+// files, which start with the big endian key id.
+const aeadVersion byte = 0x80 | FormatAEAD
+
+var ErrInvalidFormat = fmt.Errorf("invalid encryption format")
+
+type aeadReadSeeker struct {
 	inputSeeker io.ReadSeeker
-	cipher      cipher.Stream
+	aead        cipher.AEAD
+	size        int64 // Size of the plaintext
+	segments    int64 // Number of segments
+	encSize     int64 // Size of the ciphertext including the version byte
+	pos         int64 // Position in the ciphertext
+	segment     int64 // Index of the segment in buf
+	plain       []byte
+	buf         []byte
 }
 
-func (er *encryptingReadSeeker) Read(p []byte) (n int, err error) {
-	n, err = er.inputSeeker.Read(p)
-	if n > 0 {
-		er.cipher.XORKeyStream(p[:n], p[:n])
+func (ar *aeadReadSeeker) Read(p []byte) (n int, err error) {
+	if ar.pos >= ar.encSize {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if ar.pos == 0 {
+		p[0] = aeadVersion
+		ar.pos++
+		return 1, nil
 	}
-	return n, err
+
+	encSegmentSize := int64(SegmentSize + ar.aead.Overhead())
+	idx := (ar.pos - 1) / encSegmentSize
+	offset := (ar.pos - 1) % encSegmentSize
+	if idx != ar.segment {
+		_, err = ar.inputSeeker.Seek(idx*SegmentSize, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		l, err := io.ReadFull(ar.inputSeeker, ar.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		nonce := segmentNonce(idx, idx == ar.segments-1)
+		ar.buf = ar.aead.Seal(ar.buf[:0], nonce, ar.plain[:l], []byte{aeadVersion})
+		ar.segment = idx
+	}
+
+	n = copy(p, ar.buf[offset:])
+	ar.pos += int64(n)
+	return n, nil
 }
 
-func (er *encryptingReadSeeker) Seek(offset int64, whence int) (int64, error) {
-	return er.inputSeeker.Seek(offset, whence)
+func (ar *aeadReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ar.pos
+	case io.SeekEnd:
+		offset += ar.encSize
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	ar.pos = offset
+	return offset, nil
 }
 
+// encryptReader returns a reader that encrypts the input in FormatAEAD. The returned reader supports seeking so that
+// stores can compute the size or retry the upload.
 func encryptReader(inputSeeker io.ReadSeeker, key []byte, iv []byte) (io.ReadSeeker, error) {
-	block, err := aes.NewCipher(key)
+	aead, err := newSegmentAEAD(key, iv)
 	if err != nil {
 		return nil, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
+	size, err := inputSeeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	segments := segmentsCount(size)
 
-	return &encryptingReadSeeker{
+	return &aeadReadSeeker{
 		inputSeeker: inputSeeker,
-		cipher:      stream,
+		aead:        aead,
+		size:        size,
+		segments:    segments,
+		encSize:     1 + size + segments*int64(aead.Overhead()),
+		segment:     -1,
+		plain:       make([]byte, SegmentSize),
 	}, nil
 }
 
@@ -47,16 +127,201 @@ func (dw *decryptingWriter) Write(p []byte) (n int, err error) {
 	return dw.outputWriter.Write(p)
 }
 
-func decryptWriter(outputWriter io.Writer, key []byte, iv []byte) (io.Writer, error) {
-	block, err := aes.NewCipher(key)
+func (dw *decryptingWriter) Close() error {
+	return nil
+}
+
+type aeadDecryptingWriter struct {
+	outputWriter io.Writer
+	aead         cipher.AEAD
+	version      bool  // True when the version byte must be read from the stream
+	segment      int64 // Index of the next segment to decrypt
+	lastSegment  int64 // Index of the last segment of the body or -1 if the last segment is the one found at Close
+	skip         int64 // Plaintext bytes to skip in the first segment
+	limit        int64 // Plaintext bytes to write or -1 for no limit
+	buf          []byte
+	plain        []byte
+}
+
+func (aw *aeadDecryptingWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	if aw.version && len(p) > 0 {
+		if p[0] != aeadVersion {
+			return 0, ErrInvalidFormat
+		}
+		aw.version = false
+		p = p[1:]
+	}
+
+	aw.buf = append(aw.buf, p...)
+	encSegmentSize := SegmentSize + aw.aead.Overhead()
+	for len(aw.buf) > encSegmentSize {
+		err = aw.open(aw.buf[:encSegmentSize], aw.segment == aw.lastSegment)
+		if err != nil {
+			return 0, err
+		}
+		aw.buf = aw.buf[:copy(aw.buf, aw.buf[encSegmentSize:])]
+	}
+	return n, nil
+}
+
+// Close decrypts the last segment. It returns an error if the stream is truncated or has been tampered with.
+func (aw *aeadDecryptingWriter) Close() error {
+	if aw.version {
+		return ErrInvalidFormat
+	}
+	return aw.open(aw.buf, aw.lastSegment < 0 || aw.segment == aw.lastSegment)
+}
+
+func (aw *aeadDecryptingWriter) open(segment []byte, final bool) error {
+	var err error
+
+	aw.plain, err = aw.aead.Open(aw.plain[:0], segmentNonce(aw.segment, final), segment, []byte{aeadVersion})
+	if err != nil {
+		return err
+	}
+	aw.segment++
+
+	plain := aw.plain
+	if aw.skip > 0 {
+		skip := min64(aw.skip, int64(len(plain)))
+		plain = plain[skip:]
+		aw.skip -= skip
+	}
+	if aw.limit >= 0 {
+		plain = plain[:min64(aw.limit, int64(len(plain)))]
+		aw.limit -= int64(len(plain))
+	}
+	if len(plain) == 0 {
+		return nil
+	}
+	_, err = aw.outputWriter.Write(plain)
+	return err
+}
+
+// decryptWriter returns a writer that decrypts the body of the file described by header. When rang is not nil, the
+// writer expects the bytes returned by bodyRange for the same range. Close must be called after the last write.
+func decryptWriter(outputWriter io.Writer, header Header, rang *storage.Range) (io.WriteCloser, error) {
+	switch header.Format {
+	case FormatLegacy:
+		block, err := aes.NewCipher(header.BodyKey)
+		if err != nil {
+			return nil, err
+		}
+		var offset int64
+		if rang != nil {
+			offset = rang.From
+		}
+		return &decryptingWriter{
+			outputWriter: outputWriter,
+			cipher:       newCTRAt(block, header.IV, offset),
+		}, nil
+	case FormatAEAD:
+		aead, err := newSegmentAEAD(header.BodyKey, header.IV)
+		if err != nil {
+			return nil, err
+		}
+		aw := &aeadDecryptingWriter{
+			outputWriter: outputWriter,
+			aead:         aead,
+			version:      rang == nil,
+			lastSegment:  -1,
+			limit:        -1,
+		}
+		if rang != nil {
+			from, to := clampRange(header, rang)
+			aw.segment = from / SegmentSize
+			aw.skip = from - aw.segment*SegmentSize
+			aw.limit = to - from
+			aw.lastSegment = segmentsCount(header.Size) - 1
+		}
+		return aw, nil
+	default:
+		return nil, ErrInvalidFormat
+	}
+}
+
+// bodyRange converts a range on the plaintext into the range of the body to read from the store
+func bodyRange(header Header, rang *storage.Range) *storage.Range {
+	if rang == nil || header.Format != FormatAEAD {
+		return rang
+	}
+
+	from, to := clampRange(header, rang)
+	encSegmentSize := int64(SegmentSize + gcmOverhead)
+	first := from / SegmentSize
+	last := first
+	if to > from {
+		last = (to - 1) / SegmentSize
+	}
+	encSize := 1 + header.Size + segmentsCount(header.Size)*gcmOverhead
+	return &storage.Range{
+		From: 1 + first*encSegmentSize,
+		To:   min64(1+(last+1)*encSegmentSize, encSize),
+	}
+}
+
+func clampRange(header Header, rang *storage.Range) (from, to int64) {
+	from, to = rang.From, rang.To
+	if to > header.Size || to <= 0 {
+		to = header.Size
+	}
+	if from > to {
+		from = to
+	}
+	return from, to
+}
+
+func segmentsCount(size int64) int64 {
+	segments := (size + SegmentSize - 1) / SegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return segments
+}
+
+// newSegmentAEAD returns an AES-GCM cipher with a key specific for the body, derived from the body key and the IV.
+func newSegmentAEAD(key []byte, iv []byte) (cipher.AEAD, error) {
+	h, err := blake2b.New256(key)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(iv)
+
+	block, err := aes.NewCipher(h.Sum(nil))
 	if err != nil {
 		return nil, err
 	}
+	return cipher.NewGCM(block)
+}
 
-	stream := cipher.NewCTR(block, iv)
+// segmentNonce returns the nonce for a segment: 7 zero bytes, the segment index and a flag for the last segment
+func segmentNonce(idx int64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[7:11], uint32(idx))
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
 
-	return &decryptingWriter{
-		outputWriter: outputWriter,
-		cipher:       stream,
-	}, nil
+// newCTRAt returns an AES-CTR stream positioned at offset
+func newCTRAt(block cipher.Block, iv []byte, offset int64) cipher.Stream {
+	counter := new(big.Int).SetBytes(iv)
+	counter.Add(counter, big.NewInt(offset/aes.BlockSize))
+	counter.Mod(counter, new(big.Int).Lsh(big.NewInt(1), 8*aes.BlockSize))
+	ctr := make([]byte, aes.BlockSize)
+	counter.FillBytes(ctr)
+
+	stream := cipher.NewCTR(block, ctr)
+	skip := make([]byte, offset%aes.BlockSize)
+	stream.XORKeyStream(skip, skip)
+	return stream
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
 }
@@ -0,0 +1,108 @@
+package safe
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/storage"
+)
+
+func encryptForTest(t *testing.T, header Header, data []byte) []byte {
+	r, err := encryptReader(core.NewBytesReader(data), header.BodyKey, header.IV)
+	core.TestErr(t, err, "cannot create encrypting reader: %v")
+
+	size, err := r.Seek(0, io.SeekEnd)
+	core.TestErr(t, err, "cannot seek: %v")
+	_, err = r.Seek(0, io.SeekStart)
+	core.TestErr(t, err, "cannot seek: %v")
+
+	ciphertext, err := io.ReadAll(r)
+	core.TestErr(t, err, "cannot encrypt: %v")
+	core.Assert(t, int64(len(ciphertext)) == size, "Expected size %d, got %d", size, len(ciphertext))
+	return ciphertext
+}
+
+func decryptForTest(header Header, ciphertext []byte, rang *storage.Range) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := decryptWriter(&b, header, rang)
+	if err != nil {
+		return nil, err
+	}
+	if r := bodyRange(header, rang); r != nil {
+		ciphertext = ciphertext[r.From:r.To]
+	}
+	ciphertext = append([]byte{}, ciphertext...)
+	for len(ciphertext) > 0 {
+		n := len(ciphertext)
+		if n > 1000 {
+			n = 1000
+		}
+		_, err = w.Write(ciphertext[:n])
+		if err != nil {
+			return nil, err
+		}
+		ciphertext = ciphertext[n:]
+	}
+	err = w.Close()
+	return b.Bytes(), err
+}
+
+func TestEncryptAndDecryptBody(t *testing.T) {
+	for _, size := range []int{0, 1, SegmentSize, 3*SegmentSize + 5} {
+		data := core.GenerateRandomBytes(size)
+		header := Header{
+			Size:    int64(size),
+			Format:  FormatAEAD,
+			BodyKey: core.GenerateRandomBytes(KeySize),
+			IV:      core.GenerateRandomBytes(aes.BlockSize),
+		}
+
+		ciphertext := encryptForTest(t, header, data)
+		core.Assert(t, ciphertext[0] == aeadVersion, "Expected version byte")
+
+		plain, err := decryptForTest(header, ciphertext, nil)
+		core.TestErr(t, err, "cannot decrypt: %v")
+		core.Assert(t, bytes.Equal(data, plain), "Decrypted data does not match for size %d", size)
+
+		if size > 0 {
+			from, to := int64(size/3), int64(size-size/4)
+			plain, err = decryptForTest(header, ciphertext, &storage.Range{From: from, To: to})
+			core.TestErr(t, err, "cannot decrypt range: %v")
+			core.Assert(t, bytes.Equal(data[from:to], plain), "Decrypted range does not match for size %d", size)
+		}
+
+		tampered := append([]byte{}, ciphertext...)
+		tampered[len(tampered)/2] ^= 1
+		_, err = decryptForTest(header, tampered, nil)
+		core.Assert(t, err != nil, "Expected tampered body to fail for size %d", size)
+
+		_, err = decryptForTest(header, ciphertext[:len(ciphertext)-1], nil)
+		core.Assert(t, err != nil, "Expected truncated body to fail for size %d", size)
+	}
+}
+
+func TestDecryptLegacyBody(t *testing.T) {
+	data := core.GenerateRandomBytes(1000)
+	header := Header{
+		Size:    int64(len(data)),
+		BodyKey: core.GenerateRandomBytes(KeySize),
+		IV:      core.GenerateRandomBytes(aes.BlockSize),
+	}
+
+	block, err := aes.NewCipher(header.BodyKey)
+	core.TestErr(t, err, "cannot create cipher: %v")
+	ciphertext := make([]byte, len(data))
+	cipher.NewCTR(block, header.IV).XORKeyStream(ciphertext, data)
+
+	plain, err := decryptForTest(header, ciphertext, nil)
+	core.TestErr(t, err, "cannot decrypt: %v")
+	core.Assert(t, bytes.Equal(data, plain), "Decrypted data does not match")
+
+	plain, err = decryptForTest(header, ciphertext, &storage.Range{From: 33, To: 500})
+	core.TestErr(t, err, "cannot decrypt range: %v")
+	core.Assert(t, bytes.Equal(data[33:500], plain), "Decrypted range does not match")
+}
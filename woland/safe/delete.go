@@ -1,23 +1,228 @@
 package safe
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/godruoyi/go-snowflake"
+
 	"github.com/stregato/master/woland/core"
 	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
 )
 
+// TombstoneRetention is the minimal age of a tombstone before compaction can remove it from the headers files. Peers
+// offline for longer do not learn about the deletion.
+var TombstoneRetention = 30 * 24 * time.Hour
+
+// ErrReplicaUnreachable is returned by CollectGarbage when a replica cannot be opened, since its bodies would leak
+var ErrReplicaUnreachable = fmt.Errorf("a replica of the safe is not reachable")
+
+// GarbageCollectionPeriod is the time between two garbage collections in the background job
+var GarbageCollectionPeriod = time.Hour
+
+// DeleteFile marks the file as deleted and writes a signed tombstone header so that the deletion reaches all peers
+// on their next sync. The body is removed from the stores by the garbage collection.
 func DeleteFile(s *Safe, bucket string, fileId uint64) error {
-	r, err := sql.Exec("SET_DELETED_FILE", sql.Args{
-		"safe":   s.Name,
-		"fileId": fileId,
-	})
-	if core.IsErr(err, nil, "cannot set deleted file for %d: %v", err) {
+	header, _, err := getLastHeader(s.Name, bucket, "", fileId)
+	if err == ErrFileNotExist {
+		core.Info("Cannot mark [%d] as deleted in %s because it does not exist", fileId, s.Name)
+		return nil
+	}
+	if core.IsErr(err, nil, "cannot get header for %d: %v", fileId) {
 		return err
 	}
-	n, _ := r.RowsAffected()
-	if n > 0 {
-		core.Info("Marked [%d] as deleted in %s", fileId, s.Name)
-	} else {
-		core.Info("Cannot mark [%d] as deleted in %s because it does not exist", fileId, s.Name)
+	if header.Deleted {
+		core.Info("[%d] is already deleted in %s", fileId, s.Name)
+		return nil
+	}
+	versions, _, err := getVersions(s, bucket, header.Name)
+	if core.IsErr(err, nil, "cannot get versions of %s: %v", header.Name) {
+		return err
+	}
+	if deltaBases(versions, versions)[fileId] {
+		core.Info("cannot delete %s[%d] because a later version is a delta over it", header.Name, fileId)
+		return ErrDeltaBase
+	}
+
+	return writeTombstone(s, bucket, header)
+}
+
+// canDelete returns true if the user is the creator of the file or an administrator
+func canDelete(header Header, userId string, permission Permission) bool {
+	return canWrite(permission) && (header.Creator == userId || permission&Admin != 0)
+}
+
+// ErrUnverifiedTombstone is returned when a tombstone refers to a file not known yet. The tombstone stays in quarantine
+// until the header of the file arrives.
+var ErrUnverifiedTombstone = fmt.Errorf("tombstone of an unknown file")
+
+// verifyTombstone checks that the creator of the tombstone was allowed to delete the file when the tombstone was created
+func verifyTombstone(safeName, bucket string, tombstone Header, history PermissionHistory) error {
+	header, _, err := getLastHeader(safeName, bucket, "", tombstone.FileId)
+	if err == ErrFileNotExist {
+		return ErrUnverifiedTombstone
+	}
+	if err != nil {
+		return err
+	}
+	if !canDelete(header, tombstone.Creator, history.At(tombstone.Creator, tombstone.ModTime)) {
+		return fmt.Errorf("%w: %s cannot delete %s[%d] created by %s", ErrNoWritePermission, tombstone.Creator,
+			header.Name, header.FileId, header.Creator)
 	}
 	return nil
 }
+
+func writeTombstone(s *Safe, bucket string, header Header) error {
+	if !canDelete(header, s.CurrentUser.Id, s.Permission) {
+		core.Info("user %s cannot delete %s[%d] in %s: permission %d", s.CurrentUser.Id, header.Name, header.FileId,
+			s.Name, s.Permission)
+		return ErrNoWritePermission
+	}
+
+	tombstone := Header{
+		Name:    header.Name,
+		Creator: s.CurrentUser.Id,
+		ModTime: core.Now(),
+		FileId:  header.FileId,
+		BodyId:  header.BodyId,
+		Deleted: true,
+	}
+	headerId := snowflake.ID()
+	tombstone, err := writeHeader(s, bucket, tombstone, headerId)
+	if core.IsErr(err, nil, "cannot write tombstone for %s[%d]: %v", header.Name, header.FileId) {
+		return err
+	}
+	err = insertHeaderOrIgnoreToDB(s.Name, bucket, headerId, tombstone)
+	if core.IsErr(err, nil, "cannot insert tombstone for %s[%d]: %v", header.Name, header.FileId) {
+		return err
+	}
+	core.Info("Marked %s[%d] as deleted in %s", header.Name, header.FileId, s.Name)
+	return nil
+}
+
+// CollectGarbage removes from the stores and from the cache the bodies of the files deleted since the last collection,
+// as well as the chunks no longer referenced by any file. A body is removed only after the tombstone of its file has
+// reached all the replicas. It returns the number of deleted files that have been processed.
+func CollectGarbage(s *Safe) (int, error) {
+	now := core.Now()
+	key := fmt.Sprintf("%s/lastCollection", s.Name)
+	_, lastCollection, _, _ := sql.GetConfig("safe:gc", key)
+	replicated := replicasSyncTime(s).UnixMilli()
+	next := now.UnixMilli() // the tombstones not yet on all the replicas are processed by a later collection
+
+	rows, err := sql.Query("GET_TOMBSTONES", sql.Args{"safe": s.Name, "after": lastCollection})
+	if core.IsErr(err, nil, "cannot query tombstones in %s: %v", s.Name) {
+		return 0, err
+	}
+	type deletedFile struct {
+		bucket string
+		fileId uint64
+		bodyId uint64
+	}
+	var files []deletedFile
+	for rows.Next() {
+		var bucket string
+		var data []byte
+		var syncTime int64
+		var header Header
+		if core.IsErr(rows.Scan(&bucket, &data, &syncTime), nil, "cannot scan tombstone: %v") {
+			continue
+		}
+		if core.IsErr(json.Unmarshal(data, &header), nil, "cannot unmarshal tombstone: %v") {
+			continue
+		}
+		if syncTime > replicated {
+			core.Info("tombstone of %s[%d] has not reached all the replicas yet", header.Name, header.FileId)
+			if syncTime < next {
+				next = syncTime
+			}
+			continue
+		}
+		files = append(files, deletedFile{bucket: bucket, fileId: header.FileId, bodyId: bodyIdOf(header)})
+	}
+	rows.Close()
+
+	replicas, err := openReplicas(s)
+	if core.IsErr(err, nil, "cannot open replicas of %s: %v", s.Name) {
+		return 0, err
+	}
+	defer closeReplicas(replicas)
+	stores := replicaStores(s, replicas)
+	if stores == nil {
+		core.Info("garbage collection in %s postponed until all the replicas are reachable", s.Name)
+		return 0, ErrReplicaUnreachable
+	}
+	for _, f := range files {
+		if isBodyReferenced(s.Name, f.bodyId) {
+			core.Info("body %d of deleted file %d is used by a restored version", f.bodyId, f.fileId)
+		} else {
+			deleteBody(s, stores, f.bucket, f.bodyId)
+		}
+		cacheFile := cacheFileOf(s.Name, f.fileId)
+		if os.Remove(cacheFile) == nil {
+			core.Info("Deleted cache file %s", cacheFile)
+		}
+		os.Remove(cacheFile + ".etag")
+		if os.Remove(cacheFile+".part") == nil {
+			sql.Exec("DELETE_DOWNLOAD_PARTS", sql.Args{"safe": s.Name, "fileId": f.fileId})
+			core.Info("Deleted partial download %s", cacheFile)
+		}
+		err = releaseChunks(s, stores, f.fileId)
+		core.IsErr(err, nil, "cannot release chunks of %d: %v", f.fileId)
+	}
+	_, err = deleteOrphanChunks(s, stores)
+	core.IsErr(err, nil, "cannot delete orphan chunks in %s: %v", s.Name)
+
+	err = sql.SetConfig("safe:gc", key, "", next, nil)
+	if core.IsErr(err, nil, "cannot save last collection time in %s: %v", s.Name) {
+		return len(files), err
+	}
+	core.Info("collected garbage of %d deleted files in %s", len(files), s.Name)
+	return len(files), nil
+}
+
+// deleteBody removes the body of a file and its Merkle tree from the stores
+func deleteBody(s *Safe, stores []storage.Store, bucket string, bodyId uint64) {
+	bodyFile := path.Join(s.Name, DataFolder, hashPath(bucket), BodyFolder, fmt.Sprintf("%d", bodyId))
+	for _, store := range stores {
+		err := store.Delete(bodyFile)
+		if os.IsNotExist(err) || core.IsErr(err, nil, "cannot delete body %s from %s: %v", bodyFile, store) {
+			continue
+		}
+		core.Info("Deleted body %s from %s", bodyFile, store)
+	}
+	treeFile := path.Join(s.Name, DataFolder, hashPath(bucket), MerkleFolder, fmt.Sprintf("%d", bodyId))
+	for _, store := range stores {
+		store.Delete(treeFile)
+	}
+}
+
+// isBodyReferenced returns true when a version not deleted uses the body, either its own or as a restored version
+func isBodyReferenced(safeName string, bodyId uint64) bool {
+	var refs int
+	err := sql.QueryRow("COUNT_BODY_REFS", sql.Args{"safe": safeName, "bodyId": bodyId}, &refs)
+	if core.IsErr(err, nil, "cannot count references of body %d: %v", bodyId) {
+		return true
+	}
+	return refs > 0
+}
+
+// isTombstoneCollectable returns true if the tombstone is older than TombstoneRetention and the body of the file has
+// been removed from the stores of all the replicas. Without stores, as when a replica is unreachable, it returns false.
+func isTombstoneCollectable(s *Safe, stores []storage.Store, bucket string, header Header) bool {
+	if !header.Deleted || core.Since(header.ModTime) < TombstoneRetention || len(stores) == 0 {
+		return false
+	}
+
+	bodyFile := path.Join(s.Name, DataFolder, hashPath(bucket), BodyFolder, fmt.Sprintf("%d", bodyIdOf(header)))
+	for _, store := range stores {
+		if _, err := store.Stat(bodyFile); !os.IsNotExist(err) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,221 @@
+package safe
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestDeleteFile(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	a, err := Put(s, "bucket", "a", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	b, err := Put(s, "bucket", "b", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+
+	err = DeleteFile(s, "bucket", a.FileId)
+	core.TestErr(t, err, "cannot delete file: %v")
+	files, err := ListFiles(s, "bucket", ListOptions{})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(files) == 1 && files[0].Name == "b", "Expected only file b, got %v", files)
+
+	// the header of the deleted file keeps its creator and metadata
+	deleted, _, err := getLastHeader(s.Name, "bucket", "", a.FileId)
+	core.TestErr(t, err, "cannot get header of a: %v")
+	core.Assert(t, deleted.Deleted && deleted.Creator == a.Creator && deleted.Size == a.Size,
+		"Expected the header of a marked deleted, got %v", deleted)
+
+	// Simulate a peer that has never seen the bucket
+	_, err = sql.Exec("DELETE_SAFE_HEADERS", sql.Args{"safe": s.Name})
+	core.TestErr(t, err, "cannot delete headers: %v")
+	_, err = sql.Exec("DELETE_SAFE_TOMBSTONES", sql.Args{"safe": s.Name})
+	core.TestErr(t, err, "cannot delete tombstones: %v")
+	err = sql.DelConfigs(fmt.Sprintf("safe:cache:%s", s.Name))
+	core.TestErr(t, err, "cannot reset touch info: %v")
+	_, err = SyncBucket(s, "bucket", SyncOptions{}, nil)
+	core.TestErr(t, err, "cannot sync bucket: %v")
+
+	files, err = ListFiles(s, "bucket", ListOptions{})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(files) == 1 && files[0].Name == "b", "Expected only file b after sync, got %v", files)
+	files, err = ListFiles(s, "bucket", ListOptions{IncludeDeleted: true})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(files) == 2 && files[0].Deleted, "Expected deleted file a after sync, got %v", files)
+
+	n, err := CollectGarbage(s)
+	core.TestErr(t, err, "cannot collect garbage: %v")
+	core.Assert(t, n == 1, "Expected 1 deleted file, got %d", n)
+
+	bodyFolder := path.Join(s.Name, DataFolder, hashPath("bucket"), BodyFolder)
+	_, err = s.PrimaryStore.Stat(path.Join(bodyFolder, fmt.Sprintf("%d", a.FileId)))
+	core.Assert(t, os.IsNotExist(err), "Expected body of a to be deleted, got %v", err)
+	_, err = s.PrimaryStore.Stat(path.Join(bodyFolder, fmt.Sprintf("%d", b.FileId)))
+	core.TestErr(t, err, "expected body of b to exist: %v")
+
+	b.Creator = Identity2.Id
+	s.Permission = Standard
+	err = writeTombstone(s, "bucket", b)
+	core.Assert(t, err == ErrNoWritePermission, "Expected ErrNoWritePermission, got %v", err)
+}
+
+func TestUnverifiedTombstones(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+	err = SetUsers(s, map[string]Permission{Identity2.Id: Standard}, SetUsersOptions{})
+	core.TestErr(t, err, "cannot set users: %v")
+
+	a, err := Put(s, "bucket", "a", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	b, err := Put(s, "bucket", "b", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	err = DeleteFile(s, "bucket", b.FileId)
+	core.TestErr(t, err, "cannot delete file: %v")
+
+	// compaction keeps the header of b next to its tombstone
+	folder := path.Join(s.Name, DataFolder, hashPath("bucket"), HeaderFolder)
+	ls, err := s.PrimaryStore.ReadDir(folder, storage.Filter{})
+	core.TestErr(t, err, "cannot read headers: %v")
+	var files []string
+	for _, l := range ls {
+		files = append(files, l.Name())
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	mergeHeadersFiles(s, folder, files, &wg)
+	ls, err = s.PrimaryStore.ReadDir(folder, storage.Filter{})
+	core.TestErr(t, err, "cannot read headers: %v")
+	core.Assert(t, len(ls) == 1, "Expected 1 headers file after merge, got %d", len(ls))
+	merged, err := readHeadersFile(s.PrimaryStore, s.Name, path.Join(folder, ls[0].Name()), s.Keystore.Keys)
+	core.TestErr(t, err, "cannot read merged headers: %v")
+	core.Assert(t, len(merged.Headers) == 3, "Expected a, b and the tombstone of b, got %d", len(merged.Headers))
+
+	// a peer that does not know a receives a tombstone from a standard user who did not create a
+	forged := Header{Name: a.Name, Creator: Identity2.Id, ModTime: core.Now(), FileId: a.FileId, Deleted: true}
+	err = signHeader(Identity2, &forged)
+	core.TestErr(t, err, "cannot sign tombstone: %v")
+	_, err = sql.Exec("DELETE_SAFE_HEADERS", sql.Args{"safe": s.Name})
+	core.TestErr(t, err, "cannot delete headers: %v")
+	_, err = sql.Exec("DELETE_SAFE_TOMBSTONES", sql.Args{"safe": s.Name})
+	core.TestErr(t, err, "cannot delete tombstones: %v")
+
+	err = verifyTombstone(s.Name, "bucket", forged, s.history)
+	core.Assert(t, err == ErrUnverifiedTombstone, "Expected ErrUnverifiedTombstone, got %v", err)
+	// the name is older than the merged file, so that the tombstone is read before the header of a
+	err = writeHeadersFile(s.PrimaryStore, s.Name, path.Join(folder, fmt.Sprintf("%d", a.FileId)),
+		s.Keystore.Keys[s.Keystore.LastKeyId], HeadersFile{Bucket: "bucket", KeyId: s.Keystore.LastKeyId,
+			Headers: []Header{forged}})
+	core.TestErr(t, err, "cannot write headers file: %v")
+
+	err = sql.DelConfigs(fmt.Sprintf("safe:cache:%s", s.Name))
+	core.TestErr(t, err, "cannot reset touch info: %v")
+	_, err = SyncBucket(s, "bucket", SyncOptions{}, nil)
+	core.TestErr(t, err, "cannot sync bucket: %v")
+
+	ls2, err := ListFiles(s, "bucket", ListOptions{})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(ls2) == 1 && ls2[0].Name == "a", "Expected only file a, got %v", ls2)
+	quarantined, err := ListQuarantine(s, "bucket")
+	core.TestErr(t, err, "cannot list quarantine: %v")
+	core.Assert(t, len(quarantined) == 1 && quarantined[0].Reason != ErrUnverifiedTombstone.Error(),
+		"Expected the forged tombstone rejected, got %v", quarantined)
+}
+
+func TestCollectGarbageWaitsForReplicas(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	replicaDir := filepath.Join(os.TempDir(), "woland-gc-replica")
+	os.RemoveAll(replicaDir)
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+	err = AddStore(s, StoreConfig{Name: "replica", Url: "file://" + replicaDir, Quota: testStoreConfig.Quota})
+	core.TestErr(t, err, "cannot add store: %v")
+
+	a, err := Put(s, "bucket", "a", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	err = DeleteFile(s, "bucket", a.FileId)
+	core.TestErr(t, err, "cannot delete file: %v")
+
+	n, err := CollectGarbage(s)
+	core.TestErr(t, err, "cannot collect garbage: %v")
+	core.Assert(t, n == 0, "Expected no collection before replication, got %d", n)
+
+	time.Sleep(time.Millisecond)
+	_, err = Replicate(s)
+	core.TestErr(t, err, "cannot replicate: %v")
+	n, err = CollectGarbage(s)
+	core.TestErr(t, err, "cannot collect garbage: %v")
+	core.Assert(t, n == 1, "Expected 1 deleted file after replication, got %d", n)
+}
+
+func TestTombstoneCollectableOnAllReplicas(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+	for _, name := range []string{"replica1", "replica2"} {
+		replicaDir := filepath.Join(os.TempDir(), "woland-gc-"+name)
+		os.RemoveAll(replicaDir)
+		err = AddStore(s, StoreConfig{Name: name, Url: "file://" + replicaDir, Quota: testStoreConfig.Quota})
+		core.TestErr(t, err, "cannot add store: %v")
+	}
+
+	a, err := Put(s, "bucket", "a", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	_, err = Replicate(s)
+	core.TestErr(t, err, "cannot replicate: %v")
+
+	retention := TombstoneRetention
+	TombstoneRetention = 0
+	defer func() { TombstoneRetention = retention }()
+	tombstone := Header{Name: a.Name, FileId: a.FileId, ModTime: core.Now(), Deleted: true}
+
+	replicas, err := openReplicas(s)
+	core.TestErr(t, err, "cannot open replicas: %v")
+	defer closeReplicas(replicas)
+	stores := replicaStores(s, replicas)
+	core.Assert(t, len(stores) == 3, "Expected 3 stores, got %d", len(stores))
+
+	bodyFile := path.Join(s.Name, DataFolder, hashPath("bucket"), BodyFolder, fmt.Sprintf("%d", a.FileId))
+	for _, store := range stores[:2] {
+		store.Delete(bodyFile)
+	}
+	core.Assert(t, !isTombstoneCollectable(s, stores, "bucket", tombstone),
+		"Expected the tombstone kept while a replica has the body")
+	core.Assert(t, !isTombstoneCollectable(s, nil, "bucket", tombstone),
+		"Expected the tombstone kept when the replicas are unknown")
+
+	deleteBody(s, stores, "bucket", a.FileId)
+	core.Assert(t, isTombstoneCollectable(s, stores, "bucket", tombstone),
+		"Expected the tombstone collectable once the body is gone from all the replicas")
+}
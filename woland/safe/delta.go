@@ -0,0 +1,362 @@
+package safe
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"github.com/godruoyi/go-snowflake"
+
+	"github.com/stregato/master/woland/algo"
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+var MaxDeltaDepth = 8   // Number of deltas over a full body before the background job re-materialises the body
+var MaxDeltaRatio = 0.5 // A delta is used only when the changed blocks are less than this fraction of the file
+var ErrDeltaBase = fmt.Errorf("file is the base of a delta version")
+
+// Delta describes a body as a patch over the body of a previous version. The body of the file contains only the
+// bytes of the changed blocks.
+type Delta struct {
+	BaseId uint64    `json:"b"` // FileId of the previous version
+	Depth  int       `json:"d"` // Number of deltas between the file and a full body
+	Ops    []DeltaOp `json:"o"` // Sequence of ranges that compose the content
+}
+
+// DeltaOp is a range of the content, copied from the body of the base version or from the body of the file
+type DeltaOp struct {
+	Base   bool  `json:"b,omitempty"` // True if the range is in the body of the base version
+	Offset int64 `json:"o"`           // Offset of the range in the body of the base version or of the file
+	Length int64 `json:"l"`           // Length of the range
+}
+
+// size returns the size of the body of the file, that is the changed blocks only
+func (d *Delta) size() int64 {
+	var size int64
+	for _, op := range d.Ops {
+		if !op.Base {
+			size += op.Length
+		}
+	}
+	return size
+}
+
+// deltaBase returns the version to use as base of a delta when the file replaces fileId. Only full bodies and deltas
+// not deeper than MaxDeltaDepth with a Merkle tree can be a base.
+func deltaBase(s *Safe, bucket string, fileId uint64) (Header, bool) {
+	base, _, err := getLastHeader(s.Name, bucket, "", fileId)
+	if err != nil || base.Deleted || base.Uploading {
+		return Header{}, false
+	}
+	if base.PrivateId != "" || base.Format != FormatAEAD || base.Compression != nil || len(base.Chunks) > 0 ||
+		len(base.Attributes.MerkleRoot) == 0 {
+		return Header{}, false
+	}
+	if base.Delta != nil && base.Delta.Depth >= MaxDeltaDepth {
+		return Header{}, false
+	}
+	return base, true
+}
+
+// computeDelta splits the content with the hash function of the Merkle tree of the base version and compares the
+// blocks with the leaves of the tree. It returns a temporary file with the changed blocks and the operations of the
+// delta; the caller closes and removes the file. The returned file is nil when the changes are too large for a delta.
+func computeDelta(s *Safe, bucket string, r io.ReadSeeker, header Header) (*os.File, []DeltaOp, error) {
+	base, _, err := getLastHeader(s.Name, bucket, "", header.Delta.BaseId)
+	if core.IsErr(err, nil, "cannot get base %d of %s: %v", header.Delta.BaseId, header.Name) {
+		return nil, nil, err
+	}
+	tree, err := readMerkleTree(s, bucket, base)
+	if core.IsErr(err, nil, "cannot read merkle tree of base %d: %v", base.FileId) {
+		return nil, nil, err
+	}
+
+	leaves := map[string]int64{}
+	var offset int64
+	for _, block := range tree.Blocks[:tree.Leaves] {
+		leaves[hex.EncodeToString(block.Hash)] = offset
+		offset += block.Length
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		return nil, nil, err
+	}
+	blocks, err := algo.HashSplit(r, MerkleSplitBits, merkleHash(base))
+	if core.IsErr(err, nil, "cannot split file: %v", err) {
+		return nil, nil, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		return nil, nil, err
+	}
+
+	changed, err := os.CreateTemp("", "delta")
+	if core.IsErr(err, nil, "cannot create temp file: %v", err) {
+		return nil, nil, err
+	}
+	discard := func() {
+		changed.Close()
+		os.Remove(changed.Name())
+	}
+
+	var ops []DeltaOp
+	var changedSize int64
+	for _, block := range blocks {
+		length := block.Length
+		baseOffset, found := leaves[hex.EncodeToString(block.Hash)]
+		if found {
+			_, err = r.Seek(length, io.SeekCurrent)
+		} else {
+			baseOffset = changedSize
+			_, err = io.CopyN(changed, r, length)
+			changedSize += length
+		}
+		if core.IsErr(err, nil, "cannot read block: %v", err) {
+			discard()
+			return nil, nil, err
+		}
+
+		last := len(ops) - 1
+		if last >= 0 && ops[last].Base == found && ops[last].Offset+ops[last].Length == baseOffset {
+			ops[last].Length += length
+		} else {
+			ops = append(ops, DeltaOp{Base: found, Offset: baseOffset, Length: length})
+		}
+	}
+
+	if float64(changedSize) > float64(header.Size)*MaxDeltaRatio {
+		core.Info("changes of %s are %d bytes, too large for a delta", header.Name, changedSize)
+		discard()
+		return nil, nil, nil
+	}
+	_, err = changed.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		discard()
+		return nil, nil, err
+	}
+	core.Info("delta of %s over %d has %d bytes of changes in %d ranges", header.Name, base.FileId, changedSize,
+		len(ops))
+	return changed, ops, nil
+}
+
+// readDelta writes the content of a delta, or the range of it, to w
+func readDelta(s *Safe, bucket string, header Header, w io.Writer, rang *storage.Range) error {
+	base, _, err := getLastHeader(s.Name, bucket, "", header.Delta.BaseId)
+	if core.IsErr(err, nil, "cannot get base %d of %s: %v", header.Delta.BaseId, header.Name) {
+		return err
+	}
+	if base.Deleted {
+		return fmt.Errorf("%w: base %d of %s has been deleted", ErrFileNotExist, base.FileId, header.Name)
+	}
+
+	patch := header
+	patch.Delta = nil
+	patch.Size = header.Delta.size()
+
+	from, to := int64(0), header.Size
+	if rang != nil {
+		from, to = clampRange(header, rang)
+	}
+	var offset int64
+	for _, op := range header.Delta.Ops {
+		start, end := offset, offset+op.Length
+		offset = end
+		if end <= from || start >= to {
+			continue
+		}
+
+		r := &storage.Range{From: op.Offset + max64(from-start, 0), To: op.Offset + min64(to, end) - start}
+		if op.Base {
+			err = readBody(s, bucket, base, w, r)
+		} else {
+			err = readBody(s, bucket, patch, w, r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBody writes the content of a body that is not compressed or chunked, or the range of it, to w
+func readBody(s *Safe, bucket string, header Header, w io.Writer, rang *storage.Range) error {
+	if header.Delta != nil {
+		return readDelta(s, bucket, header, w, rang)
+	}
+
+	dw, err := decryptWriter(w, header, rang)
+	if core.IsErr(err, nil, "cannot create decrypting writer: %v", err) {
+		return err
+	}
+	name := path.Join(s.Name, DataFolder, hashPath(bucket), BodyFolder, fmt.Sprintf("%d", bodyIdOf(header)))
+	primary, secondary := getStores(s)
+	err = secondary.Read(name, bodyRange(header, rang), dw, nil)
+	if err != nil && secondary != primary {
+		err = primary.Read(name, bodyRange(header, rang), dw, nil)
+	}
+	if core.IsErr(err, nil, "cannot read body %s: %v", name) {
+		return err
+	}
+	err = dw.Close()
+	if core.IsErr(err, nil, "cannot decrypt body %s: %v", name) {
+		return err
+	}
+	return nil
+}
+
+// queueMaterialization asks the background job to re-materialise the full body of a delta
+func queueMaterialization(s *Safe, bucket string, header Header) error {
+	_, err := sql.Exec("INSERT_MATERIALIZE", sql.Args{"safe": s.Name, "bucket": bucket, "fileId": header.FileId})
+	if core.IsErr(err, nil, "cannot queue materialization of %s: %v", header.Name) {
+		return err
+	}
+	core.Info("queued materialization of %s[%d] at depth %d", header.Name, header.FileId, header.Delta.Depth)
+	return nil
+}
+
+// materializeDeltas re-materialises the full bodies of the deltas queued by Put. It returns the number of bodies
+// written.
+func materializeDeltas(s *Safe) (int, error) {
+	rows, err := sql.Query("GET_MATERIALIZE", sql.Args{"safe": s.Name})
+	if core.IsErr(err, nil, "cannot query materializations in %s: %v", s.Name) {
+		return 0, err
+	}
+	type task struct {
+		bucket string
+		fileId uint64
+	}
+	var tasks []task
+	for rows.Next() {
+		var t task
+		if !core.IsErr(rows.Scan(&t.bucket, &t.fileId), nil, "cannot scan materialization: %v") {
+			tasks = append(tasks, t)
+		}
+	}
+	rows.Close()
+
+	count := 0
+	for _, t := range tasks {
+		err = materialize(s, t.bucket, t.fileId)
+		if core.IsErr(err, nil, "cannot materialize %d in %s: %v", t.fileId, s.Name) {
+			continue
+		}
+		_, err = sql.Exec("DELETE_MATERIALIZE", sql.Args{"safe": s.Name, "bucket": t.bucket, "fileId": t.fileId})
+		core.IsErr(err, nil, "cannot delete materialization of %d: %v", t.fileId)
+		count++
+	}
+	return count, nil
+}
+
+// materialize writes the full content of a delta as a new version that replaces the delta. The new version has its
+// own file id, so that peers with the header of the delta and readers in progress still find the delta body.
+func materialize(s *Safe, bucket string, fileId uint64) error {
+	header, _, err := getLastHeader(s.Name, bucket, "", fileId)
+	if err == ErrFileNotExist {
+		return nil
+	}
+	if core.IsErr(err, nil, "cannot get header of %d: %v", fileId) {
+		return err
+	}
+	if header.Delta == nil || header.Deleted || header.Creator != s.CurrentUser.Id {
+		return nil
+	}
+	// a replaced version keeps its delta since the header of a hidden file is not updated
+	_, current, err := getVersions(s, bucket, header.Name)
+	if core.IsErr(err, nil, "cannot get versions of %s: %v", header.Name) {
+		return err
+	}
+	if current != header.FileId {
+		core.Info("%s[%d] has been replaced, skipping materialization", header.Name, header.FileId)
+		return nil
+	}
+
+	f, err := os.CreateTemp("", "materialize")
+	if core.IsErr(err, nil, "cannot create temp file: %v", err) {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = readDelta(s, bucket, header, f, nil)
+	if core.IsErr(err, nil, "cannot read delta of %s: %v", header.Name) {
+		return err
+	}
+
+	full := header
+	full.FileId = snowflake.ID()
+	full.ModTime = core.Now()
+	full.IV = core.GenerateRandomBytes(aes.BlockSize)
+	full.Delta = nil
+	full.ReplaceId = header.FileId
+	full.Replace = false
+	full.Cached, full.CachedExpires, full.Downloads, full.SourceFile = "", time.Time{}, nil, ""
+	full.Attributes.MerkleRoot = nil
+
+	bodyFile := path.Join(s.Name, DataFolder, hashPath(bucket), BodyFolder, fmt.Sprintf("%d", full.FileId))
+	primary, secondary := getStores(s)
+	stores := []storage.Store{primary}
+	if secondary != nil && secondary != primary {
+		stores = append(stores, secondary)
+	}
+	for _, store := range stores {
+		if header.Attributes.MerkleRoot != nil {
+			err = writeMerkleTree(s, store, bucket, f, &full)
+			if core.IsErr(err, nil, "cannot write merkle tree of %s: %v", full.Name) {
+				return err
+			}
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+			return err
+		}
+		r, err := encryptReader(f, full.BodyKey, full.IV)
+		if core.IsErr(err, nil, "cannot create encrypting reader: %v", err) {
+			return err
+		}
+		err = store.Write(bodyFile, r, nil)
+		if core.IsErr(err, nil, "cannot write body %s to %s: %v", bodyFile, store) {
+			return err
+		}
+	}
+
+	headerId := snowflake.ID()
+	err = insertHeaderOrIgnoreToDB(s.Name, bucket, headerId, full)
+	if core.IsErr(err, nil, "cannot insert header of %s: %v", full.Name) {
+		return err
+	}
+	_, err = writeHeader(s, bucket, full, headerId)
+	if core.IsErr(err, nil, "cannot write header of %s: %v", full.Name) {
+		return err
+	}
+	// the delta is hidden like any replaced file and kept as a version until the retention of the bucket is exceeded
+	_, err = sql.Exec("SET_DELETED_FILE", sql.Args{"safe": s.Name, "fileId": header.FileId})
+	if core.IsErr(err, nil, "cannot hide %s[%d]: %v", header.Name, header.FileId) {
+		return err
+	}
+	core.Info("materialized full body of %s[%d] as %d", header.Name, header.FileId, full.FileId)
+	return nil
+}
+
+// deltaBases returns the versions that are the base, directly or through other deltas, of one of the headers
+func deltaBases(headers []Header, versions []Header) map[uint64]bool {
+	byId := map[uint64]Header{}
+	for _, v := range versions {
+		byId[v.FileId] = v
+	}
+
+	bases := map[uint64]bool{}
+	for _, h := range headers {
+		for h.Delta != nil && !bases[h.Delta.BaseId] {
+			bases[h.Delta.BaseId] = true
+			h = byId[h.Delta.BaseId]
+		}
+	}
+	return bases
+}
@@ -0,0 +1,88 @@
+package safe
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestDelta(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	splitBits, minSize, maxDepth := MerkleSplitBits, MinMerkleSize, MaxDeltaDepth
+	MerkleSplitBits, MinMerkleSize, MaxDeltaDepth = 10, 0, 2
+	defer func() { MerkleSplitBits, MinMerkleSize, MaxDeltaDepth = splitBits, minSize, maxDepth }()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	h1, err := Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	core.Assert(t, h1.Delta == nil, "Expected a full body for the first version")
+
+	data = append([]byte{}, data...)
+	copy(data[30000:], []byte("a few changed bytes"))
+	h2, err := Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{ReplaceID: h1.FileId}, nil)
+	core.TestErr(t, err, "cannot put second version: %v")
+	core.Assert(t, h2.Delta != nil && h2.Delta.BaseId == h1.FileId, "Expected a delta over the first version")
+	core.Assert(t, h2.Delta.size() < int64(len(data))/8, "Expected a small delta, got %d bytes", h2.Delta.size())
+
+	b := bytes.Buffer{}
+	_, err = Get(s, "bucket", "file", &b, GetOptions{})
+	core.TestErr(t, err, "cannot get file: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), data), "Unexpected content of delta")
+
+	b.Reset()
+	_, err = Get(s, "bucket", "file", &b, GetOptions{Range: &storage.Range{From: 29000, To: 31000}})
+	core.TestErr(t, err, "cannot get range: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), data[29000:31000]), "Unexpected range of delta")
+
+	data = append([]byte{}, data...)
+	copy(data[100:], []byte("more changes"))
+	h3, err := Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{ReplaceID: h2.FileId}, nil)
+	core.TestErr(t, err, "cannot put third version: %v")
+	core.Assert(t, h3.Delta != nil && h3.Delta.Depth == 2, "Expected a delta of depth 2")
+
+	err = DeleteFile(s, "bucket", h1.FileId)
+	core.Assert(t, errors.Is(err, ErrDeltaBase), "Expected ErrDeltaBase, got %v", err)
+
+	n, err := materializeDeltas(s)
+	core.TestErr(t, err, "cannot materialize deltas: %v")
+	core.Assert(t, n == 1, "Expected 1 materialization, got %d", n)
+
+	b.Reset()
+	h, err := Get(s, "bucket", "file", &b, GetOptions{NoCache: true})
+	core.TestErr(t, err, "cannot get file: %v")
+	core.Assert(t, h.FileId != h3.FileId && h.ReplaceId == h3.FileId && h.Delta == nil,
+		"Expected a full body replacing the delta after materialization")
+	core.Assert(t, bytes.Equal(b.Bytes(), data), "Unexpected content after materialization")
+
+	b.Reset()
+	_, err = Get(s, "bucket", "file", &b, GetOptions{Range: &storage.Range{From: 29000, To: 31000}, NoCache: true})
+	core.TestErr(t, err, "cannot get range after materialization: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), data[29000:31000]), "Unexpected range after materialization")
+
+	// the delta is still readable by peers that have not seen the materialized version
+	b.Reset()
+	_, err = Get(s, "bucket", "file", &b, GetOptions{FileId: h3.FileId, NoCache: true})
+	core.TestErr(t, err, "cannot get delta after materialization: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), data), "Unexpected content of the delta after materialization")
+	versions, err := ListVersions(s, "bucket", "file")
+	core.TestErr(t, err, "cannot list versions: %v")
+	core.Assert(t, len(versions) == 4 && versions[0].FileId == h.FileId, "Expected the materialized version on top")
+
+	h4, err := Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{ReplaceID: h.FileId}, nil)
+	core.TestErr(t, err, "cannot put fourth version: %v")
+	core.Assert(t, h4.Delta != nil && h4.Delta.Depth == 1, "Expected a delta over the materialized body")
+}
@@ -0,0 +1,216 @@
+package safe
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+var DownloadPartSize int64 = 8 * 1024 * 1024 // Size of the ranges fetched in parallel. Smaller bodies are read in one go
+var DownloadConcurrency = 4                  // Number of ranges fetched in parallel
+var DownloadRetries = 3                      // Number of attempts for each range before the download is suspended
+
+// downloadLock serializes the downloads of the same body, which share the partial file
+type downloadLock struct {
+	sync.Mutex
+	users int
+}
+
+// downloadKey identifies a body across the safes
+type downloadKey struct {
+	safe   string
+	fileId uint64
+}
+
+var downloadsLock sync.Mutex
+var downloads = map[downloadKey]*downloadLock{}
+
+// lockDownload waits until no other download of the body with fileId in the safe is in progress. It returns the
+// function that releases the lock and whether another download was waited for.
+func lockDownload(safeName string, fileId uint64) (unlock func(), waited bool) {
+	key := downloadKey{safe: safeName, fileId: fileId}
+	downloadsLock.Lock()
+	l := downloads[key]
+	if l == nil {
+		l = &downloadLock{}
+		downloads[key] = l
+	}
+	l.users++
+	waited = l.users > 1
+	downloadsLock.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		downloadsLock.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(downloads, key)
+		}
+		downloadsLock.Unlock()
+	}, waited
+}
+
+// downloadInParts reads the encrypted body into the cache file with ranges fetched in parallel. The ranges are written
+// to a partial file and recorded in the DB so that an interrupted download resumes from the missing ranges, also
+// after a restart. The ranges are valid only for the same version of the body, as given by its ETag. Downloads of the
+// same body are serialized. The ETag of a completed download is recorded next to the cache file, so that a get that
+// waited for a concurrent download of the same version reuses the cache file. It returns false when the body is too
+// small to be split and must be read with writeFile.
+func downloadInParts(s *Safe, bucket string, header Header, cacheFile string) (bool, error) {
+	unlock, waited := lockDownload(s.Name, header.FileId)
+	defer unlock()
+
+	name := path.Join(s.Name, DataFolder, hashPath(bucket), BodyFolder, fmt.Sprintf("%d", bodyIdOf(header)))
+	primary, store := getStores(s)
+	stat, err := store.Stat(name)
+	if err != nil && store != primary {
+		store = primary
+		stat, err = store.Stat(name)
+	}
+	if err != nil || stat.Size() < 2*DownloadPartSize {
+		return false, nil
+	}
+	size := stat.Size()
+	etag, err := storage.ETag(store, name)
+	if core.IsErr(err, nil, "cannot get version of %s: %v", name) {
+		return false, nil
+	}
+	if cached, err := os.Stat(cacheFile); waited && err == nil && cached.Size() == size {
+		if data, err := os.ReadFile(cacheFile + ".etag"); err == nil && string(data) == etag {
+			core.Info("%s[%d] downloaded by a concurrent get", header.Name, header.FileId)
+			return true, nil
+		}
+	}
+
+	partFile := cacheFile + ".part"
+	done := getDownloadedParts(s.Name, header.FileId, size, etag, partFile)
+	f, err := os.OpenFile(partFile, os.O_RDWR|os.O_CREATE, 0644)
+	if core.IsErr(err, nil, "cannot open partial file %s: %v", partFile) {
+		return true, err
+	}
+	defer f.Close()
+
+	parts := (size + DownloadPartSize - 1) / DownloadPartSize
+	todo := make(chan int64, parts)
+	for part := int64(0); part < parts; part++ {
+		if !done[part] {
+			todo <- part
+		}
+	}
+	close(todo)
+	if len(done) > 0 {
+		core.Info("resuming download of %s[%d] with %d of %d parts done", header.Name, header.FileId, len(done), parts)
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var downloadErr error
+	for i := 0; i < DownloadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range todo {
+				err := downloadPart(s, store, name, f, part, size, etag, header.FileId)
+				if err != nil {
+					lock.Lock()
+					downloadErr = err
+					lock.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if downloadErr != nil {
+		return true, downloadErr
+	}
+
+	err = f.Close()
+	if core.IsErr(err, nil, "cannot close partial file %s: %v", partFile) {
+		return true, err
+	}
+	err = os.Rename(partFile, cacheFile)
+	if core.IsErr(err, nil, "cannot rename partial file %s: %v", partFile) {
+		return true, err
+	}
+	err = os.WriteFile(cacheFile+".etag", []byte(etag), 0644)
+	core.IsErr(err, nil, "cannot record version of %s: %v", cacheFile)
+	_, err = sql.Exec("DELETE_DOWNLOAD_PARTS", sql.Args{"safe": s.Name, "fileId": header.FileId})
+	core.IsErr(err, nil, "cannot delete download parts of %d: %v", header.FileId)
+	core.Info("downloaded %s[%d] in %d parts from %s", header.Name, header.FileId, parts, store)
+	return true, nil
+}
+
+// downloadPart reads a range of the body into the partial file at the same offset and records it in the DB
+func downloadPart(s *Safe, store storage.Store, name string, f *os.File, part, size int64, etag string,
+	fileId uint64) error {
+	rang := storage.Range{From: part * DownloadPartSize, To: min64((part+1)*DownloadPartSize, size)}
+
+	var err error
+	for attempt := 0; attempt < DownloadRetries; attempt++ {
+		w := &countingWriter{w: io.NewOffsetWriter(f, rang.From)}
+		err = store.Read(name, &rang, w, nil)
+		if err == nil && w.n != rang.To-rang.From {
+			err = fmt.Errorf("short read of part %d of %s: %d bytes", part, name, w.n)
+		}
+		if err == nil {
+			break
+		}
+		core.Info("cannot read part %d of %s, attempt %d: %v", part, name, attempt+1, err)
+	}
+	if core.IsErr(err, nil, "cannot download part %d of %s: %v", part, name) {
+		return err
+	}
+
+	_, err = sql.Exec("INSERT_DOWNLOAD_PART", sql.Args{"safe": s.Name, "fileId": fileId, "size": size,
+		"etag": etag, "partSize": DownloadPartSize, "part": part})
+	core.IsErr(err, nil, "cannot save download part %d of %d: %v", part, fileId)
+	return nil
+}
+
+// getDownloadedParts returns the parts already in the partial file. Parts of a download with a different size, ETag or
+// part size, or without the partial file, are discarded.
+func getDownloadedParts(safeName string, fileId uint64, size int64, etag string, partFile string) map[int64]bool {
+	done := map[int64]bool{}
+	rows, err := sql.Query("GET_DOWNLOAD_PARTS", sql.Args{"safe": safeName, "fileId": fileId})
+	if core.IsErr(err, nil, "cannot query download parts of %d: %v", fileId) {
+		return done
+	}
+	valid := true
+	for rows.Next() {
+		var part, partSize, fileSize int64
+		var partEtag string
+		if core.IsErr(rows.Scan(&part, &fileSize, &partEtag, &partSize), nil, "cannot scan download part: %v") {
+			continue
+		}
+		valid = valid && fileSize == size && partEtag == etag && partSize == DownloadPartSize
+		done[part] = true
+	}
+	rows.Close()
+
+	if _, err := os.Stat(partFile); len(done) > 0 && (!valid || err != nil) {
+		core.Info("discarding partial download of %d", fileId)
+		sql.Exec("DELETE_DOWNLOAD_PARTS", sql.Args{"safe": safeName, "fileId": fileId})
+		os.Remove(partFile)
+		return map[int64]bool{}
+	}
+	return done
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,137 @@
+package safe
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestDownloadInParts(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	partSize := DownloadPartSize
+	DownloadPartSize = 4096
+	defer func() { DownloadPartSize = partSize }()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	h, err := Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+
+	// simulate a download interrupted after two parts
+	name := path.Join(s.Name, DataFolder, hashPath("bucket"), BodyFolder, fmt.Sprintf("%d", h.FileId))
+	stat, err := s.PrimaryStore.Stat(name)
+	core.TestErr(t, err, "cannot stat body: %v")
+	etag, err := storage.ETag(s.PrimaryStore, name)
+	core.TestErr(t, err, "cannot get etag of body: %v")
+	cacheFile := cacheFileOf(s.Name, h.FileId)
+	os.MkdirAll(CacheFolder, 0755)
+	f, err := os.Create(cacheFile + ".part")
+	core.TestErr(t, err, "cannot create partial file: %v")
+	for _, part := range []int64{0, 3} {
+		err = downloadPart(s, s.PrimaryStore, name, f, part, stat.Size(), etag, h.FileId)
+		core.TestErr(t, err, "cannot download part %d: %v", part)
+	}
+	f.Close()
+	done := getDownloadedParts(s.Name, h.FileId, stat.Size(), etag, cacheFile+".part")
+	core.Assert(t, len(done) == 2, "Expected 2 downloaded parts, got %d", len(done))
+
+	b := bytes.Buffer{}
+	_, err = Get(s, "bucket", "file", &b, GetOptions{})
+	core.TestErr(t, err, "cannot get file: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), data), "Unexpected content")
+
+	done = getDownloadedParts(s.Name, h.FileId, stat.Size(), etag, cacheFile+".part")
+	core.Assert(t, len(done) == 0, "Expected no parts after the download, got %d", len(done))
+	_, err = os.Stat(cacheFile + ".part")
+	core.Assert(t, os.IsNotExist(err), "Expected the partial file to be renamed")
+
+	// parts of a previous version of the body are not resumed
+	f, err = os.Create(cacheFile + ".part")
+	core.TestErr(t, err, "cannot create partial file: %v")
+	err = downloadPart(s, s.PrimaryStore, name, f, 0, stat.Size(), "previous", h.FileId)
+	core.TestErr(t, err, "cannot download part: %v")
+	f.Close()
+	done = getDownloadedParts(s.Name, h.FileId, stat.Size(), etag, cacheFile+".part")
+	core.Assert(t, len(done) == 0, "Expected no parts of a different version, got %d", len(done))
+
+	// concurrent gets of the same file share the download
+	os.Remove(cacheFile)
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	contents := make([]bytes.Buffer, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = Get(s, "bucket", "file", &contents[i], GetOptions{})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		core.TestErr(t, err, "cannot get file concurrently: %v")
+		core.Assert(t, bytes.Equal(contents[i].Bytes(), data), "Unexpected content of concurrent get %d", i)
+	}
+}
+
+func TestDownloadWaitedStaleCache(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	partSize := DownloadPartSize
+	DownloadPartSize = 4096
+	defer func() { DownloadPartSize = partSize }()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+	h, err := Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+
+	// downloads of the same fileId in another safe do not wait
+	unlock, _ := lockDownload(s.Name, h.FileId)
+	unlockOther, waited := lockDownload("another-safe", h.FileId)
+	unlockOther()
+	core.Assert(t, !waited, "Expected no wait for a download in another safe")
+
+	// a cache file of the same size but of another version is not taken as the download of a concurrent get
+	name := path.Join(s.Name, DataFolder, hashPath("bucket"), BodyFolder, fmt.Sprintf("%d", h.FileId))
+	stat, err := s.PrimaryStore.Stat(name)
+	core.TestErr(t, err, "cannot stat body: %v")
+	cacheFile := cacheFileOf(s.Name, h.FileId)
+	os.MkdirAll(CacheFolder, 0755)
+	core.TestErr(t, os.WriteFile(cacheFile, make([]byte, stat.Size()), 0644), "cannot write cache file: %v")
+	core.TestErr(t, os.WriteFile(cacheFile+".etag", []byte("previous"), 0644), "cannot write etag: %v")
+
+	var b bytes.Buffer
+	done := make(chan error)
+	go func() {
+		_, err := Get(s, "bucket", "file", &b, GetOptions{})
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	unlock()
+	core.TestErr(t, <-done, "cannot get file: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), data), "Unexpected content from a stale cache file")
+}
@@ -0,0 +1,161 @@
+package safe
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/storage"
+)
+
+// PrimaryProbePeriod is the time between two health probes of the primary store in the background job
+var PrimaryProbePeriod = time.Minute
+
+// StoreRetryPolicy defines the retries of the operations on the stores and when a store is reported as degraded
+var StoreRetryPolicy = storage.DefaultRetryPolicy
+
+// StoreHealth reports the state of the stores of a safe
+type StoreHealth struct {
+	Primary   string `json:"primary"`   // Url of the store in use as primary
+	Secondary string `json:"secondary"` // Url of the store in use as secondary
+	Failover  bool   `json:"failover"`  // True when a replica replaces the primary
+	Degraded  bool   `json:"degraded"`  // True when the primary failed repeatedly and its operations are suspended
+	Circuit   string `json:"circuit"`   // State of the circuit breaker of the primary: closed, open or half-open
+}
+
+// GetStoreHealth returns the state of the stores of the safe, e.g. to show that the store is degraded
+func GetStoreHealth(s *Safe) StoreHealth {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	var h StoreHealth
+	if s.PrimaryStore != nil {
+		state := storage.GetCircuitState(s.PrimaryStore)
+		h.Primary = s.PrimaryStore.Url()
+		h.Degraded = state != storage.CircuitClosed
+		h.Circuit = state.String()
+	}
+	if s.SecondaryStore != nil {
+		h.Secondary = s.SecondaryStore.Url()
+	}
+	h.Failover = s.Failover
+	return h
+}
+
+// probeStore returns an error when the store cannot be reached or does not contain the safe
+func probeStore(store storage.Store, safeName string) error {
+	ls, err := store.ReadDir(path.Join(safeName, ConfigFolder), storage.Filter{Suffix: ".keystore", MaxResults: 1})
+	if err != nil {
+		return err
+	}
+	if len(ls) == 0 {
+		return fmt.Errorf("no keystore for %s in %s", safeName, store)
+	}
+	return nil
+}
+
+// checkPrimary probes the primary store. When the primary is unreachable, a healthy replica is promoted so that reads
+// and writes continue on the replica. When the primary is reachable again, it is restored and the replicas are
+// reconciled with the changes made in the meantime.
+func checkPrimary(s *Safe) error {
+	if s.primaryUrl == "" {
+		return nil
+	}
+
+	s.storeLock.Lock()
+	current, failover := s.PrimaryStore, s.Failover
+	s.storeLock.Unlock()
+
+	if !failover {
+		err := probeStore(current, s.Name)
+		if err == nil {
+			return nil
+		}
+		core.Info("primary %s of %s is unreachable: %v", current, s.Name, err)
+		return promoteReplica(s)
+	}
+
+	primary, err := storage.Open(s.primaryUrl)
+	if err != nil {
+		core.Info("primary %s of %s is still unreachable: %v", s.primaryUrl, s.Name, err)
+		return nil
+	}
+	primary = wrapStore(s, primary)
+	if err = probeStore(primary, s.Name); err != nil {
+		core.Info("primary %s of %s is still unreachable: %v", s.primaryUrl, s.Name, err)
+		primary.Close()
+		return nil
+	}
+
+	setPrimaryStore(s, primary, false)
+	core.Info("primary %s of %s is back, reconciling replicas", primary, s.Name)
+	_, err = replicate(s, nil)
+	if core.IsErr(err, nil, "cannot reconcile replicas of %s: %v", s.Name) {
+		return err
+	}
+	return nil
+}
+
+// promoteReplica replaces the primary store with the first healthy replica
+func promoteReplica(s *Safe) error {
+	for _, c := range s.StoreConfigs {
+		if c.Url == s.primaryUrl {
+			continue
+		}
+		store, err := storage.Open(c.Url)
+		if core.IsErr(err, nil, "cannot connect to replica %s: %v", c.Url) {
+			continue
+		}
+		store = wrapStore(s, store)
+		if core.IsErr(probeStore(store, s.Name), nil, "cannot use replica %s of %s: %v", c.Url, s.Name) {
+			store.Close()
+			continue
+		}
+		setPrimaryStore(s, store, true)
+		core.Info("promoted replica %s to primary of %s", store, s.Name)
+		return nil
+	}
+	core.Info("no healthy replica available for %s", s.Name)
+	return ErrNoStoreAvailable
+}
+
+// setPrimaryStore replaces the primary store with store, which must be already wrapped with wrapStore. On failover
+// the replica is also the secondary store, so that reads do not try the unreachable primary first. When the primary
+// is back, the replica stays in use as secondary store.
+func setPrimaryStore(s *Safe, store storage.Store, failover bool) {
+	store = cacheStore(s, store)
+	s.storeLock.Lock()
+	previous, previousSecondary := s.PrimaryStore, s.SecondaryStore
+	s.PrimaryStore = store
+	if failover || previous == nil {
+		s.SecondaryStore = store
+	} else {
+		s.SecondaryStore = previous
+	}
+	secondary := s.SecondaryStore
+	s.Failover = failover
+	s.storeLock.Unlock()
+
+	if previous != nil && previous != secondary {
+		previous.Close()
+	}
+	if previousSecondary != nil && previousSecondary != previous && previousSecondary != secondary {
+		previousSecondary.Close()
+	}
+}
+
+// getPrimaryStore returns the primary store of the safe. The primary store changes on failover, so it must not be
+// read from the field once the safe is open.
+func getPrimaryStore(s *Safe) storage.Store {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	return s.PrimaryStore
+}
+
+// getStores returns the primary and the secondary store of the safe, which may be the same store
+func getStores(s *Safe) (primary, secondary storage.Store) {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	return s.PrimaryStore, s.SecondaryStore
+}
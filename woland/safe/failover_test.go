@@ -0,0 +1,69 @@
+package safe
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+func TestFailover(t *testing.T) {
+	InitTest()
+	if !strings.HasPrefix(testUrl, "file://") {
+		t.Skip("failover test requires a local store")
+	}
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	replicaDir := filepath.Join(os.TempDir(), "woland-failover")
+	os.RemoveAll(replicaDir)
+	replicaUrl := "file://" + replicaDir
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	err = AddStore(s, StoreConfig{Name: "replica", Url: replicaUrl, Quota: testStoreConfig.Quota})
+	core.TestErr(t, err, "cannot add store: %v")
+	_, err = Replicate(s)
+	core.TestErr(t, err, "cannot replicate: %v")
+
+	// simulate an outage of the primary
+	safeDir := filepath.Join(strings.TrimPrefix(testUrl, "file://"), testSafe)
+	err = os.Rename(safeDir, safeDir+".down")
+	core.TestErr(t, err, "cannot hide primary: %v")
+	defer os.RemoveAll(safeDir + ".down")
+
+	err = checkPrimary(s)
+	core.TestErr(t, err, "cannot check primary: %v")
+	core.Assert(t, s.Failover && s.PrimaryStore.Url() == replicaUrl, "Expected replica to be promoted")
+	health := GetStoreHealth(s)
+	core.Assert(t, health.Failover && !health.Degraded && health.Primary == replicaUrl && health.Secondary == replicaUrl,
+		"Unexpected health %+v", health)
+
+	h, err := Put(s, "bucket", "file", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file during failover: %v")
+
+	err = os.Rename(safeDir+".down", safeDir)
+	core.TestErr(t, err, "cannot restore primary: %v")
+
+	err = checkPrimary(s)
+	core.TestErr(t, err, "cannot check primary: %v")
+	core.Assert(t, !s.Failover && s.PrimaryStore.Url() == testUrl, "Expected primary to be restored")
+
+	bodyFile := path.Join(testSafe, DataFolder, hashPath("bucket"), BodyFolder, fmt.Sprintf("%d", h.FileId))
+	_, err = s.PrimaryStore.Stat(bodyFile)
+	core.TestErr(t, err, "body written during failover not reconciled: %v")
+
+	b := bytes.Buffer{}
+	_, err = Get(s, "bucket", "file", &b, GetOptions{NoCache: true})
+	core.TestErr(t, err, "cannot get file: %v")
+	core.Assert(t, bytes.Equal(b.Bytes(), testData), "Unexpected content %s", b.String())
+}
@@ -1,9 +1,178 @@
 package safe
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/security"
+)
+
+var ErrSafeNotFederated = fmt.Errorf("safe is not part of the federation")
+
 type FederateOptions struct {
+	StoreUrls    map[string]string      `json:"storeUrls"`    // Store url for each safe, required only when the safe is not yet in the DB
+	CreatorIds   map[string]string      `json:"creatorIds"`   // Creator id for each safe
+	OpenOptions  OpenOptions            `json:"openOptions"`  // Options used to open each safe
+	OrderBy      string                 `json:"orderBy"`      // Order by name or modTime. Default is name
+	ReverseOrder bool                   `json:"reverseOrder"` // Order descending when true. Default is false
+	Dedup        bool                   `json:"dedup"`        // Keep only the first file for each hash
+	Filters      map[string]ListOptions `json:"filters"`      // List options specific to a safe. They replace the options passed to the list
+}
+
+// Federation is a read view over the buckets of multiple safes
+type Federation struct {
+	Safes   map[string]*Safe `json:"safes"`   // Opened safes by name
+	Names   []string         `json:"names"`   // Names of the safes in the order they were provided
+	Buckets []string         `json:"buckets"` // Buckets to aggregate in each safe
+
+	options FederateOptions
+}
+
+// FederatedHeader is a header tagged with the safe and bucket it comes from
+type FederatedHeader struct {
+	Header
+	Safe   string `json:"safe"`   // Name of the safe that contains the file
+	Bucket string `json:"bucket"` // Bucket that contains the file
 }
 
-func Federate(names []string, buckets []string, options FederateOptions) error {
-	// TODO: implement
-	return nil
+// Federate opens the named safes and returns a federation that aggregates the provided buckets.
+func Federate(currentUser security.Identity, names []string, buckets []string, options FederateOptions) (*Federation, error) {
+	switch options.OrderBy {
+	case "", "name", "modTime":
+	default:
+		return nil, fmt.Errorf("invalid order by: %s", options.OrderBy)
+	}
+
+	f := &Federation{
+		Safes:   map[string]*Safe{},
+		Buckets: buckets,
+		options: options,
+	}
+	for _, name := range names {
+		name, err := validName(name)
+		if core.IsErr(err, nil, "invalid name %s: %v", name) {
+			CloseFederation(f)
+			return nil, err
+		}
+		if _, ok := f.Safes[name]; ok {
+			continue
+		}
+
+		s, err := Open(currentUser, name, options.StoreUrls[name], options.CreatorIds[name], options.OpenOptions)
+		if core.IsErr(err, nil, "cannot open safe %s for federation: %v", name) {
+			CloseFederation(f)
+			return nil, err
+		}
+		f.Safes[name] = s
+		f.Names = append(f.Names, name)
+	}
+
+	core.Info("federation created: safes %v, buckets %v", f.Names, buckets)
+	return f, nil
+}
+
+// ListFederatedFiles lists the files in all the safes and buckets of the federation and merges them in a single
+// ordered list. Offset and Limit apply to the merged list.
+func ListFederatedFiles(f *Federation, listOptions ListOptions) ([]FederatedHeader, error) {
+	offset, limit := listOptions.Offset, listOptions.Limit
+
+	var headers []FederatedHeader
+	for _, name := range f.Names {
+		s := f.Safes[name]
+		options := listOptions
+		if filter, ok := f.options.Filters[name]; ok {
+			options = filter
+		}
+		options.Offset, options.Limit = 0, 0
+
+		for _, bucket := range f.Buckets {
+			hs, err := ListFiles(s, bucket, options)
+			if core.IsErr(err, nil, "cannot list files in %s/%s: %v", name, bucket) {
+				return nil, err
+			}
+			for _, h := range hs {
+				headers = append(headers, FederatedHeader{Header: h, Safe: name, Bucket: strings.Trim(bucket, "/")})
+			}
+		}
+	}
+
+	sortFederatedHeaders(headers, f.options.OrderBy, f.options.ReverseOrder)
+	if f.options.Dedup {
+		headers = dedupFederatedHeaders(headers)
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(headers) {
+		offset = len(headers)
+	}
+	headers = headers[offset:]
+	if limit > 0 && limit < len(headers) {
+		headers = headers[:limit]
+	}
+
+	core.Info("found %d headers in federation %v", len(headers), f.Names)
+	return headers, nil
+}
+
+// GetFederated reads the file described by the header from the safe it belongs to.
+func GetFederated(f *Federation, header FederatedHeader, dest any, options GetOptions) (Header, error) {
+	s, ok := f.Safes[header.Safe]
+	if !ok {
+		return Header{}, ErrSafeNotFederated
+	}
+
+	options.FileId = header.FileId
+	return Get(s, header.Bucket, header.Name, dest, options)
+}
+
+// CloseFederation closes all the safes opened by the federation
+func CloseFederation(f *Federation) {
+	for _, s := range f.Safes {
+		Close(s)
+	}
+	f.Safes = map[string]*Safe{}
+	f.Names = nil
+}
+
+func sortFederatedHeaders(headers []FederatedHeader, orderBy string, reverse bool) {
+	less := func(a, b FederatedHeader) bool {
+		if orderBy == "modTime" {
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		} else if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Safe != b.Safe {
+			return a.Safe < b.Safe
+		}
+		return a.FileId < b.FileId
+	}
+
+	sort.SliceStable(headers, func(i, j int) bool {
+		if reverse {
+			return less(headers[j], headers[i])
+		}
+		return less(headers[i], headers[j])
+	})
+}
+
+// dedupFederatedHeaders keeps only the first header for each hash. Headers without a hash are always kept.
+func dedupFederatedHeaders(headers []FederatedHeader) []FederatedHeader {
+	var unique []FederatedHeader
+	seen := map[string]bool{}
+
+	for _, h := range headers {
+		hash := string(h.Attributes.Hash)
+		if hash != "" && seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		unique = append(unique, h)
+	}
+	return unique
 }
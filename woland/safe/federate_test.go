@@ -0,0 +1,70 @@
+package safe
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+func TestFederate(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	names := []string{testSafe, testSafe + "2"}
+	for i, name := range names {
+		s, err := Create(Identity1, name, testStoreConfig, nil, CreateOptions{Wipe: true})
+		core.TestErr(t, err, "cannot create safe: %v")
+
+		_, err = Put(s, "bucket", "shared", core.NewBytesReader(testData), PutOptions{}, nil)
+		core.TestErr(t, err, "cannot put file: %v")
+		_, err = Put(s, "bucket", "own", core.NewBytesReader([]byte(name)), PutOptions{}, nil)
+		core.TestErr(t, err, "cannot put file: %v")
+		if i == 0 {
+			_, err = Put(s, "bucket", "first", core.NewBytesReader([]byte("first")), PutOptions{}, nil)
+			core.TestErr(t, err, "cannot put file: %v")
+		}
+		Close(s)
+	}
+
+	creatorIds := map[string]string{names[0]: Identity1.Id, names[1]: Identity1.Id}
+	f, err := Federate(Identity1, names, []string{"bucket"}, FederateOptions{CreatorIds: creatorIds})
+	core.TestErr(t, err, "cannot federate: %v")
+
+	headers, err := ListFederatedFiles(f, ListOptions{})
+	core.TestErr(t, err, "cannot list federation: %v")
+	core.Assert(t, len(headers) == 5, "Expected 5 files, got %d", len(headers))
+	core.Assert(t, headers[0].Name == "first", "Expected first file to be 'first', got '%s'", headers[0].Name)
+	core.Assert(t, headers[1].Safe == names[0] && headers[2].Safe == names[1], "Expected 'own' files ordered by safe")
+
+	all, err := ListFederatedFiles(f, ListOptions{Offset: -1})
+	core.TestErr(t, err, "cannot list federation: %v")
+	core.Assert(t, len(all) == 5, "Expected 5 files with a negative offset, got %d", len(all))
+	none, err := ListFederatedFiles(f, ListOptions{Offset: 6})
+	core.TestErr(t, err, "cannot list federation: %v")
+	core.Assert(t, len(none) == 0, "Expected no files with an offset past the end, got %d", len(none))
+
+	b := bytes.NewBuffer(nil)
+	_, err = GetFederated(f, headers[2], b, GetOptions{})
+	core.TestErr(t, err, "cannot get file: %v")
+	core.Assert(t, b.String() == names[1], "Expected data to be '%s', got '%s'", names[1], b.String())
+	CloseFederation(f)
+
+	f, err = Federate(Identity1, names, []string{"bucket"}, FederateOptions{
+		CreatorIds: creatorIds,
+		Dedup:      true,
+		Filters:    map[string]ListOptions{names[1]: {Name: "shared"}},
+	})
+	core.TestErr(t, err, "cannot federate: %v")
+
+	headers, err = ListFederatedFiles(f, ListOptions{})
+	core.TestErr(t, err, "cannot list federation: %v")
+	core.Assert(t, len(headers) == 3, "Expected 3 files, got %d", len(headers))
+	for _, h := range headers {
+		core.Assert(t, h.Safe == names[0], "Expected all files from %s, got %s", names[0], h.Safe)
+	}
+	CloseFederation(f)
+}
@@ -17,6 +17,7 @@ import (
 
 var ErrFileNotExist = fmt.Errorf("file does not exist") // Returned when a file does not exist
 var MaxCacheSize = int64(128 * 1024 * 1024)             // Maximum size of the cache
+var MaxStoreCacheSize = int64(32 * 1024 * 1024)         // Maximum size of the header, change and body files cached on disk
 var DelayForDestination = 100 * time.Millisecond        // Delay before checking if the file is downloaded to the specified destination
 var currentCacheSize int64 = -1                         // Current size of the cache
 
@@ -44,7 +45,7 @@ func Get(s *Safe, bucket, name string, dest any, options GetOptions) (Header, er
 		}
 	}
 
-	var header, headerId, err = getLastHeader(s.Name, bucket, name, options.FileId)
+	var header, _, err = getLastHeader(s.Name, bucket, name, options.FileId)
 	if core.IsErr(err, nil, "cannot get header: %v", err) {
 		return Header{}, err
 	}
@@ -55,6 +56,10 @@ func Get(s *Safe, bucket, name string, dest any, options GetOptions) (Header, er
 		return Header{}, err
 	}
 
+	if options.Range != nil {
+		// a range is only a part of the body and cannot be used as cache
+		options.NoCache = true
+	}
 	if dest == nil && options.NoCache {
 		return header, nil
 	}
@@ -77,20 +82,75 @@ func Get(s *Safe, bucket, name string, dest any, options GetOptions) (Header, er
 		}
 	}
 
+	var mw *merkleWriter
+	if w != nil && options.Range != nil && len(header.Attributes.MerkleRoot) > 0 {
+		tree, err := readMerkleTree(s, bucket, header)
+		if core.IsErr(err, nil, "cannot read merkle tree of %s: %v", header.Name) {
+			return Header{}, err
+		}
+		mw, options.Range = newMerkleWriter(w, tree, header, options.Range)
+		w = mw
+	}
+
+	if len(header.Chunks) > 0 || header.Delta != nil {
+		// chunks and deltas are read from several bodies and are not cached
+		if w != nil {
+			if options.Progress != nil {
+				w = progressWriter(w, options.Progress)
+			}
+			if header.Delta != nil {
+				err = readDelta(s, bucket, header, w, options.Range)
+			} else {
+				err = readChunks(s, header, w, options.Range)
+			}
+			if core.IsErr(err, nil, "cannot read body of %s: %v", header.Name) {
+				return Header{}, err
+			}
+		}
+		if mw != nil {
+			err = mw.Close()
+			if core.IsErr(err, nil, "cannot verify %s: %v", header.Name) {
+				return Header{}, err
+			}
+		}
+		return header, nil
+	}
+
+	// the encrypted body of a compressed file contains the compressed frames
+	body := header
+	if header.Compression != nil {
+		body.Size = header.Compression.size()
+	}
+
+	var dw io.WriteCloser
 	if w != nil {
-		w, err = decryptWriter(w, header.BodyKey, header.IV)
+		if header.Compression != nil {
+			w, options.Range, err = decompressWriter(w, header, options.Range)
+			if core.IsErr(err, nil, "cannot create decompressing writer: %v", err) {
+				return Header{}, err
+			}
+		}
+		dw, err = decryptWriter(w, body, options.Range)
 		if core.IsErr(err, nil, "cannot create decrypting writer: %v", err) {
 			return Header{}, err
 		}
+		w = dw
 		if options.Progress != nil {
 			w = progressWriter(w, options.Progress)
 			core.Info("Progress writer created")
 		}
 	}
+	options.Range = bodyRange(body, options.Range)
 
 	if !options.NoCache && header.Cached != "" {
 		err = copyFromCachedFile(header, w)
 		if err == nil {
+			if dw != nil {
+				err = dw.Close()
+				if core.IsErr(err, nil, "cannot decrypt cached file %s: %v", header.Cached) {
+					return Header{}, err
+				}
+			}
 			return header, nil
 		}
 	}
@@ -100,8 +160,23 @@ func Get(s *Safe, bucket, name string, dest any, options GetOptions) (Header, er
 		if currentCacheSize < 0 {
 			currentCacheSize = getCurrentCacheSize()
 		}
-		name := filepath.Join(CacheFolder, fmt.Sprintf("%d.cache", header.FileId))
-		f, err := os.Create(name)
+		name := cacheFileOf(s.Name, header.FileId)
+
+		// large bodies are fetched in parallel ranges and resume from a partial cache file
+		var parallel bool
+		if options.Range == nil && !header.Zip {
+			parallel, err = downloadInParts(s, bucket, header, name)
+			if core.IsErr(err, nil, "cannot download %s: %v", header.Name) {
+				return Header{}, err
+			}
+		}
+
+		var f *os.File
+		if parallel {
+			f, err = os.Open(name)
+		} else {
+			f, err = os.Create(name)
+		}
 		if core.IsErr(err, nil, "cannot create cache file: %v", err) {
 			return Header{}, err
 		}
@@ -110,9 +185,11 @@ func Get(s *Safe, bucket, name string, dest any, options GetOptions) (Header, er
 			cachedFile = name
 		}
 
-		err = writeFile(s, bucket, options, headerId, header, destFile, f)
-		if core.IsErr(err, nil, "cannot write file: %v", err) {
-			return Header{}, err
+		if !parallel {
+			err = writeFile(s, bucket, options, header, destFile, f)
+			if core.IsErr(err, nil, "cannot write file: %v", err) {
+				return Header{}, err
+			}
 		}
 		f.Seek(0, 0)
 
@@ -139,12 +216,25 @@ func Get(s *Safe, bucket, name string, dest any, options GetOptions) (Header, er
 			}
 		}
 	} else if w != nil {
-		err = writeFile(s, bucket, options, headerId, header, destFile, w)
+		err = writeFile(s, bucket, options, header, destFile, w)
 		if core.IsErr(err, nil, "cannot write file: %v", err) {
 			return Header{}, err
 		}
 	}
 
+	if dw != nil {
+		err = dw.Close()
+		if core.IsErr(err, nil, "cannot decrypt %s: %v", header.Name) {
+			return Header{}, err
+		}
+	}
+	if mw != nil {
+		err = mw.Close()
+		if core.IsErr(err, nil, "cannot verify %s: %v", header.Name) {
+			return Header{}, err
+		}
+	}
+
 	if destFile != "" || cachedFile != "" {
 		updateHeaderInDB(s.Name, bucket, header.FileId, func(h Header) Header {
 			if cachedFile != "" {
@@ -178,12 +268,13 @@ func Get(s *Safe, bucket, name string, dest any, options GetOptions) (Header, er
 
 func getLastHeader(safeName, bucket, name string, fileId uint64) (header Header, headerId uint64, err error) {
 	var data []byte
+	var tombstoned bool
 	err = sql.QueryRow("GET_LAST_HEADER", sql.Args{
 		"safe":   safeName,
 		"bucket": bucket,
 		"name":   name,
 		"fileId": fileId,
-	}, &data, &headerId)
+	}, &data, &headerId, &tombstoned)
 	if err == sql.ErrNoRows {
 		core.Info("file %s/%s does not exist", bucket, name)
 		return Header{}, 0, ErrFileNotExist
@@ -196,6 +287,8 @@ func getLastHeader(safeName, bucket, name string, fileId uint64) (header Header,
 	if core.IsErr(err, nil, "cannot unmarshal header: %v", err) {
 		return Header{}, 0, err
 	}
+	// the header of a deleted file is kept next to its tombstone
+	header.Deleted = header.Deleted || tombstoned
 	core.Info("header for %s/%s found, fileId %d", bucket, name, header.FileId)
 	return header, headerId, nil
 }
@@ -224,27 +317,21 @@ func copyFromCachedFile(header Header, w io.Writer) error {
 	return err
 }
 
-func writeFile(s *Safe, bucket string, options GetOptions, headerId uint64, header Header, destFile string, w io.Writer) error {
+func writeFile(s *Safe, bucket string, options GetOptions, header Header, destFile string, w io.Writer) error {
 	var err error
 
 	dir := hashPath(bucket)
-	fullname := path.Join(s.Name, DataFolder, dir, BodyFolder, fmt.Sprintf("%d", header.FileId))
+	fullname := path.Join(s.Name, DataFolder, dir, BodyFolder, fmt.Sprintf("%d", bodyIdOf(header)))
 
-	secondary := s.SecondaryStore
+	primary, secondary := getStores(s)
 	err = secondary.Read(fullname, options.Range, w, nil)
 	if err == nil {
-		if destFile != "" {
-			w.(*os.File).Close()
-		}
 		core.Info("Read %s[%d] into %s from secondary store %s", header.Name, header.FileId, fullname, secondary.String())
 		return nil
 	}
 	notExist := os.IsNotExist(err)
 
-	err = s.PrimaryStore.Read(fullname, options.Range, w, nil)
-	if destFile != "" {
-		w.(*os.File).Close()
-	}
+	err = primary.Read(fullname, options.Range, w, nil)
 	if core.IsErr(err, nil, "cannot read file: %v", err) {
 		if os.IsNotExist(err) {
 			_, err := sql.Exec("SET_DELETED_FILE", sql.Args{"safe": s.Name, "fileId": header.FileId})
@@ -258,27 +345,25 @@ func writeFile(s *Safe, bucket string, options GetOptions, headerId uint64, head
 		}
 		return err
 	}
-	core.Info("Read %s[%d] into %s from primary store %s", header.Name, header.FileId, fullname, s.PrimaryStore.String())
-
-	if notExist {
-		r, ok := w.(io.ReadSeeker)
-		if ok {
-			core.Info("Cloning %s[%d] into secondary store %s", header.Name, header.FileId, secondary.String())
-			if f, ok := r.(*os.File); ok {
-				err = f.Sync()
-				core.IsErr(err, nil, "cannot sync file: %v", err)
-			}
-			r.Seek(0, 0)
-			_, err = writeToStore(s, secondary, bucket, r, headerId, header, nil)
-			if !core.IsErr(err, nil, "cannot write to secondary store: %v", err) {
-				core.Info("Wrote %s[%d] into secondary store %s", header.Name, header.FileId, secondary.String())
-			}
+	core.Info("Read %s[%d] into %s from primary store %s", header.Name, header.FileId, fullname, primary.String())
+
+	if notExist && secondary != primary {
+		// the body is copied as it is, since it is already encrypted and its format is recorded in the header
+		core.Info("Cloning %s[%d] into secondary store %s", header.Name, header.FileId, secondary.String())
+		err = storage.CopyFile(secondary, fullname, primary, fullname)
+		if !core.IsErr(err, nil, "cannot write to secondary store: %v", err) {
+			core.Info("Wrote %s[%d] into secondary store %s", header.Name, header.FileId, secondary.String())
 		}
 	}
 
 	return nil
 }
 
+// cacheFileOf returns the cache file of the body of a file in the safe
+func cacheFileOf(safeName string, fileId uint64) string {
+	return filepath.Join(CacheFolder, fmt.Sprintf("%s.%d.cache", hashPath(safeName), fileId))
+}
+
 func getCurrentCacheSize() int64 {
 	var cacheSize int64
 	var cacheMap = make(map[string]time.Time)
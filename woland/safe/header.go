@@ -16,6 +16,8 @@ import (
 	"time"
 
 	"github.com/godruoyi/go-snowflake"
+	"golang.org/x/crypto/blake2b"
+
 	"github.com/stregato/master/woland/core"
 	"github.com/stregato/master/woland/security"
 	"github.com/stregato/master/woland/sql"
@@ -28,6 +30,7 @@ var MergeBatchSize = 4
 
 var ErrInvalidHeaders = fmt.Errorf("headers are invalid")
 var ErrNoEncryptionKey = fmt.Errorf("no encryption key")
+var ErrInvalidSignature = fmt.Errorf("header signature is missing or invalid")
 
 type Attributes struct {
 	Hash        []byte         `json:"ha,omitempty"` // Hash of the file
@@ -35,6 +38,7 @@ type Attributes struct {
 	Thumbnail   []byte         `json:"th,omitempty"` // Thumbnail of the file
 	Tags        []string       `json:"ta,omitempty"` // Tags of the file
 	Meta        map[string]any `json:"mt,omitempty"` // Extra attributes of the file
+	MerkleRoot  []byte         `json:"mr,omitempty"` // Root of the Merkle tree of the content, used to verify ranges
 }
 
 type Header struct {
@@ -43,8 +47,13 @@ type Header struct {
 	Size                int64                `json:"si"`            //	Size of the file
 	ModTime             time.Time            `json:"mo"`            // Last modification time of the file
 	FileId              uint64               `json:"fi"`            // ID used in the storage to identify the file
+	BodyId              uint64               `json:"bi,omitempty"`  // FileId of the version whose body is reused
 	IV                  []byte               `json:"iv"`            // IV used to encrypt the attributes
-	Zip                 bool                 `json:"zi,omitempty"`  // True if the file is zipped
+	Zip                 bool                 `json:"zi,omitempty"`  // True if the encrypted body is gzipped (legacy)
+	Compression         *Compression         `json:"cm,omitempty"`  // Compression of the body before encryption
+	Chunks              []Chunk              `json:"ck,omitempty"`  // Chunks of the body when stored in chunks
+	Delta               *Delta               `json:"dt,omitempty"`  // Patch over a previous version when only changes are stored
+	Format              int                  `json:"fm,omitempty"`  // Encryption format of the body, FormatLegacy or FormatAEAD
 	Attributes          Attributes           `json:"at,omitempty"`  // Attributes of the file
 	EncryptedAttributes []byte               `json:"en,omitempty"`  // Encrypted attributes of the file
 	BodyKey             []byte               `json:"bo,omitempty"`  // Key used to encrypt the body
@@ -57,14 +66,18 @@ type Header struct {
 	ReplaceId           uint64               `json:"re,omitempty"`  // ID of the file to replace
 	Replace             bool                 `json:"rp,omitempty"`  // True if the file is replacing another file
 	Downloads           map[string]time.Time `json:"do,omitempty"`  // Map of download locations and times
+	Signature           []byte               `json:"sg,omitempty"`  // Signature of the creator on the header fields
 }
 
 type HeadersFile struct {
 	KeyId   uint64   `json:"-"`
 	Bucket  string   `json:"b"`
 	Headers []Header `json:"h"`
+	Node    string   `json:"n,omitempty"` // Installation that wrote the file
 }
 
+// marshalHeadersFile encrypts the headers in FormatAEAD: the version byte, the key id, the nonce and the AES-GCM
+// ciphertext. The version byte and the key id are authenticated as additional data.
 func marshalHeadersFile(headersFile HeadersFile, keyValue []byte) ([]byte, error) {
 	data, err := json.Marshal(headersFile)
 	if core.IsErr(err, nil, "cannot marshal files: %v", err) {
@@ -75,25 +88,32 @@ func marshalHeadersFile(headersFile HeadersFile, keyValue []byte) ([]byte, error
 	if core.IsErr(err, nil, "cannot create cipher: %v", err) {
 		return nil, err
 	}
+	aead, err := cipher.NewGCM(block)
+	if core.IsErr(err, nil, "cannot create GCM: %v", err) {
+		return nil, err
+	}
 
-	ciphertext := make([]byte, 8+aes.BlockSize+len(data)) // 8 bytes for the KeyID
-	binary.BigEndian.PutUint64(ciphertext[:8], headersFile.KeyId)
+	prefix := make([]byte, 9+aead.NonceSize(), 9+aead.NonceSize()+len(data)+aead.Overhead()) // 1 byte for the version, 8 bytes for the KeyID
+	prefix[0] = aeadVersion
+	binary.BigEndian.PutUint64(prefix[1:9], headersFile.KeyId)
 
-	iv := ciphertext[8 : 8+aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	nonce := prefix[9:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		if core.IsErr(err, nil, "cannot read random bytes: %v", err) {
 			return nil, err
 		}
 	}
 
-	stream := cipher.NewCFBEncrypter(block, iv)
-	stream.XORKeyStream(ciphertext[8+aes.BlockSize:], data)
-
-	return ciphertext, nil
+	return aead.Seal(prefix, nonce, data, prefix[:9]), nil
 }
 
+// unmarshalHeadersFile decrypts headers in FormatAEAD or in the legacy format, where the key id is followed by the
+// IV and the AES-CFB ciphertext.
 func unmarshalHeadersFile(ciphertext []byte, keys map[uint64][]byte) (headersFile HeadersFile, err error) {
-	if len(ciphertext) < 8 {
+	if len(ciphertext) > 0 && ciphertext[0]&0x80 != 0 {
+		return unmarshalAEADHeadersFile(ciphertext, keys)
+	}
+	if len(ciphertext) < 8+aes.BlockSize {
 		return HeadersFile{}, ErrInvalidHeaders
 	}
 
@@ -113,17 +133,55 @@ func unmarshalHeadersFile(ciphertext []byte, keys map[uint64][]byte) (headersFil
 	stream := cipher.NewCFBDecrypter(block, iv)
 	stream.XORKeyStream(ciphertext[8+aes.BlockSize:], ciphertext[8+aes.BlockSize:])
 
-	var headerId HeadersFile
 	err = json.Unmarshal(ciphertext[8+aes.BlockSize:], &headersFile)
 	if err != nil {
-		return headerId, err
+		return HeadersFile{}, err
 	}
 
-	headerId.KeyId = keyId
+	headersFile.KeyId = keyId
+	return headersFile, nil
+}
+
+func unmarshalAEADHeadersFile(ciphertext []byte, keys map[uint64][]byte) (headersFile HeadersFile, err error) {
+	if ciphertext[0] != aeadVersion || len(ciphertext) < 9 {
+		return HeadersFile{}, ErrInvalidHeaders
+	}
+
+	keyId := binary.BigEndian.Uint64(ciphertext[1:9])
+	key := keys[keyId]
+	if key == nil {
+		return HeadersFile{}, ErrNoEncryptionKey
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return HeadersFile{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return HeadersFile{}, err
+	}
+	if len(ciphertext) < 9+aead.NonceSize()+aead.Overhead() {
+		return HeadersFile{}, ErrInvalidHeaders
+	}
+
+	nonce := ciphertext[9 : 9+aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, ciphertext[9+aead.NonceSize():], ciphertext[:9])
+	if err != nil {
+		return HeadersFile{}, ErrInvalidHeaders
+	}
+
+	err = json.Unmarshal(data, &headersFile)
+	if err != nil {
+		return HeadersFile{}, err
+	}
+
+	headersFile.KeyId = keyId
 	return headersFile, nil
 }
 
 func writeHeadersFile(store storage.Store, safeName string, filePath string, key []byte, headersFile HeadersFile) error {
+	headersFile.Node = getNodeId()
 	data, err := marshalHeadersFile(headersFile, key)
 	if core.IsErr(err, nil, "cannot encrypt header: %v", err) {
 		return err
@@ -153,6 +211,10 @@ func readHeadersFile(store storage.Store, safeName string, filePath string, keys
 }
 
 func insertHeaderOrIgnoreToDB(safeName, bucket string, headerId uint64, header Header) error {
+	if header.Deleted {
+		return insertTombstoneToDB(safeName, bucket, headerId, header)
+	}
+
 	data, err := json.Marshal(header)
 	if core.IsErr(err, nil, "cannot marshal header: %v", err) {
 		return err
@@ -167,6 +229,7 @@ func insertHeaderOrIgnoreToDB(safeName, bucket string, headerId uint64, header H
 		"name":         header.Name,
 		"size":         header.Size,
 		"fileId":       header.FileId,
+		"bodyId":       header.BodyId,
 		"headerId":     headerId,
 		"base":         path.Base(header.Name),
 		"dir":          getDir(header.Name),
@@ -192,6 +255,60 @@ func insertHeaderOrIgnoreToDB(safeName, bucket string, headerId uint64, header H
 	}
 	core.Info("Saved header %s [%d]", header.Name, header.FileId)
 
+	err = insertChunkRefsToDB(safeName, header)
+	if core.IsErr(err, nil, "cannot save chunks of %s: %v", header.Name) {
+		return err
+	}
+
+	return nil
+}
+
+// insertTombstoneToDB saves the tombstone and hides the file it deletes. The header of the file is kept since it holds
+// the creator and the metadata of the deleted file.
+func insertTombstoneToDB(safeName, bucket string, headerId uint64, tombstone Header) error {
+	data, err := json.Marshal(tombstone)
+	if core.IsErr(err, nil, "cannot marshal tombstone: %v", err) {
+		return err
+	}
+
+	_, err = sql.Exec("INSERT_TOMBSTONE", sql.Args{
+		"safe":     safeName,
+		"bucket":   bucket,
+		"fileId":   tombstone.FileId,
+		"headerId": headerId,
+		"creator":  tombstone.Creator,
+		"modTime":  tombstone.ModTime.UnixMilli(),
+		"syncTime": core.Now().UnixMilli(),
+		"header":   data,
+	})
+	if core.IsErr(err, nil, "cannot save tombstone: %v", err) {
+		return err
+	}
+	_, err = sql.Exec("SET_DELETED_FILE", sql.Args{"safe": safeName, "fileId": tombstone.FileId})
+	if core.IsErr(err, nil, "cannot set deleted file: %v", err) {
+		return err
+	}
+	core.Info("Saved tombstone %s [%d]", tombstone.Name, tombstone.FileId)
+	return nil
+}
+
+// updateHeaderFileInDB sets the headers file that contains the header or the tombstone
+func updateHeaderFileInDB(safeName, bucket string, header Header, headerId uint64) error {
+	key := "UPDATE_HEADER_FILE"
+	if header.Deleted {
+		key = "UPDATE_TOMBSTONE_FILE"
+	}
+	res, err := sql.Exec(key, sql.Args{
+		"safe":     safeName,
+		"bucket":   bucket,
+		"fileId":   header.FileId,
+		"headerId": headerId,
+	})
+	if core.IsErr(err, nil, "cannot update header file: %v", err) {
+		return err
+	}
+	cnt, _ := res.RowsAffected()
+	core.Info("Updated header file for %s %d", header.Name, cnt)
 	return nil
 }
 
@@ -238,6 +355,102 @@ func updateHeaderInDB(safeName, bucket string, fileId uint64, update func(Header
 	return nil
 }
 
+// canonicalJSON returns the JSON encoding of v as a peer decodes it: numbers in Meta become float64 and structs become
+// maps with sorted keys. The encoding is the same before and after a round trip through the headers file.
+func canonicalJSON(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var decoded any
+	if json.Unmarshal(data, &decoded) != nil {
+		return data
+	}
+	data, _ = json.Marshal(decoded)
+	return data
+}
+
+// hashOfHeader returns the hash of the fields of the header as written in the store. Local fields like Cached,
+// Uploading and Downloads are not included. Each field is prefixed with its length to avoid ambiguities, and the
+// optional fields with a tag as well.
+func hashOfHeader(header Header) []byte {
+	hash, _ := blake2b.New384(nil)
+	write := func(data []byte) {
+		hash.Write(binary.BigEndian.AppendUint32(nil, uint32(len(data))))
+		hash.Write(data)
+	}
+	writeOptional := func(tag string, data []byte) {
+		write([]byte(tag))
+		write(data)
+	}
+
+	attributes := canonicalJSON(header.Attributes)
+	write([]byte(header.Name))
+	write([]byte(header.Creator))
+	write(binary.BigEndian.AppendUint64(nil, uint64(header.Size)))
+	write(header.ModTime.UTC().AppendFormat(nil, time.RFC3339Nano))
+	write(binary.BigEndian.AppendUint64(nil, header.FileId))
+	write(header.IV)
+	write([]byte(fmt.Sprintf("%t:%d:%t:%t", header.Zip, header.Format, header.Deleted, header.Replace)))
+	write(attributes)
+	write(header.EncryptedAttributes)
+	write(header.BodyKey)
+	write([]byte(header.PrivateId))
+	write(binary.BigEndian.AppendUint64(nil, header.ReplaceId))
+	if header.Compression != nil {
+		writeOptional("cm", canonicalJSON(header.Compression))
+	}
+	if len(header.Chunks) > 0 {
+		writeOptional("ck", canonicalJSON(header.Chunks))
+	}
+	if header.Delta != nil {
+		writeOptional("dt", canonicalJSON(header.Delta))
+	}
+	if header.BodyId != 0 {
+		writeOptional("bi", binary.BigEndian.AppendUint64(nil, header.BodyId))
+	}
+	return hash.Sum(nil)
+}
+
+// bodyIdOf returns the id of the body of the file in the store, which is the FileId unless the version reuses the
+// body of another version
+func bodyIdOf(header Header) uint64 {
+	if header.BodyId != 0 {
+		return header.BodyId
+	}
+	return header.FileId
+}
+
+// signHeader sets the signature of the header. The creator of the header must be the signing identity.
+func signHeader(identity security.Identity, header *Header) error {
+	if header.Creator != identity.Id {
+		return fmt.Errorf("cannot sign header %s: creator %s is not the current user", header.Name, header.Creator)
+	}
+	signature, err := security.Sign(identity, hashOfHeader(*header))
+	if err != nil {
+		return err
+	}
+	header.Signature = signature
+	return nil
+}
+
+// verifyHeader checks that the header has been signed by its creator and that the creator had write permission, according
+// to the permissions replayed from the change logs, both when the header was created and when the headers file was
+// written to the store. The creator chooses the modification time of the header but not the time of the store, so
+// a suspended user cannot pass a backdated header.
+func verifyHeader(header Header, history PermissionHistory, written time.Time) error {
+	if len(header.Signature) == 0 || !security.Verify(header.Creator, hashOfHeader(header), header.Signature) {
+		return ErrInvalidSignature
+	}
+	for _, t := range []time.Time{header.ModTime, written} {
+		if permission := history.At(header.Creator, t); !canWrite(permission) {
+			return fmt.Errorf("%w: creator %s had permission %d at %v", ErrNoWritePermission, header.Creator,
+				permission, t)
+		}
+	}
+	return nil
+}
+
 func getDiffHillmanKey(currentUser security.Identity, header Header) ([]byte, error) {
 	if header.PrivateId == currentUser.Id {
 		secondaryKey, err := security.DiffieHellmanKey(currentUser, header.Creator)
@@ -326,8 +539,9 @@ type CompactHeader struct {
 }
 
 func compactHeaders(s *Safe, newKey bool) error {
-	ls, err := s.PrimaryStore.ReadDir(path.Join(s.Name, DataFolder), storage.Filter{})
-	if core.IsErr(err, nil, "cannot read dir %s/%s: %v", s.PrimaryStore, s.Name, err) {
+	store := getPrimaryStore(s)
+	ls, err := store.ReadDir(path.Join(s.Name, DataFolder), storage.Filter{})
+	if core.IsErr(err, nil, "cannot read dir %s/%s: %v", store, s.Name, err) {
 		return err
 	}
 
@@ -349,7 +563,7 @@ func compactHeadersInBucket(s *Safe, buckerDir string, newKey bool) {
 	defer s.compactHeadersWg.Done()
 
 	folder := path.Join(s.Name, DataFolder, buckerDir, HeaderFolder)
-	store := s.PrimaryStore
+	store := getPrimaryStore(s)
 	ls, err := store.ReadDir(folder, storage.Filter{})
 	if core.IsErr(err, nil, "cannot read dir %s/%s: %v", store, folder, err) {
 		return
@@ -365,13 +579,7 @@ func compactHeadersInBucket(s *Safe, buckerDir string, newKey bool) {
 		return
 	}
 
-	stat, err := store.Stat(path.Join(folder, ".merging"))
-	if err == nil && core.Since(stat.ModTime()) < time.Hour {
-		return
-	}
-
-	err = store.Write(path.Join(folder, ".merging"), core.NewBytesReader(nil), nil)
-	if core.IsErr(err, nil, "cannot write merging guard: %v", err) {
+	if !acquireMergingGuard(s, store, path.Join(folder, ".merging")) {
 		return
 	}
 
@@ -395,9 +603,77 @@ func compactHeadersInBucket(s *Safe, buckerDir string, newKey bool) {
 	core.IsErr(err, nil, "cannot delete merging guard: %v", err)
 }
 
+// acquireMergingGuard creates the guard that prevents concurrent merges of the same folder. The guard is written only
+// if absent so that two peers cannot both acquire it; a guard older than an hour is taken over only if nobody else
+// has replaced it in the meantime.
+func acquireMergingGuard(s *Safe, store storage.Store, guard string) bool {
+	owner := []byte(s.CurrentUser.Id)
+	err := storage.WriteFileIf(store, guard, owner, storage.Condition{IfAbsent: true})
+	if err == nil {
+		return true
+	}
+	if err != storage.ErrConditionFailed {
+		core.IsErr(err, nil, "cannot write merging guard: %v", err)
+		return false
+	}
+
+	stat, err := store.Stat(guard)
+	if err != nil || core.Since(stat.ModTime()) < time.Hour {
+		return false
+	}
+	etag, err := storage.ETag(store, guard)
+	if err != nil {
+		return false
+	}
+	err = storage.WriteFileIf(store, guard, owner, storage.Condition{IfMatch: etag})
+	if err == storage.ErrConditionFailed {
+		return false
+	}
+	if core.IsErr(err, nil, "cannot take over stale merging guard: %v", err) {
+		return false
+	}
+	core.Info("took over stale merging guard %s/%s", store, guard)
+	return true
+}
+
+// addToMerge adds headers to the latest headers and tombstones by file id
+func addToMerge(headersMap, tombstonesMap map[uint64]Header, headers []Header) {
+	for _, header := range headers {
+		m := headersMap
+		if header.Deleted {
+			m = tombstonesMap
+		}
+		h, found := m[header.FileId]
+		if !found || h.ModTime.Before(header.ModTime) {
+			m[header.FileId] = header
+		}
+	}
+}
+
+// mergedHeaders returns the content of a merged headers file. Tombstones that can be collected from the stores of all
+// the replicas are removed together with the header they delete.
+func mergedHeaders(s *Safe, stores []storage.Store, bucket string,
+	headersMap, tombstonesMap map[uint64]Header) []Header {
+	var headers []Header
+	for fileId, tombstone := range tombstonesMap {
+		if isTombstoneCollectable(s, stores, bucket, tombstone) {
+			core.Info("Removed tombstone of %s[%d] from the merge", tombstone.Name, tombstone.FileId)
+			delete(headersMap, fileId)
+			continue
+		}
+		headers = append(headers, tombstone)
+	}
+	for _, header := range headersMap {
+		headers = append(headers, header)
+	}
+	return headers
+}
+
 func mergeHeadersFiles(s *Safe, folder string, files []string, wg *sync.WaitGroup) {
 	headersMap := map[uint64]Header{}
-	store := s.PrimaryStore
+	// tombstones are kept next to the header they delete, so that peers can verify that the deletion was allowed
+	tombstonesMap := map[uint64]Header{}
+	store := getPrimaryStore(s)
 	safeName := s.Name
 
 	var bucket string
@@ -412,12 +688,7 @@ func mergeHeadersFiles(s *Safe, folder string, files []string, wg *sync.WaitGrou
 		if bucket == "" {
 			continue
 		}
-		for _, header := range headerId.Headers {
-			h, found := headersMap[header.FileId]
-			if !found || h.ModTime.Before(header.ModTime) {
-				headersMap[header.FileId] = header
-			}
-		}
+		addToMerge(headersMap, tombstonesMap, headerId.Headers)
 		filesToDelete = append(filesToDelete, filepath)
 		core.Info("Added header file %s/%s to the merge", store, filepath)
 	}
@@ -429,34 +700,29 @@ func mergeHeadersFiles(s *Safe, folder string, files []string, wg *sync.WaitGrou
 	headerId := snowflake.ID()
 	filepath := path.Join(folder, fmt.Sprintf("%d", headerId))
 
-	var headers []Header
-	for _, header := range headersMap {
-		headers = append(headers, header)
+	replicas, err := openReplicas(s)
+	if core.IsErr(err, nil, "cannot open replicas of %s: %v", s.Name) {
+		return
 	}
-
+	headers := mergedHeaders(s, replicaStores(s, replicas), bucket, headersMap, tombstonesMap)
+	closeReplicas(replicas)
 	headersFile := HeadersFile{
 		KeyId:   s.Keystore.LastKeyId,
 		Bucket:  bucket,
 		Headers: headers,
 	}
-	err := writeHeadersFile(store, safeName, filepath, s.Keystore.Keys[s.Keystore.LastKeyId], headersFile)
+	err = writeHeadersFile(store, safeName, filepath, s.Keystore.Keys[s.Keystore.LastKeyId], headersFile)
 	if core.IsErr(err, nil, "cannot write headers: %v", err) {
 		return
 	}
 	core.Info("Wrote merged headers to %s/%s", store, filepath)
 
-	for _, header := range headersMap {
-		res, err := sql.Exec("UPDATE_HEADER_FILE", sql.Args{
-			"safe":     safeName,
-			"bucket":   bucket,
-			"fileId":   header.FileId,
-			"headerId": headerId,
-		})
-		if core.IsErr(err, nil, "cannot update header file: %v", err) {
-			return
+	for _, m := range []map[uint64]Header{headersMap, tombstonesMap} {
+		for _, header := range m {
+			if updateHeaderFileInDB(safeName, bucket, header, headerId) != nil {
+				return
+			}
 		}
-		cnt, _ := res.RowsAffected()
-		core.Info("Updated header file for %s/%s %d", store, header.Name, cnt)
 	}
 
 	for _, fileToDelete := range filesToDelete {
@@ -1,12 +1,22 @@
 package safe
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
 	"testing"
 	"time"
 
+	"github.com/godruoyi/go-snowflake"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
 )
 
 // Header and encryptionKeys are as before...
@@ -26,7 +36,7 @@ func TestEncryptAndDecryptHeader(t *testing.T) {
 
 	keyId := uint64(1234567890)
 	keyValue := core.GenerateRandomBytes(KeySize)
-	headersFile := HeadersFile{keyId, "bucket", []Header{originalHeader}}
+	headersFile := HeadersFile{KeyId: keyId, Bucket: "bucket", Headers: []Header{originalHeader}}
 	ciphertext, err := marshalHeadersFile(headersFile, keyValue)
 	assert.NoError(t, err, "encryptHeader failed")
 
@@ -48,3 +58,183 @@ func TestEncryptAndDecryptHeader(t *testing.T) {
 	// we can compare it byte-by-byte instead of converting to a string.
 	assert.EqualValues(t, originalHeader.Attributes.Thumbnail, decryptedHeader.Attributes.Thumbnail, "Thumbnail does not match original")
 }
+
+func TestLegacyAndTamperedHeadersFile(t *testing.T) {
+	keyId := uint64(1234567890)
+	keyValue := core.GenerateRandomBytes(KeySize)
+	keys := map[uint64][]byte{keyId: keyValue}
+	headersFile := HeadersFile{KeyId: keyId, Bucket: "bucket", Headers: []Header{{Name: "file", Size: 1024}}}
+
+	data, err := json.Marshal(headersFile)
+	core.TestErr(t, err, "cannot marshal headers: %v")
+	block, err := aes.NewCipher(keyValue)
+	core.TestErr(t, err, "cannot create cipher: %v")
+	legacy := make([]byte, 8+aes.BlockSize+len(data))
+	binary.BigEndian.PutUint64(legacy[:8], keyId)
+	copy(legacy[8:8+aes.BlockSize], core.GenerateRandomBytes(aes.BlockSize))
+	cipher.NewCFBEncrypter(block, legacy[8:8+aes.BlockSize]).XORKeyStream(legacy[8+aes.BlockSize:], data)
+
+	headersFile, err = unmarshalHeadersFile(legacy, keys)
+	core.TestErr(t, err, "cannot read legacy headers: %v")
+	core.Assert(t, headersFile.KeyId == keyId, "Expected key id %d, got %d", keyId, headersFile.KeyId)
+	core.Assert(t, headersFile.Headers[0].Name == "file", "Expected name file, got %s", headersFile.Headers[0].Name)
+
+	ciphertext, err := marshalHeadersFile(headersFile, keyValue)
+	core.TestErr(t, err, "cannot marshal headers: %v")
+	ciphertext[len(ciphertext)-1] ^= 1
+	_, err = unmarshalHeadersFile(ciphertext, keys)
+	core.Assert(t, err == ErrInvalidHeaders, "Expected ErrInvalidHeaders, got %v", err)
+}
+
+func TestSignedHeaders(t *testing.T) {
+	InitTest()
+
+	keyId := uint64(1234567890)
+	keyValue := core.GenerateRandomBytes(KeySize)
+	// numbers and structs in Meta do not survive a JSON round trip as they are
+	meta := map[string]any{"n": 1, "large": uint64(1<<60 + 1), "struct": struct{ B, A int }{2, 1}}
+	header := Header{
+		Name:       "file",
+		Creator:    Identity1.Id,
+		Size:       1024,
+		ModTime:    core.Now(),
+		FileId:     42,
+		IV:         core.GenerateRandomBytes(aes.BlockSize),
+		BodyKey:    core.GenerateRandomBytes(KeySize),
+		Attributes: Attributes{ContentType: "text/plain", Meta: meta},
+	}
+	err := signHeader(Identity1, &header)
+	core.TestErr(t, err, "cannot sign header: %v")
+
+	ciphertext, err := marshalHeadersFile(HeadersFile{KeyId: keyId, Bucket: "bucket", Headers: []Header{header}}, keyValue)
+	core.TestErr(t, err, "cannot marshal headers: %v")
+	headersFile, err := unmarshalHeadersFile(ciphertext, map[uint64][]byte{keyId: keyValue})
+	core.TestErr(t, err, "cannot unmarshal headers: %v")
+	history := PermissionHistory{}
+	history.add(Users{Identity1.Id: Standard}, time.Time{})
+	err = verifyHeader(headersFile.Headers[0], history, header.ModTime)
+	core.TestErr(t, err, "expected valid signature after round trip: %v")
+
+	tampered := header
+	tampered.Size = 2048
+	core.Assert(t, verifyHeader(tampered, history, header.ModTime) == ErrInvalidSignature, "Expected tampered header to fail")
+
+	forged := header
+	forged.Signature = nil
+	core.Assert(t, verifyHeader(forged, history, header.ModTime) == ErrInvalidSignature, "Expected unsigned header to fail")
+	core.Assert(t, signHeader(Identity2, &forged) != nil, "Expected signing on behalf of another user to fail")
+
+	core.Assert(t, errors.Is(verifyHeader(header, PermissionHistory{}, header.ModTime), ErrNoWritePermission),
+		"Expected header of unknown user to fail")
+	history.add(Users{Identity1.Id: Suspended}, header.ModTime.Add(time.Hour))
+	core.TestErr(t, verifyHeader(header, history, header.ModTime), "expected header before suspension to be valid: %v")
+	core.Assert(t, errors.Is(verifyHeader(header, history, header.ModTime.Add(2*time.Hour)), ErrNoWritePermission),
+		"Expected header written after suspension to fail")
+	history.add(Users{Identity1.Id: Suspended}, header.ModTime.Add(-time.Hour))
+	sort.SliceStable(history[Identity1.Id], func(i, j int) bool {
+		return history[Identity1.Id][i].Since.Before(history[Identity1.Id][j].Since)
+	})
+	core.Assert(t, verifyHeader(header, history, header.ModTime) != nil, "Expected header of suspended user to fail")
+}
+
+func TestRejectForgedHeadersOnSync(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	good, err := Put(s, "bucket", "good", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	stored, _, err := getLastHeader(s.Name, "bucket", "good", 0)
+	core.TestErr(t, err, "cannot get header: %v")
+	core.Assert(t, len(stored.Signature) > 0, "Expected the header in the DB to be signed")
+
+	unsigned := good
+	unsigned.Name = "unsigned"
+	unsigned.Creator = Identity2.Id
+	unsigned.Signature = nil
+	tampered := good
+	tampered.Name = "tampered"
+	signed := good
+	signed.Name = "signed"
+	signed.FileId = snowflake.ID()
+	err = signHeader(Identity1, &signed)
+	core.TestErr(t, err, "cannot sign header: %v")
+
+	for _, header := range []Header{unsigned, tampered, signed} {
+		filePath := path.Join(s.Name, DataFolder, hashPath("bucket"), HeaderFolder, fmt.Sprintf("%d", snowflake.ID()))
+		err = writeHeadersFile(s.PrimaryStore, s.Name, filePath, s.Keystore.Keys[s.Keystore.LastKeyId],
+			HeadersFile{Bucket: "bucket", KeyId: s.Keystore.LastKeyId, Headers: []Header{header}})
+		core.TestErr(t, err, "cannot write headers file: %v")
+	}
+	err = sql.DelConfigs(fmt.Sprintf("safe:cache:%s", s.Name))
+	core.TestErr(t, err, "cannot reset touch info: %v")
+
+	changes, err := SyncBucket(s, "bucket", SyncOptions{}, nil)
+	core.TestErr(t, err, "cannot sync bucket: %v")
+	core.Assert(t, changes == 1, "Expected 1 change, got %d", changes)
+
+	files, err := ListFiles(s, "bucket", ListOptions{OrderBy: "name"})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(files) == 2, "Expected 2 files, got %d", len(files))
+	core.Assert(t, files[0].Name == "good" && files[1].Name == "signed", "Expected only signed headers")
+
+	quarantined, err := ListQuarantine(s, "bucket")
+	core.TestErr(t, err, "cannot list quarantine: %v")
+	core.Assert(t, len(quarantined) == 2, "Expected 2 quarantined headers, got %d", len(quarantined))
+	for _, q := range quarantined {
+		core.Assert(t, q.Header.Name == "unsigned" || q.Header.Name == "tampered", "Unexpected quarantined header %s",
+			q.Header.Name)
+		core.Assert(t, q.Reason != "", "Expected a reason for %s", q.Header.Name)
+	}
+
+	s.Permission = Reader
+	_, err = Put(s, "bucket", "reader", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.Assert(t, err == ErrNoWritePermission, "Expected ErrNoWritePermission, got %v", err)
+	_, err = Patch(s, "bucket", good, PatchOptions{})
+	core.Assert(t, err == ErrNoWritePermission, "Expected ErrNoWritePermission, got %v", err)
+}
+
+func TestReleaseQuarantineOnUsersSync(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	err = SetUsers(s, map[string]Permission{Identity2.Id: Standard}, SetUsersOptions{})
+	core.TestErr(t, err, "cannot set users: %v")
+	// the replica has not read the grant yet
+	delete(s.history, Identity2.Id)
+
+	header := Header{Name: "granted", Creator: Identity2.Id, ModTime: core.Now(), FileId: snowflake.ID()}
+	err = signHeader(Identity2, &header)
+	core.TestErr(t, err, "cannot sign header: %v")
+	filePath := path.Join(s.Name, DataFolder, hashPath("bucket"), HeaderFolder, fmt.Sprintf("%d", snowflake.ID()))
+	err = writeHeadersFile(s.PrimaryStore, s.Name, filePath, s.Keystore.Keys[s.Keystore.LastKeyId],
+		HeadersFile{Bucket: "bucket", KeyId: s.Keystore.LastKeyId, Headers: []Header{header}})
+	core.TestErr(t, err, "cannot write headers file: %v")
+
+	changes, err := SyncBucket(s, "bucket", SyncOptions{}, nil)
+	core.TestErr(t, err, "cannot sync bucket: %v")
+	core.Assert(t, changes == 0, "Expected no change, got %d", changes)
+	quarantined, err := ListQuarantine(s, "bucket")
+	core.TestErr(t, err, "cannot list quarantine: %v")
+	core.Assert(t, len(quarantined) == 1, "Expected 1 quarantined header, got %d", len(quarantined))
+
+	_, err = syncSafeUsers(s, true)
+	core.TestErr(t, err, "cannot sync users: %v")
+	quarantined, err = ListQuarantine(s, "bucket")
+	core.TestErr(t, err, "cannot list quarantine: %v")
+	core.Assert(t, len(quarantined) == 0, "Expected the header released, got %v", quarantined)
+	files, err := ListFiles(s, "bucket", ListOptions{})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(files) == 1 && files[0].Name == "granted", "Expected the released header, got %v", files)
+}
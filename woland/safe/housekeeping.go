@@ -22,11 +22,12 @@ type cleanupCandidates struct {
 
 func enforceQuota(s *Safe) {
 	var stores []storage.Store
-	if s.PrimaryStore != nil {
-		stores = append(stores, s.PrimaryStore)
+	primary, secondary := getStores(s)
+	if primary != nil {
+		stores = append(stores, primary)
 	}
-	if s.SecondaryStore != nil && s.SecondaryStore != s.PrimaryStore {
-		stores = append(stores, s.SecondaryStore)
+	if secondary != nil && secondary != primary {
+		stores = append(stores, secondary)
 	}
 
 	for _, store := range stores {
@@ -92,7 +93,7 @@ func enforceQuotaOnStore(safeName string, store storage.Store, primary bool, lim
 		totalSize -= oldest.size
 
 		if primary {
-			_, err := sql.Exec("SET_DELETED_FILE", sql.Args{"safe": safeName, "fileId": oldest.fileId})
+			_, err := sql.Exec("SET_DELETED_BODY", sql.Args{"safe": safeName, "bodyId": oldest.fileId})
 			if !core.IsErr(err, nil, "cannot set deleted file: %v", err) {
 				core.Info("set header for %d deleted for %s", oldest.fileId, safeName)
 			}
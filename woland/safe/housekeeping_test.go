@@ -12,7 +12,9 @@ func TestHousekeeping(t *testing.T) {
 	InitTest()
 	StartTestDB(t, dbPath)
 
+	quota := testStoreConfig.Quota
 	testStoreConfig.Quota = 1000
+	defer func() { testStoreConfig.Quota = quota }()
 	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
 	core.Assert(t, err == nil, "Cannot create safe: %v", err)
 
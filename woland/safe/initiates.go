@@ -17,7 +17,7 @@ type Initiate struct {
 }
 
 func GetInitiates(s *Safe) ([]Initiate, error) {
-	store := s.PrimaryStore
+	store := getPrimaryStore(s)
 	ls, err := store.ReadDir(path.Join(s.Name, InitiateFolder), storage.Filter{})
 	if os.IsNotExist(err) {
 		return nil, nil
@@ -116,6 +116,10 @@ func writeKeyStoreFile(s storage.Store, safeName string, currentUser security.Id
 	}
 
 	name := fmt.Sprintf("%d.keystore", snowflake.ID())
+	err = claimConfigWrite(s, safeName, name)
+	if core.IsErr(err, nil, "cannot write keystore: %v", err) {
+		return err
+	}
 	err = storage.WriteFile(s, path.Join(safeName, ConfigFolder, name), data)
 	if core.IsErr(err, nil, "cannot write keystore: %v", err) {
 		return err
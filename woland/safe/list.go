@@ -110,7 +110,8 @@ func ListFiles(s *Safe, bucket string, listOptions ListOptions) ([]Header, error
 	var headers []Header
 	for rows.Next() {
 		var data []byte
-		if core.IsErr(rows.Scan(&data), nil, "cannot scan file: %v", err) {
+		var tombstoned bool
+		if core.IsErr(rows.Scan(&data, &tombstoned), nil, "cannot scan file: %v", err) {
 			continue
 		}
 		var header Header
@@ -118,13 +119,16 @@ func ListFiles(s *Safe, bucket string, listOptions ListOptions) ([]Header, error
 		if core.IsErr(err, nil, "cannot unmarshal header: %v", err) {
 			continue
 		}
+		header.Deleted = header.Deleted || tombstoned
 
 		headers = append(headers, header)
 		core.Info("found header %s, %v, %d", header.Name, header.ModTime, header.FileId)
 	}
 	rows.Close()
 
-	if listOptions.Prefetch {
+	if listOptions.Prefetch && (isOverBudget(s) || isMetered(s)) {
+		core.Info("safe %s is over budget or on a metered network, prefetch of %s skipped", s.Name, bucket)
+	} else if listOptions.Prefetch {
 		go func() {
 			for _, header := range headers {
 				if header.Cached != "" {
@@ -15,9 +15,9 @@ type Manifest struct {
 }
 
 func syncManifest(s *Safe) error {
-	synced, _ := GetCached(s.Name, s.PrimaryStore, "config/.manifest.touch", nil, "")
+	synced, _ := GetCached(s.Name, getPrimaryStore(s), "config/.manifest.touch", nil, "")
 	if !synced {
-		manifest, err := readManifest(s.Name, s.PrimaryStore, s.CreatorId)
+		manifest, err := readManifest(s.Name, getPrimaryStore(s), s.CreatorId)
 		if core.IsErr(err, nil, "cannot read manifest from store %s: %v", err) {
 			return err
 		}
@@ -26,6 +26,7 @@ func syncManifest(s *Safe) error {
 			Description: manifest.Description,
 			Keystore:    s.Keystore,
 			Users:       s.Users,
+			History:     s.history,
 		})
 		if core.IsErr(err, nil, "cannot set safe config to DB: %v") {
 			return err
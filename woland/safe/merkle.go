@@ -0,0 +1,166 @@
+package safe
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/stregato/master/woland/algo"
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/storage"
+)
+
+var MerkleSplitBits uint = 16         // The average size of a leaf of the Merkle tree is 2^MerkleSplitBits bytes
+var MinMerkleSize int64 = 1024 * 1024 // Files smaller than MinMerkleSize have no Merkle tree
+
+var ErrTamperedBody = fmt.Errorf("body does not match the merkle root in the header")
+
+// merkleHash returns the hash function of the Merkle tree of the file. The hash is keyed with the body key so that the
+// tree does not reveal the content.
+func merkleHash(header Header) hash.Hash {
+	h, _ := blake2b.New256(header.BodyKey)
+	return h
+}
+
+// writeMerkleTree computes the Merkle tree of the content, writes it to the store and sets its root in the
+// attributes of the header.
+func writeMerkleTree(s *Safe, store storage.Store, bucket string, r io.ReadSeeker, header *Header) error {
+	_, err := r.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		return err
+	}
+	tree, err := algo.MerkleTreeFromReader(r, MerkleSplitBits, merkleHash(*header))
+	if core.IsErr(err, nil, "cannot build merkle tree: %v", err) {
+		return err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	if core.IsErr(err, nil, "cannot seek to start of file: %v", err) {
+		return err
+	}
+
+	name := path.Join(s.Name, DataFolder, hashPath(bucket), MerkleFolder, fmt.Sprintf("%d", header.FileId))
+	err = storage.WriteFile(store, name, algo.MerkleTreeMarshal(tree))
+	if core.IsErr(err, nil, "cannot write merkle tree %s: %v", name) {
+		return err
+	}
+	header.Attributes.MerkleRoot = *algo.MerkleTreeHash(tree)
+	core.Info("wrote merkle tree with %d leaves for %s", tree.Leaves, header.Name)
+	return nil
+}
+
+// readMerkleTree reads the Merkle tree of the file. The tree is not trusted: each block is verified with an inclusion
+// proof against the root in the signed header.
+func readMerkleTree(s *Safe, bucket string, header Header) (algo.MerkleTree, error) {
+	name := path.Join(s.Name, DataFolder, hashPath(bucket), MerkleFolder, fmt.Sprintf("%d", bodyIdOf(header)))
+	primary, secondary := getStores(s)
+	data, err := storage.ReadFile(secondary, name)
+	if err != nil && secondary != primary {
+		data, err = storage.ReadFile(primary, name)
+	}
+	if core.IsErr(err, nil, "cannot read merkle tree %s: %v", name) {
+		return algo.MerkleTree{}, err
+	}
+	tree, err := algo.MerkleTreeUnmarshal(data)
+	if core.IsErr(err, nil, "cannot decode merkle tree %s: %v", name) {
+		return algo.MerkleTree{}, err
+	}
+	return tree, nil
+}
+
+// merkleWriter verifies each leaf of the Merkle tree before writing the requested range to the output writer
+type merkleWriter struct {
+	w       io.Writer
+	tree    algo.MerkleTree
+	root    []byte
+	hashFun hash.Hash
+	leaf    int    // Index of the leaf being received
+	last    int    // Index of the last leaf to receive
+	buf     []byte // Bytes of the current leaf
+	skip    int64  // Bytes to skip before writing
+	limit   int64  // Bytes to write
+}
+
+// newMerkleWriter returns a writer that verifies the leaves that contain the range and the range of the body to
+// read, extended to the boundaries of the leaves.
+func newMerkleWriter(w io.Writer, tree algo.MerkleTree, header Header, rang *storage.Range) (*merkleWriter,
+	*storage.Range) {
+	from, to := clampRange(header, rang)
+	first, start := algo.MerkleTreeAt(tree, from)
+	last, end := first, start
+	if to > from {
+		last, end = algo.MerkleTreeAt(tree, to-1)
+	}
+	end += tree.Blocks[last].Length
+
+	mw := &merkleWriter{
+		w:       w,
+		tree:    tree,
+		root:    header.Attributes.MerkleRoot,
+		hashFun: merkleHash(header),
+		leaf:    first,
+		last:    last,
+		skip:    from - start,
+		limit:   to - from,
+	}
+	return mw, &storage.Range{From: start, To: end}
+}
+
+func (mw *merkleWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 && mw.leaf <= mw.last {
+		block := mw.tree.Blocks[mw.leaf]
+		need := int(block.Length) - len(mw.buf)
+		if need > len(p) {
+			need = len(p)
+		}
+		mw.buf = append(mw.buf, p[:need]...)
+		p = p[need:]
+		if len(mw.buf) < int(block.Length) {
+			break
+		}
+
+		err := mw.verifyLeaf(block)
+		if err != nil {
+			return 0, err
+		}
+		mw.leaf++
+		mw.buf = mw.buf[:0]
+	}
+	return n, nil
+}
+
+func (mw *merkleWriter) verifyLeaf(block algo.HashBlock) error {
+	mw.hashFun.Reset()
+	mw.hashFun.Write(mw.buf)
+	if !bytes.Equal(mw.hashFun.Sum(nil), block.Hash) {
+		return fmt.Errorf("%w: leaf %d has a different hash", ErrTamperedBody, mw.leaf)
+	}
+	proof := algo.MerkleTreeProof(mw.tree, mw.leaf)
+	if !algo.VerifyMerkleProof(mw.root, block.Hash, mw.leaf, mw.tree.Leaves, proof, mw.hashFun) {
+		return fmt.Errorf("%w: invalid proof for leaf %d", ErrTamperedBody, mw.leaf)
+	}
+
+	data := mw.buf
+	skip := min64(mw.skip, int64(len(data)))
+	data = data[skip:]
+	mw.skip -= skip
+	data = data[:min64(mw.limit, int64(len(data)))]
+	mw.limit -= int64(len(data))
+	if len(data) == 0 {
+		return nil
+	}
+	_, err := mw.w.Write(data)
+	return err
+}
+
+// Close returns an error if some leaves of the range have not been received
+func (mw *merkleWriter) Close() error {
+	if mw.leaf <= mw.last {
+		return fmt.Errorf("%w: missing leaves %d-%d", ErrTamperedBody, mw.leaf, mw.last)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package safe
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path"
+	"testing"
+
+	"github.com/stregato/master/woland/algo"
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestMerkleRange(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	splitBits, minSize := MerkleSplitBits, MinMerkleSize
+	MerkleSplitBits, MinMerkleSize = 10, 0
+	defer func() { MerkleSplitBits, MinMerkleSize = splitBits, minSize }()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	data := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	h, err := Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	core.Assert(t, len(h.Attributes.MerkleRoot) > 0, "Expected merkle root in attributes")
+
+	for _, r := range []storage.Range{{From: 0, To: 10}, {From: 5000, To: 40000}, {From: 60000, To: 0}} {
+		b := bytes.Buffer{}
+		_, err = Get(s, "bucket", "file", &b, GetOptions{Range: &r})
+		core.TestErr(t, err, "cannot get range: %v")
+		to := r.To
+		if to == 0 {
+			to = int64(len(data))
+		}
+		core.Assert(t, bytes.Equal(b.Bytes(), data[r.From:to]), "Unexpected range %d-%d", r.From, r.To)
+	}
+
+	// tamper the tree in the store
+	treeFile := path.Join(s.Name, DataFolder, hashPath("bucket"), MerkleFolder, fmt.Sprintf("%d", h.FileId))
+	tree, err := readMerkleTree(s, "bucket", h)
+	core.TestErr(t, err, "cannot read merkle tree: %v")
+	tree.Blocks[1].Hash[0] ^= 0xff
+	err = storage.WriteFile(s.PrimaryStore, treeFile, algo.MerkleTreeMarshal(tree))
+	core.TestErr(t, err, "cannot write merkle tree: %v")
+
+	b := bytes.Buffer{}
+	_, err = Get(s, "bucket", "file", &b, GetOptions{Range: &storage.Range{From: 0, To: 5000}})
+	core.Assert(t, errors.Is(err, ErrTamperedBody), "Expected ErrTamperedBody, got %v", err)
+}
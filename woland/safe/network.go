@@ -0,0 +1,90 @@
+package safe
+
+import (
+	"sync/atomic"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/storage"
+)
+
+// NetworkPolicy limits the traffic of a safe, or of all the safes when set globally
+type NetworkPolicy struct {
+	UploadRate   int64 `json:"uploadRate"`   // Maximum upload in bytes per second, 0 for no limit
+	DownloadRate int64 `json:"downloadRate"` // Maximum download in bytes per second, 0 for no limit
+	Metered      bool  `json:"metered"`      // Pause prefetch, replication, compaction and background uploads
+}
+
+var globalUpload = storage.NewRateLimiter(0, nil)   // Limit on the uploads of all the safes
+var globalDownload = storage.NewRateLimiter(0, nil) // Limit on the downloads of all the safes
+var globalMetered atomic.Bool                       // Metered mode for all the safes
+
+// SetGlobalNetworkPolicy sets the limits shared by all the safes. The limits of each safe apply in addition.
+func SetGlobalNetworkPolicy(p NetworkPolicy) {
+	globalUpload.SetRate(p.UploadRate)
+	globalDownload.SetRate(p.DownloadRate)
+	globalMetered.Store(p.Metered)
+	core.Info("set global network policy: upload %d B/s, download %d B/s, metered %t", p.UploadRate,
+		p.DownloadRate, p.Metered)
+}
+
+// GetGlobalNetworkPolicy returns the limits shared by all the safes
+func GetGlobalNetworkPolicy() NetworkPolicy {
+	return NetworkPolicy{
+		UploadRate:   globalUpload.Rate(),
+		DownloadRate: globalDownload.Rate(),
+		Metered:      globalMetered.Load(),
+	}
+}
+
+// limiters returns the upload and download limiters of the safe, which are created on first use. It must be called
+// with storeLock held.
+func limiters(s *Safe) (upload, download *storage.RateLimiter) {
+	if s.uploadLimiter == nil {
+		s.uploadLimiter = storage.NewRateLimiter(0, globalUpload)
+		s.downloadLimiter = storage.NewRateLimiter(0, globalDownload)
+	}
+	return s.uploadLimiter, s.downloadLimiter
+}
+
+// SetNetworkPolicy sets the limits of the safe. They take effect immediately, also on transfers in progress.
+func SetNetworkPolicy(s *Safe, p NetworkPolicy) {
+	s.storeLock.Lock()
+	upload, download := limiters(s)
+	s.metered = p.Metered
+	s.storeLock.Unlock()
+
+	upload.SetRate(p.UploadRate)
+	download.SetRate(p.DownloadRate)
+	core.Info("set network policy of %s: upload %d B/s, download %d B/s, metered %t", s.Name, p.UploadRate,
+		p.DownloadRate, p.Metered)
+}
+
+// GetNetworkPolicy returns the limits of the safe
+func GetNetworkPolicy(s *Safe) NetworkPolicy {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	upload, download := limiters(s)
+	return NetworkPolicy{
+		UploadRate:   upload.Rate(),
+		DownloadRate: download.Rate(),
+		Metered:      s.metered,
+	}
+}
+
+// throttleStore wraps the store so that its traffic goes through the limiters of the safe
+func throttleStore(s *Safe, store storage.Store) storage.Store {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	upload, download := limiters(s)
+	return storage.Throttled(store, upload, download)
+}
+
+// isMetered returns true when the non urgent background work of the safe must be paused and only the headers are
+// synchronized
+func isMetered(s *Safe) bool {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	return s.metered || globalMetered.Load()
+}
@@ -0,0 +1,38 @@
+package safe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+func TestNetworkPolicy(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	SetNetworkPolicy(s, NetworkPolicy{UploadRate: 256 * 1024})
+	core.Assert(t, GetNetworkPolicy(s).UploadRate == 256*1024, "Unexpected policy %+v", GetNetworkPolicy(s))
+	data := core.GenerateRandomBytes(384 * 1024)
+	start := time.Now()
+	_, err = Put(s, "bucket", "file", core.NewBytesReader(data), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	core.Assert(t, time.Since(start) > 300*time.Millisecond, "Put not throttled: %v", time.Since(start))
+
+	SetNetworkPolicy(s, NetworkPolicy{Metered: true})
+	core.Assert(t, isMetered(s), "Expected metered mode")
+	SetNetworkPolicy(s, NetworkPolicy{})
+	core.Assert(t, !isMetered(s), "Expected metered mode to be off")
+
+	// the global policy applies to all the safes
+	SetGlobalNetworkPolicy(NetworkPolicy{Metered: true})
+	defer SetGlobalNetworkPolicy(NetworkPolicy{})
+	core.Assert(t, isMetered(s) && GetGlobalNetworkPolicy().Metered, "Expected global metered mode")
+}
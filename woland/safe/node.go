@@ -0,0 +1,104 @@
+package safe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/godruoyi/go-snowflake"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+// The node identifies the installation. Its machine id is part of the snowflake ids of the files and headers created
+// by the installation, so that two installations never create the same id. The machine id is derived from the id of
+// the node and stored in the DB. Since the machine id has only 10 bits, two nodes may still get the same one: when a
+// node finds headers of another node with its machine id, the node with the greater id moves to the next machine id.
+const (
+	nodeConfig = "node"
+	nodeKey    = "id"
+)
+
+var (
+	nodeLock      sync.Mutex
+	nodeId        string // Id of the installation, written in the headers files
+	nodeMachineId uint16 // Machine id of the snowflake ids
+)
+
+// machineIdOf derives the machine id of the node in the given round. Round 0 is the first id of the node and each
+// collision moves the node to the next round.
+func machineIdOf(id string, round int) uint16 {
+	hash := blake2b.Sum256([]byte(fmt.Sprintf("%s:%d", id, round)))
+	return binary.BigEndian.Uint16(hash[:]) & snowflake.MaxMachineID
+}
+
+// nextMachineId returns the machine id of the round after the one of the current machine id
+func nextMachineId(id string, current uint16) uint16 {
+	round := 0
+	for round <= int(snowflake.MaxMachineID) && machineIdOf(id, round) != current {
+		round++
+	}
+	round++
+	for machineIdOf(id, round) == current {
+		round++
+	}
+	return machineIdOf(id, round)
+}
+
+// initNode loads the node of the installation from the DB or creates it on first use, and sets the machine id of the
+// snowflake ids
+func initNode() error {
+	nodeLock.Lock()
+	defer nodeLock.Unlock()
+
+	id, machineId, _, ok := sql.GetConfig(nodeConfig, nodeKey)
+	if !ok || id == "" {
+		id = uuid.New().String()
+		machineId = int64(machineIdOf(id, 0))
+		err := sql.SetConfig(nodeConfig, nodeKey, id, machineId, nil)
+		if core.IsErr(err, nil, "cannot save node id: %v") {
+			return err
+		}
+		core.Info("created node %s with machine id %d", id, machineId)
+	}
+	if id != nodeId || uint16(machineId) != nodeMachineId {
+		nodeId, nodeMachineId = id, uint16(machineId)
+		snowflake.SetMachineID(nodeMachineId)
+	}
+	return nil
+}
+
+// getNodeId returns the id of the installation, empty when the node is not initialized
+func getNodeId() string {
+	nodeLock.Lock()
+	defer nodeLock.Unlock()
+	return nodeId
+}
+
+// checkNodeCollision checks whether a headers file written by another installation has an id with the machine id of
+// this installation. In that case the ids of the two installations can collide and, if this installation has the
+// greater node id, it takes the next machine id. The other installation keeps its machine id.
+func checkNodeCollision(headerId uint64, writer string) {
+	nodeLock.Lock()
+	defer nodeLock.Unlock()
+
+	if writer == "" || nodeId == "" || writer >= nodeId {
+		return
+	}
+	if uint16(snowflake.ParseID(headerId).MachineID) != nodeMachineId {
+		return
+	}
+
+	machineId := nextMachineId(nodeId, nodeMachineId)
+	err := sql.SetConfig(nodeConfig, nodeKey, nodeId, int64(machineId), nil)
+	if core.IsErr(err, nil, "cannot save new machine id: %v") {
+		return
+	}
+	core.Info("node %s uses machine id %d as this node, switching to machine id %d", writer, nodeMachineId,
+		machineId)
+	nodeMachineId = machineId
+	snowflake.SetMachineID(machineId)
+}
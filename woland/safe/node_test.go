@@ -0,0 +1,85 @@
+package safe
+
+import (
+	"testing"
+
+	"github.com/godruoyi/go-snowflake"
+	"github.com/google/uuid"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+func TestNode(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	err := initNode()
+	core.TestErr(t, err, "cannot init node: %v")
+	id, machineId := getNodeId(), nodeMachineId
+	core.Assert(t, id != "", "empty node id")
+
+	err = initNode()
+	core.TestErr(t, err, "cannot init node: %v")
+	core.Assert(t, getNodeId() == id && nodeMachineId == machineId, "node changed after init")
+	core.Assert(t, uint16(snowflake.ParseID(snowflake.ID()).MachineID) == machineId, "machine id not used in ids")
+
+	core.Assert(t, machineId == machineIdOf(id, 0), "machine id not derived from the node id")
+}
+
+func TestNodeCollision(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	// find two nodes with the same machine id
+	ids := map[uint16]string{}
+	var first, second string
+	for first == "" {
+		id := uuid.New().String()
+		machineId := machineIdOf(id, 0)
+		if other, ok := ids[machineId]; ok {
+			first, second = id, other
+			if first > second {
+				first, second = second, first
+			}
+		}
+		ids[machineId] = id
+	}
+	machineId := machineIdOf(first, 0)
+
+	// the second node finds a header of the first node
+	err := sql.SetConfig(nodeConfig, nodeKey, second, int64(machineId), nil)
+	core.TestErr(t, err, "cannot set node: %v")
+	err = initNode()
+	core.TestErr(t, err, "cannot init node: %v")
+	headerId := snowflake.ID()
+
+	// headers from this installation or from old versions do not change the machine id
+	checkNodeCollision(headerId, second)
+	checkNodeCollision(headerId, "")
+	core.Assert(t, nodeMachineId == machineId, "machine id changed without collision")
+
+	checkNodeCollision(headerId, first)
+	core.Assert(t, nodeMachineId == nextMachineId(second, machineId) && nodeMachineId != machineId,
+		"machine id not changed on collision")
+	core.Assert(t, uint16(snowflake.ParseID(snowflake.ID()).MachineID) == nodeMachineId, "new machine id not used")
+	_, stored, _, ok := sql.GetConfig(nodeConfig, nodeKey)
+	core.Assert(t, ok && uint16(stored) == nodeMachineId, "new machine id not saved")
+	err = initNode()
+	core.TestErr(t, err, "cannot init node: %v")
+	core.Assert(t, getNodeId() == second, "node id changed after collision")
+	newHeaderId := snowflake.ID()
+
+	// the first node keeps its machine id after finding a header of the second node written before the collision
+	err = sql.SetConfig(nodeConfig, nodeKey, first, int64(machineId), nil)
+	core.TestErr(t, err, "cannot set node: %v")
+	err = initNode()
+	core.TestErr(t, err, "cannot init node: %v")
+	checkNodeCollision(headerId, second)
+	checkNodeCollision(newHeaderId, second)
+	core.Assert(t, nodeMachineId == machineId, "machine id of the first node changed")
+}
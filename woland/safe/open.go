@@ -3,6 +3,10 @@ package safe
 import (
 	"encoding/json"
 	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -30,6 +34,10 @@ type OpenOptions struct {
 
 	// OnConnected is called when the connection to the stores is established
 	OnConnected chan *Safe `json:"-"`
+
+	//StoreCacheTTL reuses the listings of the primary store for the given time and keeps the header files on disk.
+	//Changes by other users may be visible only after the TTL. Zero disables the cache
+	StoreCacheTTL time.Duration `json:"storeCacheTTL"`
 }
 
 func Open(currentUser security.Identity, name string, storeUrl string, creatorId string, options OpenOptions) (*Safe, error) {
@@ -37,6 +45,10 @@ func Open(currentUser security.Identity, name string, storeUrl string, creatorId
 	if core.IsErr(err, nil, "invalid name %s: %v", name) {
 		return nil, err
 	}
+	err = initNode()
+	if core.IsErr(err, nil, "cannot initialize node: %v") {
+		return nil, err
+	}
 
 	if options.ResetDB {
 		resetSafeInDB(name)
@@ -59,7 +71,9 @@ func Open(currentUser security.Identity, name string, storeUrl string, creatorId
 		Keystore:        safeConfig.Keystore,
 		Users:           safeConfig.Users,
 		Permission:      safeConfig.Users[currentUser.Id],
+		history:         safeConfig.History,
 		MinimalSyncTime: options.MinimalSyncTime,
+		storeCacheTTL:   options.StoreCacheTTL,
 
 		storeUrl:       storeUrl,
 		storeSizes:     map[string]int64{},
@@ -172,57 +186,127 @@ func connectStores(s *Safe) error {
 			return err
 		}
 
+		store = cacheStore(s, wrapStore(s, store))
+		s.storeLock.Lock()
 		s.PrimaryStore = store
 		s.SecondaryStore = store
+		s.storeLock.Unlock()
 		core.Info("connected to primary of %s for first time in %v", s.Name, core.Since(core.Now()))
 		return nil
 	}
 
-	ch := make(chan storage.Store, len(configs))
+	type connected struct {
+		store   storage.Store
+		primary bool
+	}
+	ch := make(chan connected, len(configs))
 	s.StoreConfigs = configs
 
 	now := core.Now()
 	for _, c := range s.StoreConfigs {
+		if c.Primary && s.primaryUrl == "" {
+			s.primaryUrl = c.Url
+		}
 		go func(c StoreConfig) {
 			store, err := storage.Open(c.Url)
 			if core.IsErr(err, nil, "cannot connect to store %s: %v", c.Url, err) {
-				ch <- nil
+				ch <- connected{}
 				return
 			}
+			store = wrapStore(s, store)
 			if c.Primary {
 				core.Info("connected to primary store %s of %s in %v", store, s.Name, core.Since(now))
-				s.PrimaryStore = store
 			} else {
 				core.Info("connected to secondary store %s of %s in %v", store, s.Name, core.Since(now))
 			}
-			ch <- store
+			ch <- connected{store, c.Primary}
 		}(c)
 	}
 
+	// the stores are published only when all are connected, since the safe may be already in use with AsyncConn
+	var primary, secondary storage.Store
 	for i := 0; i < len(configs); i++ {
-		store := <-ch
-		if store == nil {
+		c := <-ch
+		if c.store == nil {
 			continue
 		}
-		if s.PrimaryStore == store {
+		if c.primary {
 			core.Info("connected to primary %s in %v", s.Name, core.Since(now))
+			primary = c.store
 		}
-		if s.SecondaryStore == nil {
+		if secondary == nil {
 			core.Info("connected to secondary %s in %v", s.Name, core.Since(now))
-			s.SecondaryStore = store
-		} else {
-			store.Close()
+			secondary = c.store
+		} else if !c.primary {
+			c.store.Close()
 		}
 	}
-	if s.PrimaryStore == nil {
-		if s.SecondaryStore != nil {
-			s.SecondaryStore.Close()
+	failover := false
+	if primary == nil {
+		if secondary == nil {
+			return ErrNoStoreAvailable
 		}
-		return ErrNoStoreAvailable
+		if core.IsErr(probeStore(secondary, s.Name), nil, "cannot use replica %s of %s: %v", secondary, s.Name) {
+			secondary.Close()
+			return ErrNoStoreAvailable
+		}
+		// the primary is down: reads and writes go to a replica until the primary is back
+		primary = secondary
+		failover = true
+		core.Info("primary of %s is unreachable, using replica %s", s.Name, primary)
+	}
+
+	cached := cacheStore(s, primary)
+	if secondary == primary {
+		secondary = cached
 	}
+	s.storeLock.Lock()
+	s.PrimaryStore = cached
+	s.SecondaryStore = secondary
+	s.Failover = failover
+	s.storeLock.Unlock()
 	return nil
 }
 
+// wrapStore adds to the store the limits, the metering and the retries of the safe
+func wrapStore(s *Safe, store storage.Store) storage.Store {
+	return storage.Resilient(meterStore(s, throttleStore(s, store)), StoreRetryPolicy)
+}
+
+// cacheStore wraps the store in a cache of the listings and of the files that are never rewritten, when the safe is
+// opened with a StoreCacheTTL
+func cacheStore(s *Safe, store storage.Store) storage.Store {
+	if s.storeCacheTTL <= 0 || CacheFolder == "" {
+		return store
+	}
+	dir := filepath.Join(CacheFolder, "stores", hashPath(store.Url()))
+	cached, err := storage.Cached(store, dir, storage.CachePolicy{
+		Immutable:   isImmutableFile,
+		MetadataTTL: s.storeCacheTTL,
+		MaxSize:     MaxStoreCacheSize,
+	})
+	if core.IsErr(err, nil, "cannot cache store %s: %v", store) {
+		return store
+	}
+	return cached
+}
+
+// isImmutableFile returns true for the header files, the bodies and the change and keystore files, whose names are
+// unique ids and are never rewritten
+func isImmutableFile(name string) bool {
+	dir, base := path.Split(name)
+	if strings.HasSuffix(base, ".change") || strings.HasSuffix(base, ".keystore") {
+		return true
+	}
+	switch path.Base(dir) {
+	case HeaderFolder, BodyFolder:
+		_, err := strconv.ParseUint(base, 10, 64)
+		return err == nil
+	default:
+		return false
+	}
+}
+
 func getSafeConfigFromDB(safeName, creatorId string) (safeConfig, error) {
 	var data []byte
 	var config safeConfig
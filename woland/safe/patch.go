@@ -14,6 +14,11 @@ type PatchOptions struct {
 func Patch(s *Safe, bucket string, header Header, options PatchOptions) (Header, error) {
 	var err error
 
+	if !canWrite(s.Permission) {
+		core.Info("user %s cannot patch %s in %s: permission %d", s.CurrentUser.Id, header.Name, s.Name, s.Permission)
+		return Header{}, ErrNoWritePermission
+	}
+
 	if options.ByName {
 		head, _, err := getLastHeader(s.Name, bucket, header.Name, 0)
 		if core.IsErr(err, nil, "cannot get last header: %v", err) {
@@ -22,8 +27,10 @@ func Patch(s *Safe, bucket string, header Header, options PatchOptions) (Header,
 		header.FileId = head.FileId
 		header.Attributes.Hash = head.Attributes.Hash
 		header.Size = head.Size
+		header.Format = head.Format
 	}
 
+	header.Creator = s.CurrentUser.Id
 	headerId := snowflake.ID()
 	err = insertHeaderOrIgnoreToDB(s.Name, bucket, headerId, header)
 	if core.IsErr(err, nil, "cannot insert header: %v", err) {
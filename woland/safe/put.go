@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/jpeg"
@@ -34,6 +35,8 @@ const (
 	ErrInvalidName = "invalid name: %s should not start with /"
 )
 
+var ErrNoWritePermission = fmt.Errorf("no write permission")
+
 type PutOptions struct {
 	Progress chan int64 // Progress channel
 
@@ -45,7 +48,9 @@ type PutOptions struct {
 	ThumbnailWidth int            `json:"thumbnailWidth"` // Thumbnail width
 	AutoThumbnail  bool           `json:"autoThumbnail"`  // Generate a thumbnail from the file
 	ContentType    string         `json:"contentType"`    // Content type of the file
-	Zip            bool           `json:"zip"`            // Zip the file if it is smaller than 64MB
+	Zip            bool           `json:"zip"`            // Compress the file if it is smaller than 64MB and not already compressed
+	Codec          string         `json:"codec"`          // Compression codec when Zip is set, DefaultCodec if empty
+	Chunked        bool           `json:"chunked"`        // Store the body in chunks shared with other files. Private files and compression are not supported
 	Meta           map[string]any `json:"meta"`           // Metadata associated with the file
 	Private        string         `json:"private"`        // Id of the target user in case of private message
 }
@@ -59,6 +64,10 @@ func Put(s *Safe, bucket, name string, src any, options PutOptions, onComplete f
 	if !s.Connected && !options.Async {
 		return Header{}, fmt.Errorf("not connected")
 	}
+	if !canWrite(s.Permission) {
+		core.Info("user %s cannot put %s in %s: permission %d", s.CurrentUser.Id, name, s.Name, s.Permission)
+		return Header{}, ErrNoWritePermission
+	}
 
 	if strings.HasPrefix(name, "/") {
 		return Header{}, fmt.Errorf(ErrInvalidName, name)
@@ -114,6 +123,38 @@ func Put(s *Safe, bucket, name string, src any, options PutOptions, onComplete f
 		core.Info("Guessed content type for %s: %s", name, options.ContentType)
 	}
 
+	var chunks []Chunk
+	if options.Chunked && options.Private == "" {
+		chunks, err = splitChunks(r, s.Keystore.Keys[s.Keystore.LastKeyId])
+		if core.IsErr(err, nil, "cannot split %s in chunks: %v", name) {
+			return Header{}, err
+		}
+		core.Info("Split %s in %d chunks", name, len(chunks))
+	}
+
+	var compression *Compression
+	if options.Zip && chunks == nil && size < MaxSizeForCompression && isCompressible(options.ContentType) {
+		codec := options.Codec
+		if codec == "" {
+			codec = DefaultCodec
+		}
+		if _, ok := Codecs[codec]; !ok {
+			return Header{}, fmt.Errorf("%w: %s", ErrUnknownCodec, codec)
+		}
+		compression = &Compression{Codec: codec}
+	}
+
+	// a new version of a large file is stored as a patch over the previous version when only some blocks changed
+	var delta *Delta
+	if options.ReplaceID != 0 && chunks == nil && compression == nil && options.Private == "" && size >= MinMerkleSize {
+		if base, ok := deltaBase(s, bucket, options.ReplaceID); ok {
+			delta = &Delta{BaseId: base.FileId, Depth: 1}
+			if base.Delta != nil {
+				delta.Depth = base.Delta.Depth + 1
+			}
+		}
+	}
+
 	headerId := snowflake.ID()
 	attributes := Attributes{
 		ContentType: options.ContentType,
@@ -124,18 +165,22 @@ func Put(s *Safe, bucket, name string, src any, options PutOptions, onComplete f
 	}
 
 	header := Header{
-		Name:       name,
-		Size:       size,
-		Creator:    s.CurrentUser.Id,
-		FileId:     bodyId,
-		IV:         core.GenerateRandomBytes(aes.BlockSize),
-		PrivateId:  options.Private,
-		Attributes: attributes,
-		ModTime:    modTime,
-		Uploading:  true,
-		SourceFile: sourceFile,
-		ReplaceId:  options.ReplaceID,
-		Replace:    options.Replace,
+		Name:        name,
+		Size:        size,
+		Creator:     s.CurrentUser.Id,
+		FileId:      bodyId,
+		IV:          core.GenerateRandomBytes(aes.BlockSize),
+		Format:      FormatAEAD,
+		PrivateId:   options.Private,
+		Attributes:  attributes,
+		ModTime:     modTime,
+		Uploading:   true,
+		SourceFile:  sourceFile,
+		ReplaceId:   options.ReplaceID,
+		Replace:     options.Replace,
+		Compression: compression,
+		Chunks:      chunks,
+		Delta:       delta,
 	}
 	if header.PrivateId != "" {
 		bodyKey, err := security.DiffieHellmanKey(s.CurrentUser, header.PrivateId)
@@ -178,7 +223,7 @@ func Put(s *Safe, bucket, name string, src any, options PutOptions, onComplete f
 		}
 		return header, nil
 	} else {
-		header, err = writeToStore(s, s.PrimaryStore, bucket, r, headerId, header, onComplete)
+		header, err = writeToStore(s, getPrimaryStore(s), bucket, r, headerId, header, onComplete)
 		if core.IsErr(err, nil, "cannot put %s into store %s: %v", name, s.Name) {
 			return header, err
 		}
@@ -217,6 +262,12 @@ type UploadTask struct {
 }
 
 func uploadFilesInBackground(s *Safe) {
+	primary := getPrimaryStore(s)
+	if storage.GetCircuitState(primary) == storage.CircuitOpen {
+		core.Info("store %s of %s is degraded, uploads postponed", primary, s.Name)
+		return
+	}
+
 	rows, err := sql.Query("GET_UPLOADS", sql.Args{"safe": s.Name})
 	if core.IsErr(err, nil, "cannot get uploads: %v", err) {
 		return
@@ -249,10 +300,17 @@ func uploadFilesInBackground(s *Safe) {
 
 	for i, header := range headers {
 		err = uploadFileInBackground(s, UploadTask{Bucket: buckets[i], Header: header, HeaderFile: headerIds[i]})
-		if err != nil && core.Since(header.ModTime) > time.Hour*24*7 {
-			_, err = sql.Exec("DELETE_UPLOAD", sql.Args{"safe": s.Name, "headerId": headerIds[i], "bucket": buckets[i]})
-			if !core.IsErr(err, nil, "cannot delete upload: %v", err) {
-				core.Info("Deleted upload %s[%d] after 7 days tries", header.Name, header.FileId)
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, storage.ErrCircuitOpen) || storage.IsRetryable(primary, err) {
+			core.Info("upload of %s[%d] failed with a transient error, retrying later: %v", header.Name, header.FileId, err)
+			continue
+		}
+		if core.Since(header.ModTime) > time.Hour*24*7 {
+			_, err2 := sql.Exec("DELETE_UPLOAD", sql.Args{"safe": s.Name, "headerId": headerIds[i], "bucket": buckets[i]})
+			if !core.IsErr(err2, nil, "cannot delete upload: %v", err2) {
+				core.Info("Dropped upload %s[%d] after 7 days of failures, last error: %v", header.Name, header.FileId, err)
 			}
 		}
 	}
@@ -268,13 +326,14 @@ func uploadFileInBackground(s *Safe, uploadTask UploadTask) error {
 	defer f.Close()
 	core.Info("Uploading %s[%d] in %s/%s", header.Name, header.FileId, s.Name, uploadTask.Bucket)
 
-	_, err = writeToStore(s, s.PrimaryStore, uploadTask.Bucket, f, uploadTask.HeaderFile, header, nil)
+	primary, secondary := getStores(s)
+	_, err = writeToStore(s, primary, uploadTask.Bucket, f, uploadTask.HeaderFile, header, nil)
 	if core.IsErr(err, nil, "cannot write to store: %v", err) {
 		return err
 	}
-	if s.SecondaryStore != s.PrimaryStore {
+	if secondary != primary {
 		f.Seek(0, io.SeekStart)
-		_, err = writeToStore(s, s.SecondaryStore, uploadTask.Bucket, f, uploadTask.HeaderFile, header, nil)
+		_, err = writeToStore(s, secondary, uploadTask.Bucket, f, uploadTask.HeaderFile, header, nil)
 		core.IsErr(err, nil, "cannot write to secondary store: %v", err)
 	}
 
@@ -293,6 +352,11 @@ var uploading = make(map[uint64]bool)
 //var uploadingLock sync.Mutex
 
 func writeToStore(s *Safe, store storage.Store, bucket string, r io.ReadSeeker, headerId uint64, header Header, onComplete func(Header, error)) (Header, error) {
+	if !canWrite(s.Permission) {
+		core.Info("user %s cannot write %s in %s: permission %d", s.CurrentUser.Id, header.Name, s.Name, s.Permission)
+		return Header{}, ErrNoWritePermission
+	}
+
 	uploading[headerId] = true
 	defer delete(uploading, headerId)
 
@@ -302,17 +366,48 @@ func writeToStore(s *Safe, store storage.Store, bucket string, r io.ReadSeeker,
 
 	var err error
 
-	if r != nil {
-		r, err = encryptReader(r, header.BodyKey, header.IV)
-		if core.IsErr(err, nil, "cannot create encrypting reader: %v", err) {
+	if r != nil && header.Creator == s.CurrentUser.Id && header.Size >= MinMerkleSize &&
+		header.Attributes.MerkleRoot == nil {
+		err = writeMerkleTree(s, store, bucket, r, &header)
+		if core.IsErr(err, nil, "cannot write merkle tree of %s: %v", header.Name) {
+			return Header{}, err
+		}
+	}
+	if r != nil && len(header.Chunks) > 0 {
+		header.Format = FormatAEAD
+		_, err = writeChunks(s, store, r, header.FileId, header.Chunks)
+		if core.IsErr(err, nil, "cannot write chunks of %s: %v", header.Name) {
 			return Header{}, err
 		}
-		if header.Zip {
-			r, err = gzipStream(r)
+	} else if r != nil {
+		if header.Delta != nil && header.Delta.Ops == nil {
+			changes, ops, err := computeDelta(s, bucket, r, header)
+			if core.IsErr(err, nil, "cannot compute delta of %s: %v", header.Name) {
+				return Header{}, err
+			}
+			if changes == nil {
+				header.Delta = nil
+			} else {
+				defer os.Remove(changes.Name())
+				defer changes.Close()
+				delta := *header.Delta
+				delta.Ops = ops
+				r, header.Delta = changes, &delta
+			}
+		}
+		if header.Compression != nil && header.Compression.Frames == nil {
+			r, header.Compression, err = compressFrames(r, header.Compression.Codec)
 			if core.IsErr(err, nil, "cannot compress data: %v", err) {
 				return Header{}, err
 			}
-			core.Info("Using compression for file %s", header.Name)
+			if header.Compression != nil {
+				core.Info("Using %s compression for file %s", header.Compression.Codec, header.Name)
+			}
+		}
+		header.Format = FormatAEAD
+		r, err = encryptReader(r, header.BodyKey, header.IV)
+		if core.IsErr(err, nil, "cannot create encrypting reader: %v", err) {
+			return Header{}, err
 		}
 
 		err = store.Write(bodyFile, r, nil)
@@ -342,9 +437,15 @@ func writeToStore(s *Safe, store storage.Store, bucket string, r io.ReadSeeker,
 		core.Info("Replacing %d files with id %d", len(replaceable), header.ReplaceId)
 	}
 
+	// replaced files are hidden but their bodies are kept as versions until the retention of the bucket is exceeded
 	for _, file := range deletables {
-		deleteFile(store, s.Name, hashedBucket, file.FileId)
-		core.Info("Deleted %s[%d]", file.Name, file.FileId)
+		if file.FileId == header.FileId {
+			continue
+		}
+		_, err = sql.Exec("SET_DELETED_FILE", sql.Args{"safe": s.Name, "fileId": file.FileId})
+		if !core.IsErr(err, nil, "cannot hide %s[%d]: %v", file.Name, file.FileId) {
+			core.Info("Replaced %s[%d]", file.Name, file.FileId)
+		}
 	}
 
 	if header.SourceFile != "" {
@@ -359,11 +460,21 @@ func writeToStore(s *Safe, store storage.Store, bucket string, r io.ReadSeeker,
 	err = updateHeaderInDB(s.Name, bucket, header.FileId, func(h Header) Header {
 		h.Uploading = false
 		h.Downloads = header.Downloads
+		h.Format = header.Format
+		h.Compression = header.Compression
+		h.Attributes.MerkleRoot = header.Attributes.MerkleRoot
+		h.Delta = header.Delta
 		return h
 	})
 	if core.IsErr(err, nil, "cannot update header: %v", err) {
 		return Header{}, err
 	}
+	if header.Delta != nil && header.Delta.Depth >= MaxDeltaDepth {
+		queueMaterialization(s, bucket, header)
+	}
+	if len(deletables) > 0 {
+		enforceRetention(s, bucket, header.Name)
+	}
 
 	if onComplete != nil {
 		onComplete(header, err)
@@ -374,11 +485,15 @@ func writeToStore(s *Safe, store storage.Store, bucket string, r io.ReadSeeker,
 			limit := sc.Quota * 9 / 10
 			s.storeLock.Lock()
 			s.storeSizes[store.Url()] = s.storeSizes[store.Url()] + header.Size
-			if s.storeSizes[store.Url()] > limit {
+			exceeding := s.storeSizes[store.Url()] > limit
+			s.storeLock.Unlock()
+			if exceeding {
 				core.Info("Enforcing quota on %s in %s because likely exceeding", store.Url(), s.Name)
-				s.enforceQuota <- true
+				select {
+				case s.enforceQuota <- true:
+				default:
+				}
 			}
-			s.storeLock.Unlock()
 		}
 	}
 
@@ -408,6 +523,12 @@ func writeHeader(s *Safe, bucket string, header Header, headerId uint64) (Header
 		header2.Attributes = Attributes{}
 		header2.BodyKey = nil
 	}
+	if header2.Creator == s.CurrentUser.Id || len(header2.Signature) == 0 {
+		err = signHeader(s.CurrentUser, &header2)
+		if core.IsErr(err, nil, "cannot sign header: %v", err) {
+			return Header{}, err
+		}
+	}
 
 	hashedBucket := hashPath(bucket)
 	filePath := path.Join(s.Name, DataFolder, hashedBucket, HeaderFolder, fmt.Sprintf("%d", headerId))
@@ -418,15 +539,27 @@ func writeHeader(s *Safe, bucket string, header Header, headerId uint64) (Header
 		Bucket:  bucket,
 		Headers: []Header{header2},
 	}
-	err = writeHeadersFile(s.PrimaryStore, s.Name, filePath, keyValue, headersFile)
+	primary := getPrimaryStore(s)
+	err = writeHeadersFile(primary, s.Name, filePath, keyValue, headersFile)
 	if core.IsErr(err, nil, "cannot write header: %v", err) {
 		return Header{}, err
 	}
 	core.Info("Wrote header for %s[%d]", header2.Name, header2.FileId)
-	err = SetCached(s.Name, s.PrimaryStore, fmt.Sprintf("data/%s/.touch", hashedBucket), nil, s.CurrentUser.Id)
+	err = SetCached(s.Name, primary, fmt.Sprintf("data/%s/.touch", hashedBucket), nil, s.CurrentUser.Id)
 	if core.IsErr(err, nil, "cannot set touch file: %v", err) {
 		return Header{}, err
 	}
+
+	header.Signature = header2.Signature
+	if !header.Deleted {
+		err = updateHeaderInDB(s.Name, bucket, header.FileId, func(h Header) Header {
+			h.Signature = header.Signature
+			return h
+		})
+		if core.IsErr(err, nil, "cannot save signature of %s: %v", header.Name) {
+			return Header{}, err
+		}
+	}
 	return header, nil
 }
 
@@ -528,27 +661,3 @@ func transformImageBasedOnEXIF(img image.Image, orientation int) image.Image {
 		return img
 	}
 }
-
-func deleteFile(store storage.Store, safeName string, hashedDir string, fileId uint64) error {
-	fullName := path.Join(safeName, DataFolder, hashedDir, fmt.Sprintf("%d.b", fileId))
-	err := store.Delete(fullName)
-	if !core.IsErr(err, nil, "cannot delete file: %v", err) {
-		core.Info("Deleted %s[%d] during Put in %s", fullName, fileId, safeName)
-	}
-
-	r, err := sql.Exec("SET_DELETED_FILE", sql.Args{
-		"safe":   safeName,
-		"fileId": fileId,
-	})
-	if core.IsErr(err, nil, "cannot set deleted file: %v", err) {
-		return err
-	}
-	n, _ := r.RowsAffected()
-	if n > 0 {
-		core.Info("Marked %s[%d] as deleted in %s", fullName, fileId, safeName)
-	} else {
-		core.Info("Cannot mark %s[%d] as deleted in %s", fullName, fileId, safeName)
-	}
-
-	return nil
-}
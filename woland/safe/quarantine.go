@@ -0,0 +1,162 @@
+package safe
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/security"
+	"github.com/stregato/master/woland/sql"
+)
+
+type QuarantinedHeader struct {
+	Bucket   string    `json:"bucket"`   // Bucket where the header was found
+	HeaderId uint64    `json:"headerId"` // Id of the headers file in the store
+	Header   Header    `json:"header"`   // Header as read from the store
+	Reason   string    `json:"reason"`   // Reason why the header has been rejected
+	Time     time.Time `json:"time"`     // Time when the header has been quarantined
+}
+
+func quarantineHeader(safeName, bucket string, headerId uint64, header Header, written time.Time,
+	reason string) error {
+	data, err := json.Marshal(header)
+	if core.IsErr(err, nil, "cannot marshal header: %v", err) {
+		return err
+	}
+
+	_, err = sql.Exec("INSERT_QUARANTINE", sql.Args{
+		"safe":     safeName,
+		"bucket":   bucket,
+		"headerId": headerId,
+		"fileId":   header.FileId,
+		"name":     header.Name,
+		"creator":  header.Creator,
+		"reason":   reason,
+		"time":     core.Now().UnixMilli(),
+		"written":  written.UnixMilli(),
+		"deleted":  header.Deleted,
+		"header":   data,
+	})
+	if core.IsErr(err, nil, "cannot insert header %s in quarantine: %v", header.Name, err) {
+		return err
+	}
+	core.Info("quarantined header %s[%d] in %s/%s: %s", header.Name, header.FileId, safeName, bucket, reason)
+	return nil
+}
+
+// checkHeader verifies the signature and the permissions of a header read from the store, written at the given
+// time. Tombstones are also checked against the header of the file they delete.
+func checkHeader(safeName, bucket string, header Header, history PermissionHistory, written time.Time) error {
+	err := verifyHeader(header, history, written)
+	if err != nil {
+		return err
+	}
+	if header.Deleted {
+		return verifyTombstone(safeName, bucket, header, history)
+	}
+	return nil
+}
+
+// releaseQuarantine verifies again the quarantined headers of a bucket, or of all buckets when bucket is empty,
+// since a grant or a file header may have arrived after them. Headers that pass are saved to the DB and removed from
+// quarantine; the others stay with the reason of the last rejection. It returns the number of headers released.
+func releaseQuarantine(currentUser security.Identity, safeName, bucket string, history PermissionHistory) int {
+	type quarantined struct {
+		bucket   string
+		headerId uint64
+		reason   string
+		written  time.Time
+		header   Header
+	}
+
+	rows, err := sql.Query("GET_QUARANTINED_HEADERS", sql.Args{"safe": safeName, "bucket": bucket})
+	if core.IsErr(err, nil, "cannot query quarantined headers in %s/%s: %v", safeName, bucket) {
+		return 0
+	}
+	var headers []quarantined
+	for rows.Next() {
+		var q quarantined
+		var quarantineTime, writtenTime int64
+		var data []byte
+		err = rows.Scan(&q.bucket, &q.headerId, &q.reason, &quarantineTime, &writtenTime, &data)
+		if core.IsErr(err, nil, "cannot scan quarantined header: %v", err) {
+			continue
+		}
+		err = json.Unmarshal(data, &q.header)
+		if core.IsErr(err, nil, "cannot unmarshal quarantined header: %v", err) {
+			continue
+		}
+		// rows quarantined before the store time was kept fall back to the time of the quarantine
+		q.written = time.UnixMilli(writtenTime)
+		if writtenTime == 0 {
+			q.written = time.UnixMilli(quarantineTime)
+		}
+		headers = append(headers, q)
+	}
+	rows.Close()
+
+	replacing := map[string][]Header{}
+	released := 0
+	for _, q := range headers {
+		args := sql.Args{"safe": safeName, "bucket": q.bucket, "headerId": q.headerId, "fileId": q.header.FileId}
+		err = checkHeader(safeName, q.bucket, q.header, history, q.written)
+		if err != nil {
+			if err.Error() != q.reason {
+				args["reason"] = err.Error()
+				_, err = sql.Exec("SET_QUARANTINE_REASON", args)
+				core.IsErr(err, nil, "cannot update quarantined header: %v", err)
+			}
+			continue
+		}
+
+		header, err := decryptPrivateHeader(currentUser, q.header)
+		if core.IsErr(err, nil, "cannot decrypt header: %v", err) {
+			continue
+		}
+		err = insertHeaderOrIgnoreToDB(safeName, q.bucket, q.headerId, header)
+		if core.IsErr(err, nil, "cannot save header to DB: %v", err) {
+			continue
+		}
+		_, err = sql.Exec("DELETE_QUARANTINE", args)
+		core.IsErr(err, nil, "cannot remove header from quarantine: %v", err)
+		core.Info("released header %s[%d] in %s/%s", header.Name, header.FileId, safeName, q.bucket)
+		if header.Replace || header.ReplaceId != 0 {
+			replacing[q.bucket] = append(replacing[q.bucket], header)
+		}
+		released++
+	}
+	for bucket, headers := range replacing {
+		applyReplacements(safeName, bucket, headers)
+	}
+	return released
+}
+
+// ListQuarantine returns the headers rejected during synchronization because their signature was invalid, their
+// creator had no write permission at the time or they are tombstones of files not known yet. When bucket is empty,
+// the headers of all buckets are returned.
+func ListQuarantine(s *Safe, bucket string) ([]QuarantinedHeader, error) {
+	rows, err := sql.Query("GET_QUARANTINE", sql.Args{"safe": s.Name, "bucket": strings.Trim(bucket, "/")})
+	if core.IsErr(err, nil, "cannot query quarantine in %s: %v", s.Name) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var headers []QuarantinedHeader
+	for rows.Next() {
+		var q QuarantinedHeader
+		var data []byte
+		var quarantineTime int64
+		err = rows.Scan(&q.Bucket, &q.HeaderId, &q.Reason, &quarantineTime, &data)
+		if core.IsErr(err, nil, "cannot scan quarantined header: %v", err) {
+			continue
+		}
+		err = json.Unmarshal(data, &q.Header)
+		if core.IsErr(err, nil, "cannot unmarshal quarantined header: %v", err) {
+			continue
+		}
+		q.Time = time.UnixMilli(quarantineTime)
+		headers = append(headers, q)
+	}
+	return headers, nil
+}
@@ -0,0 +1,488 @@
+package safe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godruoyi/go-snowflake"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+type ReplicaStatus struct {
+	Url     string        `json:"url"`     // Url of the replica
+	Primary bool          `json:"primary"` // True if the replica is the primary store
+	Copied  int           `json:"copied"`  // Files copied to the replica in the last run
+	Deleted int           `json:"deleted"` // Files removed from the replica in the last run
+	Lag     time.Duration `json:"lag"`     // Age of the oldest change that was missing on the replica in the last run
+	LastRun time.Time     `json:"lastRun"` // Time of the last run
+	Error   string        `json:"error"`   // Error in the last run, if any
+}
+
+type replica struct {
+	store  storage.Store
+	status ReplicaStatus
+	oldest time.Time // Modification time of the oldest file missing on the replica
+}
+
+// Replicate synchronizes all the replicas of the safe: the change logs and keystores are merged, the bodies of the
+// files are copied where missing and the headers files are merged in a single file written to all the replicas.
+// It returns the status of each replica.
+func Replicate(s *Safe) ([]ReplicaStatus, error) {
+	return replicate(s, nil)
+}
+
+// GetReplicasStatus returns the status of the replicas after the last replication
+func GetReplicasStatus(s *Safe) []ReplicaStatus {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	var statuses []ReplicaStatus
+	for _, sc := range s.StoreConfigs {
+		if status, ok := s.replicasStatus[sc.Url]; ok {
+			statuses = append(statuses, status)
+		} else {
+			statuses = append(statuses, ReplicaStatus{Url: sc.Url, Primary: sc.Primary})
+		}
+	}
+	return statuses
+}
+
+// replicasSyncTime returns the time before which the changes of the safe have reached all the replicas, that is the
+// start of the oldest replication without errors. A safe with a single store has no replicas to wait for.
+func replicasSyncTime(s *Safe) time.Time {
+	configs, err := getStoreConfigsFromDB(s.Name)
+	if core.IsErr(err, nil, "cannot get stores for safe %s: %v", s.Name, err) {
+		return time.Time{}
+	}
+	if len(configs) < 2 {
+		return core.Now()
+	}
+
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	var synced time.Time
+	for i, c := range configs {
+		status, ok := s.replicasStatus[c.Url]
+		if !ok || status.Error != "" {
+			return time.Time{}
+		}
+		if i == 0 || status.LastRun.Before(synced) {
+			synced = status.LastRun
+		}
+	}
+	return synced
+}
+
+// replicate synchronizes the config folder and the provided bucket dirs across the replicas. When bucketDirs is nil
+// all the bucket dirs are synchronized.
+func replicate(s *Safe, bucketDirs []string) ([]ReplicaStatus, error) {
+	now := core.Now()
+	replicas, err := openReplicas(s)
+	if core.IsErr(err, nil, "cannot open replicas of %s: %v", s.Name) {
+		return nil, err
+	}
+	defer closeReplicas(replicas)
+
+	if len(replicas) > 1 {
+		configDir := path.Join(s.Name, ConfigFolder)
+		changed := copyMissingFiles(replicas, configDir, ".change", nil, nil)
+		changed = append(changed, copyMissingFiles(replicas, configDir, ".keystore", nil, nil)...)
+		touchReplicas(s, changed, path.Join(configDir, ".access.touch"))
+
+		tombstones, err := getTombstonesByDir(s)
+		if core.IsErr(err, nil, "cannot get tombstones of %s: %v", s.Name) {
+			return nil, err
+		}
+		if bucketDirs == nil {
+			bucketDirs = listBucketDirs(s, replicas)
+			replicateChunks(s, replicas, tombstones)
+		}
+		for _, bucketDir := range bucketDirs {
+			replicateBucketDir(s, replicas, bucketDir, tombstones[bucketDir])
+		}
+	}
+
+	var statuses []ReplicaStatus
+	s.storeLock.Lock()
+	if s.replicasStatus == nil {
+		s.replicasStatus = map[string]ReplicaStatus{}
+	}
+	for _, r := range replicas {
+		r.status.LastRun = now
+		if !r.oldest.IsZero() {
+			r.status.Lag = now.Sub(r.oldest)
+		}
+		s.replicasStatus[r.status.Url] = r.status
+		statuses = append(statuses, r.status)
+	}
+	s.storeLock.Unlock()
+
+	core.Info("replicated %s on %d stores in %v", s.Name, len(replicas), core.Since(now))
+	return statuses, nil
+}
+
+func openReplicas(s *Safe) ([]*replica, error) {
+	configs, err := getStoreConfigsFromDB(s.Name)
+	if core.IsErr(err, nil, "cannot get stores for safe %s: %v", s.Name, err) {
+		return nil, err
+	}
+
+	primary := getPrimaryStore(s)
+	replicas := []*replica{{store: primary, status: ReplicaStatus{Url: primary.Url(), Primary: true}}}
+	for _, c := range configs {
+		if c.Url == primary.Url() {
+			continue
+		}
+		r := &replica{status: ReplicaStatus{Url: c.Url, Primary: c.Primary}}
+		r.store, err = storage.Open(c.Url)
+		if core.IsErr(err, nil, "cannot connect to replica %s: %v", c.Url) {
+			r.status.Error = err.Error()
+			s.storeLock.Lock()
+			if s.replicasStatus == nil {
+				s.replicasStatus = map[string]ReplicaStatus{}
+			}
+			s.replicasStatus[c.Url] = r.status
+			s.storeLock.Unlock()
+			continue
+		}
+		r.store = wrapStore(s, r.store)
+		replicas = append(replicas, r)
+	}
+	return replicas, nil
+}
+
+// closeReplicas closes the stores opened by openReplicas
+func closeReplicas(replicas []*replica) {
+	// the first replica is the primary store of the safe, which stays open
+	for _, r := range replicas[1:] {
+		r.store.Close()
+	}
+}
+
+// replicaStores returns the stores of the replicas when all the stores of the safe could be opened and nil otherwise,
+// so that a body is never considered removed only because its replica is unreachable.
+func replicaStores(s *Safe, replicas []*replica) []storage.Store {
+	configs, err := getStoreConfigsFromDB(s.Name)
+	if core.IsErr(err, nil, "cannot get stores for safe %s: %v", s.Name, err) {
+		return nil
+	}
+	opened := map[string]bool{}
+	var stores []storage.Store
+	for _, r := range replicas {
+		opened[r.status.Url] = true
+		stores = append(stores, r.store)
+	}
+	for _, c := range configs {
+		if !opened[c.Url] {
+			core.Info("replica %s of %s is not reachable", c.Url, s.Name)
+			return nil
+		}
+	}
+	return stores
+}
+
+// listFiles returns the files in dir with the suffix for each replica
+func listFiles(replicas []*replica, dir string, suffix string) []map[string]fs.FileInfo {
+	files := make([]map[string]fs.FileInfo, len(replicas))
+	for i, r := range replicas {
+		files[i] = map[string]fs.FileInfo{}
+		ls, err := r.store.ReadDir(dir, storage.Filter{Suffix: suffix})
+		if os.IsNotExist(err) {
+			continue
+		}
+		if core.IsErr(err, nil, "cannot read %s in %s: %v", dir, r.store) {
+			r.status.Error = err.Error()
+			continue
+		}
+		for _, l := range ls {
+			if !l.IsDir() && l.Name()[0] != '.' {
+				files[i][l.Name()] = l
+			}
+		}
+	}
+	return files
+}
+
+// copyMissingFiles copies to each replica the files in dir that exist in other replicas. Files for which deleted returns
+// true are instead removed from all the replicas and files for which skip returns true are not copied. It returns the
+// replicas that have been modified.
+func copyMissingFiles(replicas []*replica, dir string, suffix string, deleted func(string) bool,
+	skip func(string) bool) []*replica {
+	files := listFiles(replicas, dir, suffix)
+	modified := map[*replica]bool{}
+
+	all := map[string]int{}
+	for i, ls := range files {
+		for name := range ls {
+			if _, ok := all[name]; !ok {
+				all[name] = i
+			}
+		}
+	}
+
+	for name, source := range all {
+		src := replicas[source]
+		for i, r := range replicas {
+			_, found := files[i][name]
+			switch {
+			case deleted != nil && deleted(name):
+				if !found {
+					continue
+				}
+				err := r.store.Delete(path.Join(dir, name))
+				if !os.IsNotExist(err) && core.IsErr(err, nil, "cannot delete %s/%s: %v", dir, name) {
+					r.status.Error = err.Error()
+					continue
+				}
+				r.status.Deleted++
+			case !found && (skip == nil || !skip(name)):
+				if copyToReplica(r, src, dir, name, files[source][name]) {
+					modified[r] = true
+				}
+			}
+		}
+	}
+
+	var changed []*replica
+	for r := range modified {
+		changed = append(changed, r)
+	}
+	return changed
+}
+
+// copyToReplica copies a file from the source replica and updates the status of the target replica
+func copyToReplica(r *replica, src *replica, dir, name string, info fs.FileInfo) bool {
+	err := storage.CopyFile(r.store, path.Join(dir, name), src.store, path.Join(dir, name))
+	if core.IsErr(err, nil, "cannot copy %s/%s from %s to %s: %v", dir, name, src.store, r.store) {
+		r.status.Error = err.Error()
+		return false
+	}
+	r.status.Copied++
+	updateOldest(r, info)
+	return true
+}
+
+func updateOldest(r *replica, info fs.FileInfo) {
+	if r.oldest.IsZero() || info.ModTime().Before(r.oldest) {
+		r.oldest = info.ModTime()
+	}
+}
+
+// replicateChunks copies the missing chunks and their references across the replicas. The references of deleted files
+// and the chunks without references are not copied, so that the chunks collected on some replicas do not come back.
+func replicateChunks(s *Safe, replicas []*replica, tombstones map[string]map[uint64]bool) {
+	refDir := path.Join(s.Name, ChunkRefFolder)
+	deletedRef := func(name string) bool {
+		fileId, err := strconv.ParseUint(strings.TrimPrefix(path.Ext(name), "."), 10, 64)
+		if err != nil {
+			return false
+		}
+		for _, ids := range tombstones {
+			if ids[fileId] {
+				return true
+			}
+		}
+		return false
+	}
+	copyMissingFiles(replicas, refDir, "", nil, deletedRef)
+
+	referenced := map[string]bool{}
+	for _, refs := range listFiles(replicas, refDir, "") {
+		for name := range refs {
+			if !deletedRef(name) {
+				referenced[strings.TrimSuffix(name, path.Ext(name))] = true
+			}
+		}
+	}
+	copyMissingFiles(replicas, path.Join(s.Name, ChunkFolder), "", nil, func(name string) bool {
+		return !referenced[name]
+	})
+}
+
+// replicateBucketDir copies the missing bodies and merges the headers of a bucket across the replicas
+func replicateBucketDir(s *Safe, replicas []*replica, bucketDir string, tombstones map[uint64]bool) {
+	dataDir := path.Join(s.Name, DataFolder, bucketDir)
+	deleted := func(name string) bool {
+		fileId, err := strconv.ParseUint(name, 10, 64)
+		return err == nil && tombstones[fileId] && !isBodyReferenced(s.Name, fileId)
+	}
+	copyMissingFiles(replicas, path.Join(dataDir, BodyFolder), "", deleted, nil)
+	copyMissingFiles(replicas, path.Join(dataDir, MerkleFolder), "", deleted, nil)
+
+	changed := mergeReplicaHeaders(s, replicas, path.Join(dataDir, HeaderFolder))
+	touchReplicas(s, changed, path.Join(dataDir, ".touch"))
+}
+
+// mergeReplicaHeaders merges the headers files of all replicas into a single file when the replicas have different
+// headers files. The merged file replaces the original files on all the replicas.
+func mergeReplicaHeaders(s *Safe, replicas []*replica, dir string) []*replica {
+	files := listFiles(replicas, dir, "")
+
+	all := map[string]int{}
+	inSync := true
+	for i, ls := range files {
+		for name := range ls {
+			if _, ok := all[name]; !ok {
+				all[name] = i
+			}
+		}
+	}
+	for i := range files {
+		inSync = inSync && len(files[i]) == len(all)
+	}
+	if inSync {
+		return nil
+	}
+	guard := path.Join(dir, ".merging")
+	for i, r := range replicas {
+		if !acquireMergingGuard(s, r.store, guard) {
+			core.Info("headers in %s/%s are being merged, skip replication", r.store, dir)
+			for _, r := range replicas[:i] {
+				r.store.Delete(guard)
+			}
+			return nil
+		}
+	}
+	defer func() {
+		for _, r := range replicas {
+			err := r.store.Delete(guard)
+			core.IsErr(err, nil, "cannot delete merging guard in %s: %v", r.store)
+		}
+	}()
+
+	var bucket string
+	var merged []string
+	var changed []*replica
+	headersMap := map[uint64]Header{}
+	tombstonesMap := map[uint64]Header{}
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		source := replicas[all[name]]
+		headersFile, err := readHeadersFile(source.store, s.Name, path.Join(dir, name), s.Keystore.Keys)
+		if core.IsErr(err, nil, "cannot read headers %s/%s: %v", dir, name) {
+			// files that cannot be read with the current keys are copied as they are
+			for i, r := range replicas {
+				if _, found := files[i][name]; !found && copyToReplica(r, source, dir, name, files[all[name]][name]) {
+					changed = append(changed, r)
+				}
+			}
+			continue
+		}
+		bucket = headersFile.Bucket
+		addToMerge(headersMap, tombstonesMap, headersFile.Headers)
+		for i, r := range replicas {
+			if _, found := files[i][name]; !found {
+				updateOldest(r, files[all[name]][name])
+			}
+		}
+		merged = append(merged, name)
+	}
+	if bucket == "" {
+		return changed
+	}
+
+	headers := mergedHeaders(s, replicaStores(s, replicas), bucket, headersMap, tombstonesMap)
+	headerId := snowflake.ID()
+	headersFile := HeadersFile{
+		KeyId:   s.Keystore.LastKeyId,
+		Bucket:  bucket,
+		Headers: headers,
+	}
+	for _, r := range replicas {
+		err := writeHeadersFile(r.store, s.Name, path.Join(dir, fmt.Sprintf("%d", headerId)),
+			s.Keystore.Keys[s.Keystore.LastKeyId], headersFile)
+		if core.IsErr(err, nil, "cannot write merged headers to %s: %v", r.store) {
+			r.status.Error = err.Error()
+			return changed
+		}
+	}
+	for _, header := range headers {
+		updateHeaderFileInDB(s.Name, bucket, header, headerId)
+	}
+	for _, r := range replicas {
+		for _, name := range merged {
+			err := r.store.Delete(path.Join(dir, name))
+			if !os.IsNotExist(err) && core.IsErr(err, nil, "cannot delete %s/%s: %v", dir, name) {
+				continue
+			}
+		}
+	}
+
+	core.Info("merged %d headers files with %d headers in %s", len(merged), len(headers), dir)
+	return replicas
+}
+
+// touchReplicas updates the touch file on the modified replicas so that peers reload the content
+func touchReplicas(s *Safe, replicas []*replica, key string) {
+	for _, r := range replicas {
+		err := storage.WriteFile(r.store, key, []byte(s.CurrentUser.Id))
+		if core.IsErr(err, nil, "cannot touch %s in %s: %v", key, r.store) {
+			r.status.Error = err.Error()
+		}
+	}
+}
+
+func listBucketDirs(s *Safe, replicas []*replica) []string {
+	dirs := map[string]bool{}
+	for _, r := range replicas {
+		ls, err := r.store.ReadDir(path.Join(s.Name, DataFolder), storage.Filter{OnlyFolders: true})
+		if os.IsNotExist(err) || core.IsErr(err, nil, "cannot list buckets in %s: %v", r.store) {
+			continue
+		}
+		for _, l := range ls {
+			dirs[l.Name()] = true
+		}
+	}
+
+	var bucketDirs []string
+	for dir := range dirs {
+		bucketDirs = append(bucketDirs, dir)
+	}
+	sort.Strings(bucketDirs)
+	return bucketDirs
+}
+
+// getTombstonesByDir returns the ids of the deleted files for each hashed bucket dir. Only the tombstones that have
+// reached all the replicas are returned, since the bodies of the other files are still needed.
+func getTombstonesByDir(s *Safe) (map[string]map[uint64]bool, error) {
+	replicated := replicasSyncTime(s).UnixMilli()
+	rows, err := sql.Query("GET_TOMBSTONES", sql.Args{"safe": s.Name, "after": 0})
+	if core.IsErr(err, nil, "cannot query tombstones in %s: %v", s.Name) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tombstones := map[string]map[uint64]bool{}
+	for rows.Next() {
+		var bucket string
+		var data []byte
+		var syncTime int64
+		var header Header
+		if core.IsErr(rows.Scan(&bucket, &data, &syncTime), nil, "cannot scan tombstone: %v") {
+			continue
+		}
+		if core.IsErr(json.Unmarshal(data, &header), nil, "cannot unmarshal tombstone: %v") || syncTime > replicated {
+			continue
+		}
+		dir := hashPath(bucket)
+		if tombstones[dir] == nil {
+			tombstones[dir] = map[uint64]bool{}
+		}
+		tombstones[dir][header.FileId] = true
+	}
+	return tombstones, nil
+}
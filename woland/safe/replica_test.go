@@ -0,0 +1,75 @@
+package safe
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestReplicate(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	replicaDir := filepath.Join(os.TempDir(), "woland-replica")
+	os.RemoveAll(replicaDir)
+	replicaUrl := "file://" + replicaDir
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	h, err := Put(s, "bucket", "file", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+
+	err = AddStore(s, StoreConfig{Name: "replica", Url: replicaUrl, Quota: testStoreConfig.Quota})
+	core.TestErr(t, err, "cannot add store: %v")
+
+	statuses, err := Replicate(s)
+	core.TestErr(t, err, "cannot replicate: %v")
+	core.Assert(t, len(statuses) == 2, "Expected 2 replicas, got %d", len(statuses))
+	core.Assert(t, statuses[1].Url == replicaUrl && statuses[1].Copied > 0, "Expected files copied to replica: %v",
+		statuses[1])
+	core.Assert(t, statuses[1].Error == "", "Unexpected replica error: %s", statuses[1].Error)
+
+	replica, err := storage.Open(replicaUrl)
+	core.TestErr(t, err, "cannot open replica: %v")
+	defer replica.Close()
+
+	configDir := path.Join(s.Name, ConfigFolder)
+	for _, suffix := range []string{".change", ".keystore"} {
+		primary, err := s.PrimaryStore.ReadDir(configDir, storage.Filter{Suffix: suffix})
+		core.TestErr(t, err, "cannot read primary config: %v")
+		ls, err := replica.ReadDir(configDir, storage.Filter{Suffix: suffix})
+		core.TestErr(t, err, "cannot read replica config: %v")
+		core.Assert(t, len(ls) == len(primary), "Expected %d %s files on replica, got %d", len(primary), suffix, len(ls))
+	}
+
+	dataDir := path.Join(s.Name, DataFolder, hashPath("bucket"))
+	_, err = replica.Stat(path.Join(dataDir, BodyFolder, fmt.Sprintf("%d", h.FileId)))
+	core.TestErr(t, err, "body not replicated: %v")
+	ls, err := replica.ReadDir(path.Join(dataDir, HeaderFolder), storage.Filter{})
+	core.TestErr(t, err, "cannot read replica headers: %v")
+	core.Assert(t, len(ls) == 1, "Expected 1 headers file on replica, got %d", len(ls))
+
+	statuses, err = Replicate(s)
+	core.TestErr(t, err, "cannot replicate: %v")
+	core.Assert(t, statuses[1].Copied == 0, "Expected no copies on second run, got %d", statuses[1].Copied)
+
+	// a chunk without references, e.g. collected on the primary, is not copied back
+	orphan := path.Join(s.Name, ChunkFolder, "orphan")
+	err = storage.WriteFile(replica, orphan, testData)
+	core.TestErr(t, err, "cannot write orphan chunk: %v")
+	_, err = Replicate(s)
+	core.TestErr(t, err, "cannot replicate: %v")
+	_, err = s.PrimaryStore.Stat(orphan)
+	core.Assert(t, os.IsNotExist(err), "Expected orphan chunk not to be copied, got %v", err)
+	core.Assert(t, len(GetReplicasStatus(s)) == 2, "Expected status of 2 replicas")
+}
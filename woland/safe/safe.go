@@ -28,7 +28,11 @@ const (
 	InitiateFolder = "initiate"
 	HeaderFolder   = "h"
 	BodyFolder     = "b"
+	ChunkFolder    = "chunks"
+	ChunkRefFolder = "chunkrefs"
+	MerkleFolder   = "m"
 	BucketFile     = ".bucket"
+	SequenceFile   = ".sequence"
 )
 
 const KeySize = 32
@@ -43,9 +47,10 @@ type StoreConfig struct {
 }
 
 type safeConfig struct {
-	Description string   `json:"description"`
-	Keystore    Keystore `json:"keystore"`
-	Users       Users    `json:"users"`
+	Description string            `json:"description"`
+	Keystore    Keystore          `json:"keystore"`
+	Users       Users             `json:"users"`
+	History     PermissionHistory `json:"history"`
 }
 
 type Safe struct {
@@ -61,24 +66,38 @@ type Safe struct {
 	MinimalSyncTime time.Duration `json:"minimalSyncTime"` // Minimal time between two syncs
 	Permission      Permission    `json:"permission"`      // Permission of the current user
 	Connected       bool          `json:"connected"`       // Whether the safe is connected to a store
+	Failover        bool          `json:"failover"`        // Whether a replica replaces the unreachable primary store
 	PrimaryStore    storage.Store `json:"-"`               // Primary store of the safe
 	SecondaryStore  storage.Store `json:"-"`               // Secondary store
 
-	storeUrl             string
-	storeLock            sync.Mutex   // Lock for store sizes
-	usersLock            sync.Mutex   // Lock for users
-	background           *time.Ticker // Ticker for background tasks
-	syncUsers            chan bool    // Channel for syncing users
-	storeSizes           map[string]int64
-	compactHeaders       chan CompactHeader   // Channel for compacting the headers
-	enforceQuota         chan bool            // Channel for enforcing the quota
-	connect              chan bool            // Channel to connect to the stores
-	compactHeadersWg     sync.WaitGroup       // Wait group for compacting the headers
-	uploadFile           chan UploadTask      // Channel for uploading headers
-	quit                 chan bool            // Channel for quitting background tasks
-	wg                   sync.WaitGroup       // Wait group for background tasks
-	lastBucketSync       map[string]time.Time // Last sync time for each bucket
-	lastQuotaEnforcement time.Time            // Last time the quota was checked
+	storeUrl              string
+	storeCacheTTL         time.Duration     // Time during which the listings of the primary store are reused
+	primaryUrl            string            // Url of the primary store in the store configs
+	storeLock             sync.Mutex        // Lock for store sizes
+	usersLock             sync.Mutex        // Lock for users
+	history               PermissionHistory // Permissions of the users over time, used to validate headers
+	background            *time.Ticker      // Ticker for background tasks
+	syncUsers             chan bool         // Channel for syncing users
+	storeSizes            map[string]int64
+	compactHeaders        chan CompactHeader        // Channel for compacting the headers
+	enforceQuota          chan bool                 // Channel for enforcing the quota
+	connect               chan bool                 // Channel to connect to the stores
+	compactHeadersWg      sync.WaitGroup            // Wait group for compacting the headers
+	uploadFile            chan UploadTask           // Channel for uploading headers
+	quit                  chan bool                 // Channel for quitting background tasks
+	wg                    sync.WaitGroup            // Wait group for background tasks
+	lastBucketSync        map[string]time.Time      // Last sync time for each bucket
+	lastQuotaEnforcement  time.Time                 // Last time the quota was checked
+	lastGarbageCollection time.Time                 // Last time the bodies of deleted files were removed
+	lastReplication       time.Time                 // Last time the replicas were synchronized
+	lastPrimaryProbe      time.Time                 // Last time the primary store was probed
+	lastBudgetCheck       time.Time                 // Last time the cost was compared with the budget
+	meters                map[string]*storage.Meter // Usage of the stores by url, guarded by storeLock
+	overBudget            bool                      // True when the cost of the month exceeds the budget, guarded by storeLock
+	uploadLimiter         *storage.RateLimiter      // Limit on the uploads of the safe, guarded by storeLock
+	downloadLimiter       *storage.RateLimiter      // Limit on the downloads of the safe, guarded by storeLock
+	metered               bool                      // True when only the headers are synchronized, guarded by storeLock
+	replicasStatus        map[string]ReplicaStatus  // Status of the replicas after the last replication, guarded by storeLock
 }
 
 type StoreType int
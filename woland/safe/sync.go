@@ -10,6 +10,7 @@ import (
 
 	"github.com/stregato/master/woland/core"
 	"github.com/stregato/master/woland/security"
+	"github.com/stregato/master/woland/sql"
 	"github.com/stregato/master/woland/storage"
 )
 
@@ -25,17 +26,24 @@ func SyncBucket(s *Safe, bucket string, SyncOptions SyncOptions, async func(int,
 		}()
 		return 0, nil
 	}
-	origin := s.PrimaryStore
-	changes, err = synchorizeFiles(s.CurrentUser, origin, s.Name, bucket, s.Keystore.Keys,
+	origin := getPrimaryStore(s)
+	changes, err = synchorizeFiles(s.CurrentUser, origin, s.Name, bucket, s.Keystore.Keys, s.history,
 		s.compactHeaders, &s.compactHeadersWg)
 	if core.IsErr(err, nil, "cannot synchronize files: %v", err) {
 		return 0, err
 	}
+	if SyncOptions.Replicate {
+		_, err = replicate(s, []string{hashPath(bucket)})
+		if core.IsErr(err, nil, "cannot replicate bucket %s: %v", bucket) {
+			return changes, err
+		}
+	}
 	return changes, nil
 }
 
 func synchorizeFiles(currentUser security.Identity, store storage.Store, safeName, bucket string,
-	keys map[uint64][]byte, compactHeader chan CompactHeader, compactHeadersWg *sync.WaitGroup) (newFiles int, err error) {
+	keys map[uint64][]byte, history PermissionHistory, compactHeader chan CompactHeader,
+	compactHeadersWg *sync.WaitGroup) (newFiles int, err error) {
 	var touch time.Time
 
 	hashedBucket := hashPath(bucket)
@@ -66,6 +74,7 @@ func synchorizeFiles(currentUser security.Identity, store storage.Store, safeNam
 	}
 
 	count := 0
+	var replacing []Header
 	for _, l := range ls {
 		name := l.Name()
 		headerId, err := strconv.ParseUint(path.Base(name), 10, 64)
@@ -87,8 +96,15 @@ func synchorizeFiles(currentUser security.Identity, store storage.Store, safeNam
 		if core.IsErr(err, nil, "cannot read headers: %v", err) {
 			continue
 		}
+		checkNodeCollision(headerId, headersFile.Node)
 
 		for _, header := range headersFile.Headers {
+			err = checkHeader(safeName, bucket, header, history, l.ModTime())
+			if core.IsErr(err, nil, "rejected header %s in %s/%s: %v", header.Name, safeName, bucket) {
+				err = quarantineHeader(safeName, bucket, headerId, header, l.ModTime(), err.Error())
+				core.IsErr(err, nil, "cannot quarantine header: %v", err)
+				continue
+			}
 			header, err = decryptPrivateHeader(currentUser, header)
 			if core.IsErr(err, nil, "cannot decrypt header: %v", err) {
 				continue
@@ -98,8 +114,22 @@ func synchorizeFiles(currentUser security.Identity, store storage.Store, safeNam
 			newFiles++
 			err = insertHeaderOrIgnoreToDB(safeName, bucket, headerId, header)
 			core.IsErr(err, nil, "cannot save header to DB: %v", err)
+			// a headers file is read again while all its headers are quarantined
+			_, err = sql.Exec("DELETE_ACCEPTED_QUARANTINE", sql.Args{"safe": safeName, "bucket": bucket,
+				"headerId": headerId, "fileId": header.FileId, "deleted": header.Deleted})
+			core.IsErr(err, nil, "cannot remove header from quarantine: %v", err)
+			if header.Replace || header.ReplaceId != 0 {
+				replacing = append(replacing, header)
+			}
 		}
 	}
+
+	// headers quarantined before their file or the grant of their creator arrived can be verified now
+	newFiles += releaseQuarantine(currentUser, safeName, bucket, history)
+
+	// replacements are applied after all the headers are saved since headers files are not sorted by time
+	applyReplacements(safeName, bucket, replacing)
+
 	err = SetCached(safeName, store, fmt.Sprintf("data/%s/.touch", hashedBucket), nil, "")
 	if core.IsErr(err, nil, "cannot check touch file: %v", err) {
 		return 0, err
@@ -115,3 +145,17 @@ func synchorizeFiles(currentUser security.Identity, store storage.Store, safeNam
 
 	return newFiles, nil
 }
+
+// applyReplacements hides the versions and the files replaced by the given headers
+func applyReplacements(safeName, bucket string, replacing []Header) {
+	for _, header := range replacing {
+		if header.Replace {
+			err := setReplacedInDB(safeName, bucket, header)
+			core.IsErr(err, nil, "cannot hide versions replaced by %s: %v", header.Name)
+		}
+		if header.ReplaceId != 0 {
+			_, err := sql.Exec("SET_DELETED_FILE", sql.Args{"safe": safeName, "fileId": header.ReplaceId})
+			core.IsErr(err, nil, "cannot hide file replaced by %s: %v", header.Name)
+		}
+	}
+}
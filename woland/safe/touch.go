@@ -85,6 +85,7 @@ func SetCached(name string, store storage.Store, key string, value any, creatorI
 	}
 
 	if os.IsNotExist(err) || creatorId != "" {
+		sent := core.Now()
 		err = storage.WriteFile(store, path.Join(name, key), []byte(creatorId))
 		if core.IsErr(err, nil, "cannot write touch file %s in %s: %v", key, name, err) {
 			return err
@@ -93,6 +94,7 @@ func SetCached(name string, store storage.Store, key string, value any, creatorI
 		if core.IsErr(err, nil, "cannot stat touch file %s in %s: %v", key, name, err) {
 			return err
 		}
+		core.ObserveStoreTime(stat.ModTime(), sent, core.Now())
 		core.Info("touch %s in '%s' created", key, name)
 	}
 
@@ -0,0 +1,51 @@
+package safe
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestCachedWithWrongClock(t *testing.T) {
+	InitTest()
+	if !strings.HasPrefix(testUrl, "file://") {
+		t.Skip("the skew needs a store with its own clock")
+	}
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	store, err := storage.Open(testUrl)
+	core.TestErr(t, err, "cannot open store: %v")
+	defer store.Close()
+
+	// a device whose clock is one day behind and cannot reach NTP
+	clock := core.NewFakeClock(time.Now().Add(-24 * time.Hour))
+	core.SetClock(clock)
+	defer core.SetClock(core.SystemClock)
+	core.ResetClockSkew()
+	defer core.ResetClockSkew()
+
+	err = SetCached(testSafe, store, "touch", []byte("value"), "creator")
+	core.TestErr(t, err, "cannot set cached: %v")
+
+	var value []byte
+	synced, err := GetCached(testSafe, store, "touch", &value, "creator")
+	core.TestErr(t, err, "cannot get cached: %v")
+	core.Assert(t, synced && string(value) == "value", "cache not synced with a wrong clock: %s", value)
+
+	status := core.GetClockStatus()
+	core.Assert(t, status.Samples == 1 && status.Skew > 23*time.Hour && status.Wrong, "skew not estimated: %+v", status)
+
+	// a correct clock does not report skew
+	core.SetClock(core.SystemClock)
+	core.ResetClockSkew()
+	err = SetCached(testSafe, store, "touch", nil, "creator")
+	core.TestErr(t, err, "cannot set cached: %v")
+	status = core.GetClockStatus()
+	core.Assert(t, status.Samples == 1 && !status.Wrong, "unexpected skew: %+v", status)
+}
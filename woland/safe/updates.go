@@ -1,54 +1,205 @@
 package safe
 
 import (
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
 )
 
-func CheckForUpdates(s *Safe, dir string, after time.Time, depth int) ([]string, error) {
-	dirs := []string{dir}
+var DefaultSubscribePeriod = 30 * time.Second
 
-	synchorizeFiles(s.CurrentUser, s.PrimaryStore, s.Name, hashPath(dir), s.Keystore.Keys,
-		s.compactHeaders, &s.compactHeadersWg)
+type ChangeEvent struct {
+	Safe   string    `json:"safe"`   // Name of the safe
+	Bucket string    `json:"bucket"` // Bucket where the change happened
+	Dir    string    `json:"dir"`    // Directory that contains new or modified files
+	Time   time.Time `json:"time"`   // Time when the change was detected
+}
+
+type SubscribeOptions struct {
+	Dir    string        `json:"dir"`    // Dir is the root directory to watch. Default is the bucket root
+	Depth  int           `json:"depth"`  // Depth is the number of nested levels to watch. -1 for unlimited
+	After  time.Time     `json:"after"`  // After reports only changes after this time. Default is now
+	Period time.Duration `json:"period"` // Period between two checks. Default is DefaultSubscribePeriod
+}
+
+type Subscription struct {
+	Id      int              `json:"id"` // Id of the subscription
+	Changes chan ChangeEvent `json:"-"`  // Changes receives an event for each modified directory
+
+	quit chan bool
+	once sync.Once
+}
 
-	if depth != 0 {
-		nested, err := ListDirs(s, dir, ListDirsOptions{
-			Depth: depth,
-		})
-		if core.IsErr(err, nil, "cannot list dirs in %s: %v", dir) {
+var subscriptionsCounter int
+var subscriptionsCounterLock sync.Mutex
+
+// CheckForUpdates returns the directories in the bucket that contain files synchronized since the provided time.
+// Only dir and its nested directories up to depth levels are checked; a negative depth checks all levels.
+func CheckForUpdates(s *Safe, bucket string, dir string, after time.Time, depth int) ([]string, error) {
+	changes, err := getChangedFolders(s, bucket, dir, after, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []string
+	for _, c := range changes {
+		updates = append(updates, c.dir)
+	}
+	return updates, nil
+}
+
+// changedFolder is a directory with the sync time in milliseconds of its latest file
+type changedFolder struct {
+	dir      string
+	syncTime int64
+}
+
+// getChangedFolders returns the directories that contain files synchronized since after, with the sync time of
+// their latest file
+func getChangedFolders(s *Safe, bucket string, dir string, after time.Time, depth int) ([]changedFolder, error) {
+	bucket = strings.Trim(bucket, "/")
+	dir = strings.Trim(dir, "/")
+
+	if s.Connected {
+		_, err := synchorizeFiles(s.CurrentUser, getPrimaryStore(s), s.Name, bucket, s.Keystore.Keys, s.history,
+			s.compactHeaders, &s.compactHeadersWg)
+		if core.IsErr(err, nil, "cannot sync files in %s/%s: %v", s.Name, bucket) {
 			return nil, err
 		}
-		dirs = append(dirs, nested...)
-	}
-	ch := make(chan string)
-	for _, d := range dirs {
-		go func(d string) {
-			// TODO: check if dir has been added or modified
-			// hashedDir := hashPath(d)
-			// _, i, _, ok := sql.GetConfig("SAFE_DIR_MODTIME", hashedDir)
-			// if !ok && after.IsZero() {
-			// 	core.Info("dir %s has been added", d)
-			// 	ch <- d
-			// } else {
-			// 	touch, err := SyncTouch(s.store, DataFolder, hashedDir, ".touch")
-			// 	core.IsErr(err, nil, "cannot check touch file: %v", err)
-
-			// 	if touch.After(after) && time.Unix(i, 0) != touch {
-			// 		core.Info("dir %s has been modified", d)
-			// 		ch <- d
-			// 	} else {
-			// 		ch <- ""
-			// 	}
-			// }
-		}(d)
 	}
-	var updates []string
-	for i := 0; i < len(dirs); i++ {
-		d := <-ch
-		if d != "" {
-			updates = append(updates, d)
+
+	fromDepth := 0
+	if dir != "" {
+		fromDepth = 1 + strings.Count(dir, "/")
+	}
+	toDepth := -1
+	if depth >= 0 {
+		toDepth = fromDepth + depth
+	}
+
+	rows, err := sql.Query("GET_CHANGED_FOLDERS", sql.Args{
+		"safe":      s.Name,
+		"bucket":    bucket,
+		"dir":       dir,
+		"subdirs":   escapeLike(dir) + "/%",
+		"fromDepth": fromDepth,
+		"toDepth":   toDepth,
+		"after":     after.UnixMilli(),
+	})
+	if core.IsErr(err, nil, "cannot query changed folders: %v", err) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []changedFolder
+	for rows.Next() {
+		var c changedFolder
+		if core.IsErr(rows.Scan(&c.dir, &c.syncTime), nil, "cannot scan folder: %v", err) {
+			continue
 		}
+		changes = append(changes, c)
 	}
-	return updates, nil
+	core.Info("found %d updated dirs in %s/%s after %v", len(changes), s.Name, bucket, after)
+	return changes, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern with a backslash
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Subscribe checks periodically the bucket for updates and delivers an event for each changed directory on the
+// Changes channel of the returned subscription. The channel is closed when Unsubscribe or Close are called.
+func Subscribe(s *Safe, bucket string, options SubscribeOptions) *Subscription {
+	if options.Period == 0 {
+		options.Period = DefaultSubscribePeriod
+	}
+	after := options.After
+	if after.IsZero() {
+		after = core.Now()
+	}
+
+	subscriptionsCounterLock.Lock()
+	subscriptionsCounter++
+	sub := &Subscription{
+		Id:      subscriptionsCounter,
+		Changes: make(chan ChangeEvent, 64),
+		quit:    make(chan bool),
+	}
+	subscriptionsCounterLock.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(sub.Changes)
+
+		// the check includes the last millisecond reported, since files may be synchronized later in the same
+		// millisecond; the directories already reported for that millisecond are skipped
+		var last int64
+		reported := map[string]bool{}
+
+		ticker := time.NewTicker(options.Period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sub.quit:
+				return
+			case <-s.quit:
+				return
+			case <-ticker.C:
+			}
+
+			now := core.Now()
+			changes, err := getChangedFolders(s, bucket, options.Dir, after, options.Depth)
+			if core.IsErr(err, nil, "cannot check for updates in %s/%s: %v", s.Name, bucket) {
+				continue
+			}
+			var dirs []string
+			latest := last
+			for _, c := range changes {
+				if c.syncTime == last && reported[c.dir] {
+					continue
+				}
+				dirs = append(dirs, c.dir)
+				if c.syncTime > latest {
+					latest = c.syncTime
+				}
+			}
+			if latest > last {
+				last, reported = latest, map[string]bool{}
+			}
+			for _, c := range changes {
+				if c.syncTime == last {
+					reported[c.dir] = true
+				}
+			}
+			if last > 0 {
+				after = time.UnixMilli(last)
+			}
+
+			for _, d := range dirs {
+				select {
+				case sub.Changes <- ChangeEvent{Safe: s.Name, Bucket: bucket, Dir: d, Time: now}:
+				case <-sub.quit:
+					return
+				case <-s.quit:
+					return
+				}
+			}
+		}
+	}()
+
+	core.Info("subscription %d to %s/%s created", sub.Id, s.Name, bucket)
+	return sub
+}
+
+// Unsubscribe stops the subscription and closes its Changes channel
+func Unsubscribe(sub *Subscription) {
+	sub.once.Do(func() {
+		close(sub.quit)
+		core.Info("subscription %d stopped", sub.Id)
+	})
 }
@@ -0,0 +1,68 @@
+package safe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+func TestCheckForUpdates(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	start := core.Now()
+	for _, name := range []string{"a/b/file1", "a/file2", "c/file3"} {
+		_, err = Put(s, "bucket", name, core.NewBytesReader(testData), PutOptions{}, nil)
+		core.TestErr(t, err, "cannot put file: %v")
+	}
+
+	dirs, err := CheckForUpdates(s, "bucket", "", start.Add(-time.Second), -1)
+	core.TestErr(t, err, "cannot check for updates: %v")
+	core.Assert(t, len(dirs) == 3, "Expected 3 dirs, got %v", dirs)
+
+	dirs, err = CheckForUpdates(s, "bucket", "a", start.Add(-time.Second), 0)
+	core.TestErr(t, err, "cannot check for updates: %v")
+	core.Assert(t, len(dirs) == 1 && dirs[0] == "a", "Expected dir a, got %v", dirs)
+
+	for _, dir := range []string{"_", "%"} {
+		dirs, err = CheckForUpdates(s, "bucket", dir, start.Add(-time.Second), -1)
+		core.TestErr(t, err, "cannot check for updates: %v")
+		core.Assert(t, len(dirs) == 0, "Expected no updates in %s, got %v", dir, dirs)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	after := core.Now()
+	dirs, err = CheckForUpdates(s, "bucket", "", after, -1)
+	core.TestErr(t, err, "cannot check for updates: %v")
+	core.Assert(t, len(dirs) == 0, "Expected no updates, got %v", dirs)
+
+	sub := Subscribe(s, "bucket", SubscribeOptions{Depth: -1, After: after, Period: 10 * time.Millisecond})
+	_, err = Put(s, "bucket", "c/file4", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+
+	select {
+	case c := <-sub.Changes:
+		core.Assert(t, c.Dir == "c", "Expected change in c, got %s", c.Dir)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change event received")
+	}
+
+	// the same change is not reported again by the next checks
+	select {
+	case c := <-sub.Changes:
+		t.Fatalf("unexpected change in %s", c.Dir)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	Unsubscribe(sub)
+	for range sub.Changes {
+	}
+}
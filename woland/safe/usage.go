@@ -0,0 +1,218 @@
+package safe
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/security"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+var BudgetCheckPeriod = 10 * time.Minute    // Time between two checks of the cost of the safe against the budget
+var OverBudgetReplicaWatch = 24 * time.Hour // Time between two replications when the safe is over budget
+
+const budgetFile = ConfigFolder + "/.budget.json" // Budget file in the safe, signed by an administrator
+
+type safeBudget struct {
+	Budget float64 `json:"budget"`
+}
+
+// StoreUsage is the usage of a store of the safe in a month
+type StoreUsage struct {
+	Url string `json:"url"`
+	storage.Usage
+}
+
+// UsageReport is the usage of the stores of the safe in the current month and its cost compared to the budget
+type UsageReport struct {
+	Month      string       `json:"month"`      // Month of the report, e.g. 2023-10
+	Stores     []StoreUsage `json:"stores"`     // Usage of each store
+	Cost       float64      `json:"cost"`       // Cost of the month so far in CHF
+	Estimate   float64      `json:"estimate"`   // Cost at the end of the month at the current rate in CHF
+	Budget     float64      `json:"budget"`     // Monthly budget in CHF, 0 when there is no budget
+	OverBudget bool         `json:"overBudget"` // True when the cost exceeds the budget
+	Warning    string       `json:"warning"`    // Warning for the user when the budget is exceeded or about to be
+}
+
+// meterStore wraps the store so that its traffic is added to the usage of the safe
+func meterStore(s *Safe, store storage.Store) storage.Store {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+
+	if s.meters == nil {
+		s.meters = map[string]*storage.Meter{}
+	}
+	m, ok := s.meters[store.Url()]
+	if !ok {
+		m = &storage.Meter{}
+		s.meters[store.Url()] = m
+	}
+	return storage.Metered(store, m)
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// flushUsage adds the usage counted by the meters since the last flush to the DB
+func flushUsage(s *Safe) error {
+	s.storeLock.Lock()
+	usages := map[string]storage.Usage{}
+	for url, m := range s.meters {
+		if u := m.Take(); !u.IsZero() {
+			usages[url] = u
+		}
+	}
+	s.storeLock.Unlock()
+
+	month := usageMonth(core.Now())
+	for url, u := range usages {
+		_, err := sql.Exec("ADD_STORE_USAGE", sql.Args{"safe": s.Name, "url": url, "month": month,
+			"bytesRead": u.BytesRead, "bytesWritten": u.BytesWritten, "reads": u.Reads, "writes": u.Writes,
+			"lists": u.Lists, "deletes": u.Deletes, "cost": u.Cost})
+		if core.IsErr(err, nil, "cannot save usage of %s in %s: %v", url, s.Name) {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetUsage returns the usage of the stores of the safe in the current month, the estimated cost at the end of the
+// month and the comparison with the budget
+func GetUsage(s *Safe) (UsageReport, error) {
+	err := flushUsage(s)
+	if err != nil {
+		return UsageReport{}, err
+	}
+
+	now := core.Now().UTC()
+	report := UsageReport{Month: usageMonth(now)}
+	rows, err := sql.Query("GET_STORE_USAGE", sql.Args{"safe": s.Name, "month": report.Month})
+	if core.IsErr(err, nil, "cannot get usage of %s: %v", s.Name) {
+		return UsageReport{}, err
+	}
+	for rows.Next() {
+		var u StoreUsage
+		err = rows.Scan(&u.Url, &u.BytesRead, &u.BytesWritten, &u.Reads, &u.Writes, &u.Lists, &u.Deletes, &u.Cost)
+		if core.IsErr(err, nil, "cannot scan usage: %v") {
+			continue
+		}
+		report.Stores = append(report.Stores, u)
+		report.Cost += u.Cost
+	}
+	rows.Close()
+
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	elapsed := now.Sub(start)
+	if elapsed < time.Hour {
+		elapsed = time.Hour
+	}
+	report.Estimate = report.Cost * float64(start.AddDate(0, 1, 0).Sub(start)) / float64(elapsed)
+
+	report.Budget, err = GetBudget(s)
+	if err != nil {
+		return UsageReport{}, err
+	}
+	if report.Budget > 0 {
+		report.OverBudget = report.Cost > report.Budget
+		switch {
+		case report.OverBudget:
+			report.Warning = fmt.Sprintf("the cost of %.2f CHF exceeds the monthly budget of %.2f CHF: "+
+				"prefetch is paused and replication runs every %v", report.Cost, report.Budget, OverBudgetReplicaWatch)
+		case report.Estimate > report.Budget:
+			report.Warning = fmt.Sprintf("the estimated cost of %.2f CHF at the end of the month exceeds the budget "+
+				"of %.2f CHF", report.Estimate, report.Budget)
+		}
+	}
+	return report, nil
+}
+
+// SetBudget sets the monthly budget of the safe in CHF. Zero removes the budget. Only administrators can change the
+// budget.
+func SetBudget(s *Safe, budget float64) error {
+	if s.Permission&Admin == 0 {
+		return ErrNotAdmin
+	}
+
+	data, err := security.Marshal(s.CurrentUser, safeBudget{Budget: budget}, "signature")
+	if core.IsErr(err, nil, "cannot marshal budget: %v", err) {
+		return err
+	}
+	err = storage.WriteFile(getPrimaryStore(s), path.Join(s.Name, budgetFile), data)
+	if core.IsErr(err, nil, "cannot write budget for %s: %v", s.Name) {
+		return err
+	}
+	err = SetCached(s.Name, getPrimaryStore(s), budgetFile, safeBudget{Budget: budget}, "")
+	if core.IsErr(err, nil, "cannot cache budget for %s: %v", s.Name) {
+		return err
+	}
+	core.Info("set budget of %s to %.2f CHF", s.Name, budget)
+	checkBudget(s)
+	return nil
+}
+
+// GetBudget returns the monthly budget of the safe in CHF, 0 when there is no budget
+func GetBudget(s *Safe) (float64, error) {
+	var b safeBudget
+
+	synced, err := GetCached(s.Name, getPrimaryStore(s), budgetFile, &b, "")
+	if core.IsErr(err, nil, "cannot check budget file: %v") {
+		return 0, err
+	}
+	if synced {
+		return b.Budget, nil
+	}
+
+	data, err := storage.ReadFile(getPrimaryStore(s), path.Join(s.Name, budgetFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if core.IsErr(err, nil, "cannot read budget file: %v") {
+		return 0, err
+	}
+	signedBy, err := security.Unmarshal(data, &b, "signature")
+	if core.IsErr(err, nil, "cannot read budget file: %v") {
+		return 0, err
+	}
+	if s.Users[signedBy]&Admin == 0 {
+		core.Info("budget of %s signed by %s who is not an administrator", s.Name, signedBy)
+		return 0, nil
+	}
+
+	err = SetCached(s.Name, getPrimaryStore(s), budgetFile, b, "")
+	if core.IsErr(err, nil, "cannot cache budget: %v") {
+		return 0, err
+	}
+	return b.Budget, nil
+}
+
+// checkBudget compares the cost of the month with the budget and reduces the background traffic when the budget is
+// exceeded
+func checkBudget(s *Safe) {
+	report, err := GetUsage(s)
+	if core.IsErr(err, nil, "cannot check budget of %s: %v", s.Name) {
+		return
+	}
+
+	s.storeLock.Lock()
+	changed := s.overBudget != report.OverBudget
+	s.overBudget = report.OverBudget
+	s.storeLock.Unlock()
+
+	if changed && report.OverBudget {
+		core.Info("safe %s is over budget: %s", s.Name, report.Warning)
+	} else if changed {
+		core.Info("safe %s is within budget again", s.Name)
+	}
+}
+
+// isOverBudget returns true when the last check found the cost of the month above the budget
+func isOverBudget(s *Safe) bool {
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	return s.overBudget
+}
@@ -0,0 +1,51 @@
+package safe
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+func TestUsageAndBudget(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	_, err = Put(s, "bucket", "file", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+
+	report, err := GetUsage(s)
+	core.TestErr(t, err, "cannot get usage: %v")
+	core.Assert(t, len(report.Stores) == 1 && report.Stores[0].Url == testUrl, "Unexpected stores %v", report.Stores)
+	u := report.Stores[0]
+	core.Assert(t, u.BytesWritten >= int64(len(testData)) && u.Writes > 0, "Unexpected usage %+v", u)
+	core.Assert(t, report.Cost > 0 && report.Estimate >= report.Cost, "Unexpected cost %f, estimate %f",
+		report.Cost, report.Estimate)
+	core.Assert(t, report.Budget == 0 && !report.OverBudget && report.Warning == "", "Unexpected budget %+v", report)
+
+	// the usage is kept in the DB across flushes
+	_, err = Put(s, "bucket", "file2", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	next, err := GetUsage(s)
+	core.TestErr(t, err, "cannot get usage: %v")
+	core.Assert(t, next.Stores[0].BytesWritten > u.BytesWritten, "Usage not accumulated: %+v", next.Stores[0])
+
+	err = SetBudget(s, next.Cost/2)
+	core.TestErr(t, err, "cannot set budget: %v")
+	report, err = GetUsage(s)
+	core.TestErr(t, err, "cannot get usage: %v")
+	core.Assert(t, report.OverBudget && strings.Contains(report.Warning, "prefetch is paused"),
+		"Expected over budget, got %+v", report)
+	core.Assert(t, isOverBudget(s), "Expected background traffic to be reduced")
+
+	err = SetBudget(s, 0)
+	core.TestErr(t, err, "cannot remove budget: %v")
+	core.Assert(t, !isOverBudget(s), "Expected no budget")
+}
@@ -33,18 +33,27 @@ func SetUsers(s *Safe, users Users, options SetUsersOptions) error {
 		return err
 	}
 
-	delta := map[string]Permission{} // delta is the difference between the current users and the new users
-	var includesRevoke bool          // includesRevoke is true if the new users include a revoke of a permission
-
-	for userId, permission := range users {
-		if p, ok := s.Users[userId]; !ok || p != permission {
-			if s.Permission < p || s.Permission < permission {
-				return fmt.Errorf(ErrUnauthorized, currentUserId, userId, p, permission, s.Name)
+	var delta map[string]Permission // delta is the difference between the current users and the new users
+	var includesRevoke bool         // includesRevoke is true if the new users include a revoke of a permission
+
+	store := getPrimaryStore(s)
+	err = retryConfigChange(s, func() error {
+		delta = map[string]Permission{}
+		includesRevoke = false
+		for userId, permission := range users {
+			if p, ok := s.Users[userId]; !ok || p != permission {
+				if s.Permission < p || s.Permission < permission {
+					return fmt.Errorf(ErrUnauthorized, currentUserId, userId, p, permission, s.Name)
+				}
+
+				delta[userId] = permission
+				includesRevoke = includesRevoke || permission <= Suspended
 			}
-
-			delta[userId] = permission
-			includesRevoke = includesRevoke || permission <= Suspended
 		}
+		return writePermissionChange(store, s.Name, s.CurrentUser, delta)
+	})
+	if core.IsErr(err, nil, "cannot write permission change in %s: %v", s.Name) {
+		return err
 	}
 
 	// for userId, permission := range delta {
@@ -54,19 +63,25 @@ func SetUsers(s *Safe, users Users, options SetUsersOptions) error {
 	// 	}
 	// }
 
-	store := s.PrimaryStore
-	err = writePermissionChange(store, s.Name, s.CurrentUser, delta)
-	if core.IsErr(err, nil, "cannot write permission change in %s: %v", s.Name) {
-		return err
-	}
-
 	if includesRevoke {
-		keystore := Keystore{
-			LastKeyId: snowflake.ID(),
-			Keys:      make(map[uint64][]byte),
-		}
-		keystore.Keys[keystore.LastKeyId] = core.GenerateRandomBytes(KeySize)
-		err = writeKeyStoreFile(store, s.Name, s.CurrentUser, keystore, users)
+		var keystore Keystore
+		err = retryConfigChange(s, func() error {
+			// on a retry the key must be newer than the one written by the other peer
+			keystore = Keystore{
+				LastKeyId: snowflake.ID(),
+				Keys:      make(map[uint64][]byte),
+			}
+			keystore.Keys[keystore.LastKeyId] = core.GenerateRandomBytes(KeySize)
+
+			recipients := Users{}
+			for userId, permission := range s.Users {
+				recipients[userId] = permission
+			}
+			for userId, permission := range users {
+				recipients[userId] = permission
+			}
+			return writeKeyStoreFile(store, s.Name, s.CurrentUser, keystore, recipients)
+		})
 		if core.IsErr(err, nil, "cannot write keystore in %s: %v", s.Name) {
 			return err
 		}
@@ -83,7 +98,9 @@ func SetUsers(s *Safe, users Users, options SetUsersOptions) error {
 		}
 
 	} else {
-		err = writeKeyStoreFile(store, s.Name, s.CurrentUser, s.Keystore, delta)
+		err = retryConfigChange(s, func() error {
+			return writeKeyStoreFile(store, s.Name, s.CurrentUser, s.Keystore, delta)
+		})
 		if core.IsErr(err, nil, "cannot write keystore in %s: %v", s.Name) {
 			return err
 		}
@@ -98,11 +115,13 @@ func SetUsers(s *Safe, users Users, options SetUsersOptions) error {
 		s.Users[userId] = permission
 		deleteInitiateFile(s.Name, store, userId)
 	}
+	s.history.add(delta, core.Now())
 
 	err = setSafeConfigToDB(s.Name, safeConfig{
 		Description: s.Description,
 		Keystore:    s.Keystore,
 		Users:       s.Users,
+		History:     s.history,
 	})
 	if core.IsErr(err, nil, "cannot save config of %s to DB: %v", s.Name) {
 		return err
@@ -116,17 +135,23 @@ func GetUsers(s *Safe) (Users, error) {
 }
 
 func SyncUsers(s *Safe) (int, error) {
+	return syncSafeUsers(s, false)
+}
+
+// syncSafeUsers reads the users and the keystore from the primary store. When force is false the read is skipped
+// if the touch file did not change since the last sync.
+func syncSafeUsers(s *Safe, force bool) (int, error) {
 	now := core.Now()
 	core.Info("synchronizing users in %s", s.Name)
 	s.usersLock.Lock()
 	defer s.usersLock.Unlock()
 
-	store := s.PrimaryStore
+	store := getPrimaryStore(s)
 	synced, err := GetCached(s.Name, store, "config/.access.touch", nil, "")
 	if core.IsErr(err, nil, "cannot sync touch file in %s: %v", s.Name) {
 		return 0, err
 	}
-	if synced {
+	if synced && s.history != nil && !force {
 		core.Info("users in %s are up to date", s.Name)
 		return 0, nil
 	}
@@ -137,10 +162,14 @@ func SyncUsers(s *Safe) (int, error) {
 	}
 	core.Info("found %d new identities in safe %s", len(identities), s.Name)
 
-	users, count, err := syncUsers(s.Name, store, s.CurrentUser, s.CreatorId, s.Users)
+	users, history, replicas, count, err := syncUsers(s.Name, store, s.CurrentUser, s.CreatorId, s.Users)
 	if core.IsErr(err, nil, "cannot sync users in %s: %v", s.Name) {
 		return 0, err
 	}
+	for _, replica := range replicas {
+		err = setStoreInDB(s.Name, replica)
+		core.IsErr(err, nil, "cannot add replica %s to %s: %v", replica.Url, s.Name)
+	}
 	core.Info("synchronized %d users in %s", count, s.Name)
 
 	keystore, _, err := syncKeystore(store, s.Name, s.CurrentUser, users)
@@ -150,20 +179,24 @@ func SyncUsers(s *Safe) (int, error) {
 
 	s.Permission = users[s.CurrentUser.Id]
 	s.Users = users
+	s.history = history
 	s.Keystore = keystore
 	err = setSafeConfigToDB(s.Name, safeConfig{
 		Description: s.Description,
 		Keystore:    s.Keystore,
 		Users:       s.Users,
+		History:     s.history,
 	})
 	if core.IsErr(err, nil, "cannot save config of %s to DB: %v", s.Name) {
 		return 0, err
 	}
 	if s.Permission == 0 {
 		core.Info("creating initiate file for %s", s.CurrentUser.Id)
-		createInitiateFile(s.Name, s.PrimaryStore, s.CurrentUser)
+		createInitiateFile(s.Name, getPrimaryStore(s), s.CurrentUser)
 		return 0, fmt.Errorf("access pending")
 	}
+	// the new history may grant the permissions that quarantined headers were missing
+	releaseQuarantine(s.CurrentUser, s.Name, "", s.history)
 
 	core.Info("syncronized users in safe safe %s in %v", s.Name, core.Since(now))
 	return count, nil
@@ -201,7 +234,8 @@ func SyncUsers(s *Safe) (int, error) {
 // 	return users, nil
 // }
 
-func syncUsers(safeName string, store storage.Store, currentUser security.Identity, creatorId string, users_ Users) (users Users, diff int, err error) {
+func syncUsers(safeName string, store storage.Store, currentUser security.Identity, creatorId string,
+	users_ Users) (users Users, history PermissionHistory, replicas []StoreConfig, diff int, err error) {
 	var count int
 
 	// users_, err := getUsersFromDB(safeName)
@@ -222,9 +256,9 @@ func syncUsers(safeName string, store storage.Store, currentUser security.Identi
 	// 	}
 	// }
 
-	users, _, err = readChangeLogs(safeName, store, currentUser, creatorId, "")
+	users, history, replicas, _, err = readChangeLogs(safeName, store, currentUser, creatorId, "")
 	if core.IsErr(err, nil, "cannot read change logs in %s: %v", safeName) {
-		return Users{}, 0, err
+		return Users{}, nil, nil, 0, err
 	}
 	core.Info("found %d users in changelogs of safe %s", len(users), safeName)
 
@@ -240,7 +274,7 @@ func syncUsers(safeName string, store storage.Store, currentUser security.Identi
 	}
 
 	core.Info("synchronized %d users in %s", count, safeName)
-	return users, count, nil
+	return users, history, replicas, count, nil
 }
 
 func syncIdentities(store storage.Store, name string, currentUser security.Identity) (new []security.Identity, err error) {
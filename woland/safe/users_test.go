@@ -2,10 +2,17 @@ package safe
 
 import (
 	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
 	"testing"
 
+	"github.com/godruoyi/go-snowflake"
+
 	"github.com/stregato/master/woland/core"
 	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
 )
 
 func TestAddSecondUser(t *testing.T) {
@@ -93,3 +100,95 @@ func TestAddSecondUser(t *testing.T) {
 		core.Assert(t, headersIds2[id] == 0, "Expected headers ids to be different, got %d", id)
 	}
 }
+
+// racingStore simulates a peer that changes the config between the read of the sequence and the write
+type racingStore struct {
+	storage.Store
+}
+
+func (r racingStore) WriteIf(name string, source io.ReadSeeker, cond storage.Condition, progress chan int64) error {
+	return storage.WriteIf(r.Store, name, source, cond, progress)
+}
+
+func (r racingStore) ETag(name string) (string, error) {
+	etag, err := storage.ETag(r.Store, name)
+	if err == nil {
+		storage.WriteFile(r.Store, name, []byte(fmt.Sprintf("%d.change", snowflake.ID())))
+	}
+	return etag, err
+}
+
+func TestConcurrentConfigChange(t *testing.T) {
+	InitTest()
+
+	store, err := storage.Open("mem://")
+	core.TestErr(t, err, "cannot open store: %v")
+	defer store.Close()
+
+	users := Users{Identity1.Id: Standard + Admin}
+	err = writePermissionChange(store, testSafe, Identity1, users)
+	core.TestErr(t, err, "cannot write permission change: %v")
+	keystore := Keystore{LastKeyId: 1, Keys: map[uint64][]byte{1: core.GenerateRandomBytes(KeySize)}}
+	err = writeKeyStoreFile(store, testSafe, Identity1, keystore, users)
+	core.TestErr(t, err, "cannot write keystore: %v")
+
+	data, err := storage.ReadFile(store, path.Join(testSafe, ConfigFolder, SequenceFile))
+	core.TestErr(t, err, "cannot read sequence: %v")
+	core.Assert(t, strings.HasSuffix(string(data), ".keystore"), "Expected the keystore in the sequence, got %s", data)
+
+	err = writePermissionChange(racingStore{store}, testSafe, Identity1, users)
+	core.Assert(t, err == ErrConcurrentConfigChange, "Expected ErrConcurrentConfigChange, got %v", err)
+	err = writeKeyStoreFile(racingStore{store}, testSafe, Identity1, keystore, users)
+	core.Assert(t, err == ErrConcurrentConfigChange, "Expected ErrConcurrentConfigChange, got %v", err)
+
+	for _, suffix := range []string{".change", ".keystore"} {
+		ls, err := store.ReadDir(path.Join(testSafe, ConfigFolder), storage.Filter{Suffix: suffix})
+		core.TestErr(t, err, "cannot read config: %v")
+		core.Assert(t, len(ls) == 1, "Expected only the first %s file, got %d", suffix, len(ls))
+	}
+}
+
+// racingOnceStore simulates a peer that changes the config only before the first write
+type racingOnceStore struct {
+	storage.Store
+	races *int
+}
+
+func (r racingOnceStore) WriteIf(name string, source io.ReadSeeker, cond storage.Condition, progress chan int64) error {
+	return storage.WriteIf(r.Store, name, source, cond, progress)
+}
+
+func (r racingOnceStore) ETag(name string) (string, error) {
+	if *r.races == 0 {
+		*r.races++
+		return racingStore{r.Store}.ETag(name)
+	}
+	return storage.ETag(r.Store, name)
+}
+
+func TestRetryConcurrentConfigChange(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	primary := s.PrimaryStore
+	before, err := primary.ReadDir(path.Join(testSafe, ConfigFolder), storage.Filter{Suffix: ".change"})
+	core.TestErr(t, err, "cannot read config: %v")
+
+	var races int
+	s.PrimaryStore = racingOnceStore{primary, &races}
+	err = SetUsers(s, Users{Identity2.Id: Reader}, SetUsersOptions{})
+	s.PrimaryStore = primary
+	core.TestErr(t, err, "cannot set users after a concurrent change: %v")
+	core.Assert(t, races == 1, "Expected one concurrent change, got %d", races)
+	core.Assert(t, s.Users.Is(Identity2.Id, Reader), "Expected user %s to be reader, got %d", Identity2.Id, s.Users[Identity2.Id])
+
+	ls, err := primary.ReadDir(path.Join(testSafe, ConfigFolder), storage.Filter{Suffix: ".change"})
+	core.TestErr(t, err, "cannot read config: %v")
+	core.Assert(t, len(ls) == len(before)+1, "Expected a single change log from SetUsers, got %d", len(ls)-len(before))
+}
@@ -0,0 +1,286 @@
+package safe
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/godruoyi/go-snowflake"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/security"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+// DefaultRetention is the number of versions kept for each file when the bucket has no retention setting
+var DefaultRetention = 10
+
+var ErrNotAdmin = fmt.Errorf("only administrators can perform this operation")
+
+type Version struct {
+	FileId      uint64    `json:"fileId"`      // FileId of the version
+	Creator     string    `json:"creator"`     // Creator of the version
+	Size        int64     `json:"size"`        // Size of the version
+	Hash        []byte    `json:"hash"`        // Hash of the content
+	ModTime     time.Time `json:"modTime"`     // Time when the version was created
+	ContentType string    `json:"contentType"` // Content type of the version
+	Tags        []string  `json:"tags"`        // Tags of the version
+	Current     bool      `json:"current"`     // True if the version is the one returned by Get
+	Changes     []string  `json:"changes"`     // Metadata that differ from the previous version
+}
+
+type bucketRetention struct {
+	Retention int `json:"retention"` // Number of versions kept for each file, 0 for unlimited
+}
+
+// ListVersions returns the versions of a file from the newest to the oldest. Versions whose body has been deleted
+// are not included.
+func ListVersions(s *Safe, bucket, name string) ([]Version, error) {
+	headers, current, err := getVersions(s, bucket, name)
+	if core.IsErr(err, nil, "cannot get versions of %s/%s: %v", bucket, name) {
+		return nil, err
+	}
+
+	var versions []Version
+	for i, h := range headers {
+		versions = append(versions, Version{
+			FileId:      h.FileId,
+			Creator:     h.Creator,
+			Size:        h.Size,
+			Hash:        h.Attributes.Hash,
+			ModTime:     h.ModTime,
+			ContentType: h.Attributes.ContentType,
+			Tags:        h.Attributes.Tags,
+			Current:     h.FileId == current,
+		})
+		if i > 0 {
+			versions[i-1].Changes = diffHeaders(headers[i], headers[i-1])
+		}
+	}
+	core.Info("found %d versions of %s/%s in %s", len(versions), bucket, name, s.Name)
+	return versions, nil
+}
+
+// RestoreVersion republishes the version with the provided fileId as the current version of the file. The restored
+// version gets a new FileId and reuses the body already in the store, so that the old version stays in the history.
+func RestoreVersion(s *Safe, bucket, name string, fileId uint64) (Header, error) {
+	if !canWrite(s.Permission) {
+		core.Info("user %s cannot restore %s in %s: permission %d", s.CurrentUser.Id, name, s.Name, s.Permission)
+		return Header{}, ErrNoWritePermission
+	}
+
+	header, _, err := getLastHeader(s.Name, bucket, name, fileId)
+	if core.IsErr(err, nil, "cannot get version %d of %s/%s: %v", fileId, bucket, name) {
+		return Header{}, err
+	}
+	if header.Deleted {
+		core.Info("body of version %d of %s/%s has been deleted", fileId, bucket, name)
+		return Header{}, ErrFileNotExist
+	}
+	if header.PrivateId != "" && header.Creator != s.CurrentUser.Id {
+		// the body key of a private file depends on the creator
+		return Header{}, fmt.Errorf("%w: only the creator can restore private file %s", ErrNoWritePermission, name)
+	}
+
+	header.BodyId = bodyIdOf(header)
+	header.FileId = snowflake.ID()
+	header.Creator = s.CurrentUser.Id
+	header.ModTime = core.Now()
+	header.Replace = true
+	header.ReplaceId = 0
+	header.Uploading = false
+	header.Signature = nil
+	header.Cached, header.CachedExpires, header.Downloads, header.SourceFile = "", time.Time{}, nil, ""
+
+	// the chunks must not be collected when the old version is deleted
+	for _, c := range header.Chunks {
+		err = storage.WriteFile(getPrimaryStore(s), chunkRef(s.Name, c.id(), header.FileId), nil)
+		if core.IsErr(err, nil, "cannot write reference to chunk %s: %v", c.id()) {
+			return Header{}, err
+		}
+	}
+
+	headerId := snowflake.ID()
+	err = insertHeaderOrIgnoreToDB(s.Name, bucket, headerId, header)
+	if core.IsErr(err, nil, "cannot insert header: %v", err) {
+		return Header{}, err
+	}
+	err = setReplacedInDB(s.Name, bucket, header)
+	if core.IsErr(err, nil, "cannot hide previous versions of %s: %v", name) {
+		return Header{}, err
+	}
+	header, err = writeHeader(s, bucket, header, headerId)
+	if core.IsErr(err, nil, "cannot write header: %v", err) {
+		return Header{}, err
+	}
+	core.Info("restored version %d of %s/%s in %s as %d", fileId, bucket, name, s.Name, header.FileId)
+
+	enforceRetention(s, bucket, name)
+	return header, nil
+}
+
+// SetRetention sets the number of versions kept for each file in the bucket. Zero keeps all the versions. Only
+// administrators can change the retention.
+func SetRetention(s *Safe, bucket string, retention int) error {
+	if s.Permission&Admin == 0 {
+		return ErrNotAdmin
+	}
+
+	data, err := security.Marshal(s.CurrentUser, bucketRetention{Retention: retention}, "signature")
+	if core.IsErr(err, nil, "cannot marshal retention: %v", err) {
+		return err
+	}
+	key := path.Join(DataFolder, hashPath(bucket), ".retention.json")
+	err = storage.WriteFile(getPrimaryStore(s), path.Join(s.Name, key), data)
+	if core.IsErr(err, nil, "cannot write retention for %s/%s: %v", s.Name, bucket) {
+		return err
+	}
+	err = SetCached(s.Name, getPrimaryStore(s), key, bucketRetention{Retention: retention}, "")
+	if core.IsErr(err, nil, "cannot cache retention for %s/%s: %v", s.Name, bucket) {
+		return err
+	}
+	core.Info("set retention of %s/%s to %d versions", s.Name, bucket, retention)
+	return nil
+}
+
+// GetRetention returns the number of versions kept for each file in the bucket
+func GetRetention(s *Safe, bucket string) (int, error) {
+	var r bucketRetention
+
+	key := path.Join(DataFolder, hashPath(bucket), ".retention.json")
+	synced, err := GetCached(s.Name, getPrimaryStore(s), key, &r, "")
+	if core.IsErr(err, nil, "cannot check retention file: %v") {
+		return 0, err
+	}
+	if synced {
+		return r.Retention, nil
+	}
+
+	data, err := storage.ReadFile(getPrimaryStore(s), path.Join(s.Name, key))
+	if os.IsNotExist(err) {
+		return DefaultRetention, nil
+	}
+	if core.IsErr(err, nil, "cannot read retention file: %v") {
+		return 0, err
+	}
+	signedBy, err := security.Unmarshal(data, &r, "signature")
+	if core.IsErr(err, nil, "cannot read retention file: %v") {
+		return 0, err
+	}
+	if s.Users[signedBy]&Admin == 0 {
+		core.Info("retention of %s/%s signed by %s who is not an administrator", s.Name, bucket, signedBy)
+		return DefaultRetention, nil
+	}
+
+	err = SetCached(s.Name, getPrimaryStore(s), key, r, "")
+	if core.IsErr(err, nil, "cannot cache retention: %v") {
+		return 0, err
+	}
+	return r.Retention, nil
+}
+
+// enforceRetention deletes the oldest versions of the file beyond the retention of the bucket. Versions of other users
+// are deleted only by administrators.
+func enforceRetention(s *Safe, bucket, name string) {
+	retention, err := GetRetention(s, bucket)
+	if core.IsErr(err, nil, "cannot get retention of %s/%s: %v", s.Name, bucket) || retention <= 0 {
+		return
+	}
+
+	headers, _, err := getVersions(s, bucket, name)
+	if core.IsErr(err, nil, "cannot get versions of %s/%s: %v", bucket, name) || len(headers) <= retention {
+		return
+	}
+	// versions used as base by the kept versions are kept as well
+	bases := deltaBases(headers[:retention], headers)
+	for _, header := range headers[retention:] {
+		if !canDelete(header, s.CurrentUser.Id, s.Permission) || bases[header.FileId] {
+			continue
+		}
+		err = writeTombstone(s, bucket, header)
+		if !core.IsErr(err, nil, "cannot delete version %d of %s: %v", header.FileId, name) {
+			core.Info("deleted version %d of %s/%s beyond retention %d", header.FileId, bucket, name, retention)
+		}
+	}
+}
+
+// getVersions returns the headers with the name from the newest to the oldest, excluding tombstones, and the fileId
+// of the current version.
+func getVersions(s *Safe, bucket, name string) (headers []Header, current uint64, err error) {
+	rows, err := sql.Query("GET_VERSIONS", sql.Args{"safe": s.Name, "bucket": bucket, "name": name})
+	if core.IsErr(err, nil, "cannot query versions: %v", err) {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data []byte
+		var deleted, tombstoned bool
+		var header Header
+		if core.IsErr(rows.Scan(&data, &deleted, &tombstoned), nil, "cannot scan version: %v") {
+			continue
+		}
+		if core.IsErr(json.Unmarshal(data, &header), nil, "cannot unmarshal version: %v") {
+			continue
+		}
+		if header.Deleted || tombstoned {
+			continue
+		}
+		if header.PrivateId != "" && header.PrivateId != s.CurrentUser.Id && header.Creator != s.CurrentUser.Id {
+			continue
+		}
+		if !deleted && current == 0 {
+			current = header.FileId
+		}
+		headers = append(headers, header)
+	}
+	sort.SliceStable(headers, func(i, j int) bool {
+		return headers[i].ModTime.After(headers[j].ModTime)
+	})
+	return headers, current, nil
+}
+
+// setReplacedInDB hides the versions of the file older than the header
+func setReplacedInDB(safeName, bucket string, header Header) error {
+	_, err := sql.Exec("SET_REPLACED_FILES", sql.Args{
+		"safe":    safeName,
+		"bucket":  bucket,
+		"name":    header.Name,
+		"fileId":  header.FileId,
+		"modTime": header.ModTime.UnixMilli(),
+	})
+	return err
+}
+
+// diffHeaders returns the names of the metadata that differ between two versions
+func diffHeaders(older, newer Header) []string {
+	var changes []string
+	if older.Creator != newer.Creator {
+		changes = append(changes, "creator")
+	}
+	if older.Size != newer.Size {
+		changes = append(changes, "size")
+	}
+	if !bytes.Equal(older.Attributes.Hash, newer.Attributes.Hash) {
+		changes = append(changes, "hash")
+	}
+	if older.Attributes.ContentType != newer.Attributes.ContentType {
+		changes = append(changes, "contentType")
+	}
+	if !reflect.DeepEqual(older.Attributes.Tags, newer.Attributes.Tags) {
+		changes = append(changes, "tags")
+	}
+	if !reflect.DeepEqual(older.Attributes.Meta, newer.Attributes.Meta) {
+		changes = append(changes, "meta")
+	}
+	if !bytes.Equal(older.Attributes.Thumbnail, newer.Attributes.Thumbnail) {
+		changes = append(changes, "thumbnail")
+	}
+	return changes
+}
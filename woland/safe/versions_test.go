@@ -0,0 +1,87 @@
+package safe
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+func TestVersions(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, nil, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	defer Close(s)
+
+	var headers []Header
+	for _, data := range []string{"first", "fifth", "third!"} {
+		h, err := Put(s, "bucket", "file", core.NewBytesReader([]byte(data)), PutOptions{Replace: true}, nil)
+		core.TestErr(t, err, "cannot put file: %v")
+		headers = append(headers, h)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	versions, err := ListVersions(s, "bucket", "file")
+	core.TestErr(t, err, "cannot list versions: %v")
+	core.Assert(t, len(versions) == 3, "Expected 3 versions, got %d", len(versions))
+	core.Assert(t, versions[0].FileId == headers[2].FileId && versions[0].Current, "Expected third version to be current")
+	core.Assert(t, !versions[1].Current && !versions[2].Current, "Expected only one current version")
+	core.Assert(t, len(versions[0].Changes) == 2, "Expected hash and size changes, got %v", versions[0].Changes)
+	core.Assert(t, len(versions[1].Changes) == 1, "Expected hash change, got %v", versions[1].Changes)
+
+	restored, err := RestoreVersion(s, "bucket", "file", headers[0].FileId)
+	core.TestErr(t, err, "cannot restore version: %v")
+	core.Assert(t, restored.FileId != headers[0].FileId && restored.BodyId == headers[0].FileId,
+		"Expected restored version with a new FileId on the body of the first version")
+	files, err := ListFiles(s, "bucket", ListOptions{Name: "file"})
+	core.TestErr(t, err, "cannot list files: %v")
+	core.Assert(t, len(files) == 1 && files[0].FileId == restored.FileId, "Expected restored version in listing")
+	versions, err = ListVersions(s, "bucket", "file")
+	core.TestErr(t, err, "cannot list versions: %v")
+	core.Assert(t, len(versions) == 4, "Expected 4 versions after restore, got %d", len(versions))
+	core.Assert(t, versions[3].FileId == headers[0].FileId, "Expected the first version to stay in the history")
+
+	b := bytes.NewBuffer(nil)
+	_, err = Get(s, "bucket", "file", b, GetOptions{NoCache: true})
+	core.TestErr(t, err, "cannot get file: %v")
+	core.Assert(t, b.String() == "first", "Expected restored content 'first', got '%s'", b.String())
+
+	retention, err := GetRetention(s, "bucket")
+	core.TestErr(t, err, "cannot get retention: %v")
+	core.Assert(t, retention == DefaultRetention, "Expected default retention, got %d", retention)
+	err = SetRetention(s, "bucket", 2)
+	core.TestErr(t, err, "cannot set retention: %v")
+	retention, err = GetRetention(s, "bucket")
+	core.TestErr(t, err, "cannot get retention: %v")
+	core.Assert(t, retention == 2, "Expected retention 2, got %d", retention)
+
+	time.Sleep(10 * time.Millisecond)
+	_, err = Put(s, "bucket", "file", core.NewBytesReader([]byte("fourth")), PutOptions{Replace: true}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	versions, err = ListVersions(s, "bucket", "file")
+	core.TestErr(t, err, "cannot list versions: %v")
+	core.Assert(t, len(versions) == 2, "Expected 2 versions after retention, got %d", len(versions))
+	core.Assert(t, versions[1].FileId == restored.FileId, "Expected restored version to be kept")
+
+	_, err = CollectGarbage(s)
+	core.TestErr(t, err, "cannot collect garbage: %v")
+	bodyFolder := path.Join(s.Name, DataFolder, hashPath("bucket"), BodyFolder)
+	_, err = s.PrimaryStore.Stat(path.Join(bodyFolder, fmt.Sprintf("%d", headers[0].FileId)))
+	core.TestErr(t, err, "expected body of the restored version to be kept: %v")
+	_, err = s.PrimaryStore.Stat(path.Join(bodyFolder, fmt.Sprintf("%d", headers[1].FileId)))
+	core.Assert(t, os.IsNotExist(err), "Expected body beyond retention to be deleted, got %v", err)
+
+	b = bytes.NewBuffer(nil)
+	_, err = Get(s, "bucket", "file", b, GetOptions{NoCache: true, FileId: restored.FileId})
+	core.TestErr(t, err, "cannot get restored version: %v")
+	core.Assert(t, b.String() == "first", "Expected restored content 'first', got '%s'", b.String())
+}
@@ -1,20 +1,191 @@
 package safe
 
-// func Wipe(currentUser security.Identity, name string) error {
-// 	name, err := validName(name)
-// 	if core.IsErr(err, nil, "invalid name %s: %v", name) {
-// 		return err
-// 	}
-
-// 	s, err := storage.Open(url)
-// 	if core.IsErr(err, nil, "cannot open store: %v", err) {
-// 		return err
-// 	}
-
-// 	err = s.Delete(name)
-// 	if core.IsErr(err, nil, "cannot delete portal '%s': %v", name, err) {
-// 		return err
-// 	}
-
-// 	return nil
-// }
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/security"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+var ErrNotCreator = fmt.Errorf("only the creator can perform this operation")
+
+type WipeOptions struct {
+	DryRun bool `json:"dryRun"` // DryRun reports what would be deleted without deleting anything
+}
+
+type WipedStore struct {
+	Url   string `json:"url"`   // Url of the store
+	Files int    `json:"files"` // Number of files deleted from the store
+	Size  int64  `json:"size"`  // Total size of the files deleted from the store
+	Error string `json:"error"` // Error encountered while wiping the store, if any
+}
+
+type WipeReport struct {
+	Name       string       `json:"name"`       // Name of the safe
+	DryRun     bool         `json:"dryRun"`     // DryRun is true if nothing was actually deleted
+	Stores     []WipedStore `json:"stores"`     // Files deleted on each store
+	Headers    int          `json:"headers"`    // Headers removed from the DB
+	Users      int          `json:"users"`      // Users removed from the DB
+	StoreRows  int          `json:"storeRows"`  // Store configurations removed from the DB
+	Configs    int          `json:"configs"`    // Safe configurations removed from the DB
+	CacheFiles []string     `json:"cacheFiles"` // Files removed from the cache folder
+}
+
+// Wipe removes the safe from all its stores, from the local DB and from the cache folder. Only the creator of the
+// safe can wipe it. When options.DryRun is true, the returned report lists what would be deleted.
+func Wipe(currentUser security.Identity, name string, options WipeOptions) (WipeReport, error) {
+	name, err := validName(name)
+	if core.IsErr(err, nil, "invalid name %s: %v", name) {
+		return WipeReport{}, err
+	}
+
+	config, err := getSafeConfigFromDB(name, "")
+	if core.IsErr(err, nil, "cannot read config of safe %s from DB: %v", name) {
+		return WipeReport{}, err
+	}
+	if config.Users[currentUser.Id]&Creator == 0 {
+		core.Info("user %s cannot wipe safe %s: permission %d", currentUser.Id, name, config.Users[currentUser.Id])
+		return WipeReport{}, ErrNotCreator
+	}
+
+	storeConfigs, err := getStoreConfigsFromDB(name)
+	if core.IsErr(err, nil, "cannot get stores for safe %s: %v", name) {
+		return WipeReport{}, err
+	}
+
+	report := WipeReport{Name: name, DryRun: options.DryRun}
+	for _, sc := range storeConfigs {
+		report.Stores = append(report.Stores, wipeStore(name, sc.Url, options.DryRun))
+	}
+
+	report.CacheFiles, err = getCacheFilesOfSafe(name)
+	if core.IsErr(err, nil, "cannot get cache files of safe %s: %v", name) {
+		return WipeReport{}, err
+	}
+
+	err = sql.QueryRow("COUNT_SAFE_ROWS", sql.Args{"safe": name}, &report.Headers, &report.Users,
+		&report.StoreRows, &report.Configs)
+	if core.IsErr(err, nil, "cannot count rows of safe %s: %v", name) {
+		return WipeReport{}, err
+	}
+
+	if options.DryRun {
+		core.Info("dry run wipe of safe %s: %d stores, %d headers, %d cache files", name, len(report.Stores),
+			report.Headers, len(report.CacheFiles))
+		return report, nil
+	}
+
+	for _, f := range report.CacheFiles {
+		err = os.Remove(f)
+		core.IsErr(err, nil, "cannot remove cache file %s: %v", f)
+	}
+
+	err = resetSafeInDB(name)
+	if core.IsErr(err, nil, "cannot reset safe information in db: %v") {
+		return report, err
+	}
+	_, err = sql.Exec("DELETE_SAFE_CONFIG", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot delete config of safe %s: %v", name) {
+		return report, err
+	}
+	err = sql.DelConfigs(fmt.Sprintf("safe:cache:%s", name))
+	if core.IsErr(err, nil, "cannot delete touch info of safe %s: %v", name) {
+		return report, err
+	}
+
+	core.Info("safe %s wiped: %d stores, %d headers, %d cache files", name, len(report.Stores), report.Headers,
+		len(report.CacheFiles))
+	return report, nil
+}
+
+func wipeStore(name string, url string, dryRun bool) WipedStore {
+	ws := WipedStore{Url: url}
+
+	store, err := storage.Open(url)
+	if core.IsErr(err, nil, "cannot open store %s: %v", url) {
+		ws.Error = err.Error()
+		return ws
+	}
+	defer store.Close()
+
+	err = countFilesInStore(store, name, &ws)
+	if core.IsErr(err, nil, "cannot count files of %s in %s: %v", name, url) {
+		ws.Error = err.Error()
+		return ws
+	}
+	if dryRun {
+		return ws
+	}
+
+	err = store.Delete(name)
+	if !os.IsNotExist(err) && core.IsErr(err, nil, "cannot delete safe %s from %s: %v", name, url) {
+		ws.Error = err.Error()
+		return ws
+	}
+	core.Info("deleted %d files (%d bytes) of safe %s from %s", ws.Files, ws.Size, name, url)
+	return ws
+}
+
+func countFilesInStore(store storage.Store, dir string, ws *WipedStore) error {
+	ls, err := store.ReadDir(dir, storage.Filter{})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, l := range ls {
+		if l.IsDir() {
+			err = countFilesInStore(store, path.Join(dir, l.Name()), ws)
+			if err != nil {
+				return err
+			}
+		} else {
+			ws.Files++
+			ws.Size += l.Size()
+		}
+	}
+	return nil
+}
+
+func getCacheFilesOfSafe(name string) ([]string, error) {
+	rows, err := sql.Query("GET_SAFE_HEADS", sql.Args{"safe": name})
+	if core.IsErr(err, nil, "cannot get headers of safe %s: %v", name) {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []string
+	seen := map[string]bool{}
+	for rows.Next() {
+		var data []byte
+		var header Header
+		err = rows.Scan(&data)
+		if core.IsErr(err, nil, "cannot scan header: %v") {
+			continue
+		}
+		err = json.Unmarshal(data, &header)
+		if core.IsErr(err, nil, "cannot unmarshal header: %v") {
+			continue
+		}
+
+		cacheFile := cacheFileOf(name, header.FileId)
+		legacyCacheFile := filepath.Join(CacheFolder, fmt.Sprintf("%d.cache", header.FileId))
+		for _, f := range []string{header.Cached, cacheFile, cacheFile + ".etag", legacyCacheFile} {
+			if f == "" || seen[f] {
+				continue
+			}
+			seen[f] = true
+			if _, err := os.Stat(f); err == nil {
+				files = append(files, f)
+			}
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,44 @@
+package safe
+
+import (
+	"testing"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+	"github.com/stregato/master/woland/storage"
+)
+
+func TestWipe(t *testing.T) {
+	InitTest()
+
+	StartTestDB(t, dbPath)
+	defer sql.CloseDB()
+
+	s, err := Create(Identity1, testSafe, testStoreConfig, Users{Identity2.Id: Reader + Standard}, CreateOptions{Wipe: true})
+	core.TestErr(t, err, "cannot create safe: %v")
+	_, err = Put(s, "bucket", "file", core.NewBytesReader(testData), PutOptions{}, nil)
+	core.TestErr(t, err, "cannot put file: %v")
+	Close(s)
+
+	_, err = Wipe(Identity2, testSafe, WipeOptions{})
+	core.Assert(t, err == ErrNotCreator, "Expected ErrNotCreator, got %v", err)
+
+	report, err := Wipe(Identity1, testSafe, WipeOptions{DryRun: true})
+	core.TestErr(t, err, "cannot wipe safe: %v")
+	core.Assert(t, len(report.Stores) == 1, "Expected 1 store, got %d", len(report.Stores))
+	core.Assert(t, report.Stores[0].Files > 0, "Expected files in store")
+	core.Assert(t, report.Headers == 1, "Expected 1 header, got %d", report.Headers)
+	core.Assert(t, report.Configs == 1, "Expected 1 config, got %d", report.Configs)
+
+	report, err = Wipe(Identity1, testSafe, WipeOptions{})
+	core.TestErr(t, err, "cannot wipe safe: %v")
+	core.Assert(t, report.Stores[0].Error == "", "Unexpected error in store: %s", report.Stores[0].Error)
+
+	_, err = Wipe(Identity1, testSafe, WipeOptions{DryRun: true})
+	core.Assert(t, err == ErrNotCreator, "Expected ErrNotCreator after wipe, got %v", err)
+
+	store, err := storage.Open(testUrl)
+	core.TestErr(t, err, "cannot open store: %v")
+	_, err = store.Stat(testSafe)
+	core.Assert(t, err != nil, "Expected safe to be deleted from store")
+}
@@ -41,7 +41,16 @@ func createTables() error {
 		key, ql := part[3:cr], part[cr+1:]
 
 		if strings.HasPrefix(key, "INIT") {
-			_, err := db.Exec(ql)
+			added, err := isColumnAdded(ql)
+			if err != nil {
+				logrus.Errorf("cannot check the columns of SQL Init stmt (line %d) '%s': %v", line, ql, err)
+				return err
+			}
+			if added {
+				// the column of an ALTER TABLE was added when the DB was opened before
+				continue
+			}
+			_, err = db.Exec(ql)
 			if err != nil {
 				logrus.Errorf("cannot execute SQL Init stmt (line %d) '%s': %v", line, ql, err)
 				return err
@@ -57,6 +66,35 @@ func createTables() error {
 	return nil
 }
 
+// isColumnAdded returns true when the statement is an ALTER TABLE ... ADD COLUMN and the table already has the column
+func isColumnAdded(ql string) (bool, error) {
+	fields := strings.Fields(ql)
+	if len(fields) < 6 || !strings.EqualFold(fields[0], "ALTER") || !strings.EqualFold(fields[3], "ADD") ||
+		!strings.EqualFold(fields[4], "COLUMN") {
+		return false, nil
+	}
+	table, column := fields[2], fields[5]
+
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, typ string
+		var dflt any
+		err = rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk)
+		if err != nil {
+			return false, err
+		}
+		if strings.EqualFold(name, column) {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 // LoadSQLFromFile loads the sql queries from the provided file path. It panics in case the file cannot be loaded
 func LoadSQLFromFile(name string) error {
 	ddl, err := os.ReadFile(name)
@@ -93,7 +131,12 @@ func OpenDB(dbPath string) error {
 
 	var err error
 	//db, err = sql.Open("sqlite3", DbPath)
-	db, err = sql.Open("sqlite3", DbPath+"?cache=shared&mode=rwc")
+	dsn := DbPath + "?cache=shared&mode=rwc"
+	if DbPath == MemoryDBPath {
+		// every connection to ":memory:" opens a new empty DB unless it is a shared cache URI
+		dsn = "file::memory:?cache=shared"
+	}
+	db, err = sql.Open("sqlite3", dsn)
 	if err != nil {
 		logrus.Errorf("cannot open SQLite db in %s: %v", DbPath, err)
 		return err
@@ -104,6 +147,11 @@ func OpenDB(dbPath string) error {
 	return createTables()
 }
 
+// IsOpen returns true when the DB has been opened with OpenDB
+func IsOpen() bool {
+	return db != nil
+}
+
 func CloseDB() error {
 	if db == nil {
 		return os.ErrClosed
@@ -100,6 +100,7 @@ CREATE TABLE IF NOT EXISTS Header (
   name TEXT NOT NULL,
   size INTEGER NOT NULL,
   fileId INTEGER NOT NULL,
+  bodyId INTEGER NOT NULL DEFAULT 0,
   headerId INTEGER NOT NULL,
   base TEXT NOT NULL,
   dir TEXT,
@@ -117,6 +118,9 @@ CREATE TABLE IF NOT EXISTS Header (
   PRIMARY KEY (safe, bucket, fileId)
 );
 
+-- INIT
+ALTER TABLE Header ADD COLUMN bodyId INTEGER NOT NULL DEFAULT 0
+
 -- INIT
 CREATE INDEX IF NOT EXISTS modTimeIndex ON Header (modTime);
 
@@ -127,10 +131,242 @@ CREATE INDEX IF NOT EXISTS fileIdIndex ON Header (fileId);
 CREATE INDEX IF NOT EXISTS nameIndex ON Header (name);
 
 -- INSERT_HEADER
-INSERT INTO Header (safe, bucket, name, headerId, fileId, size, base, dir, depth, modTime, syncTime, tags, contentType, creator, privateId, deleted, uploading, cacheExpires, head)
-VALUES (:safe, :bucket, :name, :headerId, :fileId, :size, :base, :dir, :depth, :modTime, :syncTime, :tags, :contentType, :creator, :privateId, :deleted, :uploading, :cacheExpires, :header)
-ON CONFLICT (safe, bucket, fileId) DO UPDATE SET name = :name, headerId = :headerId, syncTime = :syncTime, tags = :tags, contentType = :contentType, creator = :creator, privateId = :privateId, deleted = :deleted, uploading = :uploading, cacheExpires = :cacheExpires, head = :header
-WHERE safe = :safe AND bucket = :bucket AND fileId = :fileId;
+INSERT INTO Header (safe, bucket, name, headerId, fileId, bodyId, size, base, dir, depth, modTime, syncTime, tags, contentType, creator, privateId, deleted, uploading, cacheExpires, head)
+VALUES (:safe, :bucket, :name, :headerId, :fileId, :bodyId, :size, :base, :dir, :depth, :modTime, :syncTime, :tags, :contentType, :creator, :privateId, :deleted, :uploading, :cacheExpires, :header)
+ON CONFLICT (safe, bucket, fileId) DO UPDATE SET name = :name, headerId = :headerId, modTime = :modTime, syncTime = :syncTime, tags = :tags, contentType = :contentType, creator = :creator, privateId = :privateId, deleted = :deleted, uploading = :uploading, cacheExpires = :cacheExpires, head = :header
+WHERE safe = :safe AND bucket = :bucket AND fileId = :fileId AND (deleted = 0 OR modTime < :modTime);
+
+-- INIT
+CREATE TABLE IF NOT EXISTS Quarantine (
+  safe TEXT NOT NULL,
+  bucket TEXT NOT NULL,
+  headerId INTEGER NOT NULL,
+  fileId INTEGER NOT NULL,
+  name TEXT NOT NULL,
+  creator TEXT,
+  reason TEXT,
+  quarantineTime INTEGER NOT NULL,
+  head BLOB,
+  PRIMARY KEY (safe, bucket, headerId, fileId)
+);
+
+-- INIT
+ALTER TABLE Quarantine ADD COLUMN writtenTime INTEGER NOT NULL DEFAULT 0
+
+-- INIT
+ALTER TABLE Quarantine ADD COLUMN deleted INTEGER NOT NULL DEFAULT 0
+
+-- INSERT_QUARANTINE
+INSERT OR IGNORE INTO Quarantine (safe, bucket, headerId, fileId, name, creator, reason, quarantineTime, writtenTime,
+  deleted, head)
+VALUES (:safe, :bucket, :headerId, :fileId, :name, :creator, :reason, :time, :written, :deleted, :header)
+
+-- GET_QUARANTINE
+SELECT bucket, headerId, reason, quarantineTime, head FROM Quarantine
+WHERE safe = :safe AND (:bucket = '' OR bucket = :bucket) ORDER BY quarantineTime
+
+-- GET_QUARANTINED_HEADERS
+SELECT bucket, headerId, reason, quarantineTime, writtenTime, head FROM Quarantine
+WHERE safe = :safe AND (:bucket = '' OR bucket = :bucket)
+
+-- DELETE_QUARANTINE
+DELETE FROM Quarantine WHERE safe = :safe AND bucket = :bucket AND headerId = :headerId AND fileId = :fileId
+
+-- DELETE_ACCEPTED_QUARANTINE
+DELETE FROM Quarantine
+WHERE safe = :safe AND bucket = :bucket AND headerId = :headerId AND fileId = :fileId AND deleted = :deleted
+
+-- SET_QUARANTINE_REASON
+UPDATE Quarantine SET reason = :reason
+WHERE safe = :safe AND bucket = :bucket AND headerId = :headerId AND fileId = :fileId
+
+-- DELETE_SAFE_QUARANTINE
+DELETE FROM Quarantine WHERE safe = :safe
+
+-- INIT
+CREATE TABLE IF NOT EXISTS Tombstone (
+  safe TEXT NOT NULL,
+  bucket TEXT NOT NULL,
+  fileId INTEGER NOT NULL,
+  headerId INTEGER NOT NULL,
+  creator TEXT,
+  modTime INTEGER NOT NULL,
+  syncTime INTEGER NOT NULL,
+  head BLOB,
+  PRIMARY KEY (safe, bucket, fileId)
+);
+
+-- INIT
+INSERT OR IGNORE INTO Tombstone (safe, bucket, fileId, headerId, creator, modTime, syncTime, head)
+SELECT safe, bucket, fileId, headerId, creator, modTime, syncTime, head FROM Header
+WHERE deleted = 1 AND instr(CAST(head AS TEXT), '"de":true') > 0
+
+-- INSERT_TOMBSTONE
+INSERT OR IGNORE INTO Tombstone (safe, bucket, fileId, headerId, creator, modTime, syncTime, head)
+VALUES (:safe, :bucket, :fileId, :headerId, :creator, :modTime, :syncTime, :header)
+
+-- UPDATE_TOMBSTONE_FILE
+UPDATE Tombstone SET headerId = :headerId WHERE safe = :safe AND bucket = :bucket AND fileId = :fileId
+
+-- DELETE_SAFE_TOMBSTONES
+DELETE FROM Tombstone WHERE safe = :safe
+
+-- INIT
+CREATE TABLE IF NOT EXISTS ChunkRef (
+  safe TEXT NOT NULL,
+  chunkId TEXT NOT NULL,
+  fileId INTEGER NOT NULL,
+  PRIMARY KEY (safe, chunkId, fileId)
+);
+
+-- INIT
+CREATE TABLE IF NOT EXISTS OrphanChunk (
+  safe TEXT NOT NULL,
+  chunkId TEXT NOT NULL,
+  orphanTime INTEGER NOT NULL,
+  PRIMARY KEY (safe, chunkId)
+);
+
+-- INSERT_CHUNK_REF
+INSERT OR IGNORE INTO ChunkRef (safe, chunkId, fileId) VALUES (:safe, :chunkId, :fileId)
+
+-- GET_FILE_CHUNKS
+SELECT chunkId FROM ChunkRef WHERE safe = :safe AND fileId = :fileId
+
+-- DELETE_FILE_CHUNK_REFS
+DELETE FROM ChunkRef WHERE safe = :safe AND fileId = :fileId
+
+-- COUNT_CHUNK_REFS
+SELECT COUNT(*) FROM ChunkRef WHERE safe = :safe AND chunkId = :chunkId
+
+-- INSERT_ORPHAN_CHUNK
+INSERT OR IGNORE INTO OrphanChunk (safe, chunkId, orphanTime) VALUES (:safe, :chunkId, :orphanTime)
+
+-- DELETE_REFERENCED_ORPHAN_CHUNKS
+DELETE FROM OrphanChunk WHERE safe = :safe AND chunkId IN (SELECT chunkId FROM ChunkRef WHERE safe = :safe)
+
+-- GET_ORPHAN_CHUNKS
+SELECT chunkId FROM OrphanChunk WHERE safe = :safe AND orphanTime <= :before
+
+-- DELETE_ORPHAN_CHUNK
+DELETE FROM OrphanChunk WHERE safe = :safe AND chunkId = :chunkId
+
+-- DELETE_SAFE_CHUNKS
+DELETE FROM ChunkRef WHERE safe = :safe
+
+-- DELETE_SAFE_ORPHAN_CHUNKS
+DELETE FROM OrphanChunk WHERE safe = :safe
+
+-- INIT
+CREATE TABLE IF NOT EXISTS Materialize (
+  safe TEXT NOT NULL,
+  bucket TEXT NOT NULL,
+  fileId INTEGER NOT NULL,
+  PRIMARY KEY (safe, bucket, fileId)
+);
+
+-- INSERT_MATERIALIZE
+INSERT OR IGNORE INTO Materialize (safe, bucket, fileId) VALUES (:safe, :bucket, :fileId)
+
+-- GET_MATERIALIZE
+SELECT bucket, fileId FROM Materialize WHERE safe = :safe
+
+-- DELETE_MATERIALIZE
+DELETE FROM Materialize WHERE safe = :safe AND bucket = :bucket AND fileId = :fileId
+
+-- DELETE_SAFE_MATERIALIZE
+DELETE FROM Materialize WHERE safe = :safe
+
+-- INIT
+CREATE TABLE IF NOT EXISTS S3Upload (
+  store TEXT NOT NULL,
+  name TEXT NOT NULL,
+  uploadId TEXT NOT NULL,
+  size INTEGER NOT NULL,
+  partSize INTEGER NOT NULL,
+  PRIMARY KEY (store, name)
+);
+
+-- INIT
+CREATE TABLE IF NOT EXISTS S3Part (
+  uploadId TEXT NOT NULL,
+  part INTEGER NOT NULL,
+  etag TEXT NOT NULL,
+  PRIMARY KEY (uploadId, part)
+);
+
+-- GET_S3_UPLOAD
+SELECT uploadId, size, partSize FROM S3Upload WHERE store = :store AND name = :name
+
+-- SET_S3_UPLOAD
+INSERT OR REPLACE INTO S3Upload (store, name, uploadId, size, partSize) VALUES (:store, :name, :uploadId, :size, :partSize)
+
+-- DELETE_S3_UPLOAD
+DELETE FROM S3Upload WHERE store = :store AND name = :name
+
+-- GET_S3_PARTS
+SELECT part, etag FROM S3Part WHERE uploadId = :uploadId
+
+-- SET_S3_PART
+INSERT OR REPLACE INTO S3Part (uploadId, part, etag) VALUES (:uploadId, :part, :etag)
+
+-- DELETE_S3_PARTS
+DELETE FROM S3Part WHERE uploadId = :uploadId
+
+-- INIT
+CREATE TABLE IF NOT EXISTS DownloadPart (
+  safe TEXT NOT NULL,
+  fileId INTEGER NOT NULL,
+  size INTEGER NOT NULL,
+  etag TEXT NOT NULL DEFAULT '',
+  partSize INTEGER NOT NULL,
+  part INTEGER NOT NULL,
+  PRIMARY KEY (safe, fileId, part)
+);
+
+-- INIT
+ALTER TABLE DownloadPart ADD COLUMN etag TEXT NOT NULL DEFAULT ''
+
+-- INSERT_DOWNLOAD_PART
+INSERT OR REPLACE INTO DownloadPart (safe, fileId, size, etag, partSize, part) VALUES (:safe, :fileId, :size, :etag, :partSize, :part)
+
+-- GET_DOWNLOAD_PARTS
+SELECT part, size, etag, partSize FROM DownloadPart WHERE safe = :safe AND fileId = :fileId
+
+-- DELETE_DOWNLOAD_PARTS
+DELETE FROM DownloadPart WHERE safe = :safe AND fileId = :fileId
+
+-- DELETE_SAFE_DOWNLOAD_PARTS
+DELETE FROM DownloadPart WHERE safe = :safe
+
+-- INIT
+CREATE TABLE IF NOT EXISTS StoreUsage (
+  safe TEXT NOT NULL,
+  url TEXT NOT NULL,
+  month TEXT NOT NULL,
+  bytesRead INTEGER NOT NULL,
+  bytesWritten INTEGER NOT NULL,
+  reads INTEGER NOT NULL,
+  writes INTEGER NOT NULL,
+  lists INTEGER NOT NULL,
+  deletes INTEGER NOT NULL,
+  cost REAL NOT NULL,
+  PRIMARY KEY (safe, url, month)
+);
+
+-- ADD_STORE_USAGE
+INSERT INTO StoreUsage (safe, url, month, bytesRead, bytesWritten, reads, writes, lists, deletes, cost)
+VALUES (:safe, :url, :month, :bytesRead, :bytesWritten, :reads, :writes, :lists, :deletes, :cost)
+ON CONFLICT(safe, url, month) DO UPDATE SET bytesRead = bytesRead + :bytesRead,
+  bytesWritten = bytesWritten + :bytesWritten, reads = reads + :reads, writes = writes + :writes,
+  lists = lists + :lists, deletes = deletes + :deletes, cost = cost + :cost
+
+-- GET_STORE_USAGE
+SELECT url, bytesRead, bytesWritten, reads, writes, lists, deletes, cost FROM StoreUsage
+WHERE safe = :safe AND month = :month ORDER BY url
+
+-- DELETE_SAFE_STORE_USAGE
+DELETE FROM StoreUsage WHERE safe = :safe
 
 -- UPDATE_HEADER
 UPDATE Header SET head = :header, cacheExpires=:cacheExpires, uploading=:uploading WHERE safe = :safe AND bucket = :bucket AND fileId = :fileId
@@ -144,10 +380,34 @@ DELETE FROM Header WHERE safe = :safe AND bucket = :bucket AND headerId = :heade
 -- SET_DELETED_FILE
 UPDATE Header SET deleted = 1 WHERE safe = :safe AND fileId = :fileId
 
+-- SET_DELETED_BODY
+UPDATE Header SET deleted = 1 WHERE safe = :safe AND (fileId = :bodyId OR bodyId = :bodyId)
+
+-- COUNT_BODY_REFS
+SELECT COUNT(*) FROM Header WHERE safe = :safe AND (fileId = :bodyId OR bodyId = :bodyId)
+AND NOT EXISTS (
+  SELECT 1 FROM Tombstone t WHERE t.safe = Header.safe AND t.bucket = Header.bucket AND t.fileId = Header.fileId
+)
+
+-- SET_REPLACED_FILES
+UPDATE Header SET deleted = 1
+WHERE safe = :safe AND bucket = :bucket AND name = :name AND fileId <> :fileId AND modTime < :modTime AND deleted = 0
+
+-- GET_VERSIONS
+SELECT head, deleted, EXISTS (
+  SELECT 1 FROM Tombstone t WHERE t.safe = Header.safe AND t.bucket = Header.bucket AND t.fileId = Header.fileId
+) FROM Header WHERE safe = :safe AND bucket = :bucket AND name = :name ORDER BY modTime DESC
+
+-- GET_TOMBSTONES
+SELECT bucket, head, syncTime FROM Tombstone WHERE safe = :safe AND syncTime >= :after
+
 -- GET_HEADERS_IDS
 SELECT headerId, COUNT(*) as recordCount
-FROM Header
-WHERE safe = :safe AND bucket = :bucket
+FROM (
+  SELECT headerId FROM Header WHERE safe = :safe AND bucket = :bucket
+  UNION ALL
+  SELECT headerId FROM Tombstone WHERE safe = :safe AND bucket = :bucket
+)
 GROUP BY headerId;
 
 -- GET_HEADERS_LAST_SYNC
@@ -157,7 +417,9 @@ WHERE safe = :safe AND bucket = :bucket
 ORDER BY syncTime DESC LIMIT 1;
 
 -- GET_HEADER_BY_FILE_NAME
-SELECT head FROM Header
+SELECT head, EXISTS (
+  SELECT 1 FROM Tombstone t WHERE t.safe = Header.safe AND t.bucket = Header.bucket AND t.fileId = Header.fileId
+) FROM Header
 WHERE safe = :safe
   AND bucket = :bucket
   AND (:name = '' OR name = :name)
@@ -178,7 +440,9 @@ WHERE safe = :safe
   ORDER BY name, syncTime DESC LIMIT CASE WHEN :limit = 0 THEN -1 ELSE :limit END OFFSET :offset
 
 -- GET_HEADER_BY_MODTIME
-SELECT head FROM Header
+SELECT head, EXISTS (
+  SELECT 1 FROM Tombstone t WHERE t.safe = Header.safe AND t.bucket = Header.bucket AND t.fileId = Header.fileId
+) FROM Header
 WHERE safe = :safe
   AND bucket = :bucket
   AND (:name = '' OR name = :name)
@@ -199,7 +463,9 @@ WHERE safe = :safe
   ORDER BY modTime LIMIT CASE WHEN :limit = 0 THEN -1 ELSE :limit END OFFSET :offset
 
 -- GET_HEADER_BY_FILE_NAME_DESC
-SELECT head FROM Header
+SELECT head, EXISTS (
+  SELECT 1 FROM Tombstone t WHERE t.safe = Header.safe AND t.bucket = Header.bucket AND t.fileId = Header.fileId
+) FROM Header
 WHERE safe = :safe
   AND bucket = :bucket
   AND (:name = '' OR name = :name)
@@ -220,7 +486,9 @@ WHERE safe = :safe
   ORDER BY name DESC, syncTime DESC LIMIT CASE WHEN :limit = 0 THEN -1 ELSE :limit END OFFSET :offset
 
 -- GET_HEADER_BY_MODTIME_DESC
-SELECT head FROM Header
+SELECT head, EXISTS (
+  SELECT 1 FROM Tombstone t WHERE t.safe = Header.safe AND t.bucket = Header.bucket AND t.fileId = Header.fileId
+) FROM Header
 WHERE safe = :safe
   AND bucket = :bucket
   AND (:name = '' OR name = :name)
@@ -248,8 +516,21 @@ WHERE safe= :safe
   AND (depth >= :fromDepth) 
   AND (depth <= :toDepth)
 
+-- GET_CHANGED_FOLDERS
+SELECT dir, MAX(syncTime) FROM Header
+WHERE safe = :safe
+  AND bucket = :bucket
+  AND (:dir = "" OR dir = :dir OR dir LIKE :subdirs ESCAPE '\')
+  AND (depth >= :fromDepth)
+  AND (:toDepth < 0 OR depth <= :toDepth)
+  AND syncTime >= :after
+GROUP BY dir
+ORDER BY dir
+
 -- GET_LAST_HEADER
-SELECT head, headerId
+SELECT head, headerId, EXISTS (
+  SELECT 1 FROM Tombstone t WHERE t.safe = Header.safe AND t.bucket = Header.bucket AND t.fileId = Header.fileId
+)
 FROM Header
 WHERE safe = :safe
   AND bucket = :bucket
@@ -292,6 +573,18 @@ DELETE FROM Users WHERE safe = :safe;
 -- DELETE_SAFE_CONFIGS
 DELETE FROM configs WHERE k LIKE :safe || '/%';
 
+-- DELETE_SAFE_CONFIG
+DELETE FROM SafeConfigs WHERE safe = :safe;
+
+-- GET_SAFE_HEADS
+SELECT head FROM Header WHERE safe = :safe;
+
+-- COUNT_SAFE_ROWS
+SELECT (SELECT COUNT(*) FROM Header WHERE safe = :safe),
+  (SELECT COUNT(*) FROM Users WHERE safe = :safe),
+  (SELECT COUNT(*) FROM Stores WHERE safe = :safe),
+  (SELECT COUNT(*) FROM SafeConfigs WHERE safe = :safe);
+
 -- DROP_IDENTITIES_TABLE
 DELETE FROM identities;
 
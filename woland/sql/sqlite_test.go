@@ -2,9 +2,12 @@ package sql
 
 import (
 	_ "embed"
+	"path/filepath"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/stregato/master/woland/core"
 )
 
 func TestDb(t *testing.T) {
@@ -56,3 +59,16 @@ func TestDb(t *testing.T) {
 	// err = CloseDB()
 	// assert.NoErrorf(t, err, "cannot close sqllite: %v", err)
 }
+
+func TestReopenDB(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "woland-reopen.db")
+	for i := 0; i < 2; i++ {
+		err := OpenDB(dbPath)
+		core.TestErr(t, err, "cannot open DB: %v")
+		added, err := isColumnAdded("ALTER TABLE DownloadPart ADD COLUMN etag TEXT NOT NULL DEFAULT ''")
+		core.TestErr(t, err, "cannot check columns: %v")
+		core.Assert(t, added, "Expected the etag column in DownloadPart")
+		err = CloseDB()
+		core.TestErr(t, err, "cannot close DB: %v")
+	}
+}
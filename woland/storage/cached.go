@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+)
+
+// CachePolicy defines what the Cached decorator keeps
+type CachePolicy struct {
+	Immutable   func(name string) bool // Files that never change once written. Their content is kept on disk
+	MetadataTTL time.Duration          // Time during which the results of ReadDir and Stat are reused
+	MaxSize     int64                  // Maximum size in bytes of the content kept on disk, 0 for no limit
+}
+
+type cachedStat struct {
+	info    fs.FileInfo
+	err     error
+	expires time.Time
+}
+
+type cachedDir struct {
+	dir     string
+	infos   []fs.FileInfo
+	err     error
+	expires time.Time
+}
+
+type cachedFile struct {
+	size    int64
+	lastUse time.Time
+}
+
+type cached struct {
+	Store  Store
+	Dir    string
+	Policy CachePolicy
+
+	lock  sync.Mutex
+	stats map[string]cachedStat  // Results of Stat by name
+	dirs  map[string]cachedDir   // Results of ReadDir by folder and filter
+	files map[string]*cachedFile // Content on disk by name
+	size  int64                  // Total size of the content on disk
+}
+
+// Cached returns a store that keeps the content of immutable files in the folder dir on the local disk and reuses
+// the results of ReadDir and Stat for the TTL of the policy. Writes and deletes through the store invalidate the
+// related entries. Closing the store closes s.
+func Cached(s Store, dir string, policy CachePolicy) (Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if core.IsErr(err, nil, "cannot create cache folder %s: %v", dir) {
+		return nil, err
+	}
+	c := &cached{
+		Store:  s,
+		Dir:    dir,
+		Policy: policy,
+		stats:  map[string]cachedStat{},
+		dirs:   map[string]cachedDir{},
+		files:  map[string]*cachedFile{},
+	}
+
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil || strings.HasSuffix(p, ".tmp") {
+			os.Remove(p)
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		c.files[filepath.ToSlash(rel)] = &cachedFile{size: info.Size(), lastUse: info.ModTime()}
+		c.size += info.Size()
+		return nil
+	})
+	if core.IsErr(err, nil, "cannot read cache folder %s: %v", dir) {
+		return nil, err
+	}
+	c.evict()
+	return c, nil
+}
+
+// localPath returns the location of the content of the file on disk, which mirrors the folders of the store
+func (c *cached) localPath(name string) string {
+	return filepath.Join(c.Dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (c *cached) Url() string {
+	return c.Store.Url()
+}
+
+func (c *cached) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
+	if c.Policy.MetadataTTL <= 0 || filter.Function != nil {
+		return c.Store.ReadDir(dir, filter)
+	}
+
+	key := fmt.Sprintf("%s\x00%v", path.Clean(dir), filter)
+	c.lock.Lock()
+	d, ok := c.dirs[key]
+	c.lock.Unlock()
+	if ok && core.Now().Before(d.expires) {
+		return d.infos, d.err
+	}
+
+	infos, err := c.Store.ReadDir(dir, filter)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.dirs[key] = cachedDir{path.Clean(dir), infos, err, core.Now().Add(c.Policy.MetadataTTL)}
+	c.lock.Unlock()
+	return infos, err
+}
+
+// Read reads data from a file into a writer. The content of immutable files is read from the disk when available,
+// otherwise it is saved on disk during a read of the full file unless it is larger than the size limit.
+func (c *cached) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	if c.Policy.Immutable == nil || !c.Policy.Immutable(name) {
+		return c.Store.Read(name, rang, dest, progress)
+	}
+
+	key := path.Clean(name)
+	f, err := os.Open(c.localPath(key))
+	if err == nil {
+		defer f.Close()
+		c.lock.Lock()
+		if cf, ok := c.files[key]; ok {
+			cf.lastUse = core.Now()
+		}
+		c.lock.Unlock()
+		return readLocalFile(f, rang, dest, progress)
+	}
+	if rang != nil {
+		return c.Store.Read(name, rang, dest, progress)
+	}
+
+	tmp, err := os.CreateTemp(c.Dir, "*.tmp")
+	if core.IsErr(err, nil, "cannot create cache file in %s: %v", c.Dir) {
+		return c.Store.Read(name, rang, dest, progress)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	lw := &limitedWriter{w: tmp, limit: c.Policy.MaxSize}
+	err = c.Store.Read(name, nil, io.MultiWriter(dest, lw), progress)
+	if err != nil {
+		return err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err == nil && !lw.exceeded {
+		err = os.MkdirAll(filepath.Dir(c.localPath(key)), 0755)
+		if err == nil {
+			err = os.Rename(tmp.Name(), c.localPath(key))
+		}
+		if !core.IsErr(err, nil, "cannot save %s in cache: %v", name) {
+			c.lock.Lock()
+			if cf, ok := c.files[key]; ok {
+				c.size -= cf.size
+			}
+			c.files[key] = &cachedFile{size: size, lastUse: core.Now()}
+			c.size += size
+			c.evict()
+			c.lock.Unlock()
+		}
+	}
+	return nil
+}
+
+// limitedWriter writes to w until the limit is exceeded and discards the rest, so that a file larger than the cache
+// does not take space on disk while it is read
+type limitedWriter struct {
+	w        io.Writer
+	limit    int64
+	written  int64
+	exceeded bool
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	l.written += int64(len(p))
+	if l.exceeded || l.limit > 0 && l.written > l.limit {
+		l.exceeded = true
+		return len(p), nil
+	}
+	_, err := l.w.Write(p)
+	if err != nil {
+		l.exceeded = true // the content on disk is incomplete
+	}
+	return len(p), nil
+}
+
+func readLocalFile(f *os.File, rang *Range, dest io.Writer, progress chan int64) error {
+	var n int64
+	var err error
+	if rang == nil {
+		n, err = io.Copy(dest, f)
+	} else {
+		_, err = f.Seek(rang.From, io.SeekStart)
+		if err == nil {
+			n, err = io.CopyN(dest, f, rang.To-rang.From)
+		}
+		if err == io.EOF {
+			err = nil // the range ends after the end of the file
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if progress != nil {
+		progress <- n
+	}
+	return nil
+}
+
+// evict removes the least recently used files until the content on disk is within the size limit. It must be called
+// with the lock held.
+func (c *cached) evict() {
+	if c.Policy.MaxSize == 0 || c.size <= c.Policy.MaxSize {
+		return
+	}
+
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return c.files[names[i]].lastUse.Before(c.files[names[j]].lastUse) })
+	for _, name := range names {
+		if c.size <= c.Policy.MaxSize {
+			break
+		}
+		os.Remove(c.localPath(name))
+		c.size -= c.files[name].size
+		delete(c.files, name)
+	}
+}
+
+// invalidate removes the cached entries of the file or folder name, its content and the listings of its parents
+func (c *cached) invalidate(name string) {
+	name = path.Clean(name)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for n := range c.stats {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			delete(c.stats, n)
+		}
+	}
+	for key, d := range c.dirs {
+		if d.dir == name || d.dir == "." || strings.HasPrefix(d.dir, name+"/") || strings.HasPrefix(name, d.dir+"/") {
+			delete(c.dirs, key)
+		}
+	}
+	for n, cf := range c.files {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			os.Remove(c.localPath(n))
+			c.size -= cf.size
+			delete(c.files, n)
+		}
+	}
+}
+
+// Write writes data to a file name. An existing file is overwritten
+func (c *cached) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	defer c.invalidate(name)
+	return c.Store.Write(name, source, progress)
+}
+
+// WriteIf writes data to a file name when the condition holds
+func (c *cached) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	defer c.invalidate(name)
+	return WriteIf(c.Store, name, source, cond, progress)
+}
+
+// ETag returns the version of the file to use in Condition.IfMatch
+func (c *cached) ETag(name string) (string, error) {
+	return ETag(c.Store, name)
+}
+
+// Rename renames a file
+func (c *cached) Rename(old, new string) error {
+	defer c.invalidate(old)
+	defer c.invalidate(new)
+	return Rename(c.Store, old, new)
+}
+
+// Copy copies a file
+func (c *cached) Copy(source, dest string) error {
+	defer c.invalidate(dest)
+	return Copy(c.Store, source, dest)
+}
+
+// Stat provides statistics about a file
+func (c *cached) Stat(name string) (os.FileInfo, error) {
+	if c.Policy.MetadataTTL <= 0 {
+		return c.Store.Stat(name)
+	}
+
+	key := path.Clean(name)
+	c.lock.Lock()
+	st, ok := c.stats[key]
+	c.lock.Unlock()
+	if ok && core.Now().Before(st.expires) {
+		return st.info, st.err
+	}
+
+	info, err := c.Store.Stat(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.stats[key] = cachedStat{info, err, core.Now().Add(c.Policy.MetadataTTL)}
+	c.lock.Unlock()
+	return info, err
+}
+
+// Delete deletes a file
+func (c *cached) Delete(name string) error {
+	defer c.invalidate(name)
+	return c.Store.Delete(name)
+}
+
+// Close closes the store
+func (c *cached) Close() error {
+	return c.Store.Close()
+}
+
+// String returns a human-readable representation of the storer (e.g. sftp://user@host/path)
+func (c *cached) String() string {
+	return fmt.Sprintf("%s,cached", c.Store)
+}
+
+func (c *cached) Describe() Description {
+	return c.Store.Describe()
+}
+
+// CircuitState returns the state of the circuit breaker of the wrapped store
+func (c *cached) CircuitState() CircuitState {
+	return GetCircuitState(c.Store)
+}
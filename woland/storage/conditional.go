@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/stregato/master/woland/core"
+)
+
+// ErrConditionFailed is returned by a conditional write when the condition does not hold
+var ErrConditionFailed = fmt.Errorf("condition of the write is not satisfied")
+
+// Condition is the precondition of a conditional write
+type Condition struct {
+	IfAbsent bool   // Write only if the file does not exist
+	IfMatch  string // Write only if the current version of the file has this ETag, as returned by ETag
+}
+
+// ConditionalStore is implemented by the stores that can check the condition and write in a single operation
+type ConditionalStore interface {
+	// WriteIf writes data to a file name when the condition holds and returns ErrConditionFailed otherwise
+	WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error
+
+	// ETag returns an opaque version of the file that changes at every write
+	ETag(name string) (string, error)
+}
+
+// WriteIf writes data to a file name when the condition holds. Stores that do not implement ConditionalStore check
+// the condition before the write, which leaves a window for concurrent writes.
+func WriteIf(s Store, name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	if cs, ok := s.(ConditionalStore); ok {
+		return cs.WriteIf(name, source, cond, progress)
+	}
+
+	err := checkCondition(s, name, cond)
+	if err != nil {
+		return err
+	}
+	return s.Write(name, source, progress)
+}
+
+// WriteFileIf writes data to a file name when the condition holds
+func WriteFileIf(s Store, name string, data []byte, cond Condition) error {
+	b := core.NewBytesReader(data)
+	defer b.Close()
+	return WriteIf(s, name, b, cond, nil)
+}
+
+// ETag returns the version of the file to use in Condition.IfMatch
+func ETag(s Store, name string) (string, error) {
+	if cs, ok := s.(ConditionalStore); ok {
+		return cs.ETag(name)
+	}
+	return statETag(s, name)
+}
+
+// statETag returns a version based on the modification time and the size of the file
+func statETag(s Store, name string) (string, error) {
+	stat, err := s.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()), nil
+}
+
+// checkCondition returns ErrConditionFailed when the condition does not hold for the current version of the file
+func checkCondition(s Store, name string, cond Condition) error {
+	if cond.IfAbsent {
+		_, err := s.Stat(name)
+		if err == nil {
+			return ErrConditionFailed
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if cond.IfMatch != "" {
+		etag, err := ETag(s, name)
+		if os.IsNotExist(err) {
+			return ErrConditionFailed
+		}
+		if err != nil {
+			return err
+		}
+		if etag != cond.IfMatch {
+			return ErrConditionFailed
+		}
+	}
+	return nil
+}
+
+// isWriteIfTemp returns true for the lock and temporary files that the conditional writes of Local and SFTP create
+// next to the target file. They are not listed by ReadDir.
+func isWriteIfTemp(name string) bool {
+	return strings.HasPrefix(name, ".") && (strings.HasSuffix(name, ".lock") || strings.HasSuffix(name, ".tmp"))
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"path"
+	"strings"
 
 	"github.com/stregato/master/woland/core"
 	"github.com/stregato/master/woland/security"
@@ -18,84 +20,156 @@ type encrypted struct {
 	PropagateClose bool
 }
 
+// EncryptNames returns a store that encrypts each element of the paths, so that folders can still be listed
 func EncryptNames(s Store, key []byte, nonce []byte, propagateClose bool) Store {
 	return &encrypted{s, key, nonce, propagateClose}
 }
 
+// encryptName encrypts each element of the path with a url-safe encoding that does not contain '/'
+func (s *encrypted) encryptName(name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	var parts []string
+	for _, part := range strings.Split(path.Clean(name), "/") {
+		c, err := security.EncryptBlock(s.Key, s.Nonce, []byte(part))
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, base64.RawURLEncoding.EncodeToString(c))
+	}
+	return path.Join(parts...), nil
+}
+
+func (s *encrypted) decryptName(name string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		return "", err
+	}
+	d, err := security.DecryptBlock(s.Key, s.Nonce, data)
+	if err != nil {
+		return "", err
+	}
+	return string(d), nil
+}
+
 func (s *encrypted) Url() string {
 	return s.Store.Url()
 }
 
 func (s *encrypted) ReadDir(name string, filter Filter) ([]fs.FileInfo, error) {
-	c, err := security.EncryptBlock(s.Key, s.Nonce, []byte(name))
+	name, err := s.encryptName(name)
 	if err != nil {
 		return nil, err
 	}
-	name = base64.StdEncoding.EncodeToString(c)
-	ls, err := s.Store.ReadDir(name, filter)
+	// filters on names must apply to the decrypted names
+	ls, err := s.Store.ReadDir(name, Filter{OnlyFiles: filter.OnlyFiles, OnlyFolders: filter.OnlyFolders})
 	if err != nil {
 		return nil, err
 	}
 
 	var files []fs.FileInfo
 	for _, l := range ls {
-		data, err := base64.StdEncoding.DecodeString(l.Name())
-		if core.IsWarn(err, "cannot decode %s: %v", l.Name()) {
-			continue
-		}
-		d, err := security.DecryptBlock(s.Key, s.Nonce, data)
+		d, err := s.decryptName(l.Name())
 		if core.IsWarn(err, "cannot decrypt %s: %v", l.Name()) {
 			continue
 		}
 		files = append(files, simpleFileInfo{
-			name:    string(d),
+			name:    d,
 			size:    l.Size(),
 			modTime: l.ModTime(),
 			isDir:   l.IsDir(),
 		})
 	}
-	return files, nil
+	return filterInfos(files, filter), nil
 }
 
 // Read reads data from a file into a writer
 func (s *encrypted) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
-	c, err := security.EncryptBlock(s.Key, s.Nonce, []byte(name))
+	name, err := s.encryptName(name)
 	if err != nil {
 		return err
 	}
-	name = base64.StdEncoding.EncodeToString(c)
 	return s.Store.Read(name, rang, dest, progress)
 }
 
 // Write writes data to a file name. An existing file is overwritten
 func (s *encrypted) Write(name string, source io.ReadSeeker, progress chan int64) error {
-	c, err := security.EncryptBlock(s.Key, s.Nonce, []byte(name))
+	name, err := s.encryptName(name)
 	if err != nil {
 		return err
 	}
-	name = base64.StdEncoding.EncodeToString(c)
 	return s.Store.Write(name, source, progress)
 }
 
+// WriteIf writes data to a file name when the condition holds
+func (s *encrypted) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	name, err := s.encryptName(name)
+	if err != nil {
+		return err
+	}
+	return WriteIf(s.Store, name, source, cond, progress)
+}
+
+// ETag returns the version of the file to use in Condition.IfMatch
+func (s *encrypted) ETag(name string) (string, error) {
+	name, err := s.encryptName(name)
+	if err != nil {
+		return "", err
+	}
+	return ETag(s.Store, name)
+}
+
+// Rename renames a file
+func (s *encrypted) Rename(old, new string) error {
+	o, err := s.encryptName(old)
+	if err != nil {
+		return err
+	}
+	n, err := s.encryptName(new)
+	if err != nil {
+		return err
+	}
+	return Rename(s.Store, o, n)
+}
+
+// Copy copies a file
+func (s *encrypted) Copy(source, dest string) error {
+	src, err := s.encryptName(source)
+	if err != nil {
+		return err
+	}
+	dst, err := s.encryptName(dest)
+	if err != nil {
+		return err
+	}
+	return Copy(s.Store, src, dst)
+}
+
 // Stat provides statistics about a file
 func (s *encrypted) Stat(name string) (os.FileInfo, error) {
-	c, err := security.EncryptBlock(s.Key, s.Nonce, []byte(name))
+	n, err := s.encryptName(name)
 	if err != nil {
 		return nil, err
 	}
-	name = base64.StdEncoding.EncodeToString(c)
-
-	return s.Store.Stat(name)
+	stat, err := s.Store.Stat(n)
+	if err != nil {
+		return nil, err
+	}
+	return simpleFileInfo{
+		name:    path.Base(name),
+		size:    stat.Size(),
+		modTime: stat.ModTime(),
+		isDir:   stat.IsDir(),
+	}, nil
 }
 
 // Delete deletes a file
 func (s *encrypted) Delete(name string) error {
-	c, err := security.EncryptBlock(s.Key, s.Nonce, []byte(name))
+	name, err := s.encryptName(name)
 	if err != nil {
 		return err
 	}
-	name = base64.StdEncoding.EncodeToString(c)
-
 	return s.Store.Delete(name)
 }
 
@@ -115,3 +189,8 @@ func (s *encrypted) Describe() Description {
 func (s *encrypted) String() string {
 	return fmt.Sprintf("%s,enc", s.Store)
 }
+
+// CircuitState returns the state of the circuit breaker of the wrapped store
+func (s *encrypted) CircuitState() CircuitState {
+	return GetCircuitState(s.Store)
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/stregato/master/woland/core"
+)
+
+// Opener creates a store from a connection url
+type Opener func(connectionUrl string) (Store, error)
+
+// Validator checks a connection url without connecting to the store
+type Validator func(u *url.URL) error
+
+// Capabilities are the operations that a driver supports natively in the backend
+type Capabilities struct {
+	RangeRead        bool `json:"rangeRead"`        // Ranges are read without transferring the preceding bytes
+	Rename           bool `json:"rename"`           // Files are renamed without a copy
+	ConditionalWrite bool `json:"conditionalWrite"` // Conditions of WriteIf are checked atomically with the write
+	ServerSideCopy   bool `json:"serverSideCopy"`   // Files are copied without transferring the content
+}
+
+// DriverInfo describes a registered driver
+type DriverInfo struct {
+	Scheme       string       `json:"scheme"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+type driver struct {
+	open         Opener
+	validate     Validator
+	capabilities Capabilities
+}
+
+var ErrDriverExists = fmt.Errorf("a driver is already registered for the scheme")
+var ErrInvalidUrl = fmt.Errorf("invalid connection url")
+
+var drivers = map[string]driver{}
+var driversLock sync.RWMutex
+
+// Register adds a driver for the urls with the scheme. The validator is optional and is called before the opener.
+func Register(scheme string, open Opener, validate Validator, capabilities Capabilities) error {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+
+	if _, ok := drivers[scheme]; ok {
+		return fmt.Errorf("%w: %s", ErrDriverExists, scheme)
+	}
+	drivers[scheme] = driver{open, validate, capabilities}
+	return nil
+}
+
+// Drivers returns the registered drivers sorted by scheme
+func Drivers() []DriverInfo {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+
+	var infos []DriverInfo
+	for scheme, d := range drivers {
+		infos = append(infos, DriverInfo{Scheme: scheme, Capabilities: d.capabilities})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Scheme < infos[j].Scheme })
+	return infos
+}
+
+// Validate checks that a driver is registered for the connection url and that the url is valid for the driver
+func Validate(connectionUrl string) error {
+	_, _, err := getDriver(connectionUrl)
+	return err
+}
+
+// GetCapabilities returns the capabilities of the driver of the store
+func GetCapabilities(s Store) Capabilities {
+	u, err := url.Parse(s.Url())
+	if err != nil {
+		return Capabilities{}
+	}
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	return drivers[u.Scheme].capabilities
+}
+
+func getDriver(connectionUrl string) (driver, *url.URL, error) {
+	u, err := url.Parse(connectionUrl)
+	if err != nil {
+		return driver{}, nil, fmt.Errorf("%w: %v", ErrInvalidUrl, err)
+	}
+
+	driversLock.RLock()
+	d, ok := drivers[u.Scheme]
+	driversLock.RUnlock()
+	if !ok {
+		return driver{}, nil, core.ErrNoDriver
+	}
+
+	if d.validate != nil {
+		err = d.validate(u)
+		if err != nil {
+			return driver{}, nil, fmt.Errorf("%w: %v", ErrInvalidUrl, err)
+		}
+	}
+	return d, u, nil
+}
+
+// Renamer is implemented by the stores that rename files natively
+type Renamer interface {
+	Rename(old, new string) error
+}
+
+// Copier is implemented by the stores that copy files without transferring the content
+type Copier interface {
+	Copy(source, dest string) error
+}
+
+// Rename renames a file. Stores that do not implement Renamer copy the file and delete the original.
+func Rename(s Store, old, new string) error {
+	if r, ok := s.(Renamer); ok {
+		return r.Rename(old, new)
+	}
+	err := copyContent(s, old, new)
+	if err != nil {
+		return err
+	}
+	return s.Delete(old)
+}
+
+// Copy copies a file. Stores that do not implement Copier read the content and write it again.
+func Copy(s Store, source, dest string) error {
+	if c, ok := s.(Copier); ok {
+		return c.Copy(source, dest)
+	}
+	return copyContent(s, source, dest)
+}
+
+func copyContent(s Store, source, dest string) error {
+	var b bytes.Buffer
+	err := s.Read(source, nil, &b, nil)
+	if core.IsErr(err, nil, "cannot read %s/%s: %v", s, source) {
+		return err
+	}
+	err = s.Write(dest, core.NewBytesReader(b.Bytes()), nil)
+	if core.IsErr(err, nil, "cannot write %s/%s: %v", s, dest) {
+		return err
+	}
+	return nil
+}
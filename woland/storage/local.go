@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/stregato/master/woland/core"
@@ -23,6 +24,20 @@ type Local struct {
 	touch map[string]time.Time
 }
 
+func init() {
+	Register("file", OpenLocal, validateLocalUrl, Capabilities{RangeRead: true, Rename: true, ConditionalWrite: true})
+}
+
+func validateLocalUrl(u *url.URL) error {
+	if u.Host != "" {
+		return fmt.Errorf("invalid host: %s", u.Host)
+	}
+	if u.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	return nil
+}
+
 func OpenLocal(connectionUrl string) (Store, error) {
 	u, err := url.Parse(connectionUrl)
 	if core.IsErr(err, nil, "invalid URL: %v") {
@@ -49,24 +64,17 @@ func (l *Local) Read(name string, rang *Range, dest io.Writer, progress chan int
 	if core.IsErr(err, nil, "cannot open file on %v:%v", l) {
 		return err
 	}
+	defer f.Close()
 
 	if rang == nil {
 		_, err = io.Copy(dest, f)
 	} else {
-		left := rang.To - rang.From
-		f.Seek(rang.From, 0)
-		var b [4096]byte
-
-		for left > 0 && err == nil {
-			var sz int64
-			if rang.From-rang.To > 4096 {
-				sz = 4096
-			} else {
-				sz = rang.From - rang.To
-			}
-			_, err = f.Read(b[0:sz])
-			dest.Write(b[0:sz])
-			left -= sz
+		_, err = f.Seek(rang.From, io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(dest, f, rang.To-rang.From)
+		}
+		if err == io.EOF {
+			err = nil // the range ends after the end of the file
 		}
 	}
 	if core.IsErr(err, nil, "cannot read from %s/%s:%v", l, name) {
@@ -101,6 +109,88 @@ func (l *Local) Write(name string, source io.ReadSeeker, progress chan int64) er
 	return err
 }
 
+// LocalLockTimeout is the age after which the lock or the temporary file of a conditional write is considered stale
+// and removed. The writer touches its lock every quarter of the timeout, so only the lock of a writer that is gone
+// gets stale.
+var LocalLockTimeout = time.Minute
+
+// keepLockFresh updates the modification time of the lock until stop is closed
+func keepLockFresh(lockFile string, stop chan struct{}) {
+	ticker := time.NewTicker(LocalLockTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			err := os.Chtimes(lockFile, now, now)
+			core.IsErr(err, nil, "cannot refresh lock %s: %v", lockFile)
+		}
+	}
+}
+
+// WriteIf writes the file when the condition holds. The check and the write run under a lock file created with
+// O_EXCL, and the content is written to a temporary file renamed on the target so that readers never see a partial
+// file.
+func (l *Local) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	n := filepath.Join(l.base, name)
+	err := createDir(n)
+	if core.IsErr(err, nil, "cannot create parent of %s: %v", n) {
+		return err
+	}
+
+	lockFile := filepath.Join(filepath.Dir(n), "."+filepath.Base(n)+".lock")
+	lock, err := os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		stat, statErr := os.Stat(lockFile)
+		if statErr != nil || time.Since(stat.ModTime()) < LocalLockTimeout {
+			return ErrConditionFailed
+		}
+		core.Info("removing stale lock %s", lockFile)
+		os.Remove(lockFile)
+		lock, err = os.OpenFile(lockFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	}
+	if os.IsExist(err) {
+		return ErrConditionFailed
+	}
+	if core.IsErr(err, nil, "cannot create lock %s: %v", lockFile) {
+		return err
+	}
+	lock.Close()
+	stop := make(chan struct{})
+	go keepLockFresh(lockFile, stop)
+	defer func() {
+		close(stop)
+		os.Remove(lockFile)
+	}()
+
+	err = checkCondition(l, name, cond)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(n), "."+filepath.Base(n)+".*.tmp")
+	if core.IsErr(err, nil, "cannot create temp file for %s: %v", n) {
+		return err
+	}
+	_, err = io.Copy(f, source)
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), n)
+	}
+	if core.IsErr(err, nil, "cannot write file on %v:%v", l) {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// ETag returns a version of the file based on the modification time and the size
+func (l *Local) ETag(name string) (string, error) {
+	return statETag(l, name)
+}
+
 func (l *Local) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
 	result, err := os.ReadDir(filepath.Join(l.base, dir))
 	if err != nil {
@@ -108,19 +198,35 @@ func (l *Local) ReadDir(dir string, filter Filter) ([]fs.FileInfo, error) {
 	}
 
 	var infos []fs.FileInfo
-	var cnt int64
 	for _, item := range result {
 		info, err := item.Info()
-		if err == nil && matchFilter(info, filter) {
-			infos = append(infos, info)
-			cnt++
+		if err != nil {
+			continue
 		}
-		if filter.MaxResults > 0 && cnt == filter.MaxResults {
-			break
+		if isWriteIfTemp(item.Name()) {
+			if time.Since(info.ModTime()) > LocalLockTimeout && !l.isLocked(dir, item.Name()) {
+				core.Info("removing stale %s", item.Name())
+				os.Remove(filepath.Join(l.base, dir, item.Name()))
+			}
+			continue
 		}
+		infos = append(infos, info)
 	}
 
-	return infos, nil
+	return filterInfos(infos, filter), nil
+}
+
+// isLocked returns true when the temporary file belongs to a conditional write whose lock is still fresh
+func (l *Local) isLocked(dir, tmp string) bool {
+	if !strings.HasSuffix(tmp, ".tmp") {
+		return false
+	}
+	target := strings.TrimSuffix(strings.TrimPrefix(tmp, "."), ".tmp")
+	if i := strings.LastIndex(target, "."); i >= 0 {
+		target = target[:i]
+	}
+	stat, err := os.Stat(filepath.Join(l.base, dir, "."+target+".lock"))
+	return err == nil && time.Since(stat.ModTime()) <= LocalLockTimeout
 }
 
 func (l *Local) Stat(name string) (os.FileInfo, error) {
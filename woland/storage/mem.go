@@ -2,12 +2,17 @@ package storage
 
 import (
 	"bytes"
+	"encoding/hex"
 	"io"
 	"io/fs"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
 
 	"github.com/stregato/master/woland/core"
 )
@@ -20,10 +25,15 @@ type _memoryFile struct {
 type Memory struct {
 	url  string
 	data map[string]_memoryFile
+	lock sync.RWMutex // Guards data
 }
 
 var MemoryStores = map[string]*Memory{}
 
+func init() {
+	Register("mem", OpenMemory, nil, Capabilities{RangeRead: true, Rename: true, ConditionalWrite: true})
+}
+
 func OpenMemory(connectionUrl string) (Store, error) {
 	u, err := url.Parse(connectionUrl)
 	if core.IsErr(err, nil, "invalid URL: %v") {
@@ -46,7 +56,9 @@ func (m *Memory) Url() string {
 }
 
 func (m *Memory) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
-	f, ok := m.data[name]
+	m.lock.RLock()
+	f, ok := m.data[name] // the content is replaced and never changed in place, so it can be read without the lock
+	m.lock.RUnlock()
 	if !ok {
 		return os.ErrNotExist
 	}
@@ -56,7 +68,14 @@ func (m *Memory) Read(name string, rang *Range, dest io.Writer, progress chan in
 	if rang == nil {
 		w, err = io.Copy(dest, core.NewBytesReader(f.content))
 	} else {
-		w, err = io.CopyN(dest, core.NewBytesReader(f.content[rang.From:]), rang.To-rang.From)
+		from, to := rang.From, rang.To
+		if to > int64(len(f.content)) {
+			to = int64(len(f.content))
+		}
+		if from > to {
+			from = to
+		}
+		w, err = io.Copy(dest, core.NewBytesReader(f.content[from:to]))
 	}
 	if core.IsErr(err, nil, "cannot read from %s/%s:%v", m, name) {
 		return err
@@ -69,17 +88,33 @@ func (m *Memory) Read(name string, rang *Range, dest io.Writer, progress chan in
 }
 
 func (m *Memory) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	content, err := readContent(name, source, progress)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.put(name, content)
+	return nil
+}
+
+func readContent(name string, source io.ReadSeeker, progress chan int64) ([]byte, error) {
 	var buf bytes.Buffer
 
 	_, err := io.Copy(&buf, source)
 	if core.IsErr(err, nil, "cannot copy file '%s'' in memory:%v", name) {
-		return err
+		return nil, err
 	}
 	content := buf.Bytes()
 	if progress != nil {
 		progress <- int64(len(content))
 	}
+	return content, nil
+}
 
+// put sets the content of the file. It must be called with the lock held.
+func (m *Memory) put(name string, content []byte) {
 	m.data[name] = _memoryFile{
 		simpleFileInfo: simpleFileInfo{
 			name:    path.Base(name),
@@ -89,65 +124,140 @@ func (m *Memory) Write(name string, source io.ReadSeeker, progress chan int64) e
 		},
 		content: content,
 	}
+}
+
+// Rename moves the content to the new name
+func (m *Memory) Rename(old, new string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
-	return err
+	f, ok := m.data[old]
+	if !ok {
+		return os.ErrNotExist
+	}
+	f.simpleFileInfo.name = path.Base(new)
+	m.data[new] = f
+	delete(m.data, old)
+	return nil
+}
+
+// WriteIf writes the file when the condition holds
+func (m *Memory) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	content, err := readContent(name, source, progress)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	f, ok := m.data[name]
+	if cond.IfAbsent && (ok || m.isDir(name)) {
+		return ErrConditionFailed
+	}
+	if cond.IfMatch != "" && (!ok || memoryETag(f.content) != cond.IfMatch) {
+		return ErrConditionFailed
+	}
+	m.put(name, content)
+	return nil
+}
+
+// ETag returns the hash of the content of the file
+func (m *Memory) ETag(name string) (string, error) {
+	m.lock.RLock()
+	f, ok := m.data[name]
+	m.lock.RUnlock()
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	return memoryETag(f.content), nil
+}
+
+func memoryETag(content []byte) string {
+	h := blake2b.Sum256(content)
+	return hex.EncodeToString(h[:16])
 }
 
 func (m *Memory) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	var infos []fs.FileInfo
-	subfolders := map[string]bool{}
+	subfolders := map[string]time.Time{}
 	for n, mf := range m.data {
-		if strings.HasPrefix(n, dir+"/") {
-			n = strings.TrimPrefix(n, dir+"/")
+		if strings.HasPrefix(n, prefix) {
+			n = strings.TrimPrefix(n, prefix)
 			parts := strings.Split(n, "/")
-			if len(parts) > 1 && !f.OnlyFiles {
-				subfolders[parts[0]] = true
-			} else if matchFilter(mf.simpleFileInfo, f) {
+			if len(parts) > 1 {
+				if mf.simpleFileInfo.modTime.After(subfolders[parts[0]]) {
+					subfolders[parts[0]] = mf.simpleFileInfo.modTime
+				}
+			} else {
 				infos = append(infos, mf.simpleFileInfo)
 			}
 		}
 	}
 
-	for subfolder := range subfolders {
-		info := simpleFileInfo{
+	for subfolder, modTime := range subfolders {
+		infos = append(infos, simpleFileInfo{
 			name:    subfolder,
 			size:    0,
-			modTime: core.Now(),
+			modTime: modTime,
 			isDir:   true,
-		}
-		if matchFilter(info, f) {
-			infos = append(infos, info)
-		}
+		})
 	}
 
-	return infos, nil
+	return filterInfos(infos, f), nil
 }
 
 func (m *Memory) Stat(name string) (os.FileInfo, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
 	l, ok := m.data[name]
 	if ok {
 		return l.simpleFileInfo, nil
-	} else {
-		for n := range m.data {
-			if strings.HasPrefix(n, name+"/") {
-				return simpleFileInfo{
-					name:  path.Base(name),
-					isDir: true,
-				}, nil
-			}
+	} else if m.isDir(name) {
+		return simpleFileInfo{
+			name:  path.Base(name),
+			isDir: true,
+		}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// isDir returns true when some file is in the folder name. It must be called with the lock held.
+func (m *Memory) isDir(name string) bool {
+	for n := range m.data {
+		if strings.HasPrefix(n, name+"/") {
+			return true
 		}
-		return nil, os.ErrNotExist
 	}
+	return false
 }
 
 func (m *Memory) Delete(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
 	_, ok := m.data[name]
 	if ok {
 		delete(m.data, name)
 		return nil
-	} else {
-		return os.ErrNotExist
 	}
+
+	// a missing file is not an error, as in the other stores
+	for n := range m.data {
+		if strings.HasPrefix(n, name+"/") {
+			delete(m.data, n)
+		}
+	}
+	return nil
 }
 
 func (m *Memory) Close() error {
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Usage counts the traffic and the operations on a store and their cost based on the Description of the store
+type Usage struct {
+	BytesRead    int64   `json:"bytesRead"`    // Bytes read from the store
+	BytesWritten int64   `json:"bytesWritten"` // Bytes written to the store
+	Reads        int64   `json:"reads"`        // Read operations
+	Writes       int64   `json:"writes"`       // Write, conditional write, rename and copy operations
+	Lists        int64   `json:"lists"`        // ReadDir, Stat and ETag operations
+	Deletes      int64   `json:"deletes"`      // Delete operations
+	Cost         float64 `json:"cost"`         // Cost of the traffic in CHF
+}
+
+// Add returns the sum of the two usages
+func (u Usage) Add(o Usage) Usage {
+	return Usage{
+		BytesRead:    u.BytesRead + o.BytesRead,
+		BytesWritten: u.BytesWritten + o.BytesWritten,
+		Reads:        u.Reads + o.Reads,
+		Writes:       u.Writes + o.Writes,
+		Lists:        u.Lists + o.Lists,
+		Deletes:      u.Deletes + o.Deletes,
+		Cost:         u.Cost + o.Cost,
+	}
+}
+
+// IsZero returns true when no operation has been counted
+func (u Usage) IsZero() bool {
+	return u.Reads == 0 && u.Writes == 0 && u.Lists == 0 && u.Deletes == 0
+}
+
+// Meter accumulates the usage of one or more metered stores
+type Meter struct {
+	lock  sync.Mutex
+	usage Usage
+}
+
+// Usage returns the usage accumulated since the meter was created or last taken
+func (m *Meter) Usage() Usage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.usage
+}
+
+// Take returns the usage accumulated since the meter was created or last taken and resets the meter
+func (m *Meter) Take() Usage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	u := m.usage
+	m.usage = Usage{}
+	return u
+}
+
+func (m *Meter) add(u Usage) {
+	m.lock.Lock()
+	m.usage = m.usage.Add(u)
+	m.lock.Unlock()
+}
+
+type metered struct {
+	Store       Store
+	Meter       *Meter
+	description Description
+}
+
+// Metered returns a store that adds the bytes and the operations on s to the meter. Closing the store closes s.
+func Metered(s Store, m *Meter) Store {
+	return &metered{s, m, s.Describe()}
+}
+
+func (m *metered) read(n int64) {
+	m.Meter.add(Usage{BytesRead: n, Reads: 1, Cost: float64(n)*m.description.ReadCost + m.description.ReadOpCost})
+}
+
+func (m *metered) write(n int64) {
+	m.Meter.add(Usage{BytesWritten: n, Writes: 1,
+		Cost: float64(n)*m.description.WriteCost + m.description.WriteOpCost})
+}
+
+func (m *metered) Url() string {
+	return m.Store.Url()
+}
+
+func (m *metered) ReadDir(name string, filter Filter) ([]fs.FileInfo, error) {
+	m.Meter.add(Usage{Lists: 1, Cost: m.description.WriteOpCost})
+	return m.Store.ReadDir(name, filter)
+}
+
+// Read reads data from a file into a writer
+func (m *metered) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	wc := &writeCounter{w: dest}
+	err := m.Store.Read(name, rang, wc, progress)
+	m.read(wc.n)
+	return err
+}
+
+// sourceSize returns the bytes left in the source, which are the bytes sent to the store by a write
+func sourceSize(source io.ReadSeeker) int64 {
+	pos, err := source.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0
+	}
+	end, err := source.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0
+	}
+	_, err = source.Seek(pos, io.SeekStart)
+	if err != nil {
+		return 0
+	}
+	return end - pos
+}
+
+// Write writes data to a file name. An existing file is overwritten
+func (m *metered) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	m.write(sourceSize(source))
+	return m.Store.Write(name, source, progress)
+}
+
+// WriteIf writes data to a file name when the condition holds
+func (m *metered) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	m.write(sourceSize(source))
+	return WriteIf(m.Store, name, source, cond, progress)
+}
+
+// ETag returns the version of the file to use in Condition.IfMatch
+func (m *metered) ETag(name string) (string, error) {
+	m.Meter.add(Usage{Lists: 1, Cost: m.description.ReadOpCost})
+	return ETag(m.Store, name)
+}
+
+// Rename renames a file
+func (m *metered) Rename(old, new string) error {
+	m.write(0)
+	return Rename(m.Store, old, new)
+}
+
+// Copy copies a file. The copy is counted as a single operation even when the store has no server-side copy.
+func (m *metered) Copy(source, dest string) error {
+	m.write(0)
+	return Copy(m.Store, source, dest)
+}
+
+// Stat provides statistics about a file
+func (m *metered) Stat(name string) (os.FileInfo, error) {
+	m.Meter.add(Usage{Lists: 1, Cost: m.description.ReadOpCost})
+	return m.Store.Stat(name)
+}
+
+// Delete deletes a file
+func (m *metered) Delete(name string) error {
+	m.Meter.add(Usage{Deletes: 1})
+	return m.Store.Delete(name)
+}
+
+// Close closes the store
+func (m *metered) Close() error {
+	return m.Store.Close()
+}
+
+// String returns a human-readable representation of the storer (e.g. sftp://user@host/path)
+func (m *metered) String() string {
+	return fmt.Sprintf("%s,metered", m.Store)
+}
+
+func (m *metered) Describe() Description {
+	return m.description
+}
+
+// IsRetryable classifies the errors with the wrapped store
+func (m *metered) IsRetryable(err error) bool {
+	return IsRetryable(m.Store, err)
+}
+
+// CircuitState returns the state of the circuit breaker of the wrapped store
+func (m *metered) CircuitState() CircuitState {
+	return GetCircuitState(m.Store)
+}
@@ -0,0 +1,324 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+)
+
+// ErrTransient marks the errors that are likely to disappear when the operation is retried, such as throttling or a
+// temporary unavailability of the service. Stores wrap such errors in their mapError.
+var ErrTransient = fmt.Errorf("transient store error")
+
+// ErrCircuitOpen is returned without calling the store when the store failed repeatedly
+var ErrCircuitOpen = fmt.Errorf("store is degraded: too many consecutive failures")
+
+// RetryClassifier is implemented by the stores that recognise their own transient errors. Its answer replaces the
+// default classification of network errors.
+type RetryClassifier interface {
+	IsRetryable(err error) bool
+}
+
+// RetryPolicy defines the retries and the circuit breaker of the Resilient decorator
+type RetryPolicy struct {
+	MaxAttempts      int           // Attempts of an operation, including the first one
+	InitialDelay     time.Duration // Delay before the first retry, doubled at every following retry
+	MaxDelay         time.Duration // Maximum delay between two attempts
+	Jitter           float64       // Random fraction of the delay added or removed, e.g. 0.2 for ±20%
+	FailureThreshold int           // Consecutive failed operations that open the circuit, 0 to disable the breaker
+	OpenTimeout      time.Duration // Time the circuit stays open before an operation is tried again
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:      4,
+	InitialDelay:     200 * time.Millisecond,
+	MaxDelay:         5 * time.Second,
+	Jitter:           0.2,
+	FailureThreshold: 5,
+	OpenTimeout:      30 * time.Second,
+}
+
+// CircuitState is the state of the circuit breaker of a store
+type CircuitState int
+
+const (
+	CircuitClosed   CircuitState = iota // The store works and operations are forwarded
+	CircuitOpen                         // The store failed repeatedly and operations are rejected
+	CircuitHalfOpen                     // An operation is tried to check whether the store is back
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// IsRetryable returns true if the error of an operation on the store is transient
+func IsRetryable(s Store, err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, ErrTransient) {
+		return true
+	}
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrConditionFailed) || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if c, ok := s.(RetryClassifier); ok {
+		return c.IsRetryable(err)
+	}
+	return isTransientNetError(err)
+}
+
+// isTransientNetError returns true for the network errors that usually go away after a while
+func isTransientNetError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, e := range []error{io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.ECONNREFUSED, syscall.ECONNABORTED,
+		syscall.EPIPE, syscall.ETIMEDOUT, syscall.EHOSTUNREACH, syscall.ENETUNREACH} {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+type resilient struct {
+	Store  Store
+	Policy RetryPolicy
+
+	lock     sync.Mutex
+	state    CircuitState
+	failures int       // Consecutive failed operations
+	openedAt time.Time // Time when the circuit opened
+	trial    bool      // True while an operation checks a half-open circuit
+}
+
+// Resilient returns a store that retries the operations that fail with a transient error, with exponential backoff
+// and jitter. After FailureThreshold consecutive failures, the operations fail with ErrCircuitOpen without calling the
+// store until OpenTimeout has passed. Closing the store closes s.
+func Resilient(s Store, policy RetryPolicy) Store {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return &resilient{Store: s, Policy: policy}
+}
+
+// GetCircuitState returns the state of the circuit breaker of the store, which is closed for stores without one
+func GetCircuitState(s Store) CircuitState {
+	if c, ok := s.(interface{ CircuitState() CircuitState }); ok {
+		return c.CircuitState()
+	}
+	return CircuitClosed
+}
+
+func (r *resilient) CircuitState() CircuitState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.state == CircuitOpen && core.Since(r.openedAt) >= r.Policy.OpenTimeout {
+		return CircuitHalfOpen
+	}
+	return r.state
+}
+
+// allow returns ErrCircuitOpen when the circuit is open, or half-open with a trial in progress
+func (r *resilient) allow() error {
+	if r.Policy.FailureThreshold <= 0 {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.state == CircuitOpen && core.Since(r.openedAt) >= r.Policy.OpenTimeout {
+		r.state = CircuitHalfOpen
+	}
+	switch {
+	case r.state == CircuitOpen, r.state == CircuitHalfOpen && r.trial:
+		return fmt.Errorf("%w: %s", ErrCircuitOpen, r.Store)
+	case r.state == CircuitHalfOpen:
+		r.trial = true
+	}
+	return nil
+}
+
+func (r *resilient) record(success bool) {
+	if r.Policy.FailureThreshold <= 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.trial = false
+	if success {
+		if r.state != CircuitClosed {
+			core.Info("store %s is back, closing the circuit", r.Store)
+		}
+		r.state, r.failures = CircuitClosed, 0
+		return
+	}
+	r.failures++
+	if r.state == CircuitHalfOpen || r.failures >= r.Policy.FailureThreshold {
+		if r.state != CircuitOpen {
+			core.Info("store %s failed %d times, opening the circuit", r.Store, r.failures)
+		}
+		r.state, r.openedAt = CircuitOpen, core.Now()
+	}
+}
+
+// do runs the operation with retries. An operation that returns a permanent error, e.g. a missing file, counts as a
+// success for the circuit breaker since the store answered.
+func (r *resilient) do(op string, f func() error) error {
+	err := r.allow()
+	if err != nil {
+		return err
+	}
+
+	delay := r.Policy.InitialDelay
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if !IsRetryable(r.Store, err) {
+			r.record(true)
+			return err
+		}
+		if attempt >= r.Policy.MaxAttempts {
+			break
+		}
+		wait := delay
+		if r.Policy.Jitter > 0 {
+			wait += time.Duration((rand.Float64()*2 - 1) * r.Policy.Jitter * float64(delay))
+		}
+		core.Info("%s on %s failed, attempt %d of %d, retrying in %v: %v", op, r.Store, attempt,
+			r.Policy.MaxAttempts, wait, err)
+		time.Sleep(wait)
+		delay *= 2
+		if r.Policy.MaxDelay > 0 && delay > r.Policy.MaxDelay {
+			delay = r.Policy.MaxDelay
+		}
+	}
+	r.record(false)
+	return err
+}
+
+func (r *resilient) Url() string {
+	return r.Store.Url()
+}
+
+func (r *resilient) ReadDir(name string, filter Filter) (ls []fs.FileInfo, err error) {
+	err = r.do("ReadDir", func() error {
+		ls, err = r.Store.ReadDir(name, filter)
+		return err
+	})
+	return ls, err
+}
+
+type writeCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	n, err := wc.w.Write(p)
+	wc.n += int64(n)
+	return n, err
+}
+
+// Read reads data from a file into a writer. A read is retried only when no data has reached the writer.
+func (r *resilient) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	wc := &writeCounter{w: dest}
+	return r.do("Read", func() error {
+		if wc.n > 0 {
+			return nil
+		}
+		err := r.Store.Read(name, rang, wc, progress)
+		if err != nil && wc.n > 0 {
+			return fmt.Errorf("read of %s interrupted after %d bytes: %v", name, wc.n, err)
+		}
+		return err
+	})
+}
+
+// Write writes data to a file name. An existing file is overwritten
+func (r *resilient) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	return r.do("Write", func() error {
+		_, err := source.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		return r.Store.Write(name, source, progress)
+	})
+}
+
+// WriteIf writes data to a file name when the condition holds. When the response to a successful write is lost, the
+// retry may return ErrConditionFailed.
+func (r *resilient) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	return r.do("WriteIf", func() error {
+		_, err := source.Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		return WriteIf(r.Store, name, source, cond, progress)
+	})
+}
+
+// ETag returns the version of the file to use in Condition.IfMatch
+func (r *resilient) ETag(name string) (etag string, err error) {
+	err = r.do("ETag", func() error {
+		etag, err = ETag(r.Store, name)
+		return err
+	})
+	return etag, err
+}
+
+// Rename renames a file
+func (r *resilient) Rename(old, new string) error {
+	return r.do("Rename", func() error { return Rename(r.Store, old, new) })
+}
+
+// Copy copies a file
+func (r *resilient) Copy(source, dest string) error {
+	return r.do("Copy", func() error { return Copy(r.Store, source, dest) })
+}
+
+// Stat provides statistics about a file
+func (r *resilient) Stat(name string) (info os.FileInfo, err error) {
+	err = r.do("Stat", func() error {
+		info, err = r.Store.Stat(name)
+		return err
+	})
+	return info, err
+}
+
+// Delete deletes a file
+func (r *resilient) Delete(name string) error {
+	return r.do("Delete", func() error { return r.Store.Delete(name) })
+}
+
+// Close closes the store
+func (r *resilient) Close() error {
+	return r.Store.Close()
+}
+
+// String returns a human-readable representation of the storer (e.g. sftp://user@host/path)
+func (r *resilient) String() string {
+	return r.Store.String()
+}
+
+func (r *resilient) Describe() Description {
+	return r.Store.Describe()
+}
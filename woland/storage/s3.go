@@ -18,16 +18,21 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
 	"github.com/aws/smithy-go/logging"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 	"github.com/sirupsen/logrus"
 
 	"github.com/stregato/master/woland/core"
 )
 
 type S3 struct {
-	client *s3.Client
-	bucket string
-	repr   string
-	url    string
+	client      *s3.Client
+	multipart   multipartClient // Client of the multipart uploads, the S3 client except in tests
+	bucket      string
+	repr        string
+	url         string
+	partSize    int64 // Size of the parts of a multipart upload
+	concurrency int   // Number of parts uploaded in parallel
 }
 
 type s3logger struct{}
@@ -36,23 +41,51 @@ func (l s3logger) Logf(classification logging.Classification, format string, v .
 	fmt.Printf(format, v...)
 }
 
+func init() {
+	Register("s3", OpenS3, validateS3Url, Capabilities{RangeRead: true, ConditionalWrite: true, ServerSideCopy: true})
+}
+
+func validateS3Url(u *url.URL) error {
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return fmt.Errorf("missing bucket")
+	}
+	q := u.Query()
+	if q.Get("a") == "" || q.Get("s") == "" {
+		return fmt.Errorf("missing access key or secret")
+	}
+	_, _, err := parseMultipartOptions(q)
+	return err
+}
+
 func OpenS3(connectionUrl string) (Store, error) {
 	u, err := url.Parse(connectionUrl)
 	if core.IsErr(err, nil, "invalid url '%s': %v", connectionUrl) {
 		return nil, err
 	}
 
-	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			URL: fmt.Sprintf("https://%s", u.Host),
-		}, nil
-	})
-
 	q := u.Query()
 	verbose := q.Get("v")
 	accessKey := q.Get("a")
 	secret := q.Get("s")
 	proxy := q.Get("p")
+	scheme := "https"
+	if q.Get("tls") == "false" {
+		scheme = "http"
+	}
+	pathStyle := q.Get("path") == "true"
+	partSize, concurrency, err := parseMultipartOptions(q)
+	if core.IsErr(err, nil, "invalid multipart options in '%s': %v", connectionUrl) {
+		return nil, err
+	}
+
+	r2Resolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		return aws.Endpoint{
+			URL: fmt.Sprintf("%s://%s", scheme, u.Host),
+		}, nil
+	})
 	bucket := strings.Trim(u.Path, "/")
 	repr := fmt.Sprintf("s3://%s/%s?a=%s", u.Host, bucket, accessKey)
 
@@ -88,11 +121,17 @@ func OpenS3(connectionUrl string) (Store, error) {
 		return nil, err
 	}
 
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = pathStyle
+	})
 	s := &S3{
-		client: s3.NewFromConfig(cfg),
-		repr:   repr,
-		bucket: bucket,
-		url:    connectionUrl,
+		client:      client,
+		multipart:   client,
+		repr:        repr,
+		bucket:      bucket,
+		url:         connectionUrl,
+		partSize:    partSize,
+		concurrency: concurrency,
 	}
 
 	err = s.createBucketIfNeeded()
@@ -121,11 +160,14 @@ func (s *S3) createBucketIfNeeded() error {
 }
 
 func (s *S3) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
-	rawObject, err := s.client.GetObject(context.TODO(), &s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: &s.bucket,
 		Key:    &name,
-		//		Range:  r,
-	})
+	}
+	if rang != nil {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-%d", rang.From, rang.To-1))
+	}
+	rawObject, err := s.client.GetObject(context.TODO(), input)
 	if err != nil {
 		err = s.mapError(err)
 		if os.IsNotExist(err) || core.IsErr(err, nil, "cannot read %s/%s: %v", s, name) {
@@ -149,14 +191,83 @@ func (s *S3) Write(name string, source io.ReadSeeker, progress chan int64) error
 	}
 	source.Seek(0, io.SeekStart)
 
+	if size > s.partSize {
+		return s.writeMultipart(name, source, size, progress)
+	}
+
 	_, err = s.client.PutObject(context.TODO(), &s3.PutObjectInput{
 		Bucket:        &s.bucket,
 		Key:           &name,
 		Body:          source,
 		ContentLength: size,
 	})
-	core.IsErr(err, nil, "cannot write %s/%s: %v", s, name)
-	return s.mapError(err)
+	if core.IsErr(err, nil, "cannot write %s/%s: %v", s, name) {
+		return s.mapError(err)
+	}
+	if progress != nil {
+		progress <- size
+	}
+	return nil
+}
+
+// WriteIf writes the file with If-None-Match or If-Match so that S3 checks the condition with the write
+func (s *S3) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	size, err := source.Seek(0, io.SeekEnd)
+	if core.IsErr(err, nil, "cannot seek source for '%s': %v", name) {
+		return err
+	}
+	source.Seek(0, io.SeekStart)
+
+	var headers []func(*middleware.Stack) error
+	if cond.IfAbsent {
+		headers = append(headers, smithyhttp.AddHeaderValue("If-None-Match", "*"))
+	}
+	if cond.IfMatch != "" {
+		headers = append(headers, smithyhttp.AddHeaderValue("If-Match", cond.IfMatch))
+	}
+	_, err = s.client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket:        &s.bucket,
+		Key:           &name,
+		Body:          source,
+		ContentLength: size,
+	}, s3.WithAPIOptions(headers...))
+	if err != nil {
+		err = s.mapError(err)
+		if err != ErrConditionFailed {
+			core.IsErr(err, nil, "cannot write %s/%s: %v", s, name)
+		}
+		return err
+	}
+	if progress != nil {
+		progress <- size
+	}
+	return nil
+}
+
+// Copy copies the object with a server-side copy
+func (s *S3) Copy(source, dest string) error {
+	copySource := url.PathEscape(path.Join(s.bucket, source))
+	_, err := s.client.CopyObject(context.TODO(), &s3.CopyObjectInput{
+		Bucket:     &s.bucket,
+		Key:        &dest,
+		CopySource: &copySource,
+	})
+	if core.IsErr(err, nil, "cannot copy %s/%s to %s: %v", s, source, dest) {
+		return s.mapError(err)
+	}
+	return nil
+}
+
+// ETag returns the ETag of the object
+func (s *S3) ETag(name string) (string, error) {
+	head, err := s.client.HeadObject(context.TODO(), &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &name,
+	})
+	if err != nil {
+		return "", s.mapError(err)
+	}
+	return aws.ToString(head.ETag), nil
 }
 
 func (s *S3) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
@@ -171,10 +282,12 @@ func (s *S3) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
 	}
 
 	input := &s3.ListObjectsV2Input{
-		Bucket:     aws.String(s.bucket),
-		Prefix:     aws.String(prefix),
-		StartAfter: &f.AfterName,
-		Delimiter:  aws.String("/"),
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+	if f.AfterName != "" {
+		input.StartAfter = aws.String(path.Join(dir, f.AfterName))
 	}
 
 	if f.Suffix == "" && f.MaxResults != 0 {
@@ -239,12 +352,25 @@ func (s *S3) mapError(err error) error {
 		switch apiErr.ErrorCode() {
 		case "NotFound", "NoSuchKey":
 			return fs.ErrNotExist
-		default:
-			return err
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return ErrConditionFailed
+		case "SlowDown", "RequestTimeout", "InternalError", "ServiceUnavailable", "Throttling",
+			"RequestTimeTooSkewed":
+			return fmt.Errorf("%w: %v", ErrTransient, err)
 		}
-	} else {
-		return err
 	}
+	var respErr *smithyhttp.ResponseError
+	if errors.As(err, &respErr) {
+		if code := respErr.HTTPStatusCode(); code == http.StatusTooManyRequests || code >= 500 {
+			return fmt.Errorf("%w: %v", ErrTransient, err)
+		}
+	}
+	return err
+}
+
+// IsRetryable returns true if the error is throttling or a temporary failure of the service
+func (s *S3) IsRetryable(err error) bool {
+	return errors.Is(s.mapError(err), ErrTransient) || isTransientNetError(err)
 }
 
 func (s *S3) Stat(name string) (fs.FileInfo, error) {
@@ -340,7 +466,9 @@ func (s *S3) String() string {
 // Describe implements Store.
 func (*S3) Describe() Description {
 	return Description{
-		ReadCost:  0.0000004,
-		WriteCost: 0.000005,
+		ReadCost:    0.00000000008, // 0.08 CHF per GB of egress, ingress is free
+		WriteCost:   0,
+		ReadOpCost:  0.0000004, // 0.4 CHF per million GET and HEAD requests
+		WriteOpCost: 0.000005,  // 5 CHF per million PUT, COPY and LIST requests
 	}
 }
@@ -0,0 +1,268 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
+)
+
+var S3PartSize int64 = 16 * 1024 * 1024     // Default size of the parts of a multipart upload, overridden by ps=<MB> in the url
+var S3Concurrency = 4                       // Default number of parts uploaded in parallel, overridden by c=<n> in the url
+const s3MinPartSize int64 = 5 * 1024 * 1024 // S3 rejects parts smaller than 5 MB, except the last one
+
+// multipartClient is the part of the S3 client used by multipart uploads
+type multipartClient interface {
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput,
+		optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput,
+		optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput,
+		optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput,
+		optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// partMatches returns true when the etag of an uploaded part is the MD5 of the local data. S3 returns the MD5 in quotes
+// as etag of a part.
+func partMatches(etag string, data []byte) bool {
+	hash := md5.Sum(data)
+	return strings.Trim(etag, `"`) == hex.EncodeToString(hash[:])
+}
+
+// parseMultipartOptions returns the part size and the concurrency of multipart uploads defined in the url query
+func parseMultipartOptions(q url.Values) (partSize int64, concurrency int, err error) {
+	partSize, concurrency = S3PartSize, S3Concurrency
+	if ps := q.Get("ps"); ps != "" {
+		mb, err := strconv.ParseInt(ps, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid part size %s: %w", ps, err)
+		}
+		partSize = mb * 1024 * 1024
+	}
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+	if c := q.Get("c"); c != "" {
+		concurrency, err = strconv.Atoi(c)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid concurrency %s: %w", c, err)
+		}
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return partSize, concurrency, nil
+}
+
+// writeMultipart uploads the source in parts, with up to s.concurrency parts in parallel. The upload id and the
+// finished parts are saved in the local DB so that an interrupted upload of the same content resumes from the
+// missing parts. A saved part is reused only when its etag matches the local content.
+func (s *S3) writeMultipart(name string, source io.ReadSeeker, size int64, progress chan int64) error {
+	uploadId, resumed := s.resumeUpload(name, size)
+	if uploadId == "" {
+		out, err := s.multipart.CreateMultipartUpload(context.TODO(), &s3.CreateMultipartUploadInput{
+			Bucket: &s.bucket,
+			Key:    &name,
+		})
+		if core.IsErr(err, nil, "cannot create multipart upload for %s/%s: %v", s, name) {
+			return s.mapError(err)
+		}
+		uploadId = *out.UploadId
+		s.saveUpload(name, uploadId, size)
+	} else {
+		core.Info("resuming upload of %s/%s with %d parts done", s, name, len(resumed))
+	}
+
+	etags := map[int32]string{} // Parts uploaded, written by the upload goroutines under lock
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var uploadErr error
+	slots := make(chan struct{}, s.concurrency)
+	parts := int32((size + s.partSize - 1) / s.partSize)
+	for part := int32(1); part <= parts; part++ {
+		offset := int64(part-1) * s.partSize
+		length := s.partSize
+		if size-offset < length {
+			length = size - offset
+		}
+		slots <- struct{}{}
+		lock.Lock()
+		err := uploadErr
+		lock.Unlock()
+		if err != nil {
+			<-slots
+			break
+		}
+
+		data := make([]byte, length)
+		_, err = source.Seek(offset, io.SeekStart)
+		if err == nil {
+			_, err = io.ReadFull(source, data)
+		}
+		if core.IsErr(err, nil, "cannot read part %d of %s: %v", part, name) {
+			<-slots
+			lock.Lock()
+			uploadErr = err
+			lock.Unlock()
+			break
+		}
+
+		if etag, ok := resumed[part]; ok {
+			if partMatches(etag, data) {
+				<-slots
+				lock.Lock()
+				etags[part] = etag
+				lock.Unlock()
+				if progress != nil {
+					progress <- length
+				}
+				continue
+			}
+			core.Info("part %d of %s/%s changed since the interrupted upload", part, s, name)
+		}
+
+		wg.Add(1)
+		go func(part int32, data []byte) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			out, err := s.multipart.UploadPart(context.TODO(), &s3.UploadPartInput{
+				Bucket:        &s.bucket,
+				Key:           &name,
+				UploadId:      &uploadId,
+				PartNumber:    part,
+				Body:          core.NewBytesReader(data),
+				ContentLength: int64(len(data)),
+			})
+			lock.Lock()
+			if core.IsErr(err, nil, "cannot upload part %d of %s/%s: %v", part, s, name) {
+				uploadErr = err
+				lock.Unlock()
+				return
+			}
+			etags[part] = *out.ETag
+			s.savePart(uploadId, part, *out.ETag)
+			lock.Unlock()
+			if progress != nil {
+				progress <- int64(len(data))
+			}
+		}(part, data)
+	}
+	wg.Wait()
+
+	if uploadErr != nil {
+		if isNoSuchUpload(uploadErr) {
+			s.forgetUpload(name, uploadId)
+		}
+		return s.mapError(uploadErr)
+	}
+
+	var completed []types.CompletedPart
+	for part, etag := range etags {
+		completed = append(completed, types.CompletedPart{PartNumber: part, ETag: aws.String(etag)})
+	}
+	sort.Slice(completed, func(i, j int) bool { return completed[i].PartNumber < completed[j].PartNumber })
+	_, err := s.multipart.CompleteMultipartUpload(context.TODO(), &s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &name,
+		UploadId:        &uploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if core.IsErr(err, nil, "cannot complete multipart upload of %s/%s: %v", s, name) {
+		if isNoSuchUpload(err) {
+			s.forgetUpload(name, uploadId)
+		}
+		return s.mapError(err)
+	}
+	s.forgetUpload(name, uploadId)
+	core.Info("uploaded %s/%s in %d parts", s, name, parts)
+	return nil
+}
+
+// resumeUpload returns the id and the finished parts of a previous upload of the file with the same size and part
+// size. A previous upload with different parameters is aborted.
+func (s *S3) resumeUpload(name string, size int64) (string, map[int32]string) {
+	if !sql.IsOpen() {
+		return "", nil
+	}
+
+	var uploadId string
+	var prevSize, partSize int64
+	err := sql.QueryRow("GET_S3_UPLOAD", sql.Args{"store": s.repr, "name": name}, &uploadId, &prevSize, &partSize)
+	if err != nil {
+		return "", nil
+	}
+	if prevSize != size || partSize != s.partSize {
+		s.multipart.AbortMultipartUpload(context.TODO(), &s3.AbortMultipartUploadInput{
+			Bucket:   &s.bucket,
+			Key:      &name,
+			UploadId: &uploadId,
+		})
+		s.forgetUpload(name, uploadId)
+		return "", nil
+	}
+
+	etags := map[int32]string{}
+	rows, err := sql.Query("GET_S3_PARTS", sql.Args{"uploadId": uploadId})
+	if core.IsErr(err, nil, "cannot query parts of %s: %v", name) {
+		return uploadId, etags
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var part int32
+		var etag string
+		if !core.IsErr(rows.Scan(&part, &etag), nil, "cannot scan part: %v") {
+			etags[part] = etag
+		}
+	}
+	return uploadId, etags
+}
+
+func (s *S3) saveUpload(name, uploadId string, size int64) {
+	if !sql.IsOpen() {
+		return
+	}
+	_, err := sql.Exec("SET_S3_UPLOAD", sql.Args{"store": s.repr, "name": name, "uploadId": uploadId,
+		"size": size, "partSize": s.partSize})
+	core.IsErr(err, nil, "cannot save upload of %s: %v", name)
+}
+
+func (s *S3) savePart(uploadId string, part int32, etag string) {
+	if !sql.IsOpen() {
+		return
+	}
+	_, err := sql.Exec("SET_S3_PART", sql.Args{"uploadId": uploadId, "part": part, "etag": etag})
+	core.IsErr(err, nil, "cannot save part %d of upload %s: %v", part, uploadId)
+}
+
+func (s *S3) forgetUpload(name, uploadId string) {
+	if !sql.IsOpen() {
+		return
+	}
+	_, err := sql.Exec("DELETE_S3_PARTS", sql.Args{"uploadId": uploadId})
+	core.IsErr(err, nil, "cannot delete parts of upload %s: %v", uploadId)
+	_, err = sql.Exec("DELETE_S3_UPLOAD", sql.Args{"store": s.repr, "name": name})
+	core.IsErr(err, nil, "cannot delete upload of %s: %v", name)
+}
+
+func isNoSuchUpload(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchUpload"
+}
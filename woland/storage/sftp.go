@@ -2,6 +2,7 @@ package storage
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -51,6 +52,23 @@ type SFTP struct {
 // 	return fmt.Sprintf("sftp://%s@%s/%s", config.Username, config.Addr, config.Base)
 // }
 
+func init() {
+	Register("sftp", OpenSFTP, validateSFTPUrl, Capabilities{RangeRead: true, Rename: true})
+}
+
+func validateSFTPUrl(u *url.URL) error {
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return fmt.Errorf("missing user")
+	}
+	if _, hasPassword := u.User.Password(); !hasPassword && u.Query().Get("k") == "" {
+		return fmt.Errorf("missing password or key")
+	}
+	return nil
+}
+
 // OpenSFTP create a new Exchanger. The url is in the format sftp://
 func OpenSFTP(connectionUrl string) (Store, error) {
 	u, err := url.Parse(connectionUrl)
@@ -123,27 +141,14 @@ func (s *SFTP) Read(name string, rang *Range, dest io.Writer, progress chan int6
 	if os.IsNotExist(err) || core.IsErr(err, nil, "cannot open file on sftp server %v:%v", s) {
 		return err
 	}
+	defer f.Close()
 
 	if rang == nil {
 		_, err = io.Copy(dest, f)
 	} else {
-		left := rang.To - rang.From
-		f.Seek(rang.From, 0)
-		var b [4096]byte
-
-		for left > 0 && err == nil {
-			var sz int64
-			if rang.To-rang.From > 4096 {
-				sz = 4096
-			} else {
-				sz = rang.To - rang.From
-			}
-			n, err := f.Read(b[0:sz])
-			dest.Write(b[0:n])
-			left -= int64(n)
-			if err != nil {
-				break
-			}
+		_, err = f.Seek(rang.From, io.SeekStart)
+		if err == nil {
+			_, err = io.CopyN(dest, f, rang.To-rang.From)
 		}
 	}
 	if err != io.EOF && core.IsErr(err, nil, "cannot read from %s/%s:%v", s, name) {
@@ -171,6 +176,48 @@ func (s *SFTP) Write(name string, source io.ReadSeeker, progress chan int64) err
 	return err
 }
 
+// WriteIf writes the file when the condition holds. SFTP has no compare-and-swap: a file is created with O_EXCL when
+// it must be absent, otherwise the condition is checked before an atomic rename of a temporary file, which leaves a
+// window for concurrent writes.
+func (s *SFTP) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	n := path.Join(s.base, name)
+	if cond.IfAbsent && cond.IfMatch == "" {
+		s.c.MkdirAll(path.Dir(n))
+		f, err := s.c.OpenFile(n, os.O_RDWR|os.O_CREATE|os.O_EXCL)
+		if err != nil {
+			if _, statErr := s.c.Stat(n); statErr == nil {
+				return ErrConditionFailed
+			}
+			core.IsErr(err, nil, "cannot create SFTP file '%s': %v", n)
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(f, source)
+		core.IsErr(err, nil, "cannot write SFTP file '%s': %v", n)
+		return err
+	}
+
+	tmp := path.Join(path.Dir(n), fmt.Sprintf(".%s.%d.tmp", path.Base(n), time.Now().UnixNano()))
+	err := s.Write(path.Join(path.Dir(name), path.Base(tmp)), source, progress)
+	if err != nil {
+		return err
+	}
+	err = checkCondition(s, name, cond)
+	if err == nil {
+		err = s.c.PosixRename(tmp, n)
+	}
+	if err != nil {
+		s.c.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// ETag returns a version of the file based on the modification time and the size
+func (s *SFTP) ETag(name string) (string, error) {
+	return statETag(s, name)
+}
+
 func (s *SFTP) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
 	dir = path.Join(s.base, dir)
 	ls, err := s.c.ReadDir(dir)
@@ -178,19 +225,13 @@ func (s *SFTP) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
 		return nil, err
 	}
 
-	var cnt int64
 	var infos []fs.FileInfo
-	for _, l := range ls {
-		if matchFilter(l, f) {
-			infos = append(infos, l)
-			cnt++
-		}
-		if f.MaxResults > 0 && cnt >= f.MaxResults {
-			break
+	for _, info := range ls {
+		if !isWriteIfTemp(info.Name()) {
+			infos = append(infos, info)
 		}
 	}
-
-	return infos, nil
+	return filterInfos(infos, f), nil
 }
 
 func (s *SFTP) Stat(name string) (os.FileInfo, error) {
@@ -201,9 +242,21 @@ func (s *SFTP) Rename(old, new string) error {
 	return s.c.Rename(path.Join(s.base, old), path.Join(s.base, new))
 }
 
+// IsRetryable returns true for network timeouts and resets. A lost connection is permanent since the client does not
+// reconnect.
+func (s *SFTP) IsRetryable(err error) bool {
+	if errors.Is(err, sftp.ErrSshFxConnectionLost) || errors.Is(err, sftp.ErrSshFxNoConnection) {
+		return false
+	}
+	return isTransientNetError(err)
+}
+
 func (s *SFTP) Delete(name string) error {
 	n := path.Join(s.base, name)
 	stat, err := s.c.Stat(n)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if core.IsErr(err, nil, "cannot stat %s in Delete: %v", n) {
 		return err
 	}
@@ -2,10 +2,27 @@ package storage
 
 import (
 	"io/fs"
+	"sort"
 	"strings"
 	"time"
 )
 
+// filterInfos sorts the entries by name and returns the ones that match the filter, up to MaxResults
+func filterInfos(ls []fs.FileInfo, filter Filter) []fs.FileInfo {
+	sort.Slice(ls, func(i, j int) bool { return ls[i].Name() < ls[j].Name() })
+
+	var infos []fs.FileInfo
+	for _, l := range ls {
+		if filter.MaxResults > 0 && int64(len(infos)) >= filter.MaxResults {
+			break
+		}
+		if matchFilter(l, filter) {
+			infos = append(infos, l)
+		}
+	}
+	return infos
+}
+
 func matchFilter(f fs.FileInfo, filter Filter) bool {
 	name := f.Name()
 	return strings.HasPrefix(name, filter.Prefix) &&
@@ -2,14 +2,30 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/sql"
 )
 
 func TestS3(t *testing.T) {
@@ -23,6 +39,629 @@ func TestWebdav(t *testing.T) {
 	testStore(t, credentials["dav"])
 }
 
+// failingReader fails the reads after limit bytes to simulate a dropped connection
+type failingReader struct {
+	io.ReadSeeker
+	limit int64
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	offset, _ := f.Seek(0, io.SeekCurrent)
+	if offset >= f.limit {
+		return 0, fmt.Errorf("connection dropped")
+	}
+	return f.ReadSeeker.Read(p)
+}
+
+// TestS3Multipart runs against a local MinIO, e.g. minio: s3://localhost:9000/woland?a=...&s=...&tls=false&path=true
+func TestS3Multipart(t *testing.T) {
+	credentials := LoadTestURLs("../../../credentials/urls.yaml")
+	url := credentials["minio"]
+	if url == "" {
+		t.Skip("no minio url in credentials")
+	}
+
+	err := sql.OpenDB(filepath.Join(os.TempDir(), "multipart.db"))
+	core.TestErr(t, err, "cannot open db: %v")
+	defer sql.CloseDB()
+
+	s, err := Open(url + "&ps=5&c=2")
+	core.TestErr(t, err, "cannot open store: %v", err)
+	defer s.Close()
+
+	data := core.GenerateRandomBytes(12 * 1024 * 1024)
+	name := path.Join("ut", uuid.New().String())
+	err = s.Write(name, &failingReader{core.NewBytesReader(data), 6 * 1024 * 1024}, nil)
+	core.Assert(t, err != nil, "expected an interrupted upload")
+
+	var uploadId string
+	err = sql.QueryRow("GET_S3_UPLOAD", sql.Args{"store": s.String(), "name": name}, &uploadId, new(int64), new(int64))
+	core.TestErr(t, err, "expected the upload in the DB: %v")
+	rows, err := sql.Query("GET_S3_PARTS", sql.Args{"uploadId": uploadId})
+	core.TestErr(t, err, "cannot query parts: %v")
+	parts := 0
+	for rows.Next() {
+		parts++
+	}
+	rows.Close()
+	core.Assert(t, parts > 0, "expected some finished parts")
+
+	progress := make(chan int64)
+	var progressCount int64
+	done := make(chan bool)
+	go func() {
+		for p := range progress {
+			progressCount += p
+		}
+		done <- true
+	}()
+	err = s.Write(name, core.NewBytesReader(data), progress)
+	close(progress)
+	<-done
+	core.TestErr(t, err, "cannot resume upload: %v")
+	core.Assert(t, progressCount == int64(len(data)), "wrong progress: %d", progressCount)
+	err = sql.QueryRow("GET_S3_UPLOAD", sql.Args{"store": s.String(), "name": name}, &uploadId, new(int64), new(int64))
+	core.Assert(t, err == sql.ErrNoRows, "expected the upload to be removed from the DB")
+
+	var b bytes.Buffer
+	err = s.Read(name, nil, &b, nil)
+	core.TestErr(t, err, "cannot read file: %v", err)
+	core.Assert(t, bytes.Equal(data, b.Bytes()), "wrong data")
+	core.TestErr(t, s.Delete(name), "cannot delete file: %v")
+}
+
+func TestParseMultipartOptions(t *testing.T) {
+	for query, expected := range map[string][2]int64{
+		"":          {S3PartSize, int64(S3Concurrency)},
+		"ps=32&c=8": {32 * 1024 * 1024, 8},
+		"ps=1&c=0":  {s3MinPartSize, 1},
+	} {
+		q, _ := url.ParseQuery(query)
+		partSize, concurrency, err := parseMultipartOptions(q)
+		core.TestErr(t, err, "cannot parse %s: %v", query)
+		core.Assert(t, partSize == expected[0] && int64(concurrency) == expected[1], "unexpected options for %s: %d, %d",
+			query, partSize, concurrency)
+	}
+	for _, query := range []string{"ps=big", "c=many"} {
+		q, _ := url.ParseQuery(query)
+		_, _, err := parseMultipartOptions(q)
+		core.Assert(t, err != nil, "expected an error for %s", query)
+	}
+}
+
+// fakeMultipart keeps the parts of multipart uploads in memory
+type fakeMultipart struct {
+	lock    sync.Mutex
+	parts   map[int32][]byte
+	uploads int
+	objects map[string][]byte
+}
+
+func (f *fakeMultipart) CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput,
+	optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload")}, nil
+}
+
+func (f *fakeMultipart) UploadPart(ctx context.Context, params *s3.UploadPartInput,
+	optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.parts[params.PartNumber] = data
+	f.uploads++
+	hash := md5.Sum(data)
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("%q", hex.EncodeToString(hash[:])))}, nil
+}
+
+func (f *fakeMultipart) CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput,
+	optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	var object []byte
+	for _, p := range params.MultipartUpload.Parts {
+		if !partMatches(*p.ETag, f.parts[p.PartNumber]) {
+			return nil, fmt.Errorf("invalid part %d", p.PartNumber)
+		}
+		object = append(object, f.parts[p.PartNumber]...)
+	}
+	f.objects[*params.Key] = object
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeMultipart) AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput,
+	optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.parts = map[int32][]byte{}
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestS3MultipartResume(t *testing.T) {
+	err := sql.OpenDB(filepath.Join(os.TempDir(), "multipart-resume.db"))
+	core.TestErr(t, err, "cannot open db: %v")
+	defer sql.CloseDB()
+
+	f := &fakeMultipart{parts: map[int32][]byte{}, objects: map[string][]byte{}}
+	s := &S3{multipart: f, bucket: "woland", repr: "s3://fake/woland", partSize: s3MinPartSize, concurrency: 2}
+	name := path.Join("ut", uuid.New().String())
+	s.forgetUpload(name, "upload")
+
+	data := core.GenerateRandomBytes(int(3 * s3MinPartSize))
+	err = s.writeMultipart(name, &failingReader{core.NewBytesReader(data), s3MinPartSize}, int64(len(data)), nil)
+	core.Assert(t, err != nil, "expected an interrupted upload")
+	core.Assert(t, f.uploads == 1, "expected only the first part uploaded, got %d", f.uploads)
+
+	// the first part changed locally, so it must be uploaded again
+	data[0]++
+	f.uploads = 0
+	err = s.writeMultipart(name, core.NewBytesReader(data), int64(len(data)), nil)
+	core.TestErr(t, err, "cannot resume upload: %v")
+	core.Assert(t, f.uploads == 3, "expected 3 parts uploaded, got %d", f.uploads)
+	core.Assert(t, bytes.Equal(f.objects[name], data), "wrong data")
+
+	// an interrupted upload with unchanged content skips the finished parts
+	name = path.Join("ut", uuid.New().String())
+	err = s.writeMultipart(name, &failingReader{core.NewBytesReader(data), 2 * s3MinPartSize}, int64(len(data)), nil)
+	core.Assert(t, err != nil, "expected an interrupted upload")
+	f.uploads = 0
+	err = s.writeMultipart(name, core.NewBytesReader(data), int64(len(data)), nil)
+	core.TestErr(t, err, "cannot resume upload: %v")
+	core.Assert(t, f.uploads == 1, "expected only the last part uploaded, got %d", f.uploads)
+	core.Assert(t, bytes.Equal(f.objects[name], data), "wrong data")
+}
+
+func TestConditionalWrite(t *testing.T) {
+	for _, url := range []string{"file://" + filepath.Join(os.TempDir(), "conditional"), "mem://conditional"} {
+		s, err := Open(url)
+		core.TestErr(t, err, "cannot open store %s: %v", url)
+
+		name := path.Join("ut", uuid.New().String())
+		err = WriteFileIf(s, name, []byte("first"), Condition{IfAbsent: true})
+		core.TestErr(t, err, "cannot write absent file in %s: %v", url)
+		err = WriteFileIf(s, name, []byte("second"), Condition{IfAbsent: true})
+		core.Assert(t, err == ErrConditionFailed, "expected ErrConditionFailed in %s, got %v", url, err)
+
+		etag, err := ETag(s, name)
+		core.TestErr(t, err, "cannot get etag in %s: %v", url)
+		err = WriteFileIf(s, name, []byte("third version"), Condition{IfMatch: etag})
+		core.TestErr(t, err, "cannot write matching file in %s: %v", url)
+		err = WriteFileIf(s, name, []byte("fourth"), Condition{IfMatch: etag})
+		core.Assert(t, err == ErrConditionFailed, "expected ErrConditionFailed with a stale etag in %s, got %v", url,
+			err)
+
+		data, err := ReadFile(s, name)
+		core.TestErr(t, err, "cannot read file in %s: %v", url)
+		core.Assert(t, string(data) == "third version", "wrong content in %s: %s", url, data)
+		core.TestErr(t, s.Delete(name), "cannot delete file: %v")
+		s.Close()
+	}
+}
+
+// slowReader returns one byte at a time after a delay
+type slowReader struct {
+	io.ReadSeeker
+	delay time.Duration
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.ReadSeeker.Read(p[:1])
+}
+
+func TestConditionalWriteSlowWriter(t *testing.T) {
+	timeout := LocalLockTimeout
+	LocalLockTimeout = 200 * time.Millisecond
+	defer func() { LocalLockTimeout = timeout }()
+
+	dir := filepath.Join(os.TempDir(), "conditional-slow")
+	os.RemoveAll(dir)
+	s, err := Open("file://" + dir)
+	core.TestErr(t, err, "cannot open store: %v")
+	defer s.Close()
+
+	// the write lasts longer than the lock timeout
+	done := make(chan error)
+	go func() {
+		source := slowReader{core.NewBytesReader([]byte("slow writer")), 100 * time.Millisecond}
+		done <- WriteIf(s, "ut/a", source, Condition{IfAbsent: true}, nil)
+	}()
+	time.Sleep(3 * LocalLockTimeout / 2)
+	for i := 0; i < 3; i++ {
+		_, err = s.ReadDir("ut", Filter{})
+		core.TestErr(t, err, "cannot read dir: %v")
+		err = WriteFileIf(s, "ut/a", []byte("second writer"), Condition{IfAbsent: true})
+		core.Assert(t, err == ErrConditionFailed, "expected ErrConditionFailed while the first write runs, got %v", err)
+		time.Sleep(LocalLockTimeout / 2)
+	}
+
+	core.TestErr(t, <-done, "cannot write with a slow writer: %v")
+	data, err := ReadFile(s, "ut/a")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "slow writer", "wrong content: %s", data)
+}
+
+func TestMemoryConcurrentAccess(t *testing.T) {
+	s, err := OpenMemory("mem://concurrent")
+	core.TestErr(t, err, "cannot open memory store: %v")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				name := fmt.Sprintf("ut/%d/%d", i, j)
+				WriteFile(s, name, []byte("data"))
+				WriteFileIf(s, "ut/shared", []byte(name), Condition{IfAbsent: true})
+				s.ReadDir("ut", Filter{})
+				s.Stat(name)
+				ETag(s, "ut/shared")
+				ReadFile(s, name)
+				s.Delete(name)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ls, err := s.ReadDir("ut", Filter{})
+	core.TestErr(t, err, "cannot read dir: %v")
+	core.Assert(t, len(ls) == 1 && ls[0].Name() == "shared", "expected only the shared file, got %d files", len(ls))
+}
+
+func TestConditionalWriteLeftovers(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), "conditional-leftovers")
+	os.RemoveAll(dir)
+	s, err := Open("file://" + dir)
+	core.TestErr(t, err, "cannot open store: %v")
+	defer s.Close()
+
+	err = WriteFileIf(s, "ut/a", []byte("a"), Condition{IfAbsent: true})
+	core.TestErr(t, err, "cannot write absent file: %v")
+
+	// simulate a writer that crashed while holding the lock
+	lockFile := filepath.Join(dir, "ut", ".b.lock")
+	core.TestErr(t, os.WriteFile(lockFile, nil, 0644), "cannot create lock: %v")
+	core.TestErr(t, os.WriteFile(filepath.Join(dir, "ut", ".b.1.tmp"), nil, 0644), "cannot create temp: %v")
+
+	ls, err := s.ReadDir("ut", Filter{})
+	core.TestErr(t, err, "cannot read dir: %v")
+	core.Assert(t, len(ls) == 1 && ls[0].Name() == "a", "expected only the written file, got %d files", len(ls))
+	err = WriteFileIf(s, "ut/b", []byte("b"), Condition{IfAbsent: true})
+	core.Assert(t, err == ErrConditionFailed, "expected ErrConditionFailed with a fresh lock, got %v", err)
+
+	old := time.Now().Add(-2 * LocalLockTimeout)
+	os.Chtimes(lockFile, old, old)
+	os.Chtimes(filepath.Join(dir, "ut", ".b.1.tmp"), old, old)
+	_, err = s.ReadDir("ut", Filter{})
+	core.TestErr(t, err, "cannot read dir: %v")
+	_, err = os.Stat(lockFile)
+	core.Assert(t, os.IsNotExist(err), "expected the stale lock to be removed, got %v", err)
+	_, err = os.Stat(filepath.Join(dir, "ut", ".b.1.tmp"))
+	core.Assert(t, os.IsNotExist(err), "expected the stale temp file to be removed, got %v", err)
+
+	err = WriteFileIf(s, "ut/b", []byte("b"), Condition{IfAbsent: true})
+	core.TestErr(t, err, "cannot write after the stale lock is removed: %v")
+}
+
+func TestRegister(t *testing.T) {
+	var opened string
+	err := Register("ut", func(connectionUrl string) (Store, error) {
+		opened = connectionUrl
+		return OpenMemory("mem://ut")
+	}, func(u *url.URL) error {
+		if u.Host == "" {
+			return fmt.Errorf("missing host")
+		}
+		return nil
+	}, Capabilities{Rename: true})
+	core.TestErr(t, err, "cannot register driver: %v")
+
+	err = Register("ut", OpenMemory, nil, Capabilities{})
+	core.Assert(t, errors.Is(err, ErrDriverExists), "expected ErrDriverExists, got %v", err)
+
+	s, err := Open("ut://host/path")
+	core.TestErr(t, err, "cannot open store: %v")
+	core.Assert(t, opened == "ut://host/path", "wrong url passed to the opener: %s", opened)
+	core.Assert(t, GetCapabilities(s) == Capabilities{RangeRead: true, Rename: true, ConditionalWrite: true},
+		"expected the capabilities of the memory store")
+
+	_, err = Open("ut:///path")
+	core.Assert(t, errors.Is(err, ErrInvalidUrl), "expected ErrInvalidUrl, got %v", err)
+	_, err = Open("unknown://host")
+	core.Assert(t, err == core.ErrNoDriver, "expected ErrNoDriver, got %v", err)
+	err = Validate("s3://host/bucket")
+	core.Assert(t, errors.Is(err, ErrInvalidUrl), "expected ErrInvalidUrl for missing credentials, got %v", err)
+
+	var schemes []string
+	for _, d := range Drivers() {
+		schemes = append(schemes, d.Scheme)
+	}
+	core.Assert(t, fmt.Sprint(schemes) == "[dav davs file mem s3 sftp ut]", "unexpected drivers: %v", schemes)
+
+	err = WriteFile(s, "ut/a", []byte("a"))
+	core.TestErr(t, err, "cannot write file: %v")
+	core.TestErr(t, Copy(s, "ut/a", "ut/b"), "cannot copy file: %v")
+	core.TestErr(t, Rename(s, "ut/b", "ut/c"), "cannot rename file: %v")
+	data, err := ReadFile(s, "ut/c")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "a", "wrong content: %s", data)
+	_, err = s.Stat("ut/b")
+	core.Assert(t, os.IsNotExist(err), "expected the renamed file to be removed")
+}
+
+func TestCached(t *testing.T) {
+	m, err := OpenMemory("mem://cached")
+	core.TestErr(t, err, "cannot open memory store: %v")
+	dir := filepath.Join(t.TempDir(), "cache")
+	policy := CachePolicy{
+		Immutable:   func(name string) bool { return path.Dir(name) == "h" },
+		MetadataTTL: time.Minute,
+		MaxSize:     10,
+	}
+	s, err := Cached(m, dir, policy)
+	core.TestErr(t, err, "cannot create cached store: %v")
+
+	core.TestErr(t, WriteFile(s, "h/1", []byte("header1")), "cannot write file: %v")
+	core.TestErr(t, WriteFile(s, "touch", []byte("a")), "cannot write file: %v")
+	ls, err := s.ReadDir("h", Filter{})
+	core.TestErr(t, err, "cannot read dir: %v")
+	core.Assert(t, len(ls) == 1, "expected 1 header, got %d", len(ls))
+	data, err := ReadFile(s, "h/1")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "header1", "wrong content %s", data)
+	_, err = s.Stat("touch")
+	core.TestErr(t, err, "cannot stat file: %v")
+
+	// changes by other peers are not visible until the TTL expires, while immutable content is read from disk
+	core.TestErr(t, WriteFile(m, "h/2", []byte("header2")), "cannot write file: %v")
+	core.TestErr(t, m.Delete("touch"), "cannot delete file: %v")
+	core.TestErr(t, m.Delete("h/1"), "cannot delete file: %v")
+	ls, _ = s.ReadDir("h", Filter{})
+	core.Assert(t, len(ls) == 1, "expected the cached listing, got %d entries", len(ls))
+	_, err = s.Stat("touch")
+	core.Assert(t, err == nil, "expected the cached stat, got %v", err)
+	data, err = ReadFile(s, "h/1")
+	core.TestErr(t, err, "cannot read cached file: %v")
+	core.Assert(t, string(data) == "header1", "wrong cached content %s", data)
+
+	// writes through the store invalidate the listing of the folder
+	core.TestErr(t, WriteFile(s, "h/3", []byte("header3")), "cannot write file: %v")
+	ls, _ = s.ReadDir("h", Filter{})
+	core.Assert(t, len(ls) == 2, "expected 2 headers after the write, got %d", len(ls))
+
+	// the size limit removes the least recently used content
+	_, err = ReadFile(s, "h/2")
+	core.TestErr(t, err, "cannot read file: %v")
+	_, err = os.Stat(filepath.Join(dir, "h", "1"))
+	core.Assert(t, os.IsNotExist(err), "expected h/1 to be evicted")
+	_, err = os.Stat(filepath.Join(dir, "h", "2"))
+	core.Assert(t, err == nil, "expected h/2 in the cache")
+
+	// files larger than the limit are read but not kept
+	core.TestErr(t, WriteFile(m, "h/4", []byte("a large header")), "cannot write file: %v")
+	data, err = ReadFile(s, "h/4")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "a large header", "wrong content %s", data)
+	_, err = os.Stat(filepath.Join(dir, "h", "4"))
+	core.Assert(t, os.IsNotExist(err), "expected h/4 not to be cached")
+	_, err = os.Stat(filepath.Join(dir, "h", "2"))
+	core.Assert(t, err == nil, "expected h/2 to stay in the cache")
+
+	// the content on disk survives a restart
+	s, err = Cached(m, dir, policy)
+	core.TestErr(t, err, "cannot reopen cached store: %v")
+	core.TestErr(t, m.Delete("h/2"), "cannot delete file: %v")
+	data, err = ReadFile(s, "h/2")
+	core.TestErr(t, err, "cannot read cached file after restart: %v")
+	core.Assert(t, string(data) == "header2", "wrong cached content %s", data)
+}
+
+// flakyStore fails the next operations with a transient error
+type flakyStore struct {
+	Store
+	failures int
+	calls    int
+}
+
+func (f *flakyStore) fail() error {
+	f.calls++
+	if f.failures > 0 {
+		f.failures--
+		return fmt.Errorf("%w: service unavailable", ErrTransient)
+	}
+	return nil
+}
+
+func (f *flakyStore) Stat(name string) (fs.FileInfo, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.Store.Stat(name)
+}
+
+func (f *flakyStore) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	if err := f.fail(); err != nil {
+		io.Copy(io.Discard, source)
+		return err
+	}
+	return f.Store.Write(name, source, progress)
+}
+
+// lostStore fails every Stat with a timeout that its classifier considers permanent, like a lost SFTP connection
+type lostStore struct {
+	Store
+	calls int
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "connection lost" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func (l *lostStore) Stat(name string) (fs.FileInfo, error) {
+	l.calls++
+	return nil, timeoutError{}
+}
+
+func (l *lostStore) IsRetryable(err error) bool {
+	return false
+}
+
+func TestRetryClassifierThroughDecorators(t *testing.T) {
+	m, err := OpenMemory("mem://classifier")
+	core.TestErr(t, err, "cannot open memory store: %v")
+	l := &lostStore{Store: m}
+	policy := RetryPolicy{MaxAttempts: 3, InitialDelay: time.Millisecond, MaxDelay: time.Millisecond,
+		FailureThreshold: 10, OpenTimeout: time.Second}
+	s := Resilient(Metered(Throttled(l, nil, nil), &Meter{}), policy)
+
+	_, err = s.Stat("file")
+	core.Assert(t, err != nil, "expected an error")
+	core.Assert(t, l.calls == 1, "error retried %d times despite the classifier of the store", l.calls)
+	core.Assert(t, IsRetryable(Metered(m, &Meter{}), timeoutError{}), "timeout must be retryable by default")
+	core.Assert(t, GetCircuitState(Throttled(Metered(s, &Meter{}), nil, nil)) == CircuitClosed,
+		"wrong state through the decorators")
+}
+
+func TestResilient(t *testing.T) {
+	m, err := OpenMemory("mem://resilient")
+	core.TestErr(t, err, "cannot open memory store: %v")
+	f := &flakyStore{Store: m}
+	policy := RetryPolicy{
+		MaxAttempts:      3,
+		InitialDelay:     time.Millisecond,
+		MaxDelay:         5 * time.Millisecond,
+		Jitter:           0.2,
+		FailureThreshold: 2,
+		OpenTimeout:      50 * time.Millisecond,
+	}
+	s := Resilient(f, policy)
+
+	// transient errors are retried and the source is rewound before each attempt
+	f.failures = 2
+	core.TestErr(t, WriteFile(s, "file", []byte("content")), "cannot write after retries: %v")
+	core.Assert(t, f.calls == 3, "expected 3 attempts, got %d", f.calls)
+	data, err := ReadFile(s, "file")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, string(data) == "content", "wrong content %s", data)
+
+	// permanent errors are not retried
+	f.calls = 0
+	_, err = s.Stat("missing")
+	core.Assert(t, errors.Is(err, fs.ErrNotExist), "expected ErrNotExist, got %v", err)
+	core.Assert(t, f.calls == 1, "permanent error retried %d times", f.calls)
+
+	// consecutive failures open the circuit, which rejects the operations without calling the store
+	f.failures = 6
+	for i := 0; i < 2; i++ {
+		_, err = s.Stat("file")
+		core.Assert(t, errors.Is(err, ErrTransient), "expected a transient error, got %v", err)
+	}
+	core.Assert(t, GetCircuitState(s) == CircuitOpen, "expected open circuit, got %s", GetCircuitState(s))
+	f.calls = 0
+	_, err = s.Stat("file")
+	core.Assert(t, errors.Is(err, ErrCircuitOpen), "expected ErrCircuitOpen, got %v", err)
+	core.Assert(t, f.calls == 0, "store called with open circuit")
+
+	// after the timeout an operation is tried and its success closes the circuit
+	time.Sleep(policy.OpenTimeout)
+	core.Assert(t, GetCircuitState(s) == CircuitHalfOpen, "expected half-open circuit, got %s", GetCircuitState(s))
+	f.failures = 0
+	_, err = s.Stat("file")
+	core.TestErr(t, err, "cannot stat after the circuit timeout: %v")
+	core.Assert(t, GetCircuitState(s) == CircuitClosed, "expected closed circuit, got %s", GetCircuitState(s))
+
+	// the state is visible through the other decorators
+	core.Assert(t, GetCircuitState(Sub(s, "dir", false)) == CircuitClosed, "wrong state through Sub")
+	core.Assert(t, IsRetryable(m, syscall.ECONNRESET), "connection reset must be retryable")
+	core.Assert(t, !IsRetryable(m, ErrConditionFailed), "failed condition must not be retryable")
+}
+
+func TestMetered(t *testing.T) {
+	m, err := OpenMemory("mem://metered")
+	core.TestErr(t, err, "cannot open memory store: %v")
+	meter := &Meter{}
+	s := Metered(m, meter)
+
+	core.TestErr(t, WriteFile(s, "a", []byte("0123456789")), "cannot write file: %v")
+	_, err = ReadFile(s, "a")
+	core.TestErr(t, err, "cannot read file: %v")
+	var b bytes.Buffer
+	core.TestErr(t, s.Read("a", &Range{From: 2, To: 5}, &b, nil), "cannot read range: %v")
+	_, err = s.ReadDir("", Filter{})
+	core.TestErr(t, err, "cannot read dir: %v")
+	core.TestErr(t, s.Delete("a"), "cannot delete file: %v")
+
+	u := meter.Take()
+	core.Assert(t, u.BytesWritten == 10 && u.Writes == 1, "wrong writes %+v", u)
+	core.Assert(t, u.BytesRead == 13 && u.Reads == 2, "wrong reads %+v", u)
+	core.Assert(t, u.Lists == 1 && u.Deletes == 1, "wrong operations %+v", u)
+	d := m.Describe()
+	core.Assert(t, u.Cost == 10*d.WriteCost+13*d.ReadCost, "wrong cost %f", u.Cost)
+	core.Assert(t, meter.Usage().IsZero(), "meter not reset by Take")
+}
+
+// describedStore replaces the description of a store
+type describedStore struct {
+	Store
+	description Description
+}
+
+func (d describedStore) Describe() Description {
+	return d.description
+}
+
+func TestMeteredS3Cost(t *testing.T) {
+	m, err := OpenMemory("mem://metered-s3")
+	core.TestErr(t, err, "cannot open memory store: %v")
+	meter := &Meter{}
+	d := (&S3{}).Describe()
+	s := Metered(describedStore{m, d}, meter)
+
+	data := make([]byte, 1024*1024)
+	core.TestErr(t, WriteFile(s, "a", data), "cannot write file: %v")
+	_, err = ReadFile(s, "a")
+	core.TestErr(t, err, "cannot read file: %v")
+	_, err = s.ReadDir("", Filter{})
+	core.TestErr(t, err, "cannot read dir: %v")
+
+	u := meter.Take()
+	expected := d.WriteOpCost + float64(len(data))*d.ReadCost + d.ReadOpCost + d.WriteOpCost
+	core.Assert(t, math.Abs(u.Cost-expected) < 1e-12, "wrong cost %g, expected %g", u.Cost, expected)
+
+	// a GB in and out in 1 MB requests costs cents, not thousands
+	perGB := u.Cost * 1024
+	core.Assert(t, perGB > 0.01 && perGB < 1, "unrealistic cost %f CHF per GB", perGB)
+}
+
+func TestThrottled(t *testing.T) {
+	m, err := OpenMemory("mem://throttled")
+	core.TestErr(t, err, "cannot open memory store: %v")
+	global := NewRateLimiter(0, nil)
+	upload := NewRateLimiter(1024*1024, global)
+	s := Throttled(m, upload, nil)
+
+	// the first second of traffic is in the bucket, the rest waits for the rate
+	data := core.GenerateRandomBytes(1024 * 1024 * 3 / 2)
+	start := time.Now()
+	core.TestErr(t, WriteFile(s, "a", data), "cannot write file: %v")
+	elapsed := time.Since(start)
+	core.Assert(t, elapsed > 400*time.Millisecond, "write not throttled: %v", elapsed)
+
+	start = time.Now()
+	_, err = ReadFile(s, "a")
+	core.TestErr(t, err, "cannot read file: %v")
+	core.Assert(t, time.Since(start) < 100*time.Millisecond, "read throttled without download limit")
+
+	// the global limit applies even when the local one is removed
+	upload.SetRate(0)
+	global.SetRate(1024 * 1024)
+	start = time.Now()
+	core.TestErr(t, WriteFile(s, "b", data), "cannot write file: %v")
+	elapsed = time.Since(start)
+	core.Assert(t, elapsed > 400*time.Millisecond, "write not throttled by the parent: %v", elapsed)
+}
+
 func testStore(t *testing.T, url string) {
 	s, err := Open(url)
 	core.TestErr(t, err, "cannot open store: %v", err)
@@ -0,0 +1,235 @@
+// Package storagetest checks that an implementation of storage.Store behaves as expected by the rest of the code,
+// independently of the backend.
+package storagetest
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/storage"
+)
+
+// Run runs the behavioral suite on the store. All the files are created in a new folder, which is deleted at the end.
+func Run(t *testing.T, s storage.Store) {
+	dir := "storagetest-" + uuid.New().String()
+	defer s.Delete(dir)
+
+	t.Run("ReadWrite", func(t *testing.T) { testReadWrite(t, s, dir) })
+	t.Run("NotExist", func(t *testing.T) { testNotExist(t, s, dir) })
+	t.Run("Range", func(t *testing.T) { testRange(t, s, dir) })
+	t.Run("ReadDir", func(t *testing.T) { testReadDir(t, s, dir) })
+	t.Run("Delete", func(t *testing.T) { testDelete(t, s, dir) })
+	t.Run("WriteIf", func(t *testing.T) { testWriteIf(t, s, dir) })
+	t.Run("RenameAndCopy", func(t *testing.T) { testRenameAndCopy(t, s, dir) })
+}
+
+func writeFile(t *testing.T, s storage.Store, name string, data []byte) {
+	err := storage.WriteFile(s, name, data)
+	core.TestErr(t, err, "cannot write %s: %v", name)
+}
+
+func readFile(t *testing.T, s storage.Store, name string) []byte {
+	data, err := storage.ReadFile(s, name)
+	core.TestErr(t, err, "cannot read %s: %v", name)
+	return data
+}
+
+func names(ls []fs.FileInfo) []string {
+	var names []string
+	for _, l := range ls {
+		names = append(names, l.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equal(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// testReadWrite checks that a file is read as written, that a write replaces the whole content and that Stat
+// reports the base name and the size.
+func testReadWrite(t *testing.T, s storage.Store, dir string) {
+	name := path.Join(dir, "rw", "file.txt")
+	writeFile(t, s, name, []byte("the first content"))
+	core.Assert(t, string(readFile(t, s, name)) == "the first content", "wrong content")
+
+	writeFile(t, s, name, []byte("shorter"))
+	core.Assert(t, string(readFile(t, s, name)) == "shorter", "overwrite must truncate the file")
+
+	stat, err := s.Stat(name)
+	core.TestErr(t, err, "cannot stat %s: %v", name)
+	core.Assert(t, stat.Name() == "file.txt", "Stat must return the base name, got %s", stat.Name())
+	core.Assert(t, stat.Size() == 7, "wrong size %d", stat.Size())
+	core.Assert(t, !stat.IsDir(), "file reported as folder")
+
+	stat, err = s.Stat(path.Join(dir, "rw"))
+	core.TestErr(t, err, "cannot stat folder: %v")
+	core.Assert(t, stat.IsDir(), "folder not reported as folder")
+
+	writeFile(t, s, path.Join(dir, "rw", "empty"), nil)
+	core.Assert(t, len(readFile(t, s, path.Join(dir, "rw", "empty"))) == 0, "empty file must be empty")
+}
+
+// testNotExist checks that missing files are reported with an error that matches fs.ErrNotExist and that deleting
+// a missing file is not an error.
+func testNotExist(t *testing.T, s storage.Store, dir string) {
+	name := path.Join(dir, "missing")
+
+	_, err := s.Stat(name)
+	core.Assert(t, errors.Is(err, fs.ErrNotExist), "Stat of missing file must return ErrNotExist, got %v", err)
+
+	var b bytes.Buffer
+	err = s.Read(name, nil, &b, nil)
+	core.Assert(t, errors.Is(err, fs.ErrNotExist), "Read of missing file must return ErrNotExist, got %v", err)
+
+	err = s.Delete(name)
+	core.Assert(t, err == nil, "Delete of missing file must succeed, got %v", err)
+
+	// object stores have no folders, so an empty list is acceptable for a missing folder
+	ls, err := s.ReadDir(name, storage.Filter{})
+	core.Assert(t, (err == nil && len(ls) == 0) || errors.Is(err, fs.ErrNotExist),
+		"ReadDir of missing folder must return an empty list or ErrNotExist, got %v", err)
+}
+
+// testRange checks that ranges are read as [From, To) and that a range past the end is truncated
+func testRange(t *testing.T, s storage.Store, dir string) {
+	name := path.Join(dir, "range")
+	data := []byte("0123456789")
+	writeFile(t, s, name, data)
+
+	for _, c := range []struct {
+		rang     storage.Range
+		expected string
+	}{
+		{storage.Range{From: 0, To: 10}, "0123456789"},
+		{storage.Range{From: 2, To: 5}, "234"},
+		{storage.Range{From: 9, To: 10}, "9"},
+		{storage.Range{From: 5, To: 20}, "56789"},
+	} {
+		var b bytes.Buffer
+		err := s.Read(name, &c.rang, &b, nil)
+		core.TestErr(t, err, "cannot read range %v: %v", c.rang)
+		core.Assert(t, b.String() == c.expected, "range %v: expected %s, got %s", c.rang, c.expected, b.String())
+	}
+}
+
+// testReadDir checks the entries of a folder and the fields of Filter
+func testReadDir(t *testing.T, s storage.Store, dir string) {
+	dir = path.Join(dir, "ls")
+	for _, name := range []string{"a.txt", "b.txt", "c.h", "sub/d.txt"} {
+		writeFile(t, s, path.Join(dir, name), []byte(name))
+	}
+
+	ls, err := s.ReadDir(dir, storage.Filter{})
+	core.TestErr(t, err, "cannot read dir: %v")
+	core.Assert(t, equal(names(ls), "a.txt", "b.txt", "c.h", "sub"), "wrong entries %v", names(ls))
+	for _, l := range ls {
+		core.Assert(t, l.IsDir() == (l.Name() == "sub"), "wrong IsDir for %s", l.Name())
+		if l.Name() == "b.txt" {
+			core.Assert(t, l.Size() == 5, "wrong size of %s: %d", l.Name(), l.Size())
+		}
+	}
+
+	for _, c := range []struct {
+		filter   storage.Filter
+		expected []string
+	}{
+		{storage.Filter{OnlyFiles: true}, []string{"a.txt", "b.txt", "c.h"}},
+		{storage.Filter{OnlyFolders: true}, []string{"sub"}},
+		{storage.Filter{Prefix: "b"}, []string{"b.txt"}},
+		{storage.Filter{Suffix: ".txt"}, []string{"a.txt", "b.txt"}},
+		{storage.Filter{AfterName: "b.txt"}, []string{"c.h", "sub"}},
+		{storage.Filter{OnlyFiles: true, MaxResults: 2}, []string{"a.txt", "b.txt"}},
+	} {
+		ls, err := s.ReadDir(dir, c.filter)
+		core.TestErr(t, err, "cannot read dir with filter %+v: %v", c.filter)
+		core.Assert(t, equal(names(ls), c.expected...), "filter %+v: expected %v, got %v", c.filter, c.expected,
+			names(ls))
+	}
+
+	// AfterName and MaxResults page through the files in order of name
+	var pages []string
+	var after string
+	for i := 0; i < 5; i++ {
+		ls, err := s.ReadDir(dir, storage.Filter{OnlyFiles: true, AfterName: after, MaxResults: 1})
+		core.TestErr(t, err, "cannot read page: %v")
+		if len(ls) == 0 {
+			break
+		}
+		core.Assert(t, len(ls) == 1, "page must have 1 entry, got %d", len(ls))
+		after = ls[0].Name()
+		pages = append(pages, after)
+	}
+	core.Assert(t, equal(pages, "a.txt", "b.txt", "c.h"), "wrong pages %v", pages)
+}
+
+// testDelete checks that files and folders are deleted, the latter with their content
+func testDelete(t *testing.T, s storage.Store, dir string) {
+	dir = path.Join(dir, "del")
+	writeFile(t, s, path.Join(dir, "file"), []byte("file"))
+	writeFile(t, s, path.Join(dir, "sub", "a"), []byte("a"))
+	writeFile(t, s, path.Join(dir, "sub", "b", "c"), []byte("c"))
+
+	err := s.Delete(path.Join(dir, "file"))
+	core.TestErr(t, err, "cannot delete file: %v")
+	_, err = s.Stat(path.Join(dir, "file"))
+	core.Assert(t, errors.Is(err, fs.ErrNotExist), "file still exists after Delete: %v", err)
+
+	err = s.Delete(path.Join(dir, "sub"))
+	core.TestErr(t, err, "cannot delete folder: %v")
+	_, err = s.Stat(path.Join(dir, "sub", "b", "c"))
+	core.Assert(t, errors.Is(err, fs.ErrNotExist), "content still exists after Delete of folder: %v", err)
+}
+
+// testWriteIf checks the conditional writes, also on stores that implement them with a check before the write
+func testWriteIf(t *testing.T, s storage.Store, dir string) {
+	name := path.Join(dir, "cond")
+	err := storage.WriteFileIf(s, name, []byte("first"), storage.Condition{IfAbsent: true})
+	core.TestErr(t, err, "cannot write absent file: %v")
+	err = storage.WriteFileIf(s, name, []byte("second"), storage.Condition{IfAbsent: true})
+	core.Assert(t, err == storage.ErrConditionFailed, "expected ErrConditionFailed, got %v", err)
+
+	etag, err := storage.ETag(s, name)
+	core.TestErr(t, err, "cannot get etag: %v")
+	err = storage.WriteFileIf(s, name, []byte("third version"), storage.Condition{IfMatch: etag})
+	core.TestErr(t, err, "cannot write with matching etag: %v")
+	err = storage.WriteFileIf(s, name, []byte("fourth"), storage.Condition{IfMatch: etag})
+	core.Assert(t, err == storage.ErrConditionFailed, "expected ErrConditionFailed with stale etag, got %v", err)
+	core.Assert(t, string(readFile(t, s, name)) == "third version", "wrong content after conditional writes")
+
+	_, err = storage.ETag(s, path.Join(dir, "missing"))
+	core.Assert(t, errors.Is(err, fs.ErrNotExist), "ETag of missing file must return ErrNotExist, got %v", err)
+}
+
+// testRenameAndCopy checks Rename and Copy, native or emulated
+func testRenameAndCopy(t *testing.T, s storage.Store, dir string) {
+	dir = path.Join(dir, "mv")
+	writeFile(t, s, path.Join(dir, "a"), []byte("content"))
+
+	err := storage.Copy(s, path.Join(dir, "a"), path.Join(dir, "b"))
+	core.TestErr(t, err, "cannot copy: %v")
+	core.Assert(t, string(readFile(t, s, path.Join(dir, "b"))) == "content", "wrong content of copy")
+	core.Assert(t, string(readFile(t, s, path.Join(dir, "a"))) == "content", "source changed by copy")
+
+	err = storage.Rename(s, path.Join(dir, "b"), path.Join(dir, "c"))
+	core.TestErr(t, err, "cannot rename: %v")
+	core.Assert(t, string(readFile(t, s, path.Join(dir, "c"))) == "content", "wrong content after rename")
+	_, err = s.Stat(path.Join(dir, "b"))
+	core.Assert(t, errors.Is(err, fs.ErrNotExist), "source still exists after rename: %v", err)
+}
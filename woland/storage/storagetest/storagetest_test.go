@@ -0,0 +1,81 @@
+package storagetest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+	"github.com/stregato/master/woland/storage"
+)
+
+const credentialsFile = "../../../../credentials/urls.yaml"
+
+func open(t *testing.T, url string) storage.Store {
+	s, err := storage.Open(url)
+	core.TestErr(t, err, "cannot open %s: %v", url)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestMemory(t *testing.T) {
+	Run(t, open(t, "mem://storagetest"))
+}
+
+func TestLocal(t *testing.T) {
+	Run(t, open(t, "file://"+filepath.Join(os.TempDir(), "storagetest")))
+}
+
+func TestSub(t *testing.T) {
+	Run(t, storage.Sub(open(t, "mem://storagetest-sub"), "base/folder", false))
+}
+
+func TestEncryptNames(t *testing.T) {
+	key := core.GenerateRandomBytes(32)
+	nonce := core.GenerateRandomBytes(16)
+	Run(t, storage.EncryptNames(open(t, "file://"+filepath.Join(os.TempDir(), "storagetest-enc")), key, nonce,
+		false))
+}
+
+func TestCached(t *testing.T) {
+	policy := storage.CachePolicy{
+		Immutable:   func(name string) bool { return true },
+		MetadataTTL: time.Minute,
+		MaxSize:     1024,
+	}
+	s, err := storage.Cached(open(t, "mem://storagetest-cached"), filepath.Join(t.TempDir(), "cache"), policy)
+	core.TestErr(t, err, "cannot create cached store: %v")
+	Run(t, s)
+}
+
+func TestResilient(t *testing.T) {
+	Run(t, storage.Resilient(open(t, "mem://storagetest-resilient"), storage.DefaultRetryPolicy))
+}
+
+func TestMetered(t *testing.T) {
+	Run(t, storage.Metered(open(t, "mem://storagetest-metered"), &storage.Meter{}))
+}
+
+func TestThrottled(t *testing.T) {
+	limiter := storage.NewRateLimiter(64*1024*1024, nil)
+	Run(t, storage.Throttled(open(t, "mem://storagetest-throttled"), limiter, limiter))
+}
+
+// TestRemote runs the suite on the local stand-ins of the remote stores, e.g. a MinIO, an SFTP server or a WebDAV
+// server in a container, when they are defined in the credentials file
+func TestRemote(t *testing.T) {
+	if _, err := os.Stat(credentialsFile); err != nil {
+		t.Skip("no credentials file")
+	}
+	urls := storage.LoadTestURLs(credentialsFile)
+	for _, name := range []string{"minio", "sftp", "dav"} {
+		url, ok := urls[name]
+		t.Run(name, func(t *testing.T) {
+			if !ok {
+				t.Skipf("no %s url in credentials", name)
+			}
+			Run(t, open(t, url))
+		})
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"io"
 	"io/fs"
 	"os"
-	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -45,8 +44,10 @@ type Filter struct {
 }
 
 type Description struct {
-	ReadCost  float64 //ReadCost is the cost of reading 1 byte in CHF as per 2023
-	WriteCost float64 //WriteCost is the cost of writing 1 byte in CHF as per 2023
+	ReadCost    float64 //ReadCost is the cost of reading 1 byte in CHF as per 2023
+	WriteCost   float64 //WriteCost is the cost of writing 1 byte in CHF as per 2023
+	ReadOpCost  float64 //ReadOpCost is the cost of a read or stat request in CHF as per 2023
+	WriteOpCost float64 //WriteOpCost is the cost of a write, copy or list request in CHF as per 2023
 }
 
 // Store is a low level interface to storage services such as S3 or SFTP
@@ -78,24 +79,14 @@ type Store interface {
 	Describe() Description
 }
 
-// Open creates a new exchanger giving a provided configuration
+// Open creates a new exchanger giving a provided configuration. The driver is chosen by the scheme of the url among
+// the registered ones.
 func Open(connectionUrl string) (Store, error) {
-	switch {
-	case strings.HasPrefix(connectionUrl, "sftp://"):
-		return OpenSFTP(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "s3://"):
-		return OpenS3(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "file:/"):
-		return OpenLocal(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "dav://"):
-		return OpenWebDAV(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "davs://"):
-		return OpenWebDAV(connectionUrl)
-	case strings.HasPrefix(connectionUrl, "mem://"):
-		return OpenMemory(connectionUrl)
+	d, _, err := getDriver(connectionUrl)
+	if err != nil {
+		return nil, err
 	}
-
-	return nil, core.ErrNoDriver
+	return d.open(connectionUrl)
 }
 
 func LoadTestURLs(filename string) (urls map[string]string) {
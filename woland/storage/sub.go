@@ -41,6 +41,26 @@ func (s *sub) Write(name string, source io.ReadSeeker, progress chan int64) erro
 	return s.Store.Write(path.Join(s.Base, name), source, progress)
 }
 
+// WriteIf writes data to a file name when the condition holds
+func (s *sub) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	return WriteIf(s.Store, path.Join(s.Base, name), source, cond, progress)
+}
+
+// ETag returns the version of the file to use in Condition.IfMatch
+func (s *sub) ETag(name string) (string, error) {
+	return ETag(s.Store, path.Join(s.Base, name))
+}
+
+// Rename renames a file
+func (s *sub) Rename(old, new string) error {
+	return Rename(s.Store, path.Join(s.Base, old), path.Join(s.Base, new))
+}
+
+// Copy copies a file
+func (s *sub) Copy(source, dest string) error {
+	return Copy(s.Store, path.Join(s.Base, source), path.Join(s.Base, dest))
+}
+
 // Stat provides statistics about a file
 func (s *sub) Stat(name string) (os.FileInfo, error) {
 	return s.Store.Stat(path.Join(s.Base, name))
@@ -67,3 +87,8 @@ func (s *sub) String() string {
 func (s *sub) Describe() Description {
 	return s.Store.Describe()
 }
+
+// CircuitState returns the state of the circuit breaker of the wrapped store
+func (s *sub) CircuitState() CircuitState {
+	return GetCircuitState(s.Store)
+}
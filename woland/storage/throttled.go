@@ -0,0 +1,197 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/stregato/master/woland/core"
+)
+
+// RateLimiter limits the bytes per second that go through it with a token bucket that holds one second of traffic.
+// A limiter with a parent also waits on the parent, so that a limit per safe can be combined with a global one.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   int64     // Bytes per second, 0 for no limit
+	tokens float64   // Bytes available, negative when the traffic already reserved exceeds the rate
+	last   time.Time // Last refill of the tokens
+	parent *RateLimiter
+}
+
+// NewRateLimiter returns a limiter of rate bytes per second. A rate of 0 does not limit the traffic.
+func NewRateLimiter(rate int64, parent *RateLimiter) *RateLimiter {
+	return &RateLimiter{rate: rate, tokens: float64(rate), last: core.Now(), parent: parent}
+}
+
+// SetRate changes the limit in bytes per second. A rate of 0 does not limit the traffic.
+func (l *RateLimiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate, l.tokens, l.last = rate, float64(rate), core.Now()
+}
+
+// Rate returns the limit in bytes per second
+func (l *RateLimiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must wait before sending them
+func (l *RateLimiter) reserve(n int64) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+
+	l.tokens += core.Since(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = core.Now()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// Wait blocks until n bytes can go through the limiter and its parents
+func (l *RateLimiter) Wait(n int64) {
+	for ; l != nil; l = l.parent {
+		time.Sleep(l.reserve(n))
+	}
+}
+
+type throttledReader struct {
+	r       io.ReadSeeker
+	limiter *RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.limiter.Wait(int64(n))
+	return n, err
+}
+
+func (t *throttledReader) Seek(offset int64, whence int) (int64, error) {
+	return t.r.Seek(offset, whence)
+}
+
+type throttledWriter struct {
+	w       io.Writer
+	limiter *RateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	t.limiter.Wait(int64(len(p)))
+	return t.w.Write(p)
+}
+
+type throttled struct {
+	Store    Store
+	Upload   *RateLimiter
+	Download *RateLimiter
+}
+
+// Throttled returns a store whose writes go through the upload limiter and whose reads go through the download
+// limiter. A nil limiter does not limit the traffic. Closing the store closes s.
+func Throttled(s Store, upload, download *RateLimiter) Store {
+	return &throttled{s, upload, download}
+}
+
+func (t *throttled) source(source io.ReadSeeker) io.ReadSeeker {
+	if t.Upload == nil {
+		return source
+	}
+	return &throttledReader{source, t.Upload}
+}
+
+func (t *throttled) Url() string {
+	return t.Store.Url()
+}
+
+func (t *throttled) ReadDir(name string, filter Filter) ([]fs.FileInfo, error) {
+	return t.Store.ReadDir(name, filter)
+}
+
+// Read reads data from a file into a writer
+func (t *throttled) Read(name string, rang *Range, dest io.Writer, progress chan int64) error {
+	if t.Download != nil {
+		dest = &throttledWriter{dest, t.Download}
+	}
+	return t.Store.Read(name, rang, dest, progress)
+}
+
+// Write writes data to a file name. An existing file is overwritten
+func (t *throttled) Write(name string, source io.ReadSeeker, progress chan int64) error {
+	return t.Store.Write(name, t.source(source), progress)
+}
+
+// WriteIf writes data to a file name when the condition holds
+func (t *throttled) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	return WriteIf(t.Store, name, t.source(source), cond, progress)
+}
+
+// ETag returns the version of the file to use in Condition.IfMatch
+func (t *throttled) ETag(name string) (string, error) {
+	return ETag(t.Store, name)
+}
+
+// Rename renames a file. When the store cannot rename, the content is copied through the limiters.
+func (t *throttled) Rename(old, new string) error {
+	if r, ok := t.Store.(Renamer); ok {
+		return r.Rename(old, new)
+	}
+	err := copyContent(t, old, new)
+	if err != nil {
+		return err
+	}
+	return t.Store.Delete(old)
+}
+
+// Copy copies a file. A server-side copy is not throttled, otherwise the content is copied through the limiters.
+func (t *throttled) Copy(source, dest string) error {
+	if c, ok := t.Store.(Copier); ok {
+		return c.Copy(source, dest)
+	}
+	return copyContent(t, source, dest)
+}
+
+// Stat provides statistics about a file
+func (t *throttled) Stat(name string) (os.FileInfo, error) {
+	return t.Store.Stat(name)
+}
+
+// Delete deletes a file
+func (t *throttled) Delete(name string) error {
+	return t.Store.Delete(name)
+}
+
+// Close closes the store
+func (t *throttled) Close() error {
+	return t.Store.Close()
+}
+
+// String returns a human-readable representation of the storer (e.g. sftp://user@host/path)
+func (t *throttled) String() string {
+	return fmt.Sprintf("%s,throttled", t.Store)
+}
+
+func (t *throttled) Describe() Description {
+	return t.Store.Describe()
+}
+
+// IsRetryable classifies the errors with the wrapped store
+func (t *throttled) IsRetryable(err error) bool {
+	return IsRetryable(t.Store, err)
+}
+
+// CircuitState returns the state of the circuit breaker of the wrapped store
+func (t *throttled) CircuitState() CircuitState {
+	return GetCircuitState(t.Store)
+}
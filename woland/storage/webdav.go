@@ -1,12 +1,16 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
+	"strings"
+	"sync"
 
 	"github.com/studio-b12/gowebdav"
 
@@ -14,9 +18,24 @@ import (
 )
 
 type WebDAV struct {
-	c   *gowebdav.Client
-	p   string
-	url string
+	c          *gowebdav.Client
+	p          string
+	url        string
+	lock       sync.Mutex
+	conditions map[string]Condition // Conditions of the writes in progress, added as If headers to the PUT requests
+}
+
+func init() {
+	capabilities := Capabilities{Rename: true, ConditionalWrite: true, ServerSideCopy: true}
+	Register("dav", OpenWebDAV, validateWebDAVUrl, capabilities)
+	Register("davs", OpenWebDAV, validateWebDAVUrl, capabilities)
+}
+
+func validateWebDAVUrl(u *url.URL) error {
+	if u.Host == "" {
+		return fmt.Errorf("missing host")
+	}
+	return nil
 }
 
 func OpenWebDAV(connectionUrl string) (Store, error) {
@@ -44,10 +63,12 @@ func OpenWebDAV(connectionUrl string) (Store, error) {
 	}
 
 	w := &WebDAV{
-		c:   c,
-		p:   u.Path,
-		url: connectionUrl,
+		c:          c,
+		p:          u.Path,
+		url:        connectionUrl,
+		conditions: map[string]Condition{},
 	}
+	c.SetInterceptor(w.addConditionHeaders)
 
 	return w, nil
 }
@@ -60,6 +81,9 @@ func (w *WebDAV) Read(name string, rang *Range, dest io.Writer, progress chan in
 	p := path.Join(w.p, name)
 
 	r, err := w.c.ReadStream(p)
+	if gowebdav.IsErrNotFound(err) {
+		return os.ErrNotExist
+	}
 	if core.IsErr(err, nil, "cannot read WebDAV file %s: %v", p) {
 		return err
 	}
@@ -100,7 +124,7 @@ func (w *WebDAV) Write(name string, source io.ReadSeeker, progress chan int64) e
 
 	err := w.c.WriteStream(p, source, 0)
 	if core.IsErr(err, nil, "cannot write WebDAV file %s: %v", p) {
-		return err
+		return w.mapError(err)
 	}
 
 	return nil
@@ -110,33 +134,21 @@ func (w *WebDAV) ReadDir(dir string, f Filter) ([]fs.FileInfo, error) {
 	p := path.Join(w.p, dir)
 
 	ls, err := w.c.ReadDir(p)
-	if _, ok := err.(*fs.PathError); ok {
+	if gowebdav.IsErrNotFound(err) {
 		return nil, os.ErrNotExist
 	}
 	if core.IsErr(err, nil, "cannot read WebDAV folder %s: %v", p) {
 		return nil, err
 	}
 
-	var cnt int64
-	var infos []fs.FileInfo
-	for _, l := range ls {
-		if matchFilter(l, f) {
-			infos = append(infos, l)
-			cnt++
-		}
-		if f.MaxResults > 0 && cnt >= f.MaxResults {
-			break
-		}
-	}
-
-	return infos, err
+	return filterInfos(ls, f), nil
 }
 
 func (w *WebDAV) Stat(name string) (fs.FileInfo, error) {
 	p := path.Join(w.p, name)
 
 	f, err := w.c.Stat(p)
-	if _, ok := err.(*fs.PathError); ok {
+	if gowebdav.IsErrNotFound(err) {
 		return nil, os.ErrNotExist
 	}
 
@@ -149,12 +161,17 @@ func (w *WebDAV) Stat(name string) (fs.FileInfo, error) {
 func (w *WebDAV) Rename(old, new string) error {
 	o := path.Join(w.p, old)
 	n := path.Join(w.p, new)
-	return w.c.Rename(o, n, true)
+	return w.mapError(w.c.Rename(o, n, true))
+}
+
+// Copy copies a file with the COPY method
+func (w *WebDAV) Copy(source, dest string) error {
+	return w.mapError(w.c.Copy(path.Join(w.p, source), path.Join(w.p, dest), true))
 }
 
 func (w *WebDAV) Delete(name string) error {
 	p := path.Join(w.p, name)
-	return w.c.RemoveAll(p)
+	return w.mapError(w.c.RemoveAll(p))
 }
 
 func (w *WebDAV) Close() error {
@@ -171,3 +188,82 @@ func (w *WebDAV) Describe() Description {
 		WriteCost: 0,
 	}
 }
+
+// WriteIf writes the file with the If-None-Match or If-Match headers so that the server checks the condition
+func (w *WebDAV) WriteIf(name string, source io.ReadSeeker, cond Condition, progress chan int64) error {
+	p := path.Join(w.p, name)
+	w.lock.Lock()
+	if _, ok := w.conditions[p]; ok {
+		w.lock.Unlock()
+		return ErrConditionFailed
+	}
+	w.conditions[p] = cond
+	w.lock.Unlock()
+	defer func() {
+		w.lock.Lock()
+		delete(w.conditions, p)
+		w.lock.Unlock()
+	}()
+
+	return w.Write(name, source, progress)
+}
+
+// ETag returns the ETag of the file or a version based on the modification time and the size when the server does
+// not provide it
+func (w *WebDAV) ETag(name string) (string, error) {
+	stat, err := w.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	if f, ok := stat.(gowebdav.File); ok && f.ETag() != "" {
+		return f.ETag(), nil
+	}
+	return fmt.Sprintf("%x-%x", stat.ModTime().UnixNano(), stat.Size()), nil
+}
+
+func (w *WebDAV) addConditionHeaders(method string, rq *http.Request) {
+	if method != http.MethodPut {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for p, cond := range w.conditions {
+		if !strings.HasSuffix(rq.URL.Path, p) {
+			continue
+		}
+		if cond.IfAbsent {
+			rq.Header.Set("If-None-Match", "*")
+		}
+		if cond.IfMatch != "" {
+			rq.Header.Set("If-Match", cond.IfMatch)
+		}
+	}
+}
+
+// mapError maps the status codes of the server to the errors of the package. Timeouts, throttling and server errors
+// are transient.
+func (w *WebDAV) mapError(err error) error {
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		return err
+	}
+	statusErr, ok := pathErr.Err.(gowebdav.StatusError)
+	if !ok {
+		return err
+	}
+	switch code := statusErr.Status; {
+	case code == http.StatusNotFound:
+		return os.ErrNotExist
+	case code == http.StatusPreconditionFailed:
+		return ErrConditionFailed
+	case code == http.StatusRequestTimeout, code == http.StatusTooManyRequests, code >= 500:
+		return fmt.Errorf("%w: %v", ErrTransient, err)
+	default:
+		return err
+	}
+}
+
+// IsRetryable returns true if the error is a timeout, throttling or a temporary failure of the server
+func (w *WebDAV) IsRetryable(err error) bool {
+	return errors.Is(w.mapError(err), ErrTransient) || isTransientNetError(err)
+}